@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/queuestats"
+)
+
+//AgentStateRequest - state requested for an agent, an unavailable agent
+//stops taking tasks until it is requested available again
+type AgentStateRequest struct {
+	State string `json:"state" validate:"required,oneof=available unavailable"`
+}
+
+// listAgents - agents logged in to the queue
+func (s *Server) listAgents(c echo.Context) error {
+	if _, err := s.queues.Get(c.Param("accountID"), c.Param("queueID")); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	agents, err := s.agents.List(c.Param("queueID"))
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, agents)
+}
+
+// setAgentState - request the agent available or unavailable, the agent
+// applies it on its next heartbeat
+func (s *Server) setAgentState(c echo.Context) error {
+	req := new(AgentStateRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+	queueID, agentID := c.Param("queueID"), c.Param("agentID")
+	if _, err := s.queues.Get(c.Param("accountID"), queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	agent, err := s.findAgent(queueID, agentID)
+	if err != nil {
+		return err
+	}
+	if err = s.agents.Request(queueID, agentID, req.State); err != nil {
+		return storeError(err)
+	}
+	agent.RequestedState = ""
+	if req.State == queuestats.AgentUnavailable {
+		agent.RequestedState = req.State
+	}
+	return c.JSON(http.StatusOK, agent)
+}
+
+// findAgent - agent logged in to the queue, 404 once it missed its
+// heartbeats
+func (s *Server) findAgent(queueID, agentID string) (*queuestats.Agent, error) {
+	agents, err := s.agents.List(queueID)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	for i := range agents {
+		if agents[i].AgentID == agentID {
+			return &agents[i], nil
+		}
+	}
+	return nil, newAPIError(http.StatusNotFound, CodeNotFound, "agent not found")
+}
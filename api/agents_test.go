@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/auth"
+	"queuev2/queuestats"
+)
+
+func TestAgentState(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_agents", QueueName: "agents", MaxPriority: 5}))
+	assert.NoError(t, s.agents.Heartbeat("QID_agents", "a1", queuestats.AgentAvailable))
+	base := "/v1.0/accounts/123/queue/QID_agents/agents"
+
+	rec := serve(s, http.MethodPut, base+"/a1", `{"state": "unavailable"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	agent := queuestats.Agent{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &agent))
+	assert.Equal(t, queuestats.AgentAvailable, agent.State)
+	assert.Equal(t, queuestats.AgentUnavailable, agent.RequestedState)
+
+	rec = serve(s, http.MethodGet, base, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var agents []queuestats.Agent
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &agents))
+	if assert.Len(t, agents, 1) {
+		assert.Equal(t, "a1", agents[0].AgentID)
+		assert.Equal(t, queuestats.AgentUnavailable, agents[0].RequestedState)
+	}
+
+	for _, tc := range []struct {
+		target, body string
+		code         int
+	}{
+		{base + "/a1", `{"state": "busy"}`, http.StatusBadRequest},
+		{base + "/a2", `{"state": "available"}`, http.StatusNotFound},
+		{"/v1.0/accounts/456/queue/QID_agents/agents/a1", `{"state": "available"}`, http.StatusNotFound},
+	} {
+		rec = serve(s, http.MethodPut, tc.target, tc.body)
+		assert.Equal(t, tc.code, rec.Code, tc.target+" "+tc.body)
+	}
+
+	rec = serve(s, http.MethodPut, base+"/a1", `{"state": "available"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	requested, err := s.agents.Requested("QID_agents", "a1")
+	assert.NoError(t, err)
+	assert.Empty(t, requested)
+}
+
+func TestAgentScope(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+	a := auth.NewAuthenticator(s.store, auth.JWTOptions{})
+	a.AddStaticToken("agent-token", &auth.Principal{AccountID: "123", Scopes: []string{auth.ScopeAgent}, Method: auth.MethodAPIKey})
+	a.AddStaticToken("submit-token", &auth.Principal{AccountID: "123", Scopes: []string{auth.ScopeTaskSubmit}, Method: auth.MethodAPIKey})
+	s.SetAuthenticator(a)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_agents", QueueName: "agents", MaxPriority: 5}))
+	assert.NoError(t, s.agents.Heartbeat("QID_agents", "a1", queuestats.AgentAvailable))
+	base := "/v1.0/accounts/123/queue/QID_agents"
+
+	for _, tc := range []struct {
+		token, method, target, body string
+		code                        int
+	}{
+		{"agent-token", http.MethodGet, base + "/agents", "", http.StatusOK},
+		{"agent-token", http.MethodPut, base + "/agents/a1", `{"state": "unavailable"}`, http.StatusOK},
+		{"agent-token", http.MethodPost, base + "/pause", "", http.StatusForbidden},
+		{"submit-token", http.MethodGet, base + "/agents", "", http.StatusForbidden},
+		{"submit-token", http.MethodPut, base + "/agents/a1", `{"state": "available"}`, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", tc.token)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, tc.token+" "+tc.method+" "+tc.target)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/auth"
+)
+
+//APIKeyRequest - scopes requested for a new account key
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=queue:admin task:submit agent read"`
+}
+
+//APIKeyResponse - created key, Token is returned only on creation
+type APIKeyResponse struct {
+	*auth.APIKey
+	Token string `json:"token"`
+}
+
+func (s *Server) createAPIKey(c echo.Context) error {
+	if s.auth == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "authentication is disabled")
+	}
+
+	req := new(APIKeyRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	// a key never gets more than its creator holds
+	if p := auth.PrincipalFrom(c); p != nil {
+		for _, scope := range req.Scopes {
+			if !p.HasScope(scope) {
+				return newAPIError(http.StatusForbidden, CodeForbidden, "cannot grant scope "+scope)
+			}
+		}
+	}
+
+	key, token, err := s.auth.Keys().Create(c.Param("accountID"), req.Name, req.Scopes)
+	if err != nil {
+		return storeError(err)
+	}
+	key.SecretHash = ""
+	return c.JSON(http.StatusCreated, APIKeyResponse{APIKey: key, Token: token})
+}
+
+func (s *Server) listAPIKeys(c echo.Context) error {
+	if s.auth == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "authentication is disabled")
+	}
+
+	keys, err := s.auth.Keys().List(c.Param("accountID"))
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func (s *Server) revokeAPIKey(c echo.Context) error {
+	if s.auth == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "authentication is disabled")
+	}
+
+	err := s.auth.Keys().Revoke(c.Param("accountID"), c.Param("keyID"))
+	if err == auth.ErrKeyNotFound {
+		return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/streadway/amqp"
+
+	"queuev2/events"
+	"queuev2/mq/producer"
+)
+
+const defaultBatchMaxTasks = 500
+
+//BatchTaskRequest - tasks submitted together, each one is accepted or
+//rejected on its own
+type BatchTaskRequest struct {
+	Tasks []*Task `json:"tasks"`
+}
+
+//BatchItemResult - outcome of the item at Index of the request, Task is set
+//when it was queued and Error when it was not
+type BatchItemResult struct {
+	Index  int        `json:"index"`
+	Status int        `json:"status"`
+	Task   *Task      `json:"task,omitempty"`
+	Error  *ErrorBody `json:"error,omitempty"`
+}
+
+//BatchTaskResponse - 200 when every item was queued, 207 otherwise
+type BatchTaskResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// SetBatchLimit - maximum number of tasks of a batch request
+func (s *Server) SetBatchLimit(max int) {
+	s.batchMaxTasks = max
+}
+
+// submitTaskBatch - validate every item, write the tasks and positions of
+// the valid ones with one pipelined store call per queue, then publish them
+// on one channel with publisher confirms. Items the broker refused are
+// removed from the store again, so a task is stored whenever the consumer
+// receives it. Unconfirmed items are kept for reconciliation
+func (s *Server) submitTaskBatch(c echo.Context) error {
+	req := new(BatchTaskRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	max := s.batchMaxTasks
+	if max <= 0 {
+		max = defaultBatchMaxTasks
+	}
+	if len(req.Tasks) == 0 || len(req.Tasks) > max {
+		return badRequest(fmt.Sprintf("tasks must hold 1 to %d items", max))
+	}
+
+	accID := c.Param("accountID")
+	results := make([]BatchItemResult, len(req.Tasks))
+	reject := func(i int, err error) {
+		apiErr, ok := err.(*APIError)
+		if !ok {
+			apiErr = internalError(err)
+		}
+		apiErr.Body.RequestID = requestID(c)
+		results[i] = BatchItemResult{Index: i, Status: apiErr.Status, Error: &apiErr.Body}
+	}
+
+	// validate every item and group the valid ones by queue
+	queues := map[string]*Queue{}
+	byQueue := map[string][]int{}
+	var queueOrder []string
+	for i, task := range req.Tasks {
+		if task == nil {
+			reject(i, badRequest("task must be an object"))
+			continue
+		}
+		if err := s.validateTask(c, task); err != nil {
+			reject(i, err)
+			continue
+		}
+		if _, err := s.prepareTask(c, task, queues); err != nil {
+			reject(i, err)
+			continue
+		}
+		if _, ok := byQueue[task.QueueID]; !ok {
+			queueOrder = append(queueOrder, task.QueueID)
+		}
+		byQueue[task.QueueID] = append(byQueue[task.QueueID], i)
+	}
+
+	// drop the items above the waiting tasks quota of their queue
+	var accepted []int
+	for _, queueID := range queueOrder {
+		items := byQueue[queueID]
+		remaining, err := s.waitingTasksRemaining(accID, queues[queueID])
+		if err != nil {
+			for _, i := range items {
+				reject(i, brokerError(err))
+			}
+			continue
+		}
+		if remaining >= 0 && remaining < len(items) {
+			for _, i := range items[remaining:] {
+				e := newAPIError(http.StatusTooManyRequests, CodeQuotaExceeded, "queue has reached its maximum number of waiting tasks")
+				reject(i, e)
+			}
+			items = items[:remaining]
+		}
+		accepted = append(accepted, items...)
+	}
+
+	stored := s.storeBatch(c, req.Tasks, accepted, queues, reject)
+	published := s.publishBatch(c, req.Tasks, stored, reject)
+	s.positionBatch(c, req.Tasks, published)
+
+	resp := BatchTaskResponse{Results: results}
+	for _, i := range published {
+		if results[i].Error == nil {
+			results[i] = BatchItemResult{Index: i, Status: http.StatusOK, Task: req.Tasks[i]}
+		}
+	}
+	for _, r := range results {
+		if r.Error == nil {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+
+	status := http.StatusOK
+	if resp.Rejected > 0 {
+		status = http.StatusMultiStatus
+	}
+	return c.JSON(status, resp)
+}
+
+// publishBatch - publish the stored items, returns the ones the broker
+// confirmed. The refused ones are removed from the store, see
+// publishFailed
+func (s *Server) publishBatch(c echo.Context, tasks []*Task, stored []int, reject func(int, error)) []int {
+	if len(stored) == 0 {
+		return nil
+	}
+
+	headers := amqp.Table{producer.HeaderRequestID: requestID(c)}
+	msgs := make([]producer.Message, 0, len(stored))
+	sent := make([]int, 0, len(stored))
+	for _, i := range stored {
+		data, err := json.Marshal(tasks[i])
+		if err != nil {
+			s.unstoreTask(c, tasks[i])
+			reject(i, internalError(err))
+			continue
+		}
+		msgs = append(msgs, producer.Message{
+			RoutingKey: tasks[i].QueueID + "_rKey",
+			Body:       data,
+			Priority:   tasks[i].Priority,
+			Headers:    headers,
+		})
+		sent = append(sent, i)
+	}
+
+	var published []int
+	for n, err := range s.mqProducer.PublishBatch(msgs) {
+		if err != nil {
+			s.publishFailed(c, tasks[sent[n]], err)
+			reject(sent[n], brokerError(err))
+			continue
+		}
+		published = append(published, sent[n])
+	}
+	return published
+}
+
+// storeBatch - reserve the external ids, then save the accepted tasks and
+// their positions with one store call per queue, returns the items stored
+// in the order of the request
+func (s *Server) storeBatch(c echo.Context, tasks []*Task, accepted []int, queues map[string]*Queue, reject func(int, error)) []int {
+	reserved := make([]int, 0, len(accepted))
+	for _, i := range accepted {
+		if apiErr := s.reserveTaskID(tasks[i]); apiErr != nil {
+			reject(i, apiErr)
+			continue
+		}
+		reserved = append(reserved, i)
+	}
+	if len(reserved) == 0 {
+		return nil
+	}
+
+	batch := make([]*Task, 0, len(reserved))
+	byQueue := map[string][]int{}
+	for _, i := range reserved {
+		batch = append(batch, tasks[i])
+		byQueue[tasks[i].QueueID] = append(byQueue[tasks[i].QueueID], i)
+	}
+	if err := s.tasks.SaveMulti(batch); err != nil {
+		for _, i := range reserved {
+			s.releaseTaskID(c, tasks[i])
+			reject(i, storeError(err))
+		}
+		return nil
+	}
+
+	failed := map[int]bool{}
+	for queueID, items := range byQueue {
+		queue := queues[queueID]
+		scores := make(map[string]int, len(items))
+		for _, i := range items {
+			scores[tasks[i].TaskID] = int(queue.MaxPriority - tasks[i].Priority)
+		}
+		if err := s.pos.AddItems(queueID, scores); err != nil {
+			for _, i := range items {
+				// saved but never queued
+				s.tasks.Delete(tasks[i].AccountID, tasks[i].TaskID)
+				s.releaseTaskID(c, tasks[i])
+				reject(i, storeError(err))
+				failed[i] = true
+			}
+		}
+	}
+
+	stored := make([]int, 0, len(reserved))
+	for _, i := range reserved {
+		if !failed[i] {
+			stored = append(stored, i)
+		}
+	}
+	return stored
+}
+
+// positionBatch - read the positions of the published items back in one
+// pipeline per queue
+func (s *Server) positionBatch(c echo.Context, tasks []*Task, published []int) {
+	actor := requestActor(c)
+	byQueue := map[string][]int{}
+	for _, i := range published {
+		s.emitTaskEvent(events.TaskSubmitted, tasks[i], 0, actor)
+		byQueue[tasks[i].QueueID] = append(byQueue[tasks[i].QueueID], i)
+	}
+
+	for queueID, items := range byQueue {
+		ids := make([]string, len(items))
+		for n, i := range items {
+			ids[n] = tasks[i].TaskID
+		}
+		ranks, err := s.pos.GetPositions(queueID, ids)
+		if err != nil {
+			// the tasks are queued, only their positions are unknown
+			continue
+		}
+		for n, i := range items {
+			tasks[i].Position = ranks[n] + 1
+			s.emitTaskEvent(events.TaskEnqueued, tasks[i], tasks[i].Position, actor)
+		}
+	}
+}
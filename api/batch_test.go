@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/store"
+)
+
+func TestBatchUnpublishedItemsNotStored(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_batch", QueueName: "batch", MaxPriority: 5}))
+	broker.failPublish = map[int]bool{2: true}
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/task/batch", `{"tasks": [
+		{"queue_id": "QID_batch", "priority": 1, "call_data": {"call_uuid": "c1"}},
+		{"queue_id": "QID_batch", "priority": 1, "call_data": {"call_uuid": "c2"}},
+		{"queue_id": "QID_batch", "priority": 1, "call_data": {"call_uuid": "c3"}}
+	]}`)
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	resp := BatchTaskResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Accepted)
+	assert.Equal(t, 1, resp.Rejected)
+
+	if assert.Len(t, resp.Results, 3) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Results[1].Status)
+		assert.Equal(t, 1, resp.Results[0].Task.Position)
+		assert.Equal(t, 2, resp.Results[2].Task.Position)
+	}
+
+	ids, err := s.pos.List("QID_batch")
+	assert.NoError(t, err)
+	assert.Len(t, ids, 2)
+	for _, id := range ids {
+		_, err = s.tasks.Get("123", id)
+		assert.NoError(t, err)
+	}
+}
+
+func TestBatchPartialPublishFailure(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_batch", QueueName: "batch", MaxPriority: 5}))
+	broker.failPublish = map[int]bool{2: true}
+	broker.unconfirmed = map[int]bool{3: true}
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/task/batch", `{"tasks": [
+		{"queue_id": "QID_batch", "external_id": "e1", "priority": 1, "call_data": {"call_uuid": "c1"}},
+		{"queue_id": "QID_batch", "external_id": "e2", "priority": 1, "call_data": {"call_uuid": "c2"}},
+		{"queue_id": "QID_batch", "external_id": "e3", "priority": 1, "call_data": {"call_uuid": "c3"}}
+	]}`)
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	resp := BatchTaskResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Accepted)
+	assert.Equal(t, 2, resp.Rejected)
+	if assert.Len(t, resp.Results, 3) {
+		assert.Equal(t, http.StatusOK, resp.Results[0].Status)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Results[1].Status)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Results[2].Status)
+	}
+
+	// refused, removed with its external id
+	_, err := s.tasks.Get("123", "e2")
+	assert.Equal(t, ErrTaskNotFound, err)
+	ok, err := s.tasks.Reserve("123", "e2", "t2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// not confirmed, the broker may still dispatch it
+	unconfirmed, err := s.tasks.Get("123", "e3")
+	assert.NoError(t, err)
+	ids, err := s.pos.List("QID_batch")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{resp.Results[0].Task.TaskID, unconfirmed.TaskID}, ids)
+	marked, err := s.store.GetAllItemsSortedSet(unconfirmedTasksKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"123 " + unconfirmed.TaskID}, marked)
+
+	assert.NoError(t, s.tasks.Confirmed("123", unconfirmed.TaskID))
+	marked, err = s.store.GetAllItemsSortedSet(unconfirmedTasksKey)
+	assert.NoError(t, err)
+	assert.Empty(t, marked)
+}
+
+//positionFailStore - store failing to write the positions of queueID
+type positionFailStore struct {
+	store.Store
+	queueID string
+}
+
+func (s *positionFailStore) AddSortedSetMulti(key string, items map[string]int) error {
+	if strings.HasSuffix(key, s.queueID) {
+		return errors.New("store unavailable")
+	}
+	return s.Store.AddSortedSetMulti(key, items)
+}
+
+func TestBatchStoreRollback(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	st := &positionFailStore{Store: s.store, queueID: "QID_broken"}
+	s = NewServer(0, broker, st)
+	s.SetAuthenticator(nil)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_batch", QueueName: "batch", MaxPriority: 5}))
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_broken", QueueName: "broken", MaxPriority: 5}))
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/task/batch", `{"tasks": [
+		{"queue_id": "QID_broken", "external_id": "e1", "priority": 1, "call_data": {"call_uuid": "c1"}},
+		{"queue_id": "QID_batch", "external_id": "e2", "priority": 1, "call_data": {"call_uuid": "c2"}}
+	]}`)
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	resp := BatchTaskResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Results, 2) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Results[0].Status)
+		assert.Equal(t, http.StatusOK, resp.Results[1].Status)
+	}
+
+	// rolled back before publishing
+	_, err := s.tasks.Get("123", "e1")
+	assert.Equal(t, ErrTaskNotFound, err)
+	ok, err := s.tasks.Reserve("123", "e1", "t1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"QID_batch_rKey"}, broker.published)
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"github.com/streadway/amqp"
+
+	"queuev2/mq/producer"
+)
+
+//Broker - message broker operations the API needs, implemented by
+//producer.MQProducer
+type Broker interface {
+	PublishMessage(routingKey string, body []byte, priority uint8, headers amqp.Table) error
+	PublishBatch(msgs []producer.Message) []error
+	CreateQueue(queueName string, maxPriority uint8) error
+	DeleteQueue(queueName string) error
+	QueueDepth(queueName string) (int, error)
+	Ping() error
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/streadway/amqp"
+
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/mq/producer"
+	"queuev2/store"
+)
+
+const (
+	deadLetterPrefix = "dlq:"
+	// maxDeadLetterBody - bytes kept of a message which could not be decoded
+	maxDeadLetterBody = 4096
+)
+
+var (
+	// ErrDeadLetterNotFound - unknown dead letter of the queue
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	// ErrNoTask - the dead letter could not be decoded to a task to queue
+	ErrNoTask = errors.New("dead letter holds no task to replay")
+)
+
+//DeadLetter - message a consumer gave up on. Task is set when the message
+//was a task, which a replay queues again, Body holds the start of the raw
+//message otherwise
+type DeadLetter struct {
+	ID      string    `json:"id"`
+	QueueID string    `json:"queue_id"`
+	Reason  string    `json:"reason"`
+	Task    *Task     `json:"task,omitempty"`
+	Body    string    `json:"body,omitempty"`
+	DeadAt  time.Time `json:"dead_at"`
+}
+
+//DeadLetterReplayRequest - dead letters to queue again, every one holding a
+//task when empty
+type DeadLetterReplayRequest struct {
+	IDs []string `json:"ids"`
+}
+
+//DeadLetterReplayResponse - tasks queued again, with their new position
+type DeadLetterReplayResponse struct {
+	Replayed []*Task `json:"replayed"`
+}
+
+//DeadLetterStore - dead letters of each queue, written by the consumers and
+//replayed through the API. They expire with the store key expire time
+//counted from the last one added to the queue
+type DeadLetterStore struct {
+	store store.Store
+}
+
+func NewDeadLetterStore(st store.Store) *DeadLetterStore {
+	return &DeadLetterStore{store: st}
+}
+
+func deadLetterKey(queueID string) string {
+	return deadLetterPrefix + queueID
+}
+
+// Add - keep the dead letter, a task dead lettered again replaces its
+// previous dead letter
+func (d *DeadLetterStore) Add(dl *DeadLetter) error {
+	if len(dl.Body) > maxDeadLetterBody {
+		dl.Body = dl.Body[:maxDeadLetterBody]
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return d.store.SetStructInHash(deadLetterKey(dl.QueueID), dl.ID, string(data))
+}
+
+// List - dead letters of the queue, oldest first
+func (d *DeadLetterStore) List(queueID string) ([]*DeadLetter, error) {
+	ids, err := d.store.GetKeysFromHash(deadLetterKey(queueID))
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0, len(ids))
+	for _, id := range ids {
+		dl, err := d.Get(queueID, id)
+		if err == ErrDeadLetterNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, dl)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].DeadAt.Before(letters[j].DeadAt) })
+	return letters, nil
+}
+
+// Get - dead letter of the queue by id
+func (d *DeadLetterStore) Get(queueID, id string) (*DeadLetter, error) {
+	key := deadLetterKey(queueID)
+	exists, err := d.store.KeyExistsInHash(key, id)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 1 {
+		return nil, ErrDeadLetterNotFound
+	}
+	data, err := d.store.GetStructFromHash(key, id)
+	if err != nil {
+		return nil, err
+	}
+	dl := &DeadLetter{}
+	if err = json.Unmarshal([]byte(data), dl); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// Remove - forget a replayed dead letter
+func (d *DeadLetterStore) Remove(queueID, id string) error {
+	return d.store.DeleteStructFromHash(deadLetterKey(queueID), id)
+}
+
+// Clear - forget every dead letter of a deleted queue
+func (d *DeadLetterStore) Clear(queueID string) error {
+	key := deadLetterKey(queueID)
+	exists, err := d.store.KeyExists(key)
+	if err != nil || exists == 0 {
+		return err
+	}
+	return d.store.DeleteKey(key)
+}
+
+// listDeadLetters - dead letters of the queue, oldest first
+func (s *Server) listDeadLetters(c echo.Context) error {
+	queueID := c.Param("queueID")
+	if _, err := s.queues.Get(c.Param("accountID"), queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	letters, err := s.deadLetters.List(queueID)
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, letters)
+}
+
+// replayDeadLetters - queue the tasks of the dead letters again under
+// their ids, a replayed dead letter is removed
+func (s *Server) replayDeadLetters(c echo.Context) error {
+	req := new(DeadLetterReplayRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	queue, err := s.queues.Get(c.Param("accountID"), c.Param("queueID"))
+	if err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	var letters []*DeadLetter
+	if len(req.IDs) == 0 {
+		all, err := s.deadLetters.List(queue.QueueID)
+		if err != nil {
+			return storeError(err)
+		}
+		for _, dl := range all {
+			if dl.Task != nil {
+				letters = append(letters, dl)
+			}
+		}
+	}
+	for _, id := range req.IDs {
+		dl, err := s.deadLetters.Get(queue.QueueID, id)
+		if err != nil {
+			return deadLetterError(err)
+		}
+		if dl.Task == nil {
+			return deadLetterError(ErrNoTask)
+		}
+		letters = append(letters, dl)
+	}
+
+	replayed := []*Task{}
+	for _, dl := range letters {
+		if apiErr := s.requeueTask(c, queue, dl.Task); apiErr != nil {
+			return apiErr
+		}
+		if err = s.deadLetters.Remove(queue.QueueID, dl.ID); err != nil {
+			requestLogger(c).Error("removing replayed dead letter failed", logger.FieldTaskID, dl.Task.TaskID, logger.FieldError, err)
+		}
+		replayed = append(replayed, dl.Task)
+	}
+	return c.JSON(http.StatusOK, DeadLetterReplayResponse{Replayed: replayed})
+}
+
+// requeueTask - queue a dead lettered task again under its id. The claim
+// of the consumer which took it is released so it can be dispatched again
+func (s *Server) requeueTask(c echo.Context, queue *Queue, task *Task) *APIError {
+	previous := task.Status
+	task.Status, task.Position, task.EstimatedWaitSeconds = TaskStatusWaiting, 0, nil
+	data, err := json.Marshal(task)
+	if err != nil {
+		return internalError(err)
+	}
+
+	if err = s.tasks.Unclaim(task.AccountID, task.TaskID); err != nil {
+		return storeError(err)
+	}
+	if err = s.tasks.Save(task); err != nil {
+		return storeError(err)
+	}
+	if err = s.pos.AddItem(task.QueueID, task.TaskID, int(queue.MaxPriority-task.Priority)); err != nil {
+		return storeError(err)
+	}
+	err = s.mqProducer.PublishMessage(task.QueueID+"_rKey", data, task.Priority, amqp.Table{producer.HeaderRequestID: requestID(c)})
+	if err != nil {
+		l := requestLogger(c).With(logger.FieldTaskID, task.TaskID, logger.FieldQueueID, task.QueueID)
+		if err := s.pos.RemoveItem(task.QueueID, task.TaskID); err != nil {
+			l.Error("removing position of unpublished task failed", logger.FieldError, err)
+		}
+		task.Status = previous
+		if err := s.tasks.Save(task); err != nil {
+			l.Error("restoring status of unpublished task failed", logger.FieldError, err)
+		}
+		return brokerError(err)
+	}
+
+	s.setPosition(task)
+	s.emitTaskEvent(events.TaskEnqueued, task, task.Position, requestActor(c))
+	return nil
+}
+
+func deadLetterError(err error) error {
+	switch err {
+	case ErrDeadLetterNotFound:
+		return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+	case ErrNoTask:
+		return newAPIError(http.StatusConflict, CodeConflict, err.Error())
+	}
+	return storeError(err)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayDeadLetters(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_dlq", QueueName: "dlq", MaxPriority: 5}))
+	failed := &Task{TaskID: "t1", AccountID: "123", QueueID: "QID_dlq", Priority: 2, CallData: map[string]string{"call_uuid": "c1"}, Status: TaskStatusFailed}
+	assert.NoError(t, s.tasks.Save(failed))
+	claimed, err := s.tasks.Claim("123", "t1", TaskStatusDispatched)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	now := time.Now().UTC()
+	assert.NoError(t, s.deadLetters.Add(&DeadLetter{ID: "t1", QueueID: "QID_dlq", Reason: "transfer failed", Task: failed, DeadAt: now}))
+	assert.NoError(t, s.deadLetters.Add(&DeadLetter{ID: "msg-1", QueueID: "QID_dlq", Reason: "invalid character", Body: "not a task", DeadAt: now.Add(-time.Minute)}))
+	base := "/v1.0/accounts/123/queue/QID_dlq/dlq"
+
+	rec := serve(s, http.MethodGet, base, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var letters []DeadLetter
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &letters))
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "msg-1", letters[0].ID)
+		assert.Equal(t, "t1", letters[1].ID)
+	}
+	rec = serve(s, http.MethodGet, "/v1.0/accounts/456/queue/QID_dlq/dlq", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve(s, http.MethodPost, base+"/replay", `{"ids": ["msg-1"]}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = serve(s, http.MethodPost, base+"/replay", `{"ids": ["missing"]}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, broker.published)
+
+	// the undecodable message stays, the task is queued again
+	rec = serve(s, http.MethodPost, base+"/replay", `{}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	resp := DeadLetterReplayResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Replayed, 1) {
+		assert.Equal(t, "t1", resp.Replayed[0].TaskID)
+		assert.Equal(t, TaskStatusWaiting, resp.Replayed[0].Status)
+		assert.Equal(t, 1, resp.Replayed[0].Position)
+	}
+	assert.Equal(t, []string{"QID_dlq_rKey"}, broker.published)
+	task, err := s.tasks.Get("123", "t1")
+	assert.NoError(t, err)
+	assert.Equal(t, TaskStatusWaiting, task.Status)
+	// a consumer can take it again
+	claimed, err = s.tasks.Claim("123", "t1", TaskStatusDispatched)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	remaining, err := s.deadLetters.List("QID_dlq")
+	assert.NoError(t, err)
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, "msg-1", remaining[0].ID)
+	}
+
+	// cleared with the deleted queue
+	assert.NoError(t, s.deadLetters.Clear("QID_dlq"))
+	assert.NoError(t, s.deadLetters.Clear("QID_dlq"))
+	remaining, err = s.deadLetters.List("QID_dlq")
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+}
+
+func TestReplayDeadLetterPublishFailure(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_dlq", QueueName: "dlq", MaxPriority: 5}))
+	failed := &Task{TaskID: "t1", AccountID: "123", QueueID: "QID_dlq", Priority: 2, CallData: map[string]string{"call_uuid": "c1"}, Status: TaskStatusFailed}
+	assert.NoError(t, s.tasks.Save(failed))
+	assert.NoError(t, s.deadLetters.Add(&DeadLetter{ID: "t1", QueueID: "QID_dlq", Reason: "transfer failed", Task: failed, DeadAt: time.Now()}))
+	broker.failPublish = map[int]bool{1: true}
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_dlq/dlq/replay", `{"ids": ["t1"]}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	task, err := s.tasks.Get("123", "t1")
+	assert.NoError(t, err)
+	assert.Equal(t, TaskStatusFailed, task.Status)
+	count, err := s.pos.Count("QID_dlq")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	_, err = s.deadLetters.Get("QID_dlq", "t1")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/labstack/echo/v4"
+
+	"queuev2/logger"
+	"queuev2/ratelimit"
+)
+
+// Stable error codes of the error response body
+const (
+	CodeBadRequest       = "bad_request"
+	CodeValidation       = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeQueueNotFound    = "queue_not_found"
+	CodeQueueClosed      = "queue_closed"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeUnprocessable    = "unprocessable_entity"
+	CodeRateLimited      = "rate_limited"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeNotImplemented   = "not_implemented"
+	CodeBrokerError      = "broker_error"
+	CodeStoreError       = "store_error"
+	CodeStoreUnavailable = "store_unavailable"
+	CodeInternal         = "internal_error"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusUnprocessableEntity:   CodeUnprocessable,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusNotImplemented:        CodeNotImplemented,
+	http.StatusServiceUnavailable:    CodeStoreUnavailable,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusRequestEntityTooLarge: CodeBadRequest,
+}
+
+//FieldError - validation failure of one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+//ErrorBody - single error format of every API response
+type ErrorBody struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+//ErrorResponse - envelope of ErrorBody
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+//APIError - error returned by handlers, Internal is logged but never sent
+type APIError struct {
+	Status   int
+	Body     ErrorBody
+	Internal error
+}
+
+func (e *APIError) Error() string {
+	if e.Internal != nil {
+		return e.Body.Code + ": " + e.Body.Message + ": " + e.Internal.Error()
+	}
+	return e.Body.Code + ": " + e.Body.Message
+}
+
+func newAPIError(status int, code, msg string) *APIError {
+	return &APIError{Status: status, Body: ErrorBody{Code: code, Message: msg}}
+}
+
+func badRequest(msg string) *APIError {
+	return newAPIError(http.StatusBadRequest, CodeBadRequest, msg)
+}
+
+// bindError - echo bind errors carry the decoder message
+func bindError(err error) *APIError {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return badRequest(fmt.Sprint(he.Message))
+	}
+	return badRequest(err.Error())
+}
+
+func queueNotFound() *APIError {
+	return newAPIError(http.StatusNotFound, CodeQueueNotFound, ErrQueueNotFound.Error())
+}
+
+// queueClosed - submit to a draining or closed queue, the message is the
+// reason given when it was drained
+func queueClosed(reason string) *APIError {
+	return newAPIError(http.StatusConflict, CodeQueueClosed, reason)
+}
+
+func brokerError(err error) *APIError {
+	e := newAPIError(http.StatusServiceUnavailable, CodeBrokerError, "message broker request failed")
+	e.Internal = err
+	return e
+}
+
+func storeError(err error) *APIError {
+	e := newAPIError(http.StatusServiceUnavailable, CodeStoreError, "store request failed")
+	e.Internal = err
+	return e
+}
+
+func internalError(err error) *APIError {
+	e := newAPIError(http.StatusInternalServerError, CodeInternal, "internal server error")
+	e.Internal = err
+	return e
+}
+
+// validationError - one message per invalid field, named by its json tag
+func validationError(err error) *APIError {
+	e := newAPIError(http.StatusBadRequest, CodeValidation, "request validation failed")
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		e.Body.Message = err.Error()
+		return e
+	}
+	for _, fe := range verrs {
+		e.Body.Fields = append(e.Body.Fields, FieldError{Field: fe.Field(), Message: fieldMessage(fe)})
+	}
+	return e
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return "must be at least " + fe.Param()
+	case "max":
+		return "must be at most " + fe.Param()
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	}
+	return "failed the " + fe.Tag() + " check"
+}
+
+// jsonTagName - report validation errors with the json field name
+func jsonTagName(f reflect.StructField) string {
+	name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	if name == "-" || name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// httpErrorHandler - render every error as ErrorResponse
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var apiErr *APIError
+	switch e := err.(type) {
+	case *APIError:
+		apiErr = e
+	case *echo.HTTPError:
+		apiErr = fromHTTPError(e)
+	default:
+		apiErr = internalError(err)
+	}
+
+	apiErr.Body.RequestID = requestID(c)
+	if apiErr.Status >= http.StatusInternalServerError {
+		requestLogger(c).Error("request failed", "method", c.Request().Method, "path", c.Path(),
+			"status", apiErr.Status, logger.FieldError, apiErr)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		err = c.JSON(apiErr.Status, ErrorResponse{Error: apiErr.Body})
+	}
+	if err != nil {
+		requestLogger(c).Error("writing error response failed", logger.FieldError, err)
+	}
+}
+
+func fromHTTPError(he *echo.HTTPError) *APIError {
+	code, ok := statusCodes[he.Code]
+	if !ok {
+		code = CodeInternal
+		if he.Code < http.StatusInternalServerError {
+			code = CodeBadRequest
+		}
+	}
+	if errors.Is(he.Internal, ratelimit.ErrQuotaExceeded) {
+		code = CodeQuotaExceeded
+	}
+
+	msg := fmt.Sprint(he.Message)
+	if he.Code >= http.StatusInternalServerError && he.Code != http.StatusServiceUnavailable {
+		// echo internals may put raw errors in the message
+		msg = http.StatusText(he.Code)
+	}
+	return &APIError{Status: he.Code, Body: ErrorBody{Code: code, Message: msg}, Internal: he.Internal}
+}
+
+func requestID(c echo.Context) string {
+	if id := c.Response().Header().Get(echo.HeaderXRequestID); id != "" {
+		return id
+	}
+	return c.Request().Header.Get(echo.HeaderXRequestID)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newErrorTestServer() *echo.Echo {
+	e := echo.New()
+	v := validator.New()
+	v.RegisterTagNameFunc(jsonTagName)
+	e.Validator = &CustomValidator{validator: v}
+	e.HTTPErrorHandler = httpErrorHandler
+
+	e.POST("/queue", func(c echo.Context) error {
+		q := new(Queue)
+		if err := c.Bind(q); err != nil {
+			return bindError(err)
+		}
+		return c.Validate(q)
+	})
+	e.GET("/broker", func(c echo.Context) error {
+		return brokerError(errors.New("error:: exchange Publish: channel closed"))
+	})
+	return e
+}
+
+func errorBody(t *testing.T, rec *httptest.ResponseRecorder) ErrorBody {
+	resp := ErrorResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp.Error
+}
+
+func TestValidationError(t *testing.T) {
+	e := newErrorTestServer()
+	req := httptest.NewRequest(http.MethodPost, "/queue", strings.NewReader(`{"queue_name": ""}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	body := errorBody(t, rec)
+	assert.Equal(t, CodeValidation, body.Code)
+	assert.Equal(t, "req-1", body.RequestID)
+	assert.ElementsMatch(t, []FieldError{
+		{Field: "queue_name", Message: "is required"},
+		{Field: "max_priority", Message: "is required"},
+	}, body.Fields)
+}
+
+func TestInternalErrorsAreNotLeaked(t *testing.T) {
+	e := newErrorTestServer()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/broker", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	body := errorBody(t, rec)
+	assert.Equal(t, CodeBrokerError, body.Code)
+	assert.NotContains(t, body.Message, "exchange Publish")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, CodeNotFound, errorBody(t, rec).Code)
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/auth"
+	"queuev2/eventlog"
+	"queuev2/events"
+)
+
+const (
+	defaultTailEvents = 100
+	maxTailEvents     = 1000
+	// maxTailWait - seconds a tail request may wait for new events
+	maxTailWait = 30
+)
+
+//EventPage - events after the cursor of the request, Next is the cursor of
+//the following request
+type EventPage struct {
+	Events []eventlog.Entry `json:"events"`
+	Next   string           `json:"next"`
+}
+
+// Events - lifecycle events of the tasks handled by this server, add sinks
+// such as the webhook dispatcher before starting it
+func (s *Server) Events() *events.Emitter {
+	return s.events
+}
+
+// SetEventLog - record the events of this server and enable the timeline
+// and tail endpoints
+func (s *Server) SetEventLog(l *eventlog.Log) {
+	s.eventLog = l
+	s.events.Add(l)
+}
+
+// emitTaskEvent - position is the 1 based position the task holds, or held
+// before leaving the queue
+func (s *Server) emitTaskEvent(eventType string, task *Task, position int, actor string) {
+	s.events.Emit(events.Event{
+		Type:      eventType,
+		AccountID: task.AccountID,
+		QueueID:   task.QueueID,
+		TaskID:    task.TaskID,
+		Position:  position,
+		Actor:     actor,
+	})
+}
+
+// requestActor - caller of the request as "<auth method>:<subject>", "api"
+// when authentication is disabled
+func requestActor(c echo.Context) string {
+	if p := auth.PrincipalFrom(c); p != nil && p.Subject != "" {
+		return p.Method + ":" + p.Subject
+	}
+	return "api"
+}
+
+// getTaskTimeline - events of the task oldest first, they outlive the task
+// for the retention of the event log
+func (s *Server) getTaskTimeline(c echo.Context) error {
+	if s.eventLog == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "the event log is disabled")
+	}
+	accID, taskID := c.Param("accountID"), c.Param("taskID")
+	timeline, err := s.eventLog.Timeline(accID, taskID)
+	if err != nil {
+		return storeError(err)
+	}
+	if len(timeline) == 0 {
+		task, err := s.tasks.Get(accID, taskID)
+		if err == ErrTaskNotFound {
+			return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+		} else if err != nil {
+			return storeError(err)
+		}
+		if task.TaskID != taskID {
+			// looked up by its external id
+			if timeline, err = s.eventLog.Timeline(accID, task.TaskID); err != nil {
+				return storeError(err)
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, timeline)
+}
+
+// tailEvents - events of the account after the cursor in ?after, the
+// newest ones without it. ?wait long polls up to that many seconds when
+// there are no new events
+func (s *Server) tailEvents(c echo.Context) error {
+	if s.eventLog == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "the event log is disabled")
+	}
+	limit := defaultTailEvents
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTailEvents {
+			return badRequest(fmt.Sprintf("limit must be 1 to %d", maxTailEvents))
+		}
+		limit = n
+	}
+	wait := 0
+	if v := c.QueryParam("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxTailWait {
+			return badRequest(fmt.Sprintf("wait must be 0 to %d seconds", maxTailWait))
+		}
+		wait = n
+	}
+
+	entries, next, err := s.eventLog.Tail(c.Param("accountID"), c.QueryParam("after"), limit, time.Duration(wait)*time.Second)
+	if err == eventlog.ErrInvalidCursor {
+		return badRequest(err.Error())
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, EventPage{Events: entries, Next: next})
+}
@@ -3,69 +3,470 @@ package api
 import (
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
+	"github.com/streadway/amqp"
+	"math"
 	"net/http"
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/metrics"
+	"queuev2/mq/producer"
+	"queuev2/ratelimit"
+	"queuev2/taskid"
+	"strings"
 )
 
 func (s *Server) submitTask(c echo.Context) error {
 	task := new(Task)
 	if err := c.Bind(task); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return bindError(err)
 	}
-	task.TaskID = s.getNewTaskId()
-	if err := c.Validate(task); err != nil {
+	if queueID := c.Param("queueID"); queueID != "" {
+		if task.QueueID != "" && task.QueueID != queueID {
+			return badRequest("queue_id does not match the queue in the path")
+		}
+		task.QueueID = queueID
+	}
+	if err := s.validateTask(c, task); err != nil {
+		return err
+	}
+
+	// a retry is answered from its key before the queue is checked again,
+	// it must not fail on a quota or state the first request already passed
+	idemKey, err := s.idempotencyKey(c, task)
+	if err != nil {
+		return err
+	}
+	fingerprint := taskFingerprint(task)
+	if idemKey != "" {
+		rec, err := s.claimIdempotencyKey(idemKey, fingerprint)
+		if err != nil {
+			return storeError(err)
+		}
+		if rec != nil {
+			return s.replayTask(c, rec, fingerprint)
+		}
+	}
+	fail := func(err error) error {
+		if idemKey != "" {
+			// release the key so the client can retry the failed request
+			s.store.DeleteKey(idemKey)
+		}
 		return err
 	}
 
+	queue, err := s.prepareTask(c, task, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if err = s.checkWaitingTasksQuota(c.Param("accountID"), queue); err == ratelimit.ErrQuotaExceeded {
+		return fail(ratelimit.QuotaExceeded(c, "queue has reached its maximum number of waiting tasks"))
+	} else if err != nil {
+		return fail(brokerError(err))
+	}
+	if apiErr := s.enqueueTask(c, queue, task); apiErr != nil {
+		return fail(apiErr)
+	}
+	s.setEstimatedWait(task)
+
+	if idemKey != "" {
+		if err = s.completeIdempotencyKey(idemKey, fingerprint, task); err != nil {
+			requestLogger(c).Error("storing idempotency record failed", logger.FieldTaskID, task.TaskID, logger.FieldError, err)
+		}
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// validateTask - check the fields of a submitted task, before its queue is
+// looked up
+func (s *Server) validateTask(c echo.Context, task *Task) error {
+	if task.ExternalID != "" {
+		if err := taskid.ValidateExternalID(task.ExternalID); err != nil {
+			e := newAPIError(http.StatusBadRequest, CodeValidation, "request validation failed")
+			e.Body.Fields = []FieldError{{Field: "external_id", Message: err.Error()}}
+			return e
+		}
+	}
+	return c.Validate(task)
+}
+
+// prepareTask - assign the task id and check the validated task against its
+// queue, queues caches lookups across the items of a batch and may be nil.
+// The id is generated even with an external id, positions of equal
+// priority are ordered by id and so by arrival
+func (s *Server) prepareTask(c echo.Context, task *Task, queues map[string]*Queue) (*Queue, error) {
+	accID := c.Param("accountID")
+	id, err := s.taskIDs.NewID(accID)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	task.TaskID = id
+	task.AccountID = accID
+	task.Status = TaskStatusWaiting
+
+	queue, ok := queues[task.QueueID]
+	if !ok {
+		queue, err = s.queues.Get(accID, task.QueueID)
+		if err == ErrQueueNotFound {
+			return nil, queueNotFound()
+		}
+		if err != nil {
+			return nil, storeError(err)
+		}
+		if err = s.setQueueState(queue); err != nil {
+			return nil, storeError(err)
+		}
+		if queues != nil {
+			queues[task.QueueID] = queue
+		}
+	}
+	if err := s.checkAccepting(queue); err != nil {
+		return nil, err
+	}
+	if task.Priority > queue.MaxPriority {
+		e := newAPIError(http.StatusBadRequest, CodeValidation, "request validation failed")
+		e.Body.Fields = []FieldError{{Field: "priority", Message: fmt.Sprintf("must be at most the queue max_priority %d", queue.MaxPriority)}}
+		return nil, e
+	}
+	return queue, nil
+}
+
+// enqueueTask - store the task and its position, then publish it. Both are
+// removed again when the broker refuses it. The request id is handed to
+// the consumer in the message headers
+func (s *Server) enqueueTask(c echo.Context, queue *Queue, task *Task) *APIError {
 	routingKey := task.QueueID + "_rKey"
 	data, err := json.Marshal(task)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return internalError(err)
 	}
-	err = s.mqProducer.PublishMessage(routingKey, data, task.Priority)
+
+	if apiErr := s.reserveTaskID(task); apiErr != nil {
+		return apiErr
+	}
+	// stored first so the consumer always finds the task it receives
+	if err = s.tasks.Save(task); err != nil {
+		s.releaseTaskID(c, task)
+		return storeError(err)
+	}
+	if err = s.pos.AddItem(task.QueueID, task.TaskID, int(queue.MaxPriority-task.Priority)); err != nil {
+		s.tasks.Delete(task.AccountID, task.TaskID)
+		s.releaseTaskID(c, task)
+		return storeError(err)
+	}
+	err = s.mqProducer.PublishMessage(routingKey, data, task.Priority, amqp.Table{producer.HeaderRequestID: requestID(c)})
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		s.publishFailed(c, task, err)
+		return brokerError(err)
+	}
+	actor := requestActor(c)
+	s.emitTaskEvent(events.TaskSubmitted, task, 0, actor)
+
+	if p, err := s.pos.GetPosition(task.QueueID, task.TaskID); err == nil {
+		task.Position = p + 1
+	} else {
+		// queued, only its position is unknown
+		requestLogger(c).Warn("reading position of submitted task failed", logger.FieldTaskID, task.TaskID, logger.FieldError, err)
 	}
+	s.emitTaskEvent(events.TaskEnqueued, task, task.Position, actor)
+	return nil
+}
 
-	err = s.pos.AddItem(task.TaskID, int(s.mqProducer.MaxPriority-task.Priority))
-	p, err := s.pos.GetPosition(task.TaskID)
+// publishFailed - remove the task the broker refused or never received.
+// A task the broker did not confirm in time may still be dispatched, it
+// keeps its record and position and is marked for reconciliation
+func (s *Server) publishFailed(c echo.Context, task *Task, err error) {
+	if !errors.Is(err, producer.ErrNotConfirmed) {
+		s.unstoreTask(c, task)
+		return
+	}
+	l := requestLogger(c).With(logger.FieldTaskID, task.TaskID, logger.FieldQueueID, task.QueueID)
+	l.Warn("task publish not confirmed, keeping it for reconciliation")
+	if err := s.tasks.MarkUnconfirmed(task); err != nil {
+		l.Error("marking unconfirmed task failed", logger.FieldError, err)
+	}
+}
+
+// unstoreTask - remove the task and its position after the broker refused
+// it, it was never queued
+func (s *Server) unstoreTask(c echo.Context, task *Task) {
+	l := requestLogger(c).With(logger.FieldTaskID, task.TaskID, logger.FieldQueueID, task.QueueID)
+	if err := s.pos.RemoveItem(task.QueueID, task.TaskID); err != nil {
+		l.Error("removing position of unpublished task failed", logger.FieldError, err)
+	}
+	if err := s.tasks.Delete(task.AccountID, task.TaskID); err != nil {
+		l.Error("removing unpublished task failed", logger.FieldError, err)
+	}
+	s.releaseTaskID(c, task)
+}
+
+// reserveTaskID - take the external id of the task for the account, 409
+// when another task uses it. Generated ids are unique already
+func (s *Server) reserveTaskID(task *Task) *APIError {
+	if task.ExternalID == "" {
+		return nil
+	}
+	ok, err := s.tasks.Reserve(task.AccountID, task.ExternalID, task.TaskID)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return storeError(err)
 	}
-	task.Position = p + 1
+	if !ok {
+		e := newAPIError(http.StatusConflict, CodeConflict, "external_id is used by another task")
+		e.Body.Fields = []FieldError{{Field: "external_id", Message: "already used"}}
+		return e
+	}
+	return nil
+}
+
+// releaseTaskID - free the external id of a task which was never queued,
+// so the client can submit it again
+func (s *Server) releaseTaskID(c echo.Context, task *Task) {
+	if task.ExternalID == "" {
+		return
+	}
+	if err := s.tasks.Release(task.AccountID, task.ExternalID); err != nil {
+		requestLogger(c).Error("releasing external id failed", logger.FieldTaskID, task.TaskID, logger.FieldError, err)
+	}
+}
+
+func (s *Server) getTask(c echo.Context) error {
+	task, err := s.tasks.Get(c.Param("accountID"), c.Param("taskID"))
+	if err == ErrTaskNotFound {
+		return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	s.setPosition(task)
+	s.setEstimatedWait(task)
 	return c.JSON(http.StatusOK, task)
 }
 
+// cancelTask - the message stays in the broker, the consumer drops it
+// once it sees the cancelled status. The task is claimed so it is either
+// cancelled or dispatched, never both
+func (s *Server) cancelTask(c echo.Context) error {
+	task, err := s.tasks.Get(c.Param("accountID"), c.Param("taskID"))
+	if err == ErrTaskNotFound {
+		return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	if task.Status != TaskStatusWaiting {
+		return newAPIError(http.StatusConflict, CodeConflict, "task is "+task.Status+", only waiting tasks can be cancelled")
+	}
+	claimed, err := s.tasks.Claim(task.AccountID, task.TaskID, TaskStatusCancelled)
+	if err != nil {
+		return storeError(err)
+	}
+	if !claimed {
+		// a consumer took it since it was read
+		status := TaskStatusDispatched
+		if current, err := s.tasks.Get(task.AccountID, task.TaskID); err == nil && current.Status != TaskStatusWaiting {
+			status = current.Status
+		}
+		return newAPIError(http.StatusConflict, CodeConflict, "task is "+status+", only waiting tasks can be cancelled")
+	}
+
+	s.setPosition(task)
+	held := task.Position
+	task.Status = TaskStatusCancelled
+	task.Position = 0
+	if err = s.tasks.Save(task); err != nil {
+		return storeError(err)
+	}
+	if err = s.pos.RemoveItem(task.QueueID, task.TaskID); err != nil {
+		return storeError(err)
+	}
+	s.emitTaskEvent(events.TaskAbandoned, task, held, requestActor(c))
+	return c.JSON(http.StatusOK, task)
+}
+
+// setEstimatedWait - estimated wait of a waiting task from its position,
+// unset without an estimator or when the queue has too little data
+func (s *Server) setEstimatedWait(task *Task) {
+	task.EstimatedWaitSeconds = nil
+	if s.estimator == nil || task.Status != TaskStatusWaiting || task.Position <= 0 {
+		return
+	}
+	wait, ok, err := s.estimator.Estimate(task.QueueID, task.Position-1)
+	if err != nil {
+		logger.Warn("estimating wait failed", logger.FieldTaskID, task.TaskID, logger.FieldError, err)
+		return
+	}
+	if ok {
+		seconds := int(math.Ceil(wait.Seconds()))
+		task.EstimatedWaitSeconds = &seconds
+	}
+}
+
+// setPosition - 1 based position of a waiting task, 0 otherwise
+func (s *Server) setPosition(task *Task) {
+	task.Position = 0
+	if task.Status != TaskStatusWaiting {
+		return
+	}
+	if p, err := s.pos.GetPosition(task.QueueID, task.TaskID); err == nil {
+		task.Position = p + 1
+	}
+}
+
 func (s *Server) createQueue(c echo.Context) error {
 	queue := new(Queue)
 	accID := c.Param("accountID")
 	if err := c.Bind(queue); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return bindError(err)
+	}
+	if strings.Contains(accID, "_") {
+		// the account would be ambiguous in the generated queue id
+		e := newAPIError(http.StatusBadRequest, CodeValidation, "request validation failed")
+		e.Body.Fields = []FieldError{{Field: "accountID", Message: "must not contain '_' to create queues"}}
+		return e
 	}
 	queue.QueueID = generateQueueID(accID, queue.QueueName, queue.MaxPriority)
+	queue.State, queue.StateReason = "", ""
 
 	if err := c.Validate(queue); err != nil {
 		return err
 	}
+	if legacy, ok := s.legacyQueueID(accID, queue); ok {
+		queue.QueueID = legacy
+	}
+	if owner, err := s.queues.Owner(queue.QueueID); err != nil {
+		return storeError(err)
+	} else if owner != "" && owner != accID {
+		return newAPIError(http.StatusConflict, CodeConflict, "queue id is used by another account")
+	}
+
+	if err := s.checkQueueQuota(accID, queue.QueueID); err == ratelimit.ErrQuotaExceeded {
+		return ratelimit.QuotaExceeded(c, "account has reached its maximum number of queues")
+	} else if err != nil {
+		return storeError(err)
+	}
 
 	err := s.mqProducer.CreateQueue(queue.QueueID, queue.MaxPriority)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return newAPIError(http.StatusConflict, CodeConflict, "the broker holds the queue with other settings")
+	}
+	if err != nil {
+		return brokerError(err)
+	}
+	if err = s.queues.Register(accID, queue); err != nil {
+		return storeError(err)
+	}
+	if err = s.setQueueState(queue); err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, queue)
+}
+
+func (s *Server) getQueue(c echo.Context) error {
+	queue, err := s.getQueueWithState(c)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return err
 	}
 	return c.JSON(http.StatusOK, queue)
 }
 
+// deleteQueue - delete the broker queue with its waiting messages, the
+// tasks themselves expire from the store
+func (s *Server) deleteQueue(c echo.Context) error {
+	accID, queueID := c.Param("accountID"), c.Param("queueID")
+	if _, err := s.queues.Get(accID, queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	if err := s.mqProducer.DeleteQueue(queueID); err != nil {
+		return brokerError(err)
+	}
+	if err := s.queues.Remove(accID, queueID); err != nil && err != ErrQueueNotFound {
+		return storeError(err)
+	}
+	if err := s.pos.Clear(queueID); err != nil {
+		return storeError(err)
+	}
+	if err := s.thresholds.Delete(accID, queueID); err != nil {
+		return storeError(err)
+	}
+	if err := s.states.Delete(queueID); err != nil {
+		return storeError(err)
+	}
+	if err := s.deadLetters.Clear(queueID); err != nil {
+		return storeError(err)
+	}
+	if err := s.webhooks.DeleteQueue(accID, queueID); err != nil {
+		return storeError(err)
+	}
+	s.invalidateWebhooks(accID)
+	metrics.ForgetQueue(accID, queueID)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// listQueueTasks - waiting tasks of the queue in position order
+func (s *Server) listQueueTasks(c echo.Context) error {
+	accID, queueID := c.Param("accountID"), c.Param("queueID")
+	if _, err := s.queues.Get(accID, queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	ids, err := s.pos.List(queueID)
+	if err != nil {
+		return storeError(err)
+	}
+	tasks := make([]*Task, 0, len(ids))
+	for i, id := range ids {
+		task, err := s.tasks.Get(accID, id)
+		if err == ErrTaskNotFound {
+			continue
+		}
+		if err != nil {
+			return storeError(err)
+		}
+		task.Position = i + 1
+		tasks = append(tasks, task)
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
+
+func (s *Server) listQueues(c echo.Context) error {
+	queues, err := s.queues.List(c.Param("accountID"))
+	if err != nil {
+		return storeError(err)
+	}
+	for _, queue := range queues {
+		if err = s.setQueueState(queue); err != nil {
+			return storeError(err)
+		}
+	}
+	return c.JSON(http.StatusOK, queues)
+}
+
+// generateQueueID - url safe so the id can be used as a path segment, ids
+// without '+' or '/' in the standard encoding are unchanged
 func generateQueueID(accID, queueName string, priority uint8) string {
 	qID := accID + "_" + queueName + fmt.Sprintf("%d", priority)
-	qEnc := b64.StdEncoding.EncodeToString([]byte(qID))
+	qEnc := b64.URLEncoding.EncodeToString([]byte(qID))
 	return "QID_" + qEnc
 }
 
-func (s *Server) getNewTaskId() string {
-	id := uuid.New().String()
-	id = fmt.Sprintf("%d_%s", s.keyCounter, id)
-	s.keyCounter++
-	return id
+// legacyQueueID - id of the queue when it was created with a '+' in its
+// standard encoded id, it is kept so the broker queue and its tasks stay in
+// use. Ids with a '/' were never addressable and are replaced
+func (s *Server) legacyQueueID(accID string, queue *Queue) (string, bool) {
+	legacy := "QID_" + b64.StdEncoding.EncodeToString([]byte(accID+"_"+queue.QueueName+fmt.Sprintf("%d", queue.MaxPriority)))
+	if legacy == queue.QueueID || strings.Contains(legacy, "/") {
+		return "", false
+	}
+	if _, err := s.queues.Get(accID, legacy); err != nil {
+		return "", false
+	}
+	return legacy, true
 }
@@ -0,0 +1,366 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/logger"
+	"queuev2/mq/producer"
+	"queuev2/store/mock"
+)
+
+// testBroker - Broker keeping the queues and the published messages, the
+// publishes numbered in failPublish fail and the ones in unconfirmed are
+// queued without a confirm
+type testBroker struct {
+	mu          sync.Mutex
+	queues      map[string]uint8
+	published   []string
+	attempts    int
+	failPublish map[int]bool
+	unconfirmed map[int]bool
+	createErr   error
+}
+
+func (b *testBroker) PublishMessage(routingKey string, body []byte, priority uint8, headers amqp.Table) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	if b.failPublish[b.attempts] {
+		return errors.New("error:: exchange Publish: channel closed")
+	}
+	b.published = append(b.published, routingKey)
+	if b.unconfirmed[b.attempts] {
+		return producer.ErrNotConfirmed
+	}
+	return nil
+}
+
+func (b *testBroker) PublishBatch(msgs []producer.Message) []error {
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = b.PublishMessage(m.RoutingKey, m.Body, m.Priority, m.Headers)
+	}
+	return errs
+}
+
+func (b *testBroker) CreateQueue(queueName string, maxPriority uint8) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.createErr != nil {
+		return b.createErr
+	}
+	b.queues[queueName] = maxPriority
+	return nil
+}
+
+func (b *testBroker) DeleteQueue(queueName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.queues, queueName)
+	return nil
+}
+
+func (b *testBroker) QueueDepth(queueName string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[queueName]; !ok {
+		return 0, errors.New("error:: queue inspect: NOT_FOUND")
+	}
+	return 0, nil
+}
+
+func (b *testBroker) Ping() error { return nil }
+
+// fixedIDs - task ids generated from a fixed id
+type fixedIDs struct{ id string }
+
+func (f fixedIDs) NewID(accountID string) (string, error) { return f.id, nil }
+
+// newHandlerTestServer - server without authentication over a test broker
+func newHandlerTestServer(t *testing.T) (*Server, *testBroker) {
+	logger.SetLevel(logger.LevelFatal)
+	broker := &testBroker{queues: make(map[string]uint8)}
+	s := NewServer(0, broker, mock.NewStore("", ""))
+	s.SetAuthenticator(nil)
+	return s, broker
+}
+
+// serve - response of the server to a request with an optional JSON body
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateQueueURLSafeID(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue", `{"queue_name": "q??", "max_priority": 5}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	queue := Queue{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queue))
+	assert.Equal(t, "QID_MTIzX3E_PzU=", queue.QueueID)
+	assert.Contains(t, broker.queues, queue.QueueID)
+
+	rec = serve(s, http.MethodGet, "/v1.0/accounts/123/queue/"+queue.QueueID, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// ids without '+' or '/' are the ones of the standard encoding
+	assert.Equal(t, "QID_MTIzX3NhbGVzNQ==", generateQueueID("123", "sales", 5))
+}
+
+func TestCreateQueueKeepsLegacyID(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+	legacy := "QID_MTIzX3E+PzU="
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: legacy, QueueName: "q>?", MaxPriority: 5}))
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue", `{"queue_name": "q>?", "max_priority": 5}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	queue := Queue{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queue))
+	assert.Equal(t, legacy, queue.QueueID)
+
+	count, err := s.queues.Count("123")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestCreateQueueIDCollision(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/a_b/queue", `{"queue_name": "c", "max_priority": 5}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "accountID")
+
+	// the id is registered to another account
+	queueID := generateQueueID("123", "sales", 5)
+	assert.NoError(t, s.queues.Register("456", &Queue{QueueID: queueID, QueueName: "sales", MaxPriority: 5}))
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/queue", `{"queue_name": "sales", "max_priority": 5}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	count, err := s.queues.Count("123")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// the broker holds the queue with other arguments
+	broker.createErr = fmt.Errorf("error:: queue declare: %w", &amqp.Error{Code: amqp.PreconditionFailed})
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/queue", `{"queue_name": "support", "max_priority": 5}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	count, err = s.queues.Count("123")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestQueueOwnership(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue", `{"queue_name": "sales", "max_priority": 5}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	queue := Queue{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queue))
+
+	task := `{"priority": 1, "call_data": {"call_uuid": "c1"}}`
+	other := "/v1.0/accounts/456/queue/" + queue.QueueID
+	for _, tc := range []struct {
+		method, target, body string
+	}{
+		{http.MethodGet, other, ""},
+		{http.MethodDelete, other, ""},
+		{http.MethodGet, other + "/task", ""},
+		{http.MethodPost, other + "/task", task},
+		{http.MethodPost, "/v1.0/accounts/456/task", `{"queue_id": "` + queue.QueueID + `", "priority": 1, "call_data": {"call_uuid": "c1"}}`},
+		{http.MethodPost, other + "/pause", ""},
+		{http.MethodGet, other + "/thresholds", ""},
+	} {
+		rec = serve(s, tc.method, tc.target, tc.body)
+		assert.Equal(t, http.StatusNotFound, rec.Code, tc.method+" "+tc.target)
+	}
+	assert.Empty(t, broker.published)
+	assert.Contains(t, broker.queues, queue.QueueID)
+
+	rec = serve(s, http.MethodGet, "/v1.0/accounts/456/queue", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/queue/"+queue.QueueID+"/task", task)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, broker.published, 1)
+}
+
+func TestLegacyQueueAdopted(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	// created before the registry, only the broker knows it
+	legacy := "QID_MTIzX3N1cHBvcnQxMA=="
+	broker.queues[legacy] = 10
+
+	rec := serve(s, http.MethodGet, "/v1.0/accounts/456/queue/"+legacy, "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(s, http.MethodGet, "/v1.0/accounts/123/queue/QID_MTIzX290aGVyNQ==", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve(s, http.MethodGet, "/v1.0/accounts/123/queue/"+legacy, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	queue := Queue{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queue))
+	assert.Equal(t, "support", queue.QueueName)
+	assert.Equal(t, uint8(10), queue.MaxPriority)
+
+	queues, err := s.queues.List("123")
+	assert.NoError(t, err)
+	if assert.Len(t, queues, 1) {
+		assert.Equal(t, legacy, queues[0].QueueID)
+	}
+	count, err := s.queues.Count("456")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestSubmitUnpublishedTaskNotStored(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_submit", QueueName: "submit", MaxPriority: 5}))
+	broker.failPublish = map[int]bool{1: true}
+	s.SetTaskIDGenerator(fixedIDs{"t1"})
+	task := `{"priority": 1, "call_data": {"call_uuid": "c1"}}`
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_submit/task", task)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	count, err := s.pos.Count("QID_submit")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	_, err = s.tasks.Get("123", "t1")
+	assert.Equal(t, ErrTaskNotFound, err)
+
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_submit/task", task)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	submitted := Task{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &submitted))
+	assert.Equal(t, 1, submitted.Position)
+	_, err = s.tasks.Get("123", submitted.TaskID)
+	assert.NoError(t, err)
+}
+
+func TestSubmitUnconfirmedTaskKept(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_submit", QueueName: "submit", MaxPriority: 5}))
+	broker.unconfirmed = map[int]bool{1: true}
+	s.SetTaskIDGenerator(fixedIDs{"t1"})
+
+	rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_submit/task", `{"priority": 1, "call_data": {"call_uuid": "c1"}}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	count, err := s.pos.Count("QID_submit")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = s.tasks.Get("123", "t1")
+	assert.NoError(t, err)
+	marked, err := s.store.GetAllItemsSortedSet(unconfirmedTasksKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"123 t1"}, marked)
+}
+
+func TestCancelClaimedTask(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_cancel", QueueName: "cancel", MaxPriority: 5}))
+	submit := func(id string) {
+		s.SetTaskIDGenerator(fixedIDs{id})
+		rec := serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_cancel/task", `{"priority": 1, "call_data": {"call_uuid": "`+id+`"}}`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// taken by a consumer before it saved the dispatched status
+	submit("t1")
+	claimed, err := s.tasks.Claim("123", "t1", TaskStatusDispatched)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	rec := serve(s, http.MethodDelete, "/v1.0/accounts/123/task/t1", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "task is dispatched")
+
+	// cancelled first, the consumer must drop it
+	submit("t2")
+	rec = serve(s, http.MethodDelete, "/v1.0/accounts/123/task/t2", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	claimed, err = s.tasks.Claim("123", "t2", TaskStatusDispatched)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+}
+
+func TestSubmitExternalID(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	for _, acc := range []string{"123", "456"} {
+		assert.NoError(t, s.queues.Register(acc, &Queue{QueueID: "QID_ext" + acc, QueueName: "ext", MaxPriority: 5}))
+	}
+	submit := func(acc string) *httptest.ResponseRecorder {
+		return serve(s, http.MethodPost, "/v1.0/accounts/"+acc+"/queue/QID_ext"+acc+"/task", `{"priority": 1, "external_id": "call-1", "call_data": {"call_uuid": "c1"}}`)
+	}
+
+	// released when the broker refuses the task
+	broker.failPublish = map[int]bool{1: true}
+	rec := submit("123")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// queued behind the tasks which arrived before it, whatever its id
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_ext123/task", `{"priority": 1, "call_data": {"call_uuid": "c0"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = submit("123")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	task := Task{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &task))
+	assert.Equal(t, "call-1", task.ExternalID)
+	assert.NotEqual(t, "call-1", task.TaskID)
+	assert.Equal(t, 2, task.Position)
+
+	// found by its external id too
+	rec = serve(s, http.MethodGet, "/v1.0/accounts/123/task/call-1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	found := Task{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &found))
+	assert.Equal(t, task.TaskID, found.TaskID)
+
+	rec = submit("123")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "external_id is used by another task")
+
+	// unique per account
+	rec = submit("456")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/task/batch", `{"tasks": [
+		{"queue_id": "QID_ext123", "priority": 1, "external_id": "call-2", "call_data": {"call_uuid": "c1"}},
+		{"queue_id": "QID_ext123", "priority": 1, "external_id": "call-2", "call_data": {"call_uuid": "c1"}},
+		{"queue_id": "QID_ext123", "priority": 1, "external_id": "call-1", "call_data": {"call_uuid": "c1"}}]}`)
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	resp := BatchTaskResponse{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Accepted)
+	if assert.Len(t, resp.Results, 3) {
+		assert.Equal(t, "call-2", resp.Results[0].Task.ExternalID)
+		assert.Equal(t, http.StatusConflict, resp.Results[1].Status)
+		assert.Equal(t, http.StatusConflict, resp.Results[2].Status)
+	}
+	assert.Len(t, broker.published, 4)
+}
+
+func TestQueueAccountID(t *testing.T) {
+	for queueID, account := range map[string]string{
+		generateQueueID("123", "sales", 5): "123",
+		generateQueueID("123", "q>?_x", 5): "123",
+		"QID_MTIzX3E+PzU=":                 "123",
+		"QID_c2FsZXM1":                     "",
+		"sales":                            "",
+		"QID_not base64":                   "",
+	} {
+		assert.Equal(t, account, QueueAccountID(queueID), queueID)
+	}
+}
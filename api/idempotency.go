@@ -0,0 +1,137 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	idempotencyKeyPrefix      = "idem:"
+	defaultIdempotencyWindow  = 24 * time.Hour
+	maxIdempotencyKeyLength   = 255
+	callUUIDKey               = "call_uuid"
+	idempotencyCallUUIDPrefix = "call_uuid:"
+)
+
+// idempotencyPendingTTL - how long the key of a request still being processed
+// is held, longer than the broker confirm wait of a submit. A request dying
+// before it completes frees the key for its retries
+const idempotencyPendingTTL = 30 * time.Second
+
+// idempotencyRecord - stored per key, Task is nil while the first request
+// is still being processed
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Task        *Task  `json:"task,omitempty"`
+}
+
+// SetIdempotency - how long submitted keys are remembered and whether
+// call_data.call_uuid is used as key when no Idempotency-Key header is sent
+func (s *Server) SetIdempotency(window time.Duration, dedupeCallUUID bool) {
+	s.idempotencyWindow = window
+	s.dedupeCallUUID = dedupeCallUUID
+}
+
+// idempotencyKey - store key for the request, empty if it is not deduplicated
+func (s *Server) idempotencyKey(c echo.Context, task *Task) (string, error) {
+	key := c.Request().Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", badRequest(idempotencyKeyHeader + " is too long")
+	}
+	if key == "" && s.dedupeCallUUID && task.CallData[callUUIDKey] != "" {
+		key = idempotencyCallUUIDPrefix + task.CallData[callUUIDKey]
+	}
+	if key == "" {
+		return "", nil
+	}
+	return idempotencyKeyPrefix + c.Param("accountID") + ":" + key, nil
+}
+
+// claimIdempotencyKey - returns nil, nil if the caller owns the key and has
+// to process the request, otherwise the stored record of the first request
+func (s *Server) claimIdempotencyKey(key string, fingerprint string) (*idempotencyRecord, error) {
+	pending, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := s.store.SetNX(key, string(pending), int(idempotencyPendingTTL/time.Second))
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	data, err := s.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	rec := &idempotencyRecord{}
+	if err = json.Unmarshal([]byte(data), rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *Server) completeIdempotencyKey(key, fingerprint string, task *Task) error {
+	data, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint, Task: task})
+	if err != nil {
+		return err
+	}
+	// one command, the key never loses its expire time
+	return s.store.SetEX(key, string(data), s.idempotencyWindowSec())
+}
+
+// replayTask - answer a retried request with the original task, its
+// current position, 0 once the task left the queue, and its estimated wait
+func (s *Server) replayTask(c echo.Context, rec *idempotencyRecord, fingerprint string) error {
+	if rec.Fingerprint != fingerprint {
+		return newAPIError(http.StatusUnprocessableEntity, CodeUnprocessable, idempotencyKeyHeader+" was used with a different request")
+	}
+	if rec.Task == nil {
+		return newAPIError(http.StatusConflict, CodeConflict, "a request with this "+idempotencyKeyHeader+" is still in progress")
+	}
+
+	task := *rec.Task
+	if current, err := s.tasks.Get(task.AccountID, task.TaskID); err == nil {
+		task = *current
+	}
+	s.setPosition(&task)
+	s.setEstimatedWait(&task)
+	c.Response().Header().Set(idempotentReplayedHeader, "true")
+	return c.JSON(http.StatusOK, task)
+}
+
+func (s *Server) idempotencyWindowSec() int {
+	if s.idempotencyWindow <= 0 {
+		return int(defaultIdempotencyWindow / time.Second)
+	}
+	return int(s.idempotencyWindow / time.Second)
+}
+
+// taskFingerprint - hash of the fields defining a submission, ids excluded
+func taskFingerprint(task *Task) string {
+	keys := make([]string, 0, len(task.CallData))
+	for k := range task.CallData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	h.Write([]byte(task.QueueID))
+	h.Write([]byte{0, task.Priority, 0})
+	h.Write([]byte(task.ExternalID))
+	for _, k := range keys {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(task.CallData[k]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
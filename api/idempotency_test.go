@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/ewt"
+	"queuev2/queuestats"
+	"queuev2/store"
+)
+
+// expiryStore - Store keeping the expire time of the last write of each key
+type expiryStore struct {
+	store.Store
+	expires map[string]int
+}
+
+func (e *expiryStore) SetNX(key, value string, expire int) (bool, error) {
+	e.expires[key] = expire
+	return e.Store.SetNX(key, value, expire)
+}
+
+func (e *expiryStore) SetEX(key, value string, expire int) error {
+	e.expires[key] = expire
+	return e.Store.SetEX(key, value, expire)
+}
+
+// submitWithKey - submit body to the queue of account 123 with an
+// Idempotency-Key header
+func submitWithKey(s *Server, queueID, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1.0/accounts/123/queue/"+queueID+"/task", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, key)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_idem", QueueName: "idem", MaxPriority: 5}))
+	stats := queuestats.NewStats(s.store, queuestats.DefaultOptions())
+	agents := queuestats.NewAgents(s.store)
+	assert.NoError(t, stats.RecordHandleTime("QID_idem", time.Now(), 30*time.Second))
+	assert.NoError(t, agents.Heartbeat("QID_idem", "a1", queuestats.AgentBusy))
+	s.SetEstimator(ewt.NewEstimator(stats, agents, ewt.Average{}))
+	body := `{"priority": 1, "call_data": {"call_uuid": "c1"}}`
+
+	rec := submitWithKey(s, "QID_idem", "k1", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	first := Task{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &first))
+
+	// the retry is answered even though the queue no longer accepts tasks
+	rec = serve(s, http.MethodPost, "/v1.0/accounts/123/queue/QID_idem/drain", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = submitWithKey(s, "QID_idem", "k1", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get(idempotentReplayedHeader))
+	replayed := Task{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &replayed))
+	assert.Equal(t, first.TaskID, replayed.TaskID)
+	assert.Equal(t, 1, replayed.Position)
+	if assert.NotNil(t, first.EstimatedWaitSeconds) && assert.NotNil(t, replayed.EstimatedWaitSeconds) {
+		assert.Equal(t, *first.EstimatedWaitSeconds, *replayed.EstimatedWaitSeconds)
+	}
+	assert.Len(t, broker.published, 1)
+
+	// a new key is checked against the queue
+	rec = submitWithKey(s, "QID_idem", "k2", body)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), CodeQueueClosed)
+}
+
+func TestIdempotencyKeyMismatch(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_idem", QueueName: "idem", MaxPriority: 5}))
+
+	rec := submitWithKey(s, "QID_idem", "k1", `{"priority": 1, "call_data": {"call_uuid": "c1"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = submitWithKey(s, "QID_idem", "k1", `{"priority": 2, "call_data": {"call_uuid": "c1"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Empty(t, rec.Header().Get(idempotentReplayedHeader))
+	assert.Len(t, broker.published, 1)
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_idem", QueueName: "idem", MaxPriority: 5}))
+	task := &Task{QueueID: "QID_idem", Priority: 1, CallData: map[string]string{"call_uuid": "c1"}}
+
+	// the first request holds the key and has not answered yet
+	rec, err := s.claimIdempotencyKey(idempotencyKeyPrefix+"123:k1", taskFingerprint(task))
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	resp := submitWithKey(s, "QID_idem", "k1", `{"priority": 1, "call_data": {"call_uuid": "c1"}}`)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "still in progress")
+	assert.Empty(t, broker.published)
+}
+
+func TestIdempotencyKeyExpiry(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+	expiry := &expiryStore{Store: s.store, expires: make(map[string]int)}
+	s.store = expiry
+	s.SetIdempotency(time.Hour, false)
+	task := &Task{QueueID: "QID_idem", Priority: 1, CallData: map[string]string{"call_uuid": "c1"}}
+	key := idempotencyKeyPrefix + "123:k1"
+
+	// a request dying while it holds the key blocks its retries shortly
+	rec, err := s.claimIdempotencyKey(key, taskFingerprint(task))
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+	assert.Equal(t, int(idempotencyPendingTTL/time.Second), expiry.expires[key])
+
+	assert.NoError(t, s.completeIdempotencyKey(key, taskFingerprint(task), task))
+	assert.Equal(t, 3600, expiry.expires[key])
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	s, broker := newHandlerTestServer(t)
+	assert.NoError(t, s.queues.Register("123", &Queue{QueueID: "QID_idem", QueueName: "idem", MaxPriority: 5}))
+	broker.failPublish = map[int]bool{1: true}
+	body := `{"priority": 1, "call_data": {"call_uuid": "c1"}}`
+
+	rec := submitWithKey(s, "QID_idem", "k1", body)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = submitWithKey(s, "QID_idem", "k1", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(idempotentReplayedHeader))
+	assert.Len(t, broker.published, 1)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/ratelimit"
+)
+
+func (s *Server) getLimits(c echo.Context) error {
+	limits, err := s.limiter.Limits(c.Param("accountID"))
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, limits)
+}
+
+func (s *Server) setLimits(c echo.Context) error {
+	limits := ratelimit.Limits{}
+	if err := c.Bind(&limits); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(&limits); err != nil {
+		return err
+	}
+	if err := s.limiter.SetLimits(c.Param("accountID"), limits); err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, limits)
+}
+
+// checkQueueQuota - creating an existing queue again does not count
+func (s *Server) checkQueueQuota(accountID, queueID string) error {
+	limits, err := s.limiter.Limits(accountID)
+	if err != nil || limits.MaxQueues <= 0 {
+		return err
+	}
+	if _, err = s.queues.Get(accountID, queueID); err == nil {
+		return nil
+	}
+
+	count, err := s.queues.Count(accountID)
+	if err != nil {
+		return err
+	}
+	return ratelimit.CheckQuota(count, limits.MaxQueues)
+}
+
+// waitingTasksRemaining - tasks the queue still accepts, -1 when unlimited
+func (s *Server) waitingTasksRemaining(accountID string, queue *Queue) (int, error) {
+	limits, err := s.limiter.Limits(accountID)
+	if err != nil {
+		return 0, err
+	}
+	if limits.MaxWaitingTasks <= 0 {
+		return -1, nil
+	}
+
+	depth, err := s.mqProducer.QueueDepth(queue.QueueID)
+	if err != nil {
+		return 0, err
+	}
+	if depth >= limits.MaxWaitingTasks {
+		return 0, nil
+	}
+	return limits.MaxWaitingTasks - depth, nil
+}
+
+func (s *Server) checkWaitingTasksQuota(accountID string, queue *Queue) error {
+	remaining, err := s.waitingTasksRemaining(accountID, queue)
+	if err != nil {
+		return err
+	}
+	if remaining == 0 {
+		return ratelimit.ErrQuotaExceeded
+	}
+	return nil
+}
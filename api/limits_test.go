@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLimitsValidation(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+
+	for _, body := range []string{
+		`{"account": {"requests_per_second": -1, "burst": 10}}`,
+		`{"account": {"requests_per_second": 5, "burst": -1}}`,
+		`{"routes": {"POST /v1.0/accounts/:accountID/task": {"requests_per_second": -0.5}}}`,
+		`{"max_queues": -1}`,
+		`{"max_waiting_tasks": -10}`,
+	} {
+		rec := serve(s, http.MethodPut, "/v1.0/accounts/123/limits", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+		resp := ErrorResponse{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, CodeValidation, resp.Error.Code)
+		assert.Len(t, resp.Error.Fields, 1, body)
+	}
+
+	rec := serve(s, http.MethodGet, "/v1.0/accounts/123/limits", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"account": {"requests_per_second": 0, "burst": 0}, "max_queues": 0, "max_waiting_tasks": 0}`, rec.Body.String())
+
+	// zero is unlimited
+	body := `{"account": {"requests_per_second": 0, "burst": 0}, "routes": {"POST /v1.0/accounts/:accountID/task": {"requests_per_second": 2.5, "burst": 0}}, "max_queues": 3, "max_waiting_tasks": 0}`
+	rec = serve(s, http.MethodPut, "/v1.0/accounts/123/limits", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, body, rec.Body.String())
+}
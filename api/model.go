@@ -4,16 +4,36 @@ type TaskResponse struct {
 	TaskID string `json:"task_id"`
 }
 
+// Task states, a task is waiting until it is cancelled or a consumer takes
+// it. A dispatched task is being handed to an agent and cannot be cancelled
+const (
+	TaskStatusWaiting     = "waiting"
+	TaskStatusDispatched  = "dispatched"
+	TaskStatusCancelled   = "cancelled"
+	TaskStatusTransferred = "transferred"
+	TaskStatusFailed      = "failed"
+)
+
 type Task struct {
-	TaskID   string            `json:"task_id"`
-	Priority uint8             `json:"priority" validate:"required"`
-	QueueID  string            `json:"queue_id" validate:"required"`
-	CallData map[string]string `json:"call_data" validate:"required"`
-	Position int               `json:"position"`
+	TaskID     string            `json:"task_id"`
+	ExternalID string            `json:"external_id,omitempty"`
+	AccountID  string            `json:"account_id"`
+	Priority   uint8             `json:"priority" validate:"required"`
+	QueueID    string            `json:"queue_id" validate:"required"`
+	CallData   map[string]string `json:"call_data" validate:"required"`
+	Status     string            `json:"status"`
+	Position   int               `json:"position"`
+	// EstimatedWaitSeconds - set in responses for waiting tasks once the
+	// queue has agents and handle times
+	EstimatedWaitSeconds *int `json:"estimated_wait_seconds,omitempty"`
 }
 
 type Queue struct {
 	QueueID     string `json:"queue_id"`
 	QueueName   string `json:"queue_name" validate:"required"`
 	MaxPriority uint8  `json:"max_priority" validate:"required"`
+	// State - open, paused, draining or closed, read from the queue states
+	// and not kept in the registry
+	State       string `json:"state,omitempty"`
+	StateReason string `json:"state_reason,omitempty"`
 }
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openAPISpec - OpenAPI 3 description of every route added through
+// loadRoutes, TestOpenAPICoversRoutes keeps the two in sync
+//
+//go:embed openapi/openapi.json
+var openAPISpec []byte
+
+// swaggerUI - Swagger UI page rendering openAPISpec
+//
+//go:embed openapi/index.html
+var swaggerUI []byte
+
+// swaggerUIDist - vendored swagger-ui-dist assets of the page, updated by
+// openapi/fetch-swagger-ui.sh to the version in openapi/swagger-ui/VERSION
+//
+//go:generate sh openapi/fetch-swagger-ui.sh
+//go:embed openapi/swagger-ui
+var swaggerUIDist embed.FS
+
+func (s *Server) loadDocsRoutes() {
+	s.restServer.GET("/openapi.json", serveOpenAPISpec)
+	s.restServer.GET("/swagger", serveSwaggerUI)
+	assets, _ := fs.Sub(swaggerUIDist, "openapi/swagger-ui")
+	s.restServer.GET("/swagger/*", echo.WrapHandler(http.StripPrefix("/swagger/", http.FileServer(http.FS(assets)))))
+}
+
+func serveOpenAPISpec(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, openAPISpec)
+}
+
+func serveSwaggerUI(c echo.Context) error {
+	return c.HTMLBlob(http.StatusOK, swaggerUI)
+}
@@ -0,0 +1,14 @@
+#!/bin/sh
+# Vendor the swagger-ui-dist assets served under /swagger, the version is
+# pinned in swagger-ui/VERSION. Run through go generate ./api
+set -eu
+
+dir=$(dirname "$0")/swagger-ui
+version=$(cat "$dir/VERSION")
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+curl -fsSL "https://registry.npmjs.org/swagger-ui-dist/-/swagger-ui-dist-$version.tgz" | tar -xz -C "$tmp"
+for f in swagger-ui.css swagger-ui-bundle.js LICENSE; do
+	cp "$tmp/package/$f" "$dir/$f"
+done
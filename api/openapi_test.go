@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/store/mock"
+)
+
+// echoInternalPrefix - not found fallbacks of groups with middleware and
+// wrapped net/http handlers such as /metrics and pprof
+const echoInternalPrefix = "github.com/labstack/echo/v4."
+
+var (
+	pathParamRegEx = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+	undocumentedRoutes = map[string]bool{
+		"/health":       true,
+		"/openapi.json": true,
+		"/swagger":      true,
+		"/wallboard":    true,
+	}
+)
+
+type openAPIDoc struct {
+	OpenAPI string                                `json:"openapi"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	s := NewServer(0, nil, mock.NewStore("", ""))
+	s.loadAllRoutes()
+
+	doc := openAPIDoc{}
+	assert.NoError(t, json.Unmarshal(openAPISpec, &doc))
+	assert.True(t, strings.HasPrefix(doc.OpenAPI, "3."))
+
+	for _, r := range s.restServer.Routes() {
+		if undocumentedRoutes[r.Path] || strings.HasPrefix(r.Name, echoInternalPrefix) {
+			continue
+		}
+		path := pathParamRegEx.ReplaceAllString(r.Path, "{$1}")
+		_, ok := doc.Paths[path][strings.ToLower(r.Method)]
+		assert.True(t, ok, "%s %s is missing from openapi/openapi.json", r.Method, path)
+	}
+}
+
+func TestSwaggerUIIsEmbedded(t *testing.T) {
+	s, _ := newHandlerTestServer(t)
+
+	rec := serve(s, http.MethodGet, "/swagger", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "https://")
+	assert.Contains(t, rec.Body.String(), `src="/swagger/swagger-ui-bundle.js"`)
+
+	rec = serve(s, http.MethodGet, "/swagger/VERSION", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "4.15.5", strings.TrimSpace(rec.Body.String()))
+}
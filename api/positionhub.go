@@ -0,0 +1,217 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"queuev2/logger"
+	"queuev2/position"
+)
+
+const (
+	// positionCoalesce - changes of one queue arriving within this window
+	// are pushed to its streams as a single update
+	positionCoalesce = 100 * time.Millisecond
+	// positionResubscribe - wait before subscribing again after the store
+	// subscription was lost
+	positionResubscribe = time.Second
+)
+
+//positionState - positions seen by a watcher after a change, rank is the
+//0 based rank of the watched task, -1 once it left the queue
+type positionState struct {
+	rank  int
+	items []string
+}
+
+//positionWatcher - one open stream, taskID is empty for queue streams
+type positionWatcher struct {
+	queueID string
+	taskID  string
+	updates chan positionState
+}
+
+//queueWatch - watchers of one queue and the goroutine refreshing them
+type queueWatch struct {
+	watchers map[*positionWatcher]struct{}
+	dirty    chan struct{}
+	stop     chan struct{}
+}
+
+//positionHub - one store subscription per API process shared by every
+//position stream, the positions of a queue are read once per burst of
+//changes whatever the number of its streams
+type positionHub struct {
+	pos *position.Position
+
+	mu         sync.Mutex
+	queues     map[string]*queueWatch
+	subscribed bool
+}
+
+func newPositionHub(pos *position.Position) *positionHub {
+	return &positionHub{
+		pos:    pos,
+		queues: make(map[string]*queueWatch),
+	}
+}
+
+// watch - register a stream, its first update holds the current positions
+func (h *positionHub) watch(queueID, taskID string) (*positionWatcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.subscribed {
+		changes, cancel, err := h.pos.Watch()
+		if err != nil {
+			return nil, err
+		}
+		h.subscribed = true
+		go h.listen(changes, cancel)
+	}
+
+	q, ok := h.queues[queueID]
+	if !ok {
+		q = &queueWatch{
+			watchers: make(map[*positionWatcher]struct{}),
+			dirty:    make(chan struct{}, 1),
+			stop:     make(chan struct{}),
+		}
+		h.queues[queueID] = q
+		go h.refresh(queueID, q)
+	}
+
+	w := &positionWatcher{
+		queueID: queueID,
+		taskID:  taskID,
+		updates: make(chan positionState, 1),
+	}
+	q.watchers[w] = struct{}{}
+	markDirty(q)
+	return w, nil
+}
+
+// unwatch - the refresh goroutine of a queue stops with its last stream
+func (h *positionHub) unwatch(w *positionWatcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	q, ok := h.queues[w.queueID]
+	if !ok {
+		return
+	}
+	delete(q.watchers, w)
+	if len(q.watchers) == 0 {
+		close(q.stop)
+		delete(h.queues, w.queueID)
+	}
+}
+
+// listen - mark the queues of every change dirty, resubscribe when the
+// store subscription is lost
+func (h *positionHub) listen(changes <-chan position.Change, cancel func()) {
+	for {
+		for ch := range changes {
+			h.mu.Lock()
+			if q, ok := h.queues[ch.QueueID]; ok {
+				markDirty(q)
+			}
+			h.mu.Unlock()
+		}
+		cancel()
+
+		for {
+			time.Sleep(positionResubscribe)
+			var err error
+			if changes, cancel, err = h.pos.Watch(); err == nil {
+				break
+			}
+			logger.Warn("failed to subscribe to position changes", logger.FieldError, err)
+		}
+
+		// changes published while unsubscribed are lost, refresh everything
+		h.mu.Lock()
+		for _, q := range h.queues {
+			markDirty(q)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// refresh - read the positions of the watched tasks in one store call and
+// push them, at most once per positionCoalesce
+func (h *positionHub) refresh(queueID string, q *queueWatch) {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.dirty:
+		}
+
+		h.mu.Lock()
+		watchers := make([]*positionWatcher, 0, len(q.watchers))
+		var taskIDs []string
+		listQueue := false
+		for w := range q.watchers {
+			watchers = append(watchers, w)
+			if w.taskID == "" {
+				listQueue = true
+			} else {
+				taskIDs = append(taskIDs, w.taskID)
+			}
+		}
+		h.mu.Unlock()
+
+		if err := h.push(queueID, watchers, taskIDs, listQueue); err != nil {
+			logger.Warn("failed to refresh positions", logger.FieldQueueID, queueID, logger.FieldError, err)
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(positionCoalesce):
+		}
+	}
+}
+
+func (h *positionHub) push(queueID string, watchers []*positionWatcher, taskIDs []string, listQueue bool) error {
+	ranks := make(map[string]int, len(taskIDs))
+	if len(taskIDs) > 0 {
+		r, err := h.pos.GetPositions(queueID, taskIDs)
+		if err != nil {
+			return err
+		}
+		for i, id := range taskIDs {
+			ranks[id] = r[i]
+		}
+	}
+
+	var items []string
+	if listQueue {
+		var err error
+		if items, err = h.pos.List(queueID); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range watchers {
+		state := positionState{rank: -1, items: items}
+		if w.taskID != "" {
+			state = positionState{rank: ranks[w.taskID]}
+		}
+		// only the latest state matters to a slow stream
+		select {
+		case <-w.updates:
+		default:
+		}
+		w.updates <- state
+	}
+	return nil
+}
+
+func markDirty(q *queueWatch) {
+	select {
+	case q.dirty <- struct{}{}:
+	default:
+	}
+}
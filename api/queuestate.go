@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/logger"
+	"queuev2/queuestate"
+)
+
+// defaultClosedReason - message of submits rejected by a queue drained
+// without a reason
+const defaultClosedReason = "queue is not accepting new tasks"
+
+//DrainRequest - optional body of the drain request, Reason is returned to
+//the submits rejected while the queue is draining or closed
+type DrainRequest struct {
+	Reason string `json:"reason" validate:"max=200"`
+}
+
+// SetClosedReason - replace the default message of submits rejected by
+// draining and closed queues
+func (s *Server) SetClosedReason(reason string) {
+	s.closedReason = reason
+}
+
+// pauseQueue - keep accepting tasks but stop the consumers dispatching them
+func (s *Server) pauseQueue(c echo.Context) error {
+	queue, err := s.getQueueWithState(c)
+	if err != nil {
+		return err
+	}
+	switch queue.State {
+	case queuestate.Paused:
+		return c.JSON(http.StatusOK, queue)
+	case queuestate.Draining, queuestate.Closed:
+		return newAPIError(http.StatusConflict, CodeConflict, "queue is "+queue.State+", resume it before pausing")
+	}
+	return s.changeQueueState(c, queue, queuestate.State{State: queuestate.Paused})
+}
+
+// resumeQueue - open the queue whatever its state
+func (s *Server) resumeQueue(c echo.Context) error {
+	queue, err := s.getQueueWithState(c)
+	if err != nil {
+		return err
+	}
+	if queue.State == queuestate.Open {
+		return c.JSON(http.StatusOK, queue)
+	}
+	return s.changeQueueState(c, queue, queuestate.State{State: queuestate.Open})
+}
+
+// drainQueue - reject new tasks and dispatch the waiting ones, the queue
+// is closed at once when none is waiting and by its consumer otherwise
+func (s *Server) drainQueue(c echo.Context) error {
+	req := new(DrainRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+	queue, err := s.getQueueWithState(c)
+	if err != nil {
+		return err
+	}
+
+	next := queuestate.State{State: queuestate.Draining, Reason: req.Reason}
+	waiting, err := s.pos.Count(queue.QueueID)
+	if err != nil {
+		return storeError(err)
+	}
+	if waiting == 0 || queue.State == queuestate.Closed {
+		next.State = queuestate.Closed
+	}
+	return s.changeQueueState(c, queue, next)
+}
+
+// getQueueWithState - queue of the path with its current state
+func (s *Server) getQueueWithState(c echo.Context) (*Queue, error) {
+	queue, err := s.queues.Get(c.Param("accountID"), c.Param("queueID"))
+	if err == ErrQueueNotFound {
+		return nil, queueNotFound()
+	}
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if err = s.setQueueState(queue); err != nil {
+		return nil, storeError(err)
+	}
+	return queue, nil
+}
+
+func (s *Server) changeQueueState(c echo.Context, queue *Queue, next queuestate.State) error {
+	next.QueueID = queue.QueueID
+	if err := s.states.Set(next); err != nil {
+		return storeError(err)
+	}
+	requestLogger(c).Info("queue state changed", logger.FieldQueueID, queue.QueueID, "from", queue.State, "to", next.State)
+	queue.State, queue.StateReason = next.State, next.Reason
+	return c.JSON(http.StatusOK, queue)
+}
+
+// setQueueState - fill the state fields of a registry queue
+func (s *Server) setQueueState(queue *Queue) error {
+	state, err := s.states.Get(queue.QueueID)
+	if err != nil {
+		return err
+	}
+	queue.State, queue.StateReason = state.State, state.Reason
+	return nil
+}
+
+// checkAccepting - queueClosed for draining and closed queues, the queue
+// state must be set
+func (s *Server) checkAccepting(queue *Queue) *APIError {
+	if queue.State != queuestate.Draining && queue.State != queuestate.Closed {
+		return nil
+	}
+	reason := queue.StateReason
+	if reason == "" {
+		reason = s.closedReason
+	}
+	if reason == "" {
+		reason = defaultClosedReason
+	}
+	return queueClosed(reason)
+}
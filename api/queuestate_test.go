@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/queuestate"
+)
+
+func TestDrainQueue(t *testing.T) {
+	s, ts := newStreamTestServer(t, "t1")
+	url := ts.URL + "/v1.0/accounts/" + streamAccount + "/queue/" + streamQueue
+	post := func(action, body string) (*http.Response, Queue) {
+		resp, err := http.Post(url+"/"+action, "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var q Queue
+		json.NewDecoder(resp.Body).Decode(&q)
+		return resp, q
+	}
+
+	// a task is still waiting, the consumer closes the queue once it is gone
+	resp, q := post("drain", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, queuestate.Draining, q.State)
+	assert.Empty(t, q.StateReason)
+
+	assert.NoError(t, s.pos.RemoveItem(streamQueue, "t1"))
+	resp, q = post("drain", `{"reason":"queue retired"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, queuestate.Closed, q.State)
+	assert.Equal(t, "queue retired", q.StateReason)
+
+	state, err := s.states.Get(streamQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, queuestate.Closed, state.State)
+
+	resp, _ = post("drain", `{"reason":"`+strings.Repeat("x", 201)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = post("pause", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, q = post("resume", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, queuestate.Open, q.State)
+
+	resp, err = http.Post(ts.URL+"/v1.0/accounts/"+streamAccount+"/queue/QID_missing/pause", "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
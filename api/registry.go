@@ -0,0 +1,217 @@
+package api
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+const (
+	queueRegistryPrefix = "queues:"
+	// queueOwnersHash - account of every registered queue id, a broker
+	// queue belongs to one account only
+	queueOwnersHash = "queue_owners"
+)
+
+// ErrQueueNotFound - queue unknown or owned by another account
+var ErrQueueNotFound = errors.New("queue not found")
+
+//QueueRegistry - queues of each account kept in a store hash. Queues
+//created before the registry are registered the first time they are
+//looked up, when brokerHas confirms they exist
+type QueueRegistry struct {
+	store     store.Store
+	brokerHas func(queueID string) bool
+}
+
+func NewQueueRegistry(st store.Store) *QueueRegistry {
+	return &QueueRegistry{store: st}
+}
+
+func registryKey(accountID string) string {
+	return queueRegistryPrefix + accountID
+}
+
+// Register - add or replace the queue of an account, its state is kept by
+// the queue states
+func (r *QueueRegistry) Register(accountID string, queue *Queue) error {
+	stored := *queue
+	stored.State, stored.StateReason = "", ""
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	// the registry must not expire
+	if err = r.store.SetStructInHashNoExpire(queueOwnersHash, queue.QueueID, accountID); err != nil {
+		return err
+	}
+	return r.store.SetStructInHashNoExpire(registryKey(accountID), queue.QueueID, string(data))
+}
+
+// Owner - account the queue id is registered to, empty when none is.
+// Queues registered before the owners were kept have none either
+func (r *QueueRegistry) Owner(queueID string) (string, error) {
+	exists, err := r.store.KeyExistsInHash(queueOwnersHash, queueID)
+	if err != nil || exists != 1 {
+		return "", err
+	}
+	return r.store.GetStructFromHash(queueOwnersHash, queueID)
+}
+
+// AdoptLegacy - register the queues created before the registry on their
+// first lookup, exists reports whether the broker has the queue
+func (r *QueueRegistry) AdoptLegacy(exists func(queueID string) bool) {
+	r.brokerHas = exists
+}
+
+// Get - queue of the account, ErrQueueNotFound if the account does not own it
+func (r *QueueRegistry) Get(accountID, queueID string) (*Queue, error) {
+	key := registryKey(accountID)
+	exists, err := r.store.KeyExistsInHash(key, queueID)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 1 {
+		return r.adopt(accountID, queueID)
+	}
+
+	data, err := r.store.GetStructFromHash(key, queueID)
+	if err != nil {
+		return nil, err
+	}
+	queue := &Queue{}
+	if err = json.Unmarshal([]byte(data), queue); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// Remove - drop the queue from the account, ErrQueueNotFound if it is not
+// registered
+func (r *QueueRegistry) Remove(accountID, queueID string) error {
+	key := registryKey(accountID)
+	exists, err := r.store.KeyExistsInHash(key, queueID)
+	if err != nil {
+		return err
+	}
+	if exists != 1 {
+		return ErrQueueNotFound
+	}
+	if err = r.store.DeleteStructFromHash(key, queueID); err != nil {
+		return err
+	}
+	if owner, err := r.Owner(queueID); err != nil || owner != accountID {
+		return err
+	}
+	return r.store.DeleteStructFromHash(queueOwnersHash, queueID)
+}
+
+// Count - number of queues of the account
+func (r *QueueRegistry) Count(accountID string) (int, error) {
+	return r.store.GetHashKeyCount(registryKey(accountID))
+}
+
+// List - all queues of the account
+func (r *QueueRegistry) List(accountID string) ([]*Queue, error) {
+	ids, err := r.store.GetKeysFromHash(registryKey(accountID))
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make([]*Queue, 0, len(ids))
+	for _, id := range ids {
+		queue, err := r.Get(accountID, id)
+		if err == ErrQueueNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, queue)
+	}
+	return queues, nil
+}
+
+// adopt - register a queue of the account created before the registry
+func (r *QueueRegistry) adopt(accountID, queueID string) (*Queue, error) {
+	queue, ok := legacyQueue(accountID, queueID)
+	if !ok || r.brokerHas == nil || !r.brokerHas(queueID) {
+		return nil, ErrQueueNotFound
+	}
+	if owner, err := r.Owner(queueID); err != nil {
+		return nil, err
+	} else if owner != "" && owner != accountID {
+		return nil, ErrQueueNotFound
+	}
+	if err := r.Register(accountID, queue); err != nil {
+		return nil, err
+	}
+	logger.Info("registered queue created before the registry", logger.FieldAccountID, accountID,
+		logger.FieldQueueID, queueID, "max_priority", queue.MaxPriority)
+	return queue, nil
+}
+
+// legacyQueue - queue of the account the id was generated for, ids encode
+// "<account>_<name><max priority>". The priority is read as 10 when the
+// decoded id ends with 10 and as its last digit otherwise, queues of other
+// priorities are registered by creating them again
+func legacyQueue(accountID, queueID string) (*Queue, bool) {
+	raw, ok := decodeQueueID(queueID)
+	if !ok {
+		return nil, false
+	}
+	rest := strings.TrimPrefix(raw, accountID+"_")
+	if rest == raw {
+		return nil, false
+	}
+
+	digits := 1
+	if strings.HasSuffix(rest, "10") {
+		digits = 2
+	}
+	if len(rest) <= digits {
+		return nil, false
+	}
+	priority, err := strconv.Atoi(rest[len(rest)-digits:])
+	if err != nil || priority < 1 {
+		return nil, false
+	}
+	return &Queue{QueueID: queueID, QueueName: rest[:len(rest)-digits], MaxPriority: uint8(priority)}, true
+}
+
+// QueueAccountID - account a generated queue id was created for, empty for
+// other ids. Consumers only know their queue id, createQueue refuses
+// account ids holding a '_' so the first one ends the account
+func QueueAccountID(queueID string) string {
+	raw, ok := decodeQueueID(queueID)
+	if !ok {
+		return ""
+	}
+	i := strings.IndexByte(raw, '_')
+	if i <= 0 {
+		return ""
+	}
+	return raw[:i]
+}
+
+// decodeQueueID - "<account>_<name><max priority>" of a generated id, in
+// the standard encoding of older ids or the url encoding
+func decodeQueueID(queueID string) (string, bool) {
+	encoded := strings.TrimPrefix(queueID, "QID_")
+	if encoded == queueID {
+		return "", false
+	}
+	raw, err := b64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if raw, err = b64.URLEncoding.DecodeString(encoded); err != nil {
+			return "", false
+		}
+	}
+	return string(raw), true
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/reporting"
+)
+
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	mimeCSV    = "text/csv"
+)
+
+// maxReportRange - longest date range of a report per interval, bounds the
+// number of lines
+var maxReportRange = map[string]time.Duration{
+	reporting.IntervalQuarterHour: 7 * 24 * time.Hour,
+	reporting.IntervalHour:        31 * 24 * time.Hour,
+	reporting.IntervalDay:         366 * 24 * time.Hour,
+}
+
+// SetReports - enable the reports endpoint, the buckets are written by the
+// aggregator consuming the event exchange
+func (s *Server) SetReports(r *reporting.Reports) {
+	s.reports = r
+}
+
+// getReport - ?interval is 15m (default), 1h or 1d, ?from and ?to are
+// RFC 3339 times, the last day by default. ?group_by=agent reports per
+// agent, ?queue_id narrows to one queue. ?format=csv or an Accept of
+// text/csv returns CSV
+func (s *Server) getReport(c echo.Context) error {
+	if s.reports == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "reporting is disabled")
+	}
+	interval := c.QueryParam("interval")
+	if interval == "" {
+		interval = reporting.IntervalQuarterHour
+	}
+	if _, err := reporting.IntervalLength(interval); err != nil {
+		return badRequest(err.Error())
+	}
+
+	to := time.Now().UTC()
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return badRequest("to must be an RFC 3339 time")
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return badRequest("from must be an RFC 3339 time")
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return badRequest(reporting.ErrInvalidRange.Error())
+	}
+	if to.Sub(from) > maxReportRange[interval] {
+		days := int(maxReportRange[interval] / (24 * time.Hour))
+		return badRequest("the range of " + interval + " reports is at most " + strconv.Itoa(days) + " days")
+	}
+
+	q := reporting.Query{AccountID: c.Param("accountID"), QueueID: c.QueryParam("queue_id"), From: from, To: to}
+	switch c.QueryParam("group_by") {
+	case "", reporting.GroupByQueue:
+	case reporting.GroupByAgent:
+		q.ByAgent = true
+	default:
+		return badRequest("group_by must be queue or agent")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = formatJSON
+		if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), mimeCSV) {
+			format = formatCSV
+		}
+	}
+	if format != formatJSON && format != formatCSV {
+		return badRequest("format must be json or csv")
+	}
+
+	report, err := s.reports.Report(q, interval)
+	if err != nil {
+		return internalError(err)
+	}
+	if format == formatJSON {
+		return c.JSON(http.StatusOK, report)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeCSV+"; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="report-`+interval+`.csv"`)
+	res.WriteHeader(http.StatusOK)
+	return reporting.WriteCSV(res, report)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/reporting"
+)
+
+func TestGetReport(t *testing.T) {
+	s, ts := newStreamTestServer(t)
+	url := ts.URL + "/v1.0/accounts/" + streamAccount + "/reports"
+
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	storage := reporting.NewMemoryStorage()
+	s.SetReports(reporting.NewReports(storage, reporting.DefaultOptions()))
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	assert.NoError(t, storage.Add(reporting.Row{Start: start, AccountID: streamAccount, QueueID: streamQueue, Counters: reporting.Counters{Offered: 2, Abandoned: 1}}))
+	query := "?interval=1h&from=2024-03-01T00:00:00Z&to=2024-03-02T00:00:00Z"
+
+	resp, err = http.Get(url + query)
+	assert.NoError(t, err)
+	var report reporting.Report
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if assert.Len(t, report.Lines, 1) {
+		assert.Equal(t, 2, report.Lines[0].Offered)
+		assert.Equal(t, start, report.Lines[0].Start)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url+query, nil)
+	req.Header.Set("Accept", "text/csv")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv"))
+	assert.Len(t, strings.Split(strings.TrimSpace(string(body)), "\n"), 2)
+
+	for _, bad := range []string{
+		"?interval=1w",
+		"?from=yesterday",
+		"?from=2024-03-02T00:00:00Z&to=2024-03-01T00:00:00Z",
+		"?interval=15m&from=2024-01-01T00:00:00Z&to=2024-03-01T00:00:00Z",
+		"?group_by=team",
+		"?format=xml",
+	} {
+		resp, err = http.Get(url + bad)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, bad)
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"github.com/labstack/echo/v4"
+	"queuev2/logger"
+	"queuev2/taskid"
+)
+
+var requestIDs = taskid.NewULIDGenerator()
+
+// requestIDMiddleware - accept the caller's X-Request-ID or generate one,
+// echo it in the response and attach a logger carrying it to the request
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if taskid.ValidateExternalID(id) != nil {
+			// incoming ids end up in logs and amqp headers, anything outside
+			// the external id charset is replaced
+			id, _ = requestIDs.NewID("")
+		}
+		req.Header.Set(echo.HeaderXRequestID, id)
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+		l := logger.With(logger.FieldRequestID, id)
+		c.SetRequest(req.WithContext(logger.NewContext(req.Context(), l)))
+		return next(c)
+	}
+}
+
+// requestLogger - logger of the request, tagged with its request id and the
+// account in the path
+func requestLogger(c echo.Context) *logger.Logger {
+	l := logger.FromContext(c.Request().Context())
+	if accID := c.Param("accountID"); accID != "" {
+		l = l.With(logger.FieldAccountID, accID)
+	}
+	return l
+}
@@ -2,82 +2,227 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-playground/validator"
 	"github.com/labstack/echo-contrib/prometheus"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"queuev2/auth"
+	"queuev2/eventlog"
+	"queuev2/events"
+	"queuev2/ewt"
+	"queuev2/health"
+	"queuev2/logger"
 	"queuev2/mq/producer"
 	"queuev2/position"
-	"queuev2/store/redis"
+	"queuev2/queuestate"
+	"queuev2/queuestats"
+	"queuev2/ratelimit"
+	"queuev2/redact"
+	"queuev2/reporting"
+	"queuev2/store"
+	"queuev2/taskid"
+	"queuev2/wallboard"
+	"queuev2/webhook"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	once   sync.Once
 	server *Server
+
+	// echo-contrib registers its collectors globally, servers created by
+	// NewServer share one instance
+	promOnce sync.Once
+	echoProm *prometheus.Prometheus
 )
 
 type Server struct {
 	restServerPort int
 	restServer     *echo.Echo
-	mqProducer     *producer.MQProducer
-	keyCounter     int
+	mqProducer     Broker
+	taskIDs        taskid.Generator
+	store          store.Store
 	pos            *position.Position
+	queues         *QueueRegistry
+	tasks          *TaskStore
+	deadLetters    *DeadLetterStore
+	positions      *positionHub
+	events         *events.Emitter
+	eventLog       *eventlog.Log
+	webhooks       *webhook.Store
+	dispatcher     *webhook.Dispatcher
+	estimator      *ewt.Estimator
+	stats          *queuestats.Stats
+	agents         *queuestats.Agents
+	reports        *reporting.Reports
+	thresholds     *wallboard.Store
+	wallboards     *wallboardCache
+	states         *queuestate.Store
+	checker        *health.Checker
+	auth           *auth.Authenticator
+	limiter        *ratelimit.Limiter
+	redactor       *redact.Redactor
+
+	idempotencyWindow time.Duration
+	dedupeCallUUID    bool
+	batchMaxTasks     int
+	closedReason      string
+
+	routesOnce sync.Once
 }
 
 type CustomValidator struct {
 	validator *validator.Validate
 }
 
-func GetServerInstance(restPort int, mqProducer *producer.MQProducer) *Server {
+func GetServerInstance(restPort int, mqProducer *producer.MQProducer, st store.Store) *Server {
 	once.Do(func() {
-		server = createServer(restPort, mqProducer)
+		server = NewServer(restPort, mqProducer, st)
 	})
 
 	return server
 }
 
-func createServer(restPort int, mqProducer *producer.MQProducer) *Server {
+// NewServer - server independent of the process wide instance, used to
+// embed the API in tests through Handler
+func NewServer(restPort int, mqProducer Broker, st store.Store) *Server {
+	// assigned below, the body dump closure only runs once requests arrive
+	var s *Server
 
 	apiServer := echo.New()
 	apiServer.Use(middleware.Recover())
 	apiServer.Pre(middleware.RemoveTrailingSlash())
-	apiServer.Use(middleware.BodyDump(func(e echo.Context, reqBody []byte, respBody []byte) {
-		bodyDumpHandler(e, reqBody, respBody)
+	apiServer.Pre(requestIDMiddleware)
+	apiServer.Use(middleware.BodyDumpWithConfig(middleware.BodyDumpConfig{
+		// streams would be held in memory until they close
+		Skipper: isStreamRequest,
+		Handler: func(e echo.Context, reqBody []byte, respBody []byte) {
+			bodyDumpHandler(e, s.redactor, reqBody, respBody)
+		},
 	}))
-	apiServer.Validator = &CustomValidator{validator: validator.New()}
-	apiServer.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux))
+	v := validator.New()
+	v.RegisterTagNameFunc(jsonTagName)
+	apiServer.Validator = &CustomValidator{validator: v}
+	apiServer.HTTPErrorHandler = httpErrorHandler
 	apiServer.GET("/health", healthCheck)
-	//apiServer.GET("/swagger/*", echoSwagger.WrapHandler)
-	p := prometheus.NewPrometheus("echo", nil)
-	p.Use(apiServer)
+	promOnce.Do(func() {
+		echoProm = prometheus.NewPrometheus("echo", nil)
+	})
+	p := echoProm
+	apiServer.Use(p.HandlerFunc)
+
+	checker := health.NewChecker("queue-api")
+	checker.Add("amqp", health.PingCheck(mqProducer), true)
+	if hr, ok := st.(store.HealthReporter); ok {
+		checker.Add("redis", health.PingCheck(hr), true)
+	}
+	checker.Register(apiServer)
 
-	st := redis.NewStore("127.0.0.1", "6379")
-	s := &Server{
+	pos := position.NewPosition(st)
+	s = &Server{
 		restServerPort: restPort,
 		restServer:     apiServer,
 		mqProducer:     mqProducer,
-		keyCounter:     0,
-		pos:            position.NewPosition(st),
+		taskIDs:        taskid.NewULIDGenerator(),
+		store:          st,
+		pos:            pos,
+		queues:         NewQueueRegistry(st),
+		tasks:          NewTaskStore(st),
+		deadLetters:    NewDeadLetterStore(st),
+		positions:      newPositionHub(pos),
+		events:         events.NewEmitter(),
+		webhooks:       webhook.NewStore(st),
+		agents:         queuestats.NewAgents(st),
+		thresholds:     wallboard.NewStore(st),
+		wallboards:     newWallboardCache(),
+		states:         queuestate.NewStore(st),
+		checker:        checker,
+		auth:           auth.NewAuthenticator(st, auth.JWTOptions{}),
+		limiter:        ratelimit.NewLimiter(st, ratelimit.Limits{}),
+		redactor:       redact.New(redact.DefaultOptions()),
 	}
 
+	if mqProducer != nil {
+		// queues created before the registry exist in the broker only
+		s.queues.AdoptLegacy(func(queueID string) bool {
+			_, err := mqProducer.QueueDepth(queueID)
+			return err == nil
+		})
+	}
+
+	apiServer.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux), s.requireScope(auth.ScopeAdmin))
+	apiServer.GET(p.MetricsPath, echo.WrapHandler(promhttp.Handler()), s.requireScope(auth.ScopeAdmin))
+
 	return s
 }
 
+// AddReadinessCheck - register an extra dependency for /health/ready, e.g.
+// the telephony backend
+func (s *Server) AddReadinessCheck(name string, check health.Check, critical bool) {
+	s.checker.Add(name, check, critical)
+}
+
+// SetTaskIDGenerator - replace the default ULID task id scheme
+func (s *Server) SetTaskIDGenerator(g taskid.Generator) {
+	s.taskIDs = g
+}
+
+// SetAuthenticator - replace the default api key only authenticator, nil
+// disables authentication (local development only)
+func (s *Server) SetAuthenticator(a *auth.Authenticator) {
+	s.auth = a
+}
+
+// requireScope - authenticate through the current authenticator
+func (s *Server) requireScope(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if s.auth == nil {
+				return next(c)
+			}
+			return s.auth.Require(scopes...)(next)(c)
+		}
+	}
+}
+
+// SetLimiter - replace the default limiter which has no limits
+func (s *Server) SetLimiter(l *ratelimit.Limiter) {
+	s.limiter = l
+}
+
+// SetRedactor - replace the redaction applied to logged bodies
+func (s *Server) SetRedactor(r *redact.Redactor) {
+	s.redactor = r
+}
+
+// SetEstimator - add estimated_wait_seconds to the submit and status
+// responses of waiting tasks
+func (s *Server) SetEstimator(e *ewt.Estimator) {
+	s.estimator = e
+}
+
+func (s *Server) rateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return s.limiter.Middleware(next)(c)
+	}
+}
+
 func (s *Server) StartServer() error {
 
-	s.loadQueueGroup()
-	s.loadTaskGroup()
+	s.loadAllRoutes()
 
 	data, err := json.MarshalIndent(s.restServer.Routes(), "", "  ")
 	if err != nil {
 		return err
 	}
-	log.Println("Echo routes loaded: ", string(data))
+	logger.Debug("echo routes loaded", "routes", json.RawMessage(data))
 
 	//start rest server
 	go func(port int) {
@@ -88,28 +233,93 @@ func (s *Server) StartServer() error {
 	return nil
 }
 
+// loadAllRoutes - register the API groups and their documentation, only
+// the first call has an effect
+func (s *Server) loadAllRoutes() {
+	s.routesOnce.Do(func() {
+		s.loadQueueGroup()
+		s.loadTaskGroup()
+		s.loadAPIKeyGroup()
+		s.loadLimitsGroup()
+		s.loadWebhookGroup()
+		s.loadEventGroup()
+		s.loadReportGroup()
+		s.loadWallboardGroup()
+		s.loadDocsRoutes()
+	})
+}
+
+// Handler - the API with all routes loaded, without starting a listener
+func (s *Server) Handler() http.Handler {
+	s.loadAllRoutes()
+	return s.restServer
+}
+
 func (cv *CustomValidator) Validate(i interface{}) error {
 	if err := cv.validator.Struct(i); err != nil {
-		// Optionally, you could return the error to give each route more control over the status code
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return validationError(err)
 	}
 	return nil
 }
 
+// storeAvailable - reject requests with 503 while the store is down instead
+// of failing them one by one on a dead connection
+func (s *Server) storeAvailable(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		hr, ok := s.store.(store.HealthReporter)
+		if !ok {
+			return next(c)
+		}
+
+		if h := hr.Health(); h.State == store.StateDown {
+			e := newAPIError(http.StatusServiceUnavailable, CodeStoreUnavailable, "store unavailable")
+			e.Internal = errors.New(h.LastError)
+			return e
+		}
+		return next(c)
+	}
+}
+
+// isStreamRequest - long lived SSE and WebSocket routes
+func isStreamRequest(c echo.Context) bool {
+	return strings.HasSuffix(c.Path(), "/stream") || strings.HasSuffix(c.Path(), "/wallboard")
+}
+
 func healthCheck(c echo.Context) error {
 	return c.String(http.StatusOK, "QueueService API is up and running")
 }
 
-func bodyDumpHandler(e echo.Context, reqBody, resBody []byte) {
+func bodyDumpHandler(e echo.Context, r *redact.Redactor, reqBody, resBody []byte) {
 	if e.Request().URL.Path == "/metrics" {
 		return
 	}
-	accID := e.Param("accountID")
-	uuidWithHash := e.Param("request_uuid")
-	reqBodyString, resBodyString := preprocessorBeforeBodyDump(string(reqBody), string(resBody))
-	log.Println(uuidWithHash, e.Request().URL.Path, fmt.Sprintf("AccountID: %v, Request Body: %+v, Response: %+v", accID, reqBodyString, resBodyString))
+	l := requestLogger(e)
+	fields := []interface{}{
+		"method", e.Request().Method,
+		"path", e.Request().URL.Path,
+		"status", e.Response().Status,
+	}
+	if !r.Sample() {
+		l.Info("request completed", fields...)
+		return
+	}
 
+	switch {
+	case strings.HasSuffix(e.Path(), "/apikeys"):
+		// created api key tokens must never reach the logs
+		resBody = nil
+	case strings.HasSuffix(e.Path(), "/webhooks"):
+		// webhook signing secrets are sent and echoed back on creation,
+		// the default redaction may have been replaced by the config
+		reqBody, resBody = nil, nil
+	}
+	reqBodyString, resBodyString := preprocessorBeforeBodyDump(r.Body(reqBody), r.Body(resBody))
+	l.Info("request completed", append(fields,
+		"request_body", reqBodyString,
+		"response_body", resBodyString,
+	)...)
 }
+
 func preprocessorBeforeBodyDump(reqBody, resBody string) (string, string) {
 	//removing newline \r\n, backslash and double whitespace added in the process of req/res bodydumping
 	re := regexp.MustCompile(newLineAndForwardSlashRegEx)
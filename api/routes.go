@@ -2,45 +2,85 @@ package api
 
 import (
 	"github.com/labstack/echo/v4"
-	"log"
+	"queuev2/auth"
 )
 
 type url struct {
 	Path    string
 	Handler func(echo.Context) error
 	Method  string
+	Scopes  []string
 }
 
 func (s *Server) loadTaskGroup() {
-	queueGroup := s.restServer.Group(s.getAccountLevelBaseURL() + "/task")
+	queueGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/task", s.storeAvailable)
 	routes := s.getTaskRoutes()
 	s.loadRoutes(queueGroup, routes)
 }
 
 func (s *Server) loadQueueGroup() {
-	queueGroup := s.restServer.Group(s.getAccountLevelBaseURL() + "/queue")
+	queueGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/queue", s.storeAvailable)
 	routes := s.getQueueRoutes()
 	s.loadRoutes(queueGroup, routes)
 }
 
+func (s *Server) loadAPIKeyGroup() {
+	keyGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/apikeys", s.storeAvailable)
+	routes := s.getAPIKeyRoutes()
+	s.loadRoutes(keyGroup, routes)
+}
+
+func (s *Server) loadLimitsGroup() {
+	limitsGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/limits", s.storeAvailable)
+	routes := s.getLimitsRoutes()
+	s.loadRoutes(limitsGroup, routes)
+}
+
+func (s *Server) loadWebhookGroup() {
+	webhookGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/webhooks", s.storeAvailable)
+	routes := s.getWebhookRoutes()
+	s.loadRoutes(webhookGroup, routes)
+}
+
+func (s *Server) loadEventGroup() {
+	eventGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/events", s.storeAvailable)
+	routes := s.getEventRoutes()
+	s.loadRoutes(eventGroup, routes)
+}
+
+// loadWallboardGroup - the stream of every account and the page rendering
+// it, the page is static and served without the store
+func (s *Server) loadWallboardGroup() {
+	wallboardGroup := s.restServer.Group(s.getAccountLevelBaseURL()+"/wallboard", s.storeAvailable)
+	routes := s.getWallboardRoutes()
+	s.loadRoutes(wallboardGroup, routes)
+	s.restServer.GET("/wallboard", serveWallboardPage)
+}
+
+// loadReportGroup - reports are read from their own storage, they do not
+// depend on the store being available
+func (s *Server) loadReportGroup() {
+	reportGroup := s.restServer.Group(s.getAccountLevelBaseURL() + "/reports")
+	routes := s.getReportRoutes()
+	s.loadRoutes(reportGroup, routes)
+}
+
 func (s *Server) getAccountLevelBaseURL() string {
 	return "/v1.0/accounts/:accountID"
 }
 
 func (s *Server) loadRoutes(group *echo.Group, routes []url) {
 
-	log.Println("Loading routes ", routes)
-
 	for _, route := range routes {
 		switch route.Method {
 		case "DELETE":
-			group.DELETE(route.Path, route.Handler)
+			group.DELETE(route.Path, route.Handler, s.requireScope(route.Scopes...), s.rateLimit)
 		case "GET":
-			group.GET(route.Path, route.Handler)
+			group.GET(route.Path, route.Handler, s.requireScope(route.Scopes...), s.rateLimit)
 		case "POST":
-			group.POST(route.Path, route.Handler)
+			group.POST(route.Path, route.Handler, s.requireScope(route.Scopes...), s.rateLimit)
 		case "PUT":
-			group.PUT(route.Path, route.Handler)
+			group.PUT(route.Path, route.Handler, s.requireScope(route.Scopes...), s.rateLimit)
 		}
 	}
 }
@@ -48,7 +88,12 @@ func (s *Server) loadRoutes(group *echo.Group, routes []url) {
 func (s *Server) getTaskRoutes() []url {
 	Urls := []url{
 
-		{"", s.submitTask, "POST"},
+		{"", s.submitTask, "POST", []string{auth.ScopeTaskSubmit}},
+		{"/batch", s.submitTaskBatch, "POST", []string{auth.ScopeTaskSubmit}},
+		{"/:taskID", s.getTask, "GET", []string{auth.ScopeRead}},
+		{"/:taskID", s.cancelTask, "DELETE", []string{auth.ScopeTaskSubmit}},
+		{"/:taskID/position/stream", s.taskPositionStream, "GET", []string{auth.ScopeRead}},
+		{"/:taskID/timeline", s.getTaskTimeline, "GET", []string{auth.ScopeRead}},
 	}
 
 	return Urls
@@ -57,7 +102,85 @@ func (s *Server) getTaskRoutes() []url {
 func (s *Server) getQueueRoutes() []url {
 	Urls := []url{
 
-		{"", s.createQueue, "POST"},
+		{"", s.createQueue, "POST", []string{auth.ScopeQueueAdmin}},
+		{"", s.listQueues, "GET", []string{auth.ScopeRead}},
+		{"/:queueID", s.getQueue, "GET", []string{auth.ScopeRead}},
+		{"/:queueID", s.deleteQueue, "DELETE", []string{auth.ScopeQueueAdmin}},
+		{"/:queueID/task", s.submitTask, "POST", []string{auth.ScopeTaskSubmit}},
+		{"/:queueID/task", s.listQueueTasks, "GET", []string{auth.ScopeRead}},
+		{"/:queueID/position/stream", s.queuePositionsStream, "GET", []string{auth.ScopeRead}},
+		{"/:queueID/stats", s.getQueueStats, "GET", []string{auth.ScopeRead}},
+		{"/:queueID/thresholds", s.getQueueThresholds, "GET", []string{auth.ScopeRead}},
+		{"/:queueID/thresholds", s.setQueueThresholds, "PUT", []string{auth.ScopeQueueAdmin}},
+		{"/:queueID/pause", s.pauseQueue, "POST", []string{auth.ScopeQueueAdmin}},
+		{"/:queueID/resume", s.resumeQueue, "POST", []string{auth.ScopeQueueAdmin}},
+		{"/:queueID/drain", s.drainQueue, "POST", []string{auth.ScopeQueueAdmin}},
+		{"/:queueID/agents", s.listAgents, "GET", []string{auth.ScopeRead, auth.ScopeAgent}},
+		{"/:queueID/agents/:agentID", s.setAgentState, "PUT", []string{auth.ScopeAgent, auth.ScopeQueueAdmin}},
+		{"/:queueID/dlq", s.listDeadLetters, "GET", []string{auth.ScopeRead}},
+		{"/:queueID/dlq/replay", s.replayDeadLetters, "POST", []string{auth.ScopeQueueAdmin}},
+	}
+
+	return Urls
+}
+
+func (s *Server) getAPIKeyRoutes() []url {
+	Urls := []url{
+
+		{"", s.createAPIKey, "POST", []string{auth.ScopeQueueAdmin}},
+		{"", s.listAPIKeys, "GET", []string{auth.ScopeQueueAdmin}},
+		{"/:keyID", s.revokeAPIKey, "DELETE", []string{auth.ScopeQueueAdmin}},
+	}
+
+	return Urls
+}
+
+func (s *Server) getLimitsRoutes() []url {
+	Urls := []url{
+
+		{"", s.getLimits, "GET", []string{auth.ScopeRead}},
+		{"", s.setLimits, "PUT", []string{auth.ScopeAdmin}},
+	}
+
+	return Urls
+}
+
+func (s *Server) getWebhookRoutes() []url {
+	Urls := []url{
+
+		{"", s.createWebhook, "POST", []string{auth.ScopeQueueAdmin}},
+		{"", s.listWebhooks, "GET", []string{auth.ScopeRead}},
+		{"/:webhookID", s.getWebhook, "GET", []string{auth.ScopeRead}},
+		{"/:webhookID", s.deleteWebhook, "DELETE", []string{auth.ScopeQueueAdmin}},
+		{"/:webhookID/deliveries", s.listWebhookDeliveries, "GET", []string{auth.ScopeRead}},
+		{"/:webhookID/replay", s.replayWebhookDeliveries, "POST", []string{auth.ScopeQueueAdmin}},
+	}
+
+	return Urls
+}
+
+func (s *Server) getEventRoutes() []url {
+	Urls := []url{
+
+		{"", s.tailEvents, "GET", []string{auth.ScopeRead}},
+	}
+
+	return Urls
+}
+
+func (s *Server) getReportRoutes() []url {
+	Urls := []url{
+
+		{"", s.getReport, "GET", []string{auth.ScopeRead}},
+	}
+
+	return Urls
+}
+
+func (s *Server) getWallboardRoutes() []url {
+	Urls := []url{
+
+		{"", s.wallboardStream, "GET", []string{auth.ScopeRead}},
 	}
 
 	return Urls
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/queuestats"
+)
+
+const (
+	defaultStatsInterval = 15 * time.Minute
+	// defaultSLThreshold - answered within 20 seconds, the usual 80/20
+	// target
+	defaultSLThreshold = 20 * time.Second
+	maxSLThreshold     = time.Hour
+)
+
+// SetQueueStats - record the statistics of the tasks handled by this
+// server and enable the queue stats endpoint
+func (s *Server) SetQueueStats(stats *queuestats.Stats) {
+	s.stats = stats
+	s.events.Add(queuestats.NewRecorder(stats))
+}
+
+// getQueueStats - ?interval and ?sl_threshold are in seconds, the interval
+// is rounded down to whole minutes
+func (s *Server) getQueueStats(c echo.Context) error {
+	if s.stats == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "queue statistics are disabled")
+	}
+	window := s.stats.Window()
+	interval := defaultStatsInterval
+	if interval > window {
+		interval = window
+	}
+	if v := c.QueryParam("interval"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 60 || time.Duration(n)*time.Second > window {
+			return badRequest("interval must be 60 to " + strconv.Itoa(int(window/time.Second)) + " seconds")
+		}
+		interval = time.Duration(n) * time.Second
+	}
+	threshold := defaultSLThreshold
+	if v := c.QueryParam("sl_threshold"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || time.Duration(n)*time.Second > maxSLThreshold {
+			return badRequest("sl_threshold must be 1 to " + strconv.Itoa(int(maxSLThreshold/time.Second)) + " seconds")
+		}
+		threshold = time.Duration(n) * time.Second
+	}
+
+	queue, err := s.queues.Get(c.Param("accountID"), c.Param("queueID"))
+	if err == ErrQueueNotFound {
+		return queueNotFound()
+	}
+	if err != nil {
+		return storeError(err)
+	}
+
+	snap, err := s.stats.Snapshot(s.pos, s.agents, queue.QueueID, queue.MaxPriority, interval, threshold)
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, snap)
+}
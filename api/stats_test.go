@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/queuestats"
+)
+
+func TestGetQueueStats(t *testing.T) {
+	s, ts := newStreamTestServer(t, "t1", "t2")
+	url := ts.URL + "/v1.0/accounts/" + streamAccount + "/queue/" + streamQueue + "/stats"
+
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	s.SetQueueStats(queuestats.NewStats(s.store, queuestats.DefaultOptions()))
+	resp, err = http.Get(url + "?interval=300&sl_threshold=30")
+	assert.NoError(t, err)
+	var snap queuestats.Snapshot
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&snap))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, snap.Waiting)
+	assert.Equal(t, 300, snap.IntervalSeconds)
+	assert.Equal(t, 30, snap.ServiceLevel.ThresholdSeconds)
+
+	for _, query := range []string{"?interval=30", "?interval=7200", "?sl_threshold=0"} {
+		resp, err = http.Get(url + query)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	resp, err = http.Get(ts.URL + "/v1.0/accounts/" + streamAccount + "/queue/QID_missing/stats")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
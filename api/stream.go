@@ -0,0 +1,296 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+
+	"queuev2/logger"
+)
+
+const (
+	// streamHeartbeat - keep idle streams open through proxies
+	streamHeartbeat = 15 * time.Second
+
+	defaultStreamTasks = 100
+	maxStreamTasks     = 1000
+)
+
+// stream events
+const (
+	EventPosition  = "position"
+	EventLeft      = "left"
+	EventPositions = "positions"
+	EventPing      = "ping"
+)
+
+//PositionEvent - pushed to task streams whenever the position changes, the
+//left event carries the status of the task once it is no longer waiting
+type PositionEvent struct {
+	TaskID   string `json:"task_id"`
+	QueueID  string `json:"queue_id"`
+	Status   string `json:"status"`
+	Position int    `json:"position"`
+}
+
+//QueuePositionsEvent - pushed to queue streams, Tasks holds the first
+//waiting task ids in position order
+type QueuePositionsEvent struct {
+	QueueID string   `json:"queue_id"`
+	Waiting int      `json:"waiting"`
+	Tasks   []string `json:"tasks"`
+}
+
+//StreamMessage - WebSocket frame, SSE sends Event as the event name and
+//Data as the data line
+type StreamMessage struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+//eventWriter - transport of a stream
+type eventWriter interface {
+	send(event string, data interface{}) error
+}
+
+// taskPositionStream - push the position of a waiting task until it leaves
+// the queue, Server-Sent Events or WebSocket depending on the request
+func (s *Server) taskPositionStream(c echo.Context) error {
+	task, err := s.tasks.Get(c.Param("accountID"), c.Param("taskID"))
+	if err == ErrTaskNotFound {
+		return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	if !s.pos.CanWatch() {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "position streams need a store with pub/sub")
+	}
+
+	w, err := s.positions.watch(task.QueueID, task.TaskID)
+	if err != nil {
+		return storeError(err)
+	}
+	defer s.positions.unwatch(w)
+
+	return s.serveStream(c, func(ctx context.Context, out eventWriter) error {
+		last := 0
+		for {
+			var state positionState
+			select {
+			case <-ctx.Done():
+				return nil
+			case state = <-w.updates:
+			}
+
+			if state.rank < 0 {
+				// dispatched, cancelled or expired
+				if t, err := s.tasks.Get(task.AccountID, task.TaskID); err == nil {
+					task = t
+				}
+				task.Position = 0
+				return out.send(EventLeft, positionEvent(task))
+			}
+			if state.rank+1 == last {
+				continue
+			}
+			last = state.rank + 1
+			task.Position = last
+			if err := out.send(EventPosition, positionEvent(task)); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// queuePositionsStream - push the waiting tasks of a queue on every change
+func (s *Server) queuePositionsStream(c echo.Context) error {
+	accID, queueID := c.Param("accountID"), c.Param("queueID")
+	if _, err := s.queues.Get(accID, queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+	limit := defaultStreamTasks
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxStreamTasks {
+			return badRequest(fmt.Sprintf("limit must be 0 to %d", maxStreamTasks))
+		}
+		limit = n
+	}
+	if !s.pos.CanWatch() {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "position streams need a store with pub/sub")
+	}
+
+	w, err := s.positions.watch(queueID, "")
+	if err != nil {
+		return storeError(err)
+	}
+	defer s.positions.unwatch(w)
+
+	return s.serveStream(c, func(ctx context.Context, out eventWriter) error {
+		for {
+			var state positionState
+			select {
+			case <-ctx.Done():
+				return nil
+			case state = <-w.updates:
+			}
+
+			tasks := state.items
+			if len(tasks) > limit {
+				tasks = tasks[:limit]
+			}
+			if tasks == nil {
+				tasks = []string{}
+			}
+			event := QueuePositionsEvent{QueueID: queueID, Waiting: len(state.items), Tasks: tasks}
+			if err := out.send(EventPositions, event); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func positionEvent(task *Task) PositionEvent {
+	return PositionEvent{TaskID: task.TaskID, QueueID: task.QueueID, Status: task.Status, Position: task.Position}
+}
+
+// serveStream - run loop over a WebSocket when the request asks for an
+// upgrade and over Server-Sent Events otherwise, a heartbeat is sent while
+// the loop is idle
+func (s *Server) serveStream(c echo.Context, loop func(context.Context, eventWriter) error) error {
+	l := requestLogger(c)
+	l.Info("position stream opened", "path", c.Request().URL.Path, "websocket", c.IsWebSocket())
+	defer l.Info("position stream closed", "path", c.Request().URL.Path)
+
+	if c.IsWebSocket() {
+		serveWebSocket(c, loop)
+		return nil
+	}
+	return serveSSE(c, loop)
+}
+
+func serveSSE(c echo.Context, loop func(context.Context, eventWriter) error) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// disable proxy buffering, e.g. nginx
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	out := &sseWriter{res: res}
+	done := make(chan struct{})
+	defer close(done)
+	// the response must not be written once the handler returned
+	defer out.close()
+	go heartbeat(done, out.ping)
+
+	if err := loop(c.Request().Context(), out); err != nil {
+		requestLogger(c).Debug("position stream ended", logger.FieldError, err)
+	}
+	return nil
+}
+
+func serveWebSocket(c echo.Context, loop func(context.Context, eventWriter) error) {
+	websocket.Server{
+		// clients authenticate with headers, not cookies, any origin may
+		// open a stream it holds credentials for
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ctx, cancel := context.WithCancel(c.Request().Context())
+			defer cancel()
+			// a read fails once the client closes the connection
+			go func() {
+				io.Copy(io.Discard, ws)
+				cancel()
+			}()
+
+			out := &wsWriter{ws: ws}
+			done := make(chan struct{})
+			defer close(done)
+			go heartbeat(done, func() error { return out.send(EventPing, nil) })
+
+			if err := loop(ctx, out); err != nil {
+				requestLogger(c).Debug("position stream ended", logger.FieldError, err)
+			}
+		},
+	}.ServeHTTP(c.Response(), c.Request())
+}
+
+//sseWriter - Server-Sent Events on the echo response
+type sseWriter struct {
+	mu     sync.Mutex
+	res    *echo.Response
+	closed bool
+}
+
+func (w *sseWriter) send(event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return w.write(fmt.Sprintf("event: %s\ndata: %s\n\n", event, b))
+}
+
+// ping - SSE comment line, ignored by EventSource clients
+func (w *sseWriter) ping() error {
+	return w.write(": " + EventPing + "\n\n")
+}
+
+func (w *sseWriter) write(s string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return io.ErrClosedPipe
+	}
+	if _, err := io.WriteString(w.res, s); err != nil {
+		return err
+	}
+	w.res.Flush()
+	return nil
+}
+
+func (w *sseWriter) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+}
+
+//wsWriter - StreamMessage JSON frames
+type wsWriter struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (w *wsWriter) send(event string, data interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return websocket.JSON.Send(w.ws, StreamMessage{Event: event, Data: data})
+}
+
+func heartbeat(done <-chan struct{}, ping func() error) {
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if ping() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+
+	"queuev2/logger"
+	"queuev2/store/mock"
+)
+
+const (
+	streamAccount = "123"
+	streamQueue   = "QID_stream"
+)
+
+func newStreamTestServer(t *testing.T, tasks ...string) (*Server, *httptest.Server) {
+	logger.SetLevel(logger.LevelFatal)
+	s := NewServer(0, nil, mock.NewStore("", ""))
+	s.SetAuthenticator(nil)
+	assert.NoError(t, s.queues.Register(streamAccount, &Queue{QueueID: streamQueue, QueueName: "stream", MaxPriority: 5}))
+	for i, id := range tasks {
+		task := &Task{TaskID: id, AccountID: streamAccount, QueueID: streamQueue, Priority: 1, Status: TaskStatusWaiting}
+		assert.NoError(t, s.tasks.Save(task))
+		assert.NoError(t, s.pos.AddItem(streamQueue, id, i))
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// readEvent - next event name and data of a Server-Sent Events stream,
+// comment lines are skipped
+func readEvent(t *testing.T, r *bufio.Reader, v interface{}) string {
+	var event string
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), v))
+		case line == "" && event != "":
+			return event
+		}
+	}
+}
+
+func TestTaskPositionStreamSSE(t *testing.T) {
+	s, ts := newStreamTestServer(t, "t1", "t2")
+
+	resp, err := http.Get(ts.URL + "/v1.0/accounts/" + streamAccount + "/task/t2/position/stream")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	r := bufio.NewReader(resp.Body)
+
+	ev := PositionEvent{}
+	assert.Equal(t, EventPosition, readEvent(t, r, &ev))
+	assert.Equal(t, 2, ev.Position)
+
+	// the task ahead is dispatched
+	assert.NoError(t, s.pos.RemoveItem(streamQueue, "t1"))
+	assert.Equal(t, EventPosition, readEvent(t, r, &ev))
+	assert.Equal(t, 1, ev.Position)
+
+	task, err := s.tasks.Get(streamAccount, "t2")
+	assert.NoError(t, err)
+	task.Status = TaskStatusCancelled
+	assert.NoError(t, s.tasks.Save(task))
+	assert.NoError(t, s.pos.RemoveItem(streamQueue, "t2"))
+	assert.Equal(t, EventLeft, readEvent(t, r, &ev))
+	assert.Equal(t, PositionEvent{TaskID: "t2", QueueID: streamQueue, Status: TaskStatusCancelled}, ev)
+}
+
+func TestTaskPositionStreamNotFound(t *testing.T) {
+	_, ts := newStreamTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/v1.0/accounts/" + streamAccount + "/task/unknown/position/stream")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestQueuePositionsStreamWebSocket(t *testing.T) {
+	s, ts := newStreamTestServer(t, "t1", "t2", "t3")
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1.0/accounts/" + streamAccount + "/queue/" + streamQueue + "/position/stream?limit=2"
+	ws, err := websocket.Dial(url, "", ts.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	receive := func() QueuePositionsEvent {
+		var msg struct {
+			Event string              `json:"event"`
+			Data  QueuePositionsEvent `json:"data"`
+		}
+		assert.NoError(t, websocket.JSON.Receive(ws, &msg))
+		assert.Equal(t, EventPositions, msg.Event)
+		return msg.Data
+	}
+
+	assert.Equal(t, QueuePositionsEvent{QueueID: streamQueue, Waiting: 3, Tasks: []string{"t1", "t2"}}, receive())
+
+	assert.NoError(t, s.pos.RemoveItem(streamQueue, "t1"))
+	assert.Equal(t, QueuePositionsEvent{QueueID: streamQueue, Waiting: 2, Tasks: []string{"t2", "t3"}}, receive())
+}
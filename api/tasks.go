@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"queuev2/store"
+)
+
+const (
+	taskKeyPrefix = "task:"
+
+	// taskClaimSuffix - task:{<account>}:<id>:claim holds the status of
+	// whoever took the waiting task first, the API cancelling it or a
+	// consumer dispatching it
+	taskClaimSuffix = ":claim"
+	// externalIDInfix - task:{<account>}:ext:<external id> holds the task id
+	// the client supplied id maps to, two submits with the same external_id
+	// cannot both take it
+	externalIDInfix = "ext:"
+	// claimTTL - seconds a claim is kept, longer than tasks wait
+	claimTTL = 7 * 24 * 3600
+
+	// unconfirmedTasksKey - sorted set of the tasks whose publish the broker
+	// did not confirm in time, scored by the unix time of the publish. A
+	// consumer receiving the task removes it, the ones left are for
+	// reconciliation
+	unconfirmedTasksKey = "unconfirmed_tasks"
+)
+
+// ErrTaskNotFound - task unknown, expired or owned by another account
+var ErrTaskNotFound = errors.New("task not found")
+
+//TaskStore - last known state of each task, written by the API on submit
+//and cancel and by the consumer once the task leaves the queue
+type TaskStore struct {
+	store store.Store
+}
+
+func NewTaskStore(st store.Store) *TaskStore {
+	return &TaskStore{store: st}
+}
+
+// taskKey - the account is a hash tag so SaveMulti can pipeline the tasks
+// of one account in cluster mode
+func taskKey(accountID, taskID string) string {
+	return taskKeyPrefix + "{" + accountID + "}:" + taskID
+}
+
+// Save - write the task, it expires with the store key expire time
+func (t *TaskStore) Save(task *Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return t.store.SetStruct(taskKey(task.AccountID, task.TaskID), string(data))
+}
+
+// SaveMulti - write tasks of one account in a single round trip
+func (t *TaskStore) SaveMulti(tasks []*Task) error {
+	items := make(map[string]string, len(tasks))
+	for _, task := range tasks {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		items[taskKey(task.AccountID, task.TaskID)] = string(data)
+	}
+	return t.store.SetMultiStruct(items)
+}
+
+// Claim - take the waiting task for cancelling or dispatching, false when
+// the other side took it first. Only the winner may change its status
+func (t *TaskStore) Claim(accountID, taskID, status string) (bool, error) {
+	return t.store.SetNX(taskKey(accountID, taskID)+taskClaimSuffix, status, claimTTL)
+}
+
+// Unclaim - release the claim of a task queued again, e.g. a replayed dead
+// letter, so a consumer can take it
+func (t *TaskStore) Unclaim(accountID, taskID string) error {
+	key := taskKey(accountID, taskID) + taskClaimSuffix
+	exists, err := t.store.KeyExists(key)
+	if err != nil || exists == 0 {
+		return err
+	}
+	return t.store.DeleteKey(key)
+}
+
+func unconfirmedMember(accountID, taskID string) string {
+	return accountID + " " + taskID
+}
+
+// MarkUnconfirmed - the task may or may not be queued, it is kept until it
+// is received or reconciled
+func (t *TaskStore) MarkUnconfirmed(task *Task) error {
+	return t.store.AddSortedSet(unconfirmedTasksKey, int(time.Now().Unix()), unconfirmedMember(task.AccountID, task.TaskID))
+}
+
+// Confirmed - the task reached a consumer, it was queued after all
+func (t *TaskStore) Confirmed(accountID, taskID string) error {
+	return t.store.RemoveSortedSet(unconfirmedTasksKey, unconfirmedMember(accountID, taskID))
+}
+
+// externalIDKey - shares the hash tag of the tasks of the account
+func externalIDKey(accountID, externalID string) string {
+	return taskKey(accountID, externalIDInfix+externalID)
+}
+
+// Reserve - map a client supplied external id of the account to the task
+// id, false when another task holds it
+func (t *TaskStore) Reserve(accountID, externalID, taskID string) (bool, error) {
+	return t.store.SetNX(externalIDKey(accountID, externalID), taskID, claimTTL)
+}
+
+// Release - free the external id of a task which was never queued
+func (t *TaskStore) Release(accountID, externalID string) error {
+	return t.store.DeleteKey(externalIDKey(accountID, externalID))
+}
+
+// Delete - forget a task which never reached the broker
+func (t *TaskStore) Delete(accountID, taskID string) error {
+	return t.store.DeleteKey(taskKey(accountID, taskID))
+}
+
+// Get - task of the account by its task id or its external id,
+// ErrTaskNotFound if there is none
+func (t *TaskStore) Get(accountID, taskID string) (*Task, error) {
+	key := taskKey(accountID, taskID)
+	exists, err := t.store.KeyExists(key)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 1 {
+		if key, err = t.externalTaskKey(accountID, taskID); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := t.store.GetStruct(key)
+	if err != nil {
+		return nil, err
+	}
+	task := &Task{}
+	if err = json.Unmarshal([]byte(data), task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// externalTaskKey - key of the task the external id maps to
+func (t *TaskStore) externalTaskKey(accountID, externalID string) (string, error) {
+	key := externalIDKey(accountID, externalID)
+	exists, err := t.store.KeyExists(key)
+	if err != nil {
+		return "", err
+	}
+	if exists != 1 {
+		return "", ErrTaskNotFound
+	}
+	taskID, err := t.store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	key = taskKey(accountID, taskID)
+	if exists, err = t.store.KeyExists(key); err != nil {
+		return "", err
+	}
+	if exists != 1 {
+		return "", ErrTaskNotFound
+	}
+	return key, nil
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/queuestats"
+	"queuev2/wallboard"
+)
+
+const (
+	defaultWallboardInterval = 5
+	maxWallboardInterval     = 60
+)
+
+// EventWallboard - stream event carrying a Wallboard
+const EventWallboard = "wallboard"
+
+// wallboardPage - supervisor page rendering the wallboard stream, it has
+// no external assets so it works on isolated networks
+//
+//go:embed wallboard/index.html
+var wallboardPage []byte
+
+//WallboardAgents - agents logged in to a queue by state
+type WallboardAgents struct {
+	LoggedIn  int `json:"logged_in"`
+	Available int `json:"available"`
+	Busy      int `json:"busy"`
+}
+
+//WallboardQueue - live figures of one queue, the service level covers the
+//default stats interval
+type WallboardQueue struct {
+	QueueID            string                  `json:"queue_id"`
+	QueueName          string                  `json:"queue_name"`
+	Waiting            int                     `json:"waiting"`
+	LongestWaitSeconds int                     `json:"longest_wait_seconds"`
+	Agents             WallboardAgents         `json:"agents"`
+	ServiceLevel       queuestats.ServiceLevel `json:"service_level"`
+	Alerts             []wallboard.Alert       `json:"alerts"`
+}
+
+//Wallboard - snapshot of every queue of the account ordered by name,
+//Alerts holds the alerts of all of them
+type Wallboard struct {
+	AccountID string            `json:"account_id"`
+	Time      time.Time         `json:"time"`
+	Queues    []WallboardQueue  `json:"queues"`
+	Alerts    []wallboard.Alert `json:"alerts"`
+}
+
+// wallboardStream - push a Wallboard every ?interval seconds
+func (s *Server) wallboardStream(c echo.Context) error {
+	if s.stats == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "queue statistics are disabled")
+	}
+	interval := defaultWallboardInterval
+	if v := c.QueryParam("interval"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWallboardInterval {
+			return badRequest(fmt.Sprintf("interval must be 1 to %d seconds", maxWallboardInterval))
+		}
+		interval = n
+	}
+	accID := c.Param("accountID")
+	// fail before the stream is opened when the store is unusable
+	board, err := s.sharedWallboard(accID, interval)
+	if err != nil {
+		return storeError(err)
+	}
+
+	return s.serveStream(c, func(ctx context.Context, out eventWriter) error {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			if err := out.send(EventWallboard, board); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+			if board, err = s.sharedWallboard(accID, interval); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+//wallboardKey - streams of one account pushing at the same interval
+type wallboardKey struct {
+	accountID string
+	interval  int
+}
+
+//cachedWallboard - last board of a key, mu is held while it is computed
+//so the streams of the key wait for one computation. read is guarded by
+//the mutex of the cache
+type cachedWallboard struct {
+	mu    sync.Mutex
+	board *Wallboard
+	read  time.Time
+}
+
+//wallboardCache - boards shared by the streams of an account and interval
+type wallboardCache struct {
+	mu     sync.Mutex
+	boards map[wallboardKey]*cachedWallboard
+}
+
+func newWallboardCache() *wallboardCache {
+	return &wallboardCache{boards: make(map[wallboardKey]*cachedWallboard)}
+}
+
+// entry - board of the key, the ones no stream read for two intervals are
+// dropped on the way
+func (wc *wallboardCache) entry(key wallboardKey, now time.Time) *cachedWallboard {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	for k, e := range wc.boards {
+		if now.Sub(e.read) > 2*time.Duration(k.interval)*time.Second {
+			delete(wc.boards, k)
+		}
+	}
+	e, ok := wc.boards[key]
+	if !ok {
+		e = &cachedWallboard{}
+		wc.boards[key] = e
+	}
+	e.read = now
+	return e
+}
+
+// sharedWallboard - wallboard of the account computed at most once per
+// interval, whatever the number of streams reading it
+func (s *Server) sharedWallboard(accountID string, interval int) (*Wallboard, error) {
+	now := time.Now().UTC()
+	e := s.wallboards.entry(wallboardKey{accountID, interval}, now)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.board != nil && now.Sub(e.board.Time) < time.Duration(interval)*time.Second {
+		return e.board, nil
+	}
+	board, err := s.wallboard(accountID)
+	if err != nil {
+		return nil, err
+	}
+	e.board = board
+	return board, nil
+}
+
+// wallboard - snapshot and alerts of every queue of the account
+func (s *Server) wallboard(accountID string) (*Wallboard, error) {
+	queues, err := s.queues.List(accountID)
+	if err != nil {
+		return nil, err
+	}
+	thresholds, err := s.thresholds.All(accountID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].QueueName < queues[j].QueueName })
+
+	interval := defaultStatsInterval
+	if window := s.stats.Window(); interval > window {
+		interval = window
+	}
+	board := &Wallboard{
+		AccountID: accountID,
+		Time:      time.Now().UTC(),
+		Queues:    make([]WallboardQueue, 0, len(queues)),
+		Alerts:    []wallboard.Alert{},
+	}
+	for _, q := range queues {
+		t := thresholds[q.QueueID]
+		slThreshold := defaultSLThreshold
+		if t.ServiceLevelThresholdSeconds > 0 {
+			slThreshold = time.Duration(t.ServiceLevelThresholdSeconds) * time.Second
+		}
+		snap, err := s.stats.Snapshot(s.pos, s.agents, q.QueueID, q.MaxPriority, interval, slThreshold)
+		if err != nil {
+			return nil, err
+		}
+
+		alerts := wallboard.Check(snap, t)
+		if alerts == nil {
+			alerts = []wallboard.Alert{}
+		}
+		board.Queues = append(board.Queues, WallboardQueue{
+			QueueID:            q.QueueID,
+			QueueName:          q.QueueName,
+			Waiting:            snap.Waiting,
+			LongestWaitSeconds: snap.OldestWaitSeconds,
+			Agents: WallboardAgents{
+				LoggedIn:  snap.Agents.LoggedIn,
+				Available: snap.Agents.Available,
+				Busy:      snap.Agents.LoggedIn - snap.Agents.Available,
+			},
+			ServiceLevel: snap.ServiceLevel,
+			Alerts:       alerts,
+		})
+		board.Alerts = append(board.Alerts, alerts...)
+	}
+	return board, nil
+}
+
+func (s *Server) getQueueThresholds(c echo.Context) error {
+	accID, queueID := c.Param("accountID"), c.Param("queueID")
+	if _, err := s.queues.Get(accID, queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	t, err := s.thresholds.Get(accID, queueID)
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+// setQueueThresholds - replace the wallboard alert thresholds of the queue,
+// an empty object clears them
+func (s *Server) setQueueThresholds(c echo.Context) error {
+	accID, queueID := c.Param("accountID"), c.Param("queueID")
+	t := new(wallboard.Thresholds)
+	if err := c.Bind(t); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(t); err != nil {
+		return err
+	}
+	if _, err := s.queues.Get(accID, queueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	if err := s.thresholds.Set(accID, queueID, *t); err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+func serveWallboardPage(c echo.Context) error {
+	return c.HTMLBlob(http.StatusOK, wallboardPage)
+}
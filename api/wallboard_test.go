@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/queuestats"
+	"queuev2/wallboard"
+)
+
+func TestQueueThresholds(t *testing.T) {
+	_, ts := newStreamTestServer(t)
+	url := ts.URL + "/v1.0/accounts/" + streamAccount + "/queue/" + streamQueue + "/thresholds"
+
+	put := func(url, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	assert.Equal(t, http.StatusOK, put(url, `{"max_longest_wait_seconds":120,"min_available_agents":1}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, put(url, `{"min_service_level_percent":120}`).StatusCode)
+	assert.Equal(t, http.StatusNotFound, put(strings.Replace(url, streamQueue, "QID_missing", 1), `{}`).StatusCode)
+
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.JSONEq(t, `{"max_longest_wait_seconds":120,"min_available_agents":1}`, string(body))
+}
+
+func TestWallboardStream(t *testing.T) {
+	s, ts := newStreamTestServer(t, "t1", "t2")
+	url := ts.URL + "/v1.0/accounts/" + streamAccount + "/wallboard"
+
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	s.SetQueueStats(queuestats.NewStats(s.store, queuestats.DefaultOptions()))
+	min := 1
+	assert.NoError(t, s.thresholds.Set(streamAccount, streamQueue, wallboard.Thresholds{MinAvailableAgents: &min}))
+
+	resp, err = http.Get(url + "?interval=61")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(url + "?interval=1")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	r := bufio.NewReader(resp.Body)
+
+	var board Wallboard
+	assert.Equal(t, EventWallboard, readEvent(t, r, &board))
+	if assert.Len(t, board.Queues, 1) {
+		q := board.Queues[0]
+		assert.Equal(t, streamQueue, q.QueueID)
+		assert.Equal(t, 2, q.Waiting)
+		assert.Len(t, q.Alerts, 1)
+	}
+	if assert.Len(t, board.Alerts, 1) {
+		assert.Equal(t, wallboard.MetricAvailableAgents, board.Alerts[0].Metric)
+	}
+
+	// the next snapshot follows after the interval
+	assert.NoError(t, s.agents.Heartbeat(streamQueue, "c1", queuestats.AgentAvailable))
+	assert.Equal(t, EventWallboard, readEvent(t, r, &board))
+	assert.Equal(t, WallboardAgents{LoggedIn: 1, Available: 1}, board.Queues[0].Agents)
+	assert.Empty(t, board.Alerts)
+}
+
+func TestWallboardPage(t *testing.T) {
+	_, ts := newStreamTestServer(t)
+	resp, err := http.Get(ts.URL + "/wallboard")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "<title>Queue wallboard</title>")
+	// no external assets
+	assert.NotContains(t, string(body), "src=\"http")
+	assert.NotContains(t, string(body), "href=\"http")
+}
+
+func TestSharedWallboard(t *testing.T) {
+	s, _ := newStreamTestServer(t, "t1")
+	s.SetQueueStats(queuestats.NewStats(s.store, queuestats.DefaultOptions()))
+
+	// streams of the same interval read one board until it is an interval
+	// old, the ones of another interval compute their own
+	first, err := s.sharedWallboard(streamAccount, 60)
+	assert.NoError(t, err)
+	board, err := s.sharedWallboard(streamAccount, 60)
+	assert.NoError(t, err)
+	assert.Same(t, first, board)
+	other, err := s.sharedWallboard(streamAccount, 30)
+	assert.NoError(t, err)
+	assert.NotSame(t, first, other)
+
+	first.Time = first.Time.Add(-time.Minute)
+	board, err = s.sharedWallboard(streamAccount, 60)
+	assert.NoError(t, err)
+	assert.NotSame(t, first, board)
+
+	// boards nobody read for two intervals are dropped
+	s.wallboards.entry(wallboardKey{streamAccount, 60}, time.Now().Add(time.Hour))
+	assert.Len(t, s.wallboards.boards, 1)
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/events"
+	"queuev2/webhook"
+)
+
+//WebhookRequest - subscription of url to events of one queue, a secret is
+//generated when none is given
+type WebhookRequest struct {
+	QueueID string   `json:"queue_id" validate:"required"`
+	URL     string   `json:"url" validate:"required,url"`
+	Events  []string `json:"events" validate:"required,min=1"`
+	Secret  string   `json:"secret" validate:"omitempty,min=16"`
+}
+
+//ReplayRequest - deliveries to attempt again, every failed one when empty
+type ReplayRequest struct {
+	DeliveryIDs []string `json:"delivery_ids"`
+}
+
+//ReplayResponse - deliveries queued for a new attempt
+type ReplayResponse struct {
+	Replayed []*webhook.Delivery `json:"replayed"`
+}
+
+// SetWebhookDispatcher - deliver the events of this server to the
+// webhooks and enable the replay endpoint
+func (s *Server) SetWebhookDispatcher(d *webhook.Dispatcher) {
+	s.dispatcher = d
+	s.events.Add(d)
+}
+
+// createWebhook - the secret is returned only on creation
+func (s *Server) createWebhook(c echo.Context) error {
+	req := new(WebhookRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+	if err := s.checkWebhookURL(c, req.URL); err != nil {
+		return webhookFieldError("url", err.Error())
+	}
+	for _, t := range req.Events {
+		if !events.Valid(t) {
+			return webhookFieldError("events", "unknown event type "+t)
+		}
+	}
+
+	accID := c.Param("accountID")
+	if _, err := s.queues.Get(accID, req.QueueID); err == ErrQueueNotFound {
+		return queueNotFound()
+	} else if err != nil {
+		return storeError(err)
+	}
+
+	w := &webhook.Webhook{
+		AccountID: accID,
+		QueueID:   req.QueueID,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    req.Secret,
+	}
+	if err := s.webhooks.Create(w); err != nil {
+		return storeError(err)
+	}
+	s.invalidateWebhooks(accID)
+	return c.JSON(http.StatusCreated, w)
+}
+
+func (s *Server) listWebhooks(c echo.Context) error {
+	hooks, err := s.webhooks.List(c.Param("accountID"))
+	if err != nil {
+		return storeError(err)
+	}
+	for _, w := range hooks {
+		w.Secret = ""
+	}
+	return c.JSON(http.StatusOK, hooks)
+}
+
+func (s *Server) getWebhook(c echo.Context) error {
+	w, err := s.webhooks.Get(c.Param("accountID"), c.Param("webhookID"))
+	if err != nil {
+		return webhookError(err)
+	}
+	w.Secret = ""
+	return c.JSON(http.StatusOK, w)
+}
+
+func (s *Server) deleteWebhook(c echo.Context) error {
+	accID := c.Param("accountID")
+	if err := s.webhooks.Delete(accID, c.Param("webhookID")); err != nil {
+		return webhookError(err)
+	}
+	s.invalidateWebhooks(accID)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// listWebhookDeliveries - delivery log of the webhook, newest first
+func (s *Server) listWebhookDeliveries(c echo.Context) error {
+	w, err := s.webhooks.Get(c.Param("accountID"), c.Param("webhookID"))
+	if err != nil {
+		return webhookError(err)
+	}
+	deliveries, err := s.webhooks.ListDeliveries(w.ID)
+	if err != nil {
+		return storeError(err)
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func (s *Server) replayWebhookDeliveries(c echo.Context) error {
+	if s.dispatcher == nil {
+		return newAPIError(http.StatusNotImplemented, CodeNotImplemented, "webhook delivery is disabled")
+	}
+	req := new(ReplayRequest)
+	if err := c.Bind(req); err != nil {
+		return bindError(err)
+	}
+
+	replayed, err := s.dispatcher.Replay(c.Param("accountID"), c.Param("webhookID"), req.DeliveryIDs)
+	if err != nil {
+		return webhookError(err)
+	}
+	return c.JSON(http.StatusAccepted, ReplayResponse{Replayed: replayed})
+}
+
+// checkWebhookURL - the dispatcher posts from inside our network, urls
+// reaching internal addresses are rejected unless it allows them
+func (s *Server) checkWebhookURL(c echo.Context, url string) error {
+	if s.dispatcher != nil {
+		return s.dispatcher.CheckURL(c.Request().Context(), url)
+	}
+	return webhook.CheckURL(c.Request().Context(), url, false)
+}
+
+func (s *Server) invalidateWebhooks(accountID string) {
+	if s.dispatcher != nil {
+		s.dispatcher.Invalidate(accountID)
+	}
+}
+
+func webhookError(err error) error {
+	switch err {
+	case webhook.ErrWebhookNotFound, webhook.ErrDeliveryNotFound:
+		return newAPIError(http.StatusNotFound, CodeNotFound, err.Error())
+	case webhook.ErrDeliveryPending:
+		return newAPIError(http.StatusConflict, CodeConflict, err.Error())
+	}
+	return storeError(err)
+}
+
+func webhookFieldError(field, msg string) error {
+	e := newAPIError(http.StatusBadRequest, CodeValidation, "request validation failed")
+	e.Body.Fields = []FieldError{{Field: field, Message: msg}}
+	return e
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/logger"
+)
+
+func TestCreateWebhookLogsNoSecret(t *testing.T) {
+	s, _ := newStreamTestServer(t)
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	logger.SetLevel(logger.LevelInfo)
+	defer func() {
+		logger.SetOutput(os.Stderr)
+		logger.SetLevel(logger.LevelFatal)
+	}()
+
+	body := `{"queue_id":"` + streamQueue + `","url":"https://203.0.113.10/q","events":["task.enqueued"],"secret":"s3cr3t-signing-key-1234"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1.0/accounts/"+streamAccount+"/webhooks", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, rec.Body.String(), "s3cr3t-signing-key-1234")
+	assert.Contains(t, logs.String(), "request completed")
+	assert.NotContains(t, logs.String(), "s3cr3t")
+}
+
+func TestCreateWebhookRejectsInternalURL(t *testing.T) {
+	s, _ := newStreamTestServer(t)
+	for _, url := range []string{"http://localhost:8080/q", "http://169.254.169.254/latest", "https://10.0.0.7/q", "ftp://203.0.113.10/q"} {
+		body := `{"queue_id":"` + streamQueue + `","url":"` + url + `","events":["task.enqueued"]}`
+		req := httptest.NewRequest(http.MethodPost, "/v1.0/accounts/"+streamAccount+"/webhooks", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, url)
+		assert.Contains(t, rec.Body.String(), `"field":"url"`, url)
+	}
+}
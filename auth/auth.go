@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+
+	"queuev2/store"
+)
+
+// Scopes granted to API keys and JWT tokens
+const (
+	// ScopeAdmin - platform operator, any account and the debug/metrics routes
+	ScopeAdmin = "admin"
+	// ScopeQueueAdmin - create and manage queues and api keys of the account
+	ScopeQueueAdmin = "queue:admin"
+	// ScopeTaskSubmit - submit and cancel tasks
+	ScopeTaskSubmit = "task:submit"
+	// ScopeAgent - list the agents of the queues and request their state
+	ScopeAgent = "agent"
+	// ScopeRead - read only access to queues, tasks and stats
+	ScopeRead = "read"
+)
+
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+
+	apiKeyHeader    = "X-API-Key"
+	principalKey    = "auth.principal"
+	accountParam    = "accountID"
+	bearerPrefix    = "Bearer "
+	apiKeyPrefix    = "ApiKey "
+	jwtAccountClaim = "account_id"
+	jwtScopeClaim   = "scope"
+
+	// DefaultJWTMaxLifetime - longest validity of a token, from its issue
+	// to its expiry
+	DefaultJWTMaxLifetime = 24 * time.Hour
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrAccountMismatch    = errors.New("credentials are not valid for this account")
+	ErrInsufficientScope  = errors.New("insufficient scope")
+)
+
+// Principal - authenticated caller
+type Principal struct {
+	AccountID string   `json:"account_id"`
+	Scopes    []string `json:"scopes"`
+	Method    string   `json:"method"`
+	// Subject - api key id or jwt subject
+	Subject string `json:"subject"`
+}
+
+// HasScope - admin implies every scope, queue admin implies read
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+		if s == ScopeQueueAdmin && scope == ScopeRead {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess - principal may act on the account
+func (p *Principal) CanAccess(accountID string) bool {
+	return p.AccountID == accountID || p.HasScope(ScopeAdmin)
+}
+
+// JWTOptions - verification keys of bearer tokens, HMAC secret and/or RSA
+// key. Tokens must expire within MaxLifetime of being issued,
+// DefaultJWTMaxLifetime when it is zero
+type JWTOptions struct {
+	HMACSecret   []byte
+	RSAPublicKey *rsa.PublicKey
+	Issuer       string
+	Audience     string
+	MaxLifetime  time.Duration
+}
+
+// Authenticator - resolves API keys and JWT bearer tokens to a Principal
+type Authenticator struct {
+	keys   *KeyStore
+	jwt    JWTOptions
+	static map[string]*Principal
+}
+
+func NewAuthenticator(st store.Store, jwtOpts JWTOptions) *Authenticator {
+	return &Authenticator{
+		keys:   NewKeyStore(st),
+		jwt:    jwtOpts,
+		static: make(map[string]*Principal),
+	}
+}
+
+// AddStaticToken - configured token, e.g. the bootstrap admin token used to
+// create the first account keys
+func (a *Authenticator) AddStaticToken(token string, p *Principal) {
+	a.static[hashSecret(token)] = p
+}
+
+// Keys - api key management
+func (a *Authenticator) Keys() *KeyStore {
+	return a.keys
+}
+
+// Authenticate - principal of the request credentials
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return a.verifyKey(key)
+	}
+
+	authz := r.Header.Get(echo.HeaderAuthorization)
+	switch {
+	case strings.HasPrefix(authz, apiKeyPrefix):
+		return a.verifyKey(strings.TrimPrefix(authz, apiKeyPrefix))
+	case strings.HasPrefix(authz, bearerPrefix):
+		token := strings.TrimPrefix(authz, bearerPrefix)
+		if strings.HasPrefix(token, apiKeyTokenPref) {
+			return a.verifyKey(token)
+		}
+		return a.verifyJWT(token)
+	}
+	return nil, ErrMissingCredentials
+}
+
+func (a *Authenticator) verifyKey(token string) (*Principal, error) {
+	if p, ok := a.static[hashSecret(token)]; ok {
+		return p, nil
+	}
+	return a.keys.Verify(token)
+}
+
+// Require - middleware authenticating the request, checking that the
+// principal owns :accountID and holds one of the scopes
+func (a *Authenticator) Require(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p, err := a.Authenticate(c.Request())
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="queuev2"`)
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+
+			if accID := c.Param(accountParam); accID != "" && !p.CanAccess(accID) {
+				return echo.NewHTTPError(http.StatusForbidden, ErrAccountMismatch.Error())
+			}
+
+			if len(scopes) > 0 && !hasAnyScope(p, scopes) {
+				return echo.NewHTTPError(http.StatusForbidden, ErrInsufficientScope.Error()+", requires one of: "+strings.Join(scopes, ", "))
+			}
+
+			c.Set(principalKey, p)
+			return next(c)
+		}
+	}
+}
+
+// PrincipalFrom - principal set by Require, nil for unauthenticated routes
+func PrincipalFrom(c echo.Context) *Principal {
+	p, _ := c.Get(principalKey).(*Principal)
+	return p
+}
+
+func hasAnyScope(p *Principal, scopes []string) bool {
+	for _, s := range scopes {
+		if p.HasScope(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) verifyJWT(raw string) (*Principal, error) {
+	if a.jwt.HMACSecret == nil && a.jwt.RSAPublicKey == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if a.jwt.HMACSecret != nil {
+				return a.jwt.HMACSecret, nil
+			}
+		case *jwt.SigningMethodRSA:
+			if a.jwt.RSAPublicKey != nil {
+				return a.jwt.RSAPublicKey, nil
+			}
+		}
+		return nil, errors.New("unexpected signing method " + t.Method.Alg())
+	})
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	if !a.validLifetime(claims) {
+		return nil, ErrInvalidCredentials
+	}
+	if a.jwt.Issuer != "" && !claims.VerifyIssuer(a.jwt.Issuer, true) {
+		return nil, ErrInvalidCredentials
+	}
+	if a.jwt.Audience != "" && !claims.VerifyAudience(a.jwt.Audience, true) {
+		return nil, ErrInvalidCredentials
+	}
+
+	accountID, _ := claims[jwtAccountClaim].(string)
+	subject, _ := claims["sub"].(string)
+	p := &Principal{
+		AccountID: accountID,
+		Scopes:    scopesClaim(claims[jwtScopeClaim]),
+		Method:    MethodJWT,
+		Subject:   subject,
+	}
+	if p.AccountID == "" && !p.HasScope(ScopeAdmin) {
+		return nil, ErrInvalidCredentials
+	}
+	return p, nil
+}
+
+// validLifetime - the token has an exp claim at most MaxLifetime after its
+// iat claim, or after now for tokens without one
+func (a *Authenticator) validLifetime(claims jwt.MapClaims) bool {
+	maxLifetime := a.jwt.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultJWTMaxLifetime
+	}
+	// NumericDate claims decode as float64
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return false
+	}
+	issued, ok := claims["iat"].(float64)
+	if !ok {
+		issued = float64(time.Now().Unix())
+	}
+	return exp-issued <= maxLifetime.Seconds()
+}
+
+// scopesClaim - OAuth style space separated string or a JSON list
+func scopesClaim(v interface{}) []string {
+	switch scopes := v.(type) {
+	case string:
+		return strings.Fields(scopes)
+	case []interface{}:
+		out := make([]string, 0, len(scopes))
+		for _, s := range scopes {
+			if str, ok := s.(string); ok {
+				out = append(out, str)
+			}
+		}
+		return out
+	}
+	return nil
+}
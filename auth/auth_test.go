@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/store/mock"
+)
+
+var secret = []byte("test-secret")
+
+func newTestServer(a *Authenticator) *echo.Echo {
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, PrincipalFrom(c).AccountID) }
+	e.POST("/v1.0/accounts/:accountID/task", ok, a.Require(ScopeTaskSubmit))
+	e.GET("/metrics", ok, a.Require(ScopeAdmin))
+	return e
+}
+
+func do(e *echo.Echo, method, path, header, value string) int {
+	req := httptest.NewRequest(method, path, nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func signed(claims jwt.MapClaims) string {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	return token
+}
+
+func TestAPIKey(t *testing.T) {
+	a := NewAuthenticator(mock.NewStore("", ""), JWTOptions{})
+	e := newTestServer(a)
+
+	key, token, err := a.Keys().Create("123", "ivr", []string{ScopeTaskSubmit})
+	assert.NoError(t, err)
+	assert.NotContains(t, key.SecretHash, token)
+
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", "", ""))
+	assert.Equal(t, http.StatusOK, do(e, http.MethodPost, "/v1.0/accounts/123/task", apiKeyHeader, token))
+	assert.Equal(t, http.StatusForbidden, do(e, http.MethodPost, "/v1.0/accounts/456/task", apiKeyHeader, token))
+	assert.Equal(t, http.StatusForbidden, do(e, http.MethodGet, "/metrics", apiKeyHeader, token))
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", apiKeyHeader, token+"x"))
+
+	assert.NoError(t, a.Keys().Revoke("123", key.ID))
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", apiKeyHeader, token))
+}
+
+func TestJWT(t *testing.T) {
+	a := NewAuthenticator(mock.NewStore("", ""), JWTOptions{HMACSecret: secret})
+	e := newTestServer(a)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	token := signed(jwt.MapClaims{"sub": "ivr", "account_id": "123", "scope": "task:submit read", "exp": exp})
+	assert.Equal(t, http.StatusOK, do(e, http.MethodPost, "/v1.0/accounts/123/task", echo.HeaderAuthorization, bearerPrefix+token))
+	assert.Equal(t, http.StatusForbidden, do(e, http.MethodPost, "/v1.0/accounts/456/task", echo.HeaderAuthorization, bearerPrefix+token))
+
+	readOnly := signed(jwt.MapClaims{"account_id": "123", "scope": "read", "exp": exp})
+	assert.Equal(t, http.StatusForbidden, do(e, http.MethodPost, "/v1.0/accounts/123/task", echo.HeaderAuthorization, bearerPrefix+readOnly))
+
+	expired := signed(jwt.MapClaims{"account_id": "123", "scope": "task:submit", "exp": time.Now().Add(-time.Minute).Unix()})
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", echo.HeaderAuthorization, bearerPrefix+expired))
+
+	// tokens must expire, within the max lifetime of being issued
+	forever := signed(jwt.MapClaims{"account_id": "123", "scope": "task:submit"})
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", echo.HeaderAuthorization, bearerPrefix+forever))
+	longLived := signed(jwt.MapClaims{"account_id": "123", "scope": "task:submit", "exp": time.Now().Add(DefaultJWTMaxLifetime + time.Hour).Unix()})
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", echo.HeaderAuthorization, bearerPrefix+longLived))
+	issued := time.Now().Add(-2 * DefaultJWTMaxLifetime)
+	stretched := signed(jwt.MapClaims{"account_id": "123", "scope": "task:submit", "iat": issued.Unix(), "exp": exp})
+	assert.Equal(t, http.StatusUnauthorized, do(e, http.MethodPost, "/v1.0/accounts/123/task", echo.HeaderAuthorization, bearerPrefix+stretched))
+
+	admin := signed(jwt.MapClaims{"scope": []string{"admin"}, "exp": exp})
+	assert.Equal(t, http.StatusOK, do(e, http.MethodGet, "/metrics", echo.HeaderAuthorization, bearerPrefix+admin))
+	assert.Equal(t, http.StatusOK, do(e, http.MethodPost, "/v1.0/accounts/456/task", echo.HeaderAuthorization, bearerPrefix+admin))
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"queuev2/store"
+)
+
+const (
+	apiKeysHash     = "apikeys"
+	apiKeyTokenPref = "qk_"
+	keyIDBytes      = 8
+	secretBytes     = 32
+)
+
+// ErrKeyNotFound - no api key with this id for the account
+var ErrKeyNotFound = errors.New("api key not found")
+
+//APIKey - stored api key, only the sha256 of the secret is kept
+type APIKey struct {
+	ID         string    `json:"id"`
+	AccountID  string    `json:"account_id"`
+	Name       string    `json:"name,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	SecretHash string    `json:"secret_hash,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+//KeyStore - api keys kept in a store hash keyed by key id
+type KeyStore struct {
+	store store.Store
+}
+
+func NewKeyStore(st store.Store) *KeyStore {
+	return &KeyStore{store: st}
+}
+
+// Create - new key for the account, the returned token is shown only once
+func (k *KeyStore) Create(accountID, name string, scopes []string) (*APIKey, string, error) {
+	id, err := randomHex(keyIDBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(secretBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		ID:         id,
+		AccountID:  accountID,
+		Name:       name,
+		Scopes:     scopes,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  time.Now().UTC(),
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = k.store.SetStructInHashNoExpire(apiKeysHash, id, string(data)); err != nil {
+		return nil, "", err
+	}
+
+	return key, apiKeyTokenPref + id + "." + secret, nil
+}
+
+// Verify - principal of a "qk_<id>.<secret>" token
+func (k *KeyStore) Verify(token string) (*Principal, error) {
+	id, secret, ok := splitToken(token)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	key, err := k.get(id)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Principal{
+		AccountID: key.AccountID,
+		Scopes:    key.Scopes,
+		Method:    MethodAPIKey,
+		Subject:   key.ID,
+	}, nil
+}
+
+// List - keys of the account without secret hashes
+func (k *KeyStore) List(accountID string) ([]*APIKey, error) {
+	ids, err := k.store.GetKeysFromHash(apiKeysHash)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*APIKey{}
+	for _, id := range ids {
+		key, err := k.get(id)
+		if err != nil || key.AccountID != accountID {
+			continue
+		}
+		key.SecretHash = ""
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Revoke - delete a key of the account
+func (k *KeyStore) Revoke(accountID, id string) error {
+	key, err := k.get(id)
+	if err != nil || key.AccountID != accountID {
+		return ErrKeyNotFound
+	}
+	return k.store.DeleteStructFromHash(apiKeysHash, id)
+}
+
+func (k *KeyStore) get(id string) (*APIKey, error) {
+	exists, err := k.store.KeyExistsInHash(apiKeysHash, id)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 1 {
+		return nil, ErrKeyNotFound
+	}
+
+	data, err := k.store.GetStructFromHash(apiKeysHash, id)
+	if err != nil {
+		return nil, err
+	}
+	key := &APIKey{}
+	if err = json.Unmarshal([]byte(data), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func splitToken(token string) (string, string, bool) {
+	if !strings.HasPrefix(token, apiKeyTokenPref) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyTokenPref), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
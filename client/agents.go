@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Agent states, only available and unavailable can be requested
+const (
+	AgentAvailable   = "available"
+	AgentBusy        = "busy"
+	AgentUnavailable = "unavailable"
+)
+
+//Agent - agent logged in to a queue, RequestedState is the state an
+//operator asked for until the agent applies it
+type Agent struct {
+	AgentID        string    `json:"agent_id"`
+	State          string    `json:"state"`
+	RequestedState string    `json:"requested_state,omitempty"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+// ListAgents - agents logged in to the queue
+func (c *Client) ListAgents(ctx context.Context, queueID string) ([]Agent, error) {
+	var agents []Agent
+	err := c.do(ctx, request{method: http.MethodGet, path: c.accountPath("queue", queueID, "agents"), retry: true}, &agents)
+	return agents, err
+}
+
+// SetAgentState - request the agent available or unavailable, it applies
+// the state on its next heartbeat
+func (c *Client) SetAgentState(ctx context.Context, queueID, agentID, state string) (*Agent, error) {
+	agent := &Agent{}
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   c.accountPath("queue", queueID, "agents", agentID),
+		body: struct {
+			State string `json:"state"`
+		}{state},
+		retry: true,
+	}, agent)
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiVersion = "/v1.0"
+
+	headerAPIKey         = "X-API-Key"
+	headerRequestID      = "X-Request-ID"
+	headerRetryAfter     = "Retry-After"
+	headerIdempotencyKey = "Idempotency-Key"
+
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 200 * time.Millisecond
+	maxRetryWait        = 30 * time.Second
+
+	// codeQueueClosed - error code of submits to draining and closed queues
+	codeQueueClosed = "queue_closed"
+)
+
+//Options - connection settings of a Client, APIKey and BearerToken are
+//alternatives, APIKey wins when both are set
+type Options struct {
+	AccountID   string
+	APIKey      string
+	BearerToken string
+	// HTTPClient defaults to a client with a 30s timeout
+	HTTPClient *http.Client
+	// MaxRetries - retries after a 5XX, a 429 or a network error, negative
+	// disables retries and 0 means the default of 3
+	MaxRetries int
+	// RetryBackoff - first retry delay, doubled on every retry
+	RetryBackoff time.Duration
+}
+
+//Client - typed access to the queue REST API of one account
+type Client struct {
+	baseURL string
+	opts    Options
+	http    *http.Client
+}
+
+// New - client for the API at baseURL, e.g. "http://queue-api:9898"
+func New(baseURL string, opts Options) *Client {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		opts:    opts,
+		http:    opts.HTTPClient,
+	}
+}
+
+//Error - error response of the API
+type Error struct {
+	StatusCode int          `json:"-"`
+	Code       string       `json:"code"`
+	Message    string       `json:"message"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	RequestID  string       `json:"request_id,omitempty"`
+}
+
+//FieldError - validation failure of one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("queue api: %d %s: %s (request_id %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// IsNotFound - whether err is a 404 answer of the API
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsQueueClosed - whether err rejected a task submitted to a draining or
+// closed queue, the message is the reason the queue was drained for
+func IsQueueClosed(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == codeQueueClosed
+}
+
+func (c *Client) accountPath(parts ...string) string {
+	escaped := make([]string, 0, len(parts)+2)
+	escaped = append(escaped, "accounts", url.PathEscape(c.opts.AccountID))
+	for _, p := range parts {
+		escaped = append(escaped, url.PathEscape(p))
+	}
+	return apiVersion + "/" + strings.Join(escaped, "/")
+}
+
+//request - one API call, retried only when retry is set
+type request struct {
+	method string
+	path   string
+	body   interface{}
+	header http.Header
+	retry  bool
+}
+
+// do - send req and decode the answer into out, 5XX, 429 and network
+// errors are retried with exponential backoff
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		wait, err := c.send(ctx, req, body, out)
+		if err == nil {
+			return nil
+		}
+		if !req.retry || wait < 0 || attempt >= c.opts.MaxRetries {
+			return err
+		}
+
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// send - single attempt, wait is negative when the error must not be
+// retried, 0 for the default backoff, or the delay asked by Retry-After
+func (c *Client) send(ctx context.Context, req request, body []byte, out interface{}) (time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, reader)
+	if err != nil {
+		return -1, err
+	}
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if c.opts.APIKey != "" {
+		httpReq.Header.Set(headerAPIKey, c.opts.APIKey)
+	} else if c.opts.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.opts.BearerToken)
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := decodeError(resp, data)
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return retryAfter(resp), apiErr
+		case resp.StatusCode >= http.StatusInternalServerError:
+			return 0, apiErr
+		}
+		return -1, apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return 0, nil
+	}
+	if err = json.Unmarshal(data, out); err != nil {
+		return -1, fmt.Errorf("queue api: decoding %s %s response: %w", req.method, req.path, err)
+	}
+	return 0, nil
+}
+
+func decodeError(resp *http.Response, data []byte) *Error {
+	envelope := struct {
+		Error *Error `json:"error"`
+	}{}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Error == nil {
+		envelope.Error = &Error{Message: http.StatusText(resp.StatusCode)}
+	}
+	e := envelope.Error
+	e.StatusCode = resp.StatusCode
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get(headerRequestID)
+	}
+	return e
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	sec, err := strconv.Atoi(resp.Header.Get(headerRetryAfter))
+	if err != nil || sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
@@ -0,0 +1,253 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/api"
+	"queuev2/auth"
+	"queuev2/logger"
+	"queuev2/mq/producer"
+	"queuev2/store/mock"
+)
+
+const (
+	testAccount = "123"
+	testToken   = "test-admin-token"
+)
+
+// fakeBroker - Broker failing the first failPublish publishes
+type fakeBroker struct {
+	mu          sync.Mutex
+	failPublish int
+	published   int
+}
+
+func (b *fakeBroker) PublishMessage(routingKey string, body []byte, priority uint8, headers amqp.Table) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failPublish > 0 {
+		b.failPublish--
+		return errors.New("channel closed")
+	}
+	b.published++
+	return nil
+}
+
+func (b *fakeBroker) PublishBatch(msgs []producer.Message) []error {
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = b.PublishMessage(m.RoutingKey, m.Body, m.Priority, m.Headers)
+	}
+	return errs
+}
+
+func (b *fakeBroker) CreateQueue(queueName string, maxPriority uint8) error { return nil }
+func (b *fakeBroker) DeleteQueue(queueName string) error                    { return nil }
+func (b *fakeBroker) QueueDepth(queueName string) (int, error)              { return 0, nil }
+func (b *fakeBroker) Ping() error                                           { return nil }
+
+func newTestAPI(t *testing.T) (*httptest.Server, *fakeBroker) {
+	logger.SetLevel(logger.LevelFatal)
+	st := mock.NewStore("", "")
+	broker := &fakeBroker{}
+
+	s := api.NewServer(0, broker, st)
+	a := auth.NewAuthenticator(st, auth.JWTOptions{})
+	a.AddStaticToken(testToken, &auth.Principal{Scopes: []string{auth.ScopeAdmin}, Method: auth.MethodAPIKey})
+	s.SetAuthenticator(a)
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts, broker
+}
+
+func newTestClient(ts *httptest.Server) *Client {
+	return New(ts.URL, Options{AccountID: testAccount, APIKey: testToken, RetryBackoff: time.Millisecond})
+}
+
+func TestQueues(t *testing.T) {
+	ts, _ := newTestAPI(t)
+	c := newTestClient(ts)
+	ctx := context.Background()
+
+	q, err := c.CreateQueue(ctx, "sales", 5)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, q.QueueID)
+
+	queues, err := c.ListQueues(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []Queue{*q}, queues)
+
+	got, err := c.GetQueue(ctx, q.QueueID)
+	assert.NoError(t, err)
+	assert.Equal(t, q, got)
+
+	_, err = c.GetQueue(ctx, "QID_unknown")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestTasks(t *testing.T) {
+	ts, broker := newTestAPI(t)
+	c := newTestClient(ts)
+	ctx := context.Background()
+
+	q, err := c.CreateQueue(ctx, "sales", 5)
+	assert.NoError(t, err)
+
+	// the first publish fails with 503, the retry reuses the idempotency key
+	broker.failPublish = 1
+	first, err := c.SubmitTask(ctx, SubmitTaskRequest{QueueID: q.QueueID, Priority: 3, CallData: map[string]string{"call_uuid": "c1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, broker.published)
+	assert.Equal(t, 1, first.Position)
+	assert.Equal(t, TaskStatusWaiting, first.Status)
+
+	second, err := c.SubmitTask(ctx, SubmitTaskRequest{QueueID: q.QueueID, Priority: 3, CallData: map[string]string{"call_uuid": "c2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, second.Position)
+
+	got, err := c.GetTask(ctx, second.TaskID)
+	assert.NoError(t, err)
+	assert.Equal(t, second, got)
+
+	cancelled, err := c.CancelTask(ctx, first.TaskID)
+	assert.NoError(t, err)
+	assert.Equal(t, TaskStatusCancelled, cancelled.Status)
+
+	_, err = c.CancelTask(ctx, first.TaskID)
+	apiErr, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	assert.NotEmpty(t, apiErr.RequestID)
+
+	got, err = c.GetTask(ctx, second.TaskID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, got.Position)
+}
+
+func TestQueueStates(t *testing.T) {
+	ts, _ := newTestAPI(t)
+	c := newTestClient(ts)
+	ctx := context.Background()
+
+	q, err := c.CreateQueue(ctx, "support", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "open", q.State)
+	submit := func() error {
+		_, err := c.SubmitTask(ctx, SubmitTaskRequest{QueueID: q.QueueID, Priority: 1, CallData: map[string]string{"call_uuid": "c1"}})
+		return err
+	}
+
+	// a paused queue keeps accepting tasks
+	paused, err := c.PauseQueue(ctx, q.QueueID)
+	assert.NoError(t, err)
+	assert.Equal(t, "paused", paused.State)
+	assert.NoError(t, submit())
+
+	draining, err := c.DrainQueue(ctx, q.QueueID, "moved to the sales queue")
+	assert.NoError(t, err)
+	assert.Equal(t, "draining", draining.State)
+	err = submit()
+	assert.True(t, IsQueueClosed(err))
+	assert.Equal(t, "moved to the sales queue", err.(*Error).Message)
+
+	_, err = c.PauseQueue(ctx, q.QueueID)
+	assert.Equal(t, http.StatusConflict, err.(*Error).StatusCode)
+
+	resumed, err := c.ResumeQueue(ctx, q.QueueID)
+	assert.NoError(t, err)
+	assert.Equal(t, "open", resumed.State)
+	assert.Empty(t, resumed.StateReason)
+	assert.NoError(t, submit())
+}
+
+func TestWatchPosition(t *testing.T) {
+	ts, _ := newTestAPI(t)
+	c := newTestClient(ts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q, err := c.CreateQueue(ctx, "support", 5)
+	assert.NoError(t, err)
+	first, err := c.SubmitTask(ctx, SubmitTaskRequest{QueueID: q.QueueID, Priority: 1, CallData: map[string]string{"call_uuid": "c1"}})
+	assert.NoError(t, err)
+	second, err := c.SubmitTask(ctx, SubmitTaskRequest{QueueID: q.QueueID, Priority: 1, CallData: map[string]string{"call_uuid": "c2"}})
+	assert.NoError(t, err)
+
+	updates := c.WatchPosition(ctx, second.TaskID, 5*time.Millisecond)
+	assert.Equal(t, 2, (<-updates).Position)
+
+	_, err = c.CancelTask(ctx, first.TaskID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, (<-updates).Position)
+
+	_, err = c.CancelTask(ctx, second.TaskID)
+	assert.NoError(t, err)
+	last := <-updates
+	assert.Equal(t, TaskStatusCancelled, last.Status)
+	_, open := <-updates
+	assert.False(t, open)
+}
+
+func TestAuthErrorNotRetried(t *testing.T) {
+	ts, _ := newTestAPI(t)
+	calls := 0
+	c := New(ts.URL, Options{AccountID: testAccount, HTTPClient: &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}})
+
+	_, err := c.ListQueues(context.Background())
+	apiErr, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.Equal(t, 1, calls)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestSubmitTaskBatch(t *testing.T) {
+	ts, broker := newTestAPI(t)
+	c := newTestClient(ts)
+	ctx := context.Background()
+
+	q, err := c.CreateQueue(ctx, "campaign", 5)
+	assert.NoError(t, err)
+
+	result, err := c.SubmitTaskBatch(ctx, []SubmitTaskRequest{
+		{QueueID: q.QueueID, Priority: 1, CallData: map[string]string{"call_uuid": "c1"}},
+		{QueueID: q.QueueID, Priority: 9, CallData: map[string]string{"call_uuid": "c2"}},
+		{QueueID: "QID_unknown", Priority: 1, CallData: map[string]string{"call_uuid": "c3"}},
+		{QueueID: q.QueueID, Priority: 5, CallData: map[string]string{"call_uuid": "c4"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Accepted)
+	assert.Equal(t, 2, result.Rejected)
+	assert.Equal(t, 2, broker.published)
+
+	assert.Equal(t, http.StatusOK, result.Results[0].Status)
+	assert.Equal(t, 2, result.Results[0].Task.Position)
+	assert.Equal(t, "validation_failed", result.Results[1].Error.Code)
+	assert.Equal(t, "queue_not_found", result.Results[2].Error.Code)
+	assert.True(t, IsNotFound(result.Results[2].Error))
+	// higher priority goes first
+	assert.Equal(t, 1, result.Results[3].Task.Position)
+
+	tasks, err := c.ListTasks(ctx, q.QueueID)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 2)
+	assert.Equal(t, result.Results[3].Task.TaskID, tasks[0].TaskID)
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+//DeadLetter - message a consumer gave up on, Task is set when it was a
+//task that ReplayDeadLetters can queue again
+type DeadLetter struct {
+	ID      string    `json:"id"`
+	QueueID string    `json:"queue_id"`
+	Reason  string    `json:"reason"`
+	Task    *Task     `json:"task,omitempty"`
+	Body    string    `json:"body,omitempty"`
+	DeadAt  time.Time `json:"dead_at"`
+}
+
+// ListDeadLetters - dead letters of the queue, oldest first
+func (c *Client) ListDeadLetters(ctx context.Context, queueID string) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := c.do(ctx, request{method: http.MethodGet, path: c.accountPath("queue", queueID, "dlq"), retry: true}, &letters)
+	return letters, err
+}
+
+// ReplayDeadLetters - queue the tasks of the dead letters again, every one
+// holding a task when no id is given. Not retried, dead letters replayed
+// before an answer was lost are gone and a retry would fail on their ids
+func (c *Client) ReplayDeadLetters(ctx context.Context, queueID string, ids ...string) ([]Task, error) {
+	var resp struct {
+		Replayed []Task `json:"replayed"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   c.accountPath("queue", queueID, "dlq", "replay"),
+		body: struct {
+			IDs []string `json:"ids"`
+		}{ids},
+	}, &resp)
+	return resp.Replayed, err
+}
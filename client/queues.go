@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+//Queue - priority queue of the account
+type Queue struct {
+	QueueID     string `json:"queue_id"`
+	QueueName   string `json:"queue_name"`
+	MaxPriority uint8  `json:"max_priority"`
+	// State - open, paused, draining or closed
+	State       string `json:"state,omitempty"`
+	StateReason string `json:"state_reason,omitempty"`
+}
+
+//DrainRequest - Reason is returned to the tasks submitted to the drained
+//queue, the server default when empty
+type DrainRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// CreateQueue - create the queue, creating it again returns the same queue
+func (c *Client) CreateQueue(ctx context.Context, name string, maxPriority uint8) (*Queue, error) {
+	queue := &Queue{}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   c.accountPath("queue"),
+		body:   Queue{QueueName: name, MaxPriority: maxPriority},
+		// the queue id derives from name and priority, a retry cannot
+		// create a second queue
+		retry: true,
+	}, queue)
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// ListQueues - all queues of the account
+func (c *Client) ListQueues(ctx context.Context) ([]Queue, error) {
+	var queues []Queue
+	err := c.do(ctx, request{method: http.MethodGet, path: c.accountPath("queue"), retry: true}, &queues)
+	return queues, err
+}
+
+// GetQueue - queue by id, IsNotFound reports unknown queues
+func (c *Client) GetQueue(ctx context.Context, queueID string) (*Queue, error) {
+	queue := &Queue{}
+	err := c.do(ctx, request{method: http.MethodGet, path: c.accountPath("queue", queueID), retry: true}, queue)
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// DeleteQueue - delete the queue together with the tasks still waiting in it
+func (c *Client) DeleteQueue(ctx context.Context, queueID string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: c.accountPath("queue", queueID), retry: true}, nil)
+}
+
+// PauseQueue - keep accepting tasks but stop dispatching them
+func (c *Client) PauseQueue(ctx context.Context, queueID string) (*Queue, error) {
+	return c.changeQueueState(ctx, queueID, "pause", nil)
+}
+
+// ResumeQueue - accept and dispatch tasks again
+func (c *Client) ResumeQueue(ctx context.Context, queueID string) (*Queue, error) {
+	return c.changeQueueState(ctx, queueID, "resume", nil)
+}
+
+// DrainQueue - reject new tasks and dispatch the waiting ones, the queue is
+// closed once none is left
+func (c *Client) DrainQueue(ctx context.Context, queueID, reason string) (*Queue, error) {
+	return c.changeQueueState(ctx, queueID, "drain", DrainRequest{Reason: reason})
+}
+
+// changeQueueState - the state changes are idempotent and safe to retry
+func (c *Client) changeQueueState(ctx context.Context, queueID, action string, body interface{}) (*Queue, error) {
+	queue := &Queue{}
+	err := c.do(ctx, request{method: http.MethodPost, path: c.accountPath("queue", queueID, action), body: body, retry: true}, queue)
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
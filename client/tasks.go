@@ -0,0 +1,209 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Task states reported by the API
+const (
+	TaskStatusWaiting     = "waiting"
+	TaskStatusDispatched  = "dispatched"
+	TaskStatusCancelled   = "cancelled"
+	TaskStatusTransferred = "transferred"
+	TaskStatusFailed      = "failed"
+)
+
+//Task - call waiting in a queue, Position is 1 based and 0 once the task
+//left the queue
+type Task struct {
+	TaskID     string            `json:"task_id"`
+	ExternalID string            `json:"external_id,omitempty"`
+	AccountID  string            `json:"account_id"`
+	Priority   uint8             `json:"priority"`
+	QueueID    string            `json:"queue_id"`
+	CallData   map[string]string `json:"call_data"`
+	Status     string            `json:"status"`
+	Position   int               `json:"position"`
+}
+
+//SubmitTaskRequest - task to queue, IdempotencyKey is generated when empty
+//so retries never queue the call twice
+type SubmitTaskRequest struct {
+	QueueID        string
+	Priority       uint8
+	ExternalID     string
+	CallData       map[string]string
+	IdempotencyKey string
+}
+
+// SubmitTask - queue a task and return it with its position
+func (c *Client) SubmitTask(ctx context.Context, req SubmitTaskRequest) (*Task, error) {
+	key := req.IdempotencyKey
+	if key == "" {
+		var err error
+		if key, err = newIdempotencyKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	task := &Task{}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   c.accountPath("queue", req.QueueID, "task"),
+		body: Task{
+			QueueID:    req.QueueID,
+			Priority:   req.Priority,
+			ExternalID: req.ExternalID,
+			CallData:   req.CallData,
+		},
+		header: http.Header{headerIdempotencyKey: []string{key}},
+		retry:  true,
+	}, task)
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+//BatchItemResult - outcome of the batch item at Index, Task is set when
+//it was queued and Error when it was not
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Task   *Task  `json:"task,omitempty"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+//BatchResult - per item results of SubmitTaskBatch
+type BatchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// SubmitTaskBatch - queue several tasks in one request. Items are accepted
+// or rejected on their own, the request is not retried since a batch has
+// no idempotency key
+func (c *Client) SubmitTaskBatch(ctx context.Context, reqs []SubmitTaskRequest) (*BatchResult, error) {
+	tasks := make([]Task, len(reqs))
+	for i, r := range reqs {
+		tasks[i] = Task{QueueID: r.QueueID, Priority: r.Priority, ExternalID: r.ExternalID, CallData: r.CallData}
+	}
+
+	result := &BatchResult{}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   c.accountPath("task", "batch"),
+		body: struct {
+			Tasks []Task `json:"tasks"`
+		}{tasks},
+	}, result)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Results {
+		if e := result.Results[i].Error; e != nil {
+			e.StatusCode = result.Results[i].Status
+		}
+	}
+	return result, nil
+}
+
+// GetTask - task with its current position
+func (c *Client) GetTask(ctx context.Context, taskID string) (*Task, error) {
+	task := &Task{}
+	err := c.do(ctx, request{method: http.MethodGet, path: c.accountPath("task", taskID), retry: true}, task)
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// ListTasks - waiting tasks of the queue in position order
+func (c *Client) ListTasks(ctx context.Context, queueID string) ([]Task, error) {
+	var tasks []Task
+	err := c.do(ctx, request{method: http.MethodGet, path: c.accountPath("queue", queueID, "task"), retry: true}, &tasks)
+	return tasks, err
+}
+
+// CancelTask - cancel a waiting task, the API answers 409 once the task
+// left the queue
+func (c *Client) CancelTask(ctx context.Context, taskID string) (*Task, error) {
+	task := &Task{}
+	err := c.do(ctx, request{method: http.MethodDelete, path: c.accountPath("task", taskID), retry: true}, task)
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+//PositionUpdate - new position or status of a watched task, Err is set on
+//the last update when watching stopped on an error
+type PositionUpdate struct {
+	TaskID   string
+	Status   string
+	Position int
+	Err      error
+}
+
+// WatchPosition - poll the task every interval and send an update whenever
+// its position or status changes. The channel is closed once the task left
+// the waiting state, on error, or when ctx is done
+func (c *Client) WatchPosition(ctx context.Context, taskID string, interval time.Duration) <-chan PositionUpdate {
+	updates := make(chan PositionUpdate, 1)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := PositionUpdate{Position: -1}
+		for {
+			task, err := c.GetTask(ctx, taskID)
+			if err != nil {
+				if ctx.Err() == nil {
+					send(ctx, updates, PositionUpdate{TaskID: taskID, Err: err})
+				}
+				return
+			}
+
+			u := PositionUpdate{TaskID: taskID, Status: task.Status, Position: task.Position}
+			if u != last {
+				if !send(ctx, updates, u) {
+					return
+				}
+				last = u
+			}
+			if task.Status != TaskStatusWaiting {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return updates
+}
+
+func send(ctx context.Context, ch chan<- PositionUpdate, u PositionUpdate) bool {
+	select {
+	case ch <- u:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"queuev2/client"
+)
+
+var (
+	queueColumns = []string{"QUEUE ID", "NAME", "MAX PRIORITY", "STATE"}
+	taskColumns  = []string{"TASK ID", "QUEUE ID", "PRIORITY", "STATUS", "POSITION", "EXTERNAL ID"}
+	agentColumns = []string{"AGENT ID", "STATE", "REQUESTED STATE", "LAST SEEN"}
+	dlqColumns   = []string{"ID", "TASK ID", "DEAD AT", "REASON"}
+)
+
+func queueCreate(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("queue create", flag.ContinueOnError)
+	name := fs.String("name", "", "queue name")
+	maxPriority := fs.Uint("max-priority", 0, "highest task priority, 1-255")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *name == "" || *maxPriority == 0 || *maxPriority > 255 {
+		return fmt.Errorf("%w: -name and a -max-priority of 1-255 are required", errUsage)
+	}
+
+	q, err := a.client.CreateQueue(ctx, *name, uint8(*maxPriority))
+	if err != nil {
+		return err
+	}
+	return a.printQueues(q, *q)
+}
+
+func queueList(ctx context.Context, a *app, args []string) error {
+	if _, err := parseFlags(flag.NewFlagSet("queue list", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	queues, err := a.client.ListQueues(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].QueueName < queues[j].QueueName })
+	return a.printQueues(queues, queues...)
+}
+
+func queueGet(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("queue get", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	q, err := a.client.GetQueue(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	return a.printQueues(q, *q)
+}
+
+func queueDelete(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("queue delete", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	if err = a.client.DeleteQueue(ctx, pos[0]); err != nil {
+		return err
+	}
+	return a.printMessage(map[string]string{"queue_id": pos[0], "result": "deleted"}, "queue "+pos[0]+" deleted")
+}
+
+func queuePause(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("queue pause", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	q, err := a.client.PauseQueue(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	return a.printQueues(q, *q)
+}
+
+func queueResume(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("queue resume", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	q, err := a.client.ResumeQueue(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	return a.printQueues(q, *q)
+}
+
+func queueDrain(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("queue drain", flag.ContinueOnError)
+	reason := fs.String("reason", "", "message returned to tasks submitted to the queue")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	q, err := a.client.DrainQueue(ctx, pos[0], *reason)
+	if err != nil {
+		return err
+	}
+	return a.printQueues(q, *q)
+}
+
+func taskSubmit(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("task submit", flag.ContinueOnError)
+	queueID := fs.String("queue", "", "queue id")
+	priority := fs.Uint("priority", 0, "task priority, at most the queue max priority")
+	externalID := fs.String("external-id", "", "client supplied task id")
+	idemKey := fs.String("idempotency-key", "", "Idempotency-Key of the request, generated when empty")
+	data := keyValues{}
+	fs.Var(data, "data", "call data as key=value, repeatable")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *queueID == "" || *priority == 0 || *priority > 255 {
+		return fmt.Errorf("%w: -queue and a -priority of 1-255 are required", errUsage)
+	}
+
+	task, err := a.client.SubmitTask(ctx, client.SubmitTaskRequest{
+		QueueID:        *queueID,
+		Priority:       uint8(*priority),
+		ExternalID:     *externalID,
+		CallData:       data,
+		IdempotencyKey: *idemKey,
+	})
+	if err != nil {
+		return err
+	}
+	return a.printTasks(task, *task)
+}
+
+func taskGet(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("task get", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	task, err := a.client.GetTask(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	return a.printTasks(task, *task)
+}
+
+func taskCancel(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("task cancel", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	task, err := a.client.CancelTask(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	return a.printTasks(task, *task)
+}
+
+func taskList(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("task list", flag.ContinueOnError)
+	queueID := fs.String("queue", "", "queue id")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *queueID == "" {
+		return fmt.Errorf("%w: -queue is required", errUsage)
+	}
+
+	tasks, err := a.client.ListTasks(ctx, *queueID)
+	if err != nil {
+		return err
+	}
+	return a.printTasks(tasks, tasks...)
+}
+
+func agentList(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("agent list", flag.ContinueOnError)
+	queueID := fs.String("queue", "", "queue id")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *queueID == "" {
+		return fmt.Errorf("%w: -queue is required", errUsage)
+	}
+
+	agents, err := a.client.ListAgents(ctx, *queueID)
+	if err != nil {
+		return err
+	}
+	return a.printAgents(agents, agents...)
+}
+
+func agentSetState(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("agent set-state", flag.ContinueOnError)
+	queueID := fs.String("queue", "", "queue id")
+	pos, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	if *queueID == "" {
+		return fmt.Errorf("%w: -queue is required", errUsage)
+	}
+	if state := pos[1]; state != client.AgentAvailable && state != client.AgentUnavailable {
+		return fmt.Errorf("%w: state must be %s or %s", errUsage, client.AgentAvailable, client.AgentUnavailable)
+	}
+
+	agent, err := a.client.SetAgentState(ctx, *queueID, pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	return a.printAgents(agent, *agent)
+}
+
+func dlqList(ctx context.Context, a *app, args []string) error {
+	pos, err := parseFlags(flag.NewFlagSet("dlq list", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	letters, err := a.client.ListDeadLetters(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(letters))
+	for _, dl := range letters {
+		taskID := ""
+		if dl.Task != nil {
+			taskID = dl.Task.TaskID
+		}
+		rows = append(rows, []string{dl.ID, taskID, dl.DeadAt.Format(time.RFC3339), dl.Reason})
+	}
+	return a.print(letters, dlqColumns, rows)
+}
+
+// dlqReplay - every dead letter holding a task when no id is given
+func dlqReplay(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("%w: dlq replay expects a queue id", errUsage)
+	}
+
+	tasks, err := a.client.ReplayDeadLetters(ctx, fs.Arg(0), fs.Args()[1:]...)
+	if err != nil {
+		return err
+	}
+	return a.printTasks(tasks, tasks...)
+}
+
+func (a *app) printQueues(v interface{}, queues ...client.Queue) error {
+	rows := make([][]string, 0, len(queues))
+	for _, q := range queues {
+		rows = append(rows, []string{q.QueueID, q.QueueName, fmt.Sprint(q.MaxPriority), q.State})
+	}
+	return a.print(v, queueColumns, rows)
+}
+
+func (a *app) printTasks(v interface{}, tasks ...client.Task) error {
+	rows := make([][]string, 0, len(tasks))
+	for _, t := range tasks {
+		rows = append(rows, []string{t.TaskID, t.QueueID, fmt.Sprint(t.Priority), t.Status, fmt.Sprint(t.Position), t.ExternalID})
+	}
+	return a.print(v, taskColumns, rows)
+}
+
+func (a *app) printAgents(v interface{}, agents ...client.Agent) error {
+	rows := make([][]string, 0, len(agents))
+	for _, ag := range agents {
+		rows = append(rows, []string{ag.AgentID, ag.State, ag.RequestedState, ag.LastSeen.Format(time.RFC3339)})
+	}
+	return a.print(v, agentColumns, rows)
+}
+
+func (a *app) printMessage(v interface{}, msg string) error {
+	if a.format == "json" {
+		return a.print(v, nil, nil)
+	}
+	_, err := fmt.Fprintln(a.out, msg)
+	return err
+}
+
+// print - v as indented JSON, or rows under columns as a table
+func (a *app) print(v interface{}, columns []string, rows [][]string) error {
+	if a.format == "json" {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+//keyValues - repeatable key=value flag
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValues) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("%q is not key=value", s)
+	}
+	kv[s[:i]] = s[i+1:]
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"queuev2/client"
+)
+
+const (
+	envPrefix      = "QUEUECTL"
+	configName     = "queuectl"
+	defaultTimeout = 30 * time.Second
+
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `usage: queuectl [flags] <command> <action> [args]
+
+commands:
+  queue create -name <name> -max-priority <n>
+  queue list
+  queue get <queueID>
+  queue delete <queueID>
+  queue pause <queueID>
+  queue resume <queueID>
+  queue drain [-reason <message>] <queueID>
+  task submit -queue <queueID> -priority <n> [-external-id <id>] [-data key=value ...] [-idempotency-key <key>]
+  task get <taskID>
+  task cancel <taskID>
+  task list -queue <queueID>
+  agent list -queue <queueID>
+  agent set-state -queue <queueID> <agentID> available|unavailable
+  dlq list <queueID>
+  dlq replay <queueID> [id ...]
+
+flags:
+`
+
+// errUsage - wrong arguments, main prints the usage and exits with 2
+var errUsage = errors.New("invalid arguments")
+
+//command - one action of a command group
+type command func(ctx context.Context, app *app, args []string) error
+
+var commands = map[string]map[string]command{
+	"queue": {
+		"create": queueCreate,
+		"list":   queueList,
+		"get":    queueGet,
+		"delete": queueDelete,
+		"pause":  queuePause,
+		"resume": queueResume,
+		"drain":  queueDrain,
+	},
+	"task": {
+		"submit": taskSubmit,
+		"get":    taskGet,
+		"cancel": taskCancel,
+		"list":   taskList,
+	},
+	"agent": {
+		"list":      agentList,
+		"set-state": agentSetState,
+	},
+	"dlq": {
+		"list":   dlqList,
+		"replay": dlqReplay,
+	},
+}
+
+//app - resolved configuration shared by the commands
+type app struct {
+	client *client.Client
+	out    io.Writer
+	format string
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("queuectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "", "config file, default $HOME/.config/queuectl/queuectl.yaml or ./queuectl.yaml")
+	endpoint := fs.String("endpoint", "", "queue API base url, e.g. http://localhost:9898")
+	account := fs.String("account", "", "account id")
+	output := fs.String("o", "", "output format: table or json")
+	timeout := fs.Duration("timeout", defaultTimeout, "timeout of the whole command")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, "queuectl:", err)
+		return exitError
+	}
+	override := func(key, value string) {
+		if value != "" {
+			conf.Set(key, value)
+		}
+	}
+	override("endpoint", *endpoint)
+	override("account", *account)
+	override("output", *output)
+
+	rest := fs.Args()
+	if len(rest) < 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	cmd, ok := commands[rest[0]][rest[1]]
+	if !ok {
+		fmt.Fprintf(stderr, "queuectl: unknown command %q\n", strings.Join(rest[:2], " "))
+		fs.Usage()
+		return exitUsage
+	}
+
+	format := conf.GetString("output")
+	if format != "table" && format != "json" {
+		fmt.Fprintf(stderr, "queuectl: unknown output format %q\n", format)
+		return exitUsage
+	}
+	if conf.GetString("account") == "" {
+		fmt.Fprintln(stderr, "queuectl: account is not set, use -account or the account key of the config file")
+		return exitUsage
+	}
+
+	a := &app{
+		client: client.New(conf.GetString("endpoint"), client.Options{
+			AccountID:   conf.GetString("account"),
+			APIKey:      conf.GetString("apiKey"),
+			BearerToken: conf.GetString("token"),
+		}),
+		out:    stdout,
+		format: format,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = cmd(ctx, a, rest[2:]); err != nil {
+		fmt.Fprintln(stderr, "queuectl:", err)
+		if errors.Is(err, errUsage) {
+			return exitUsage
+		}
+		return exitError
+	}
+	return 0
+}
+
+// loadConfig - endpoint and credentials from the config file, overridden by
+// QUEUECTL_ENDPOINT, QUEUECTL_ACCOUNT, QUEUECTL_APIKEY and QUEUECTL_TOKEN
+func loadConfig(file string) (*viper.Viper, error) {
+	conf := viper.New()
+	conf.SetDefault("endpoint", "http://localhost:9898")
+	conf.SetDefault("output", "table")
+	conf.SetEnvPrefix(envPrefix)
+	conf.AutomaticEnv()
+
+	if file != "" {
+		conf.SetConfigFile(file)
+		return conf, conf.ReadInConfig()
+	}
+
+	conf.SetConfigName(configName)
+	if home, err := os.UserHomeDir(); err == nil {
+		conf.AddConfigPath(filepath.Join(home, ".config", configName))
+	}
+	conf.AddConfigPath(".")
+	if err := conf.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+// parseFlags - parse action flags, positional arguments must match want
+func parseFlags(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() != want {
+		return nil, fmt.Errorf("%w: %s expects %d argument(s)", errUsage, fs.Name(), want)
+	}
+	return fs.Args(), nil
+}
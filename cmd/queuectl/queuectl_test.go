@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/api"
+	"queuev2/auth"
+	"queuev2/logger"
+	"queuev2/mq/producer"
+	"queuev2/queuestats"
+	"queuev2/store/mock"
+)
+
+const (
+	testToken   = "test-admin-token"
+	testQueueID = "QID_MTIzX3NhbGVzNQ=="
+)
+
+// testBroker - Broker accepting every queue and message
+type testBroker struct{}
+
+func (testBroker) PublishMessage(routingKey string, body []byte, priority uint8, headers amqp.Table) error {
+	return nil
+}
+
+func (testBroker) PublishBatch(msgs []producer.Message) []error {
+	return make([]error, len(msgs))
+}
+
+func (testBroker) CreateQueue(queueName string, maxPriority uint8) error { return nil }
+func (testBroker) DeleteQueue(queueName string) error                    { return nil }
+func (testBroker) QueueDepth(queueName string) (int, error)              { return 0, nil }
+func (testBroker) Ping() error                                           { return nil }
+
+// fixedIDs - task ids generated from a fixed id
+type fixedIDs struct{ id string }
+
+func (f fixedIDs) NewID(accountID string) (string, error) { return f.id, nil }
+
+// newTestAPI - API of account 123 holding the queue sales with the task t1,
+// the agent a1 and a dead letter of t1
+func newTestAPI(t *testing.T) *httptest.Server {
+	logger.SetLevel(logger.LevelFatal)
+	st := mock.NewStore("", "")
+	s := api.NewServer(0, testBroker{}, st)
+	a := auth.NewAuthenticator(st, auth.JWTOptions{})
+	a.AddStaticToken(testToken, &auth.Principal{Scopes: []string{auth.ScopeAdmin}, Method: auth.MethodAPIKey})
+	s.SetAuthenticator(a)
+	s.SetTaskIDGenerator(fixedIDs{"t1"})
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	// no config file of the user, the key comes from the environment
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("QUEUECTL_APIKEY", testToken)
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{
+		{"queue", "create", "-name", "sales", "-max-priority", "5"},
+		{"task", "submit", "-queue", testQueueID, "-priority", "2", "-data", "call_uuid=c1"},
+	} {
+		code := run(append([]string{"-endpoint", ts.URL, "-account", "123"}, args...), &stdout, &stderr)
+		if !assert.Equal(t, 0, code, stderr.String()) {
+			t.FailNow()
+		}
+	}
+	assert.NoError(t, queuestats.NewAgents(st).Heartbeat(testQueueID, "a1", queuestats.AgentAvailable))
+	task := &api.Task{TaskID: "t1", AccountID: "123", QueueID: testQueueID, Priority: 2, CallData: map[string]string{"call_uuid": "c1"}, Status: api.TaskStatusFailed}
+	assert.NoError(t, api.NewDeadLetterStore(st).Add(&api.DeadLetter{ID: "t1", QueueID: testQueueID, Reason: "transfer failed", Task: task, DeadAt: time.Now()}))
+	return ts
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		code      int
+		stdout    []string
+		stderr    string
+		noAuth    bool
+		noAccount bool
+	}{
+		{name: "no command", args: nil, code: exitUsage, stderr: "usage: queuectl"},
+		{name: "unknown command", args: []string{"agent", "logout"}, code: exitUsage, stderr: `unknown command "agent logout"`},
+		{name: "unknown format", args: []string{"-o", "yaml", "queue", "list"}, code: exitUsage, stderr: `unknown output format "yaml"`},
+		{name: "unknown flag", args: []string{"-verbose", "queue", "list"}, code: exitUsage},
+		{name: "queue list", args: []string{"queue", "list"}, stdout: []string{"QUEUE ID", testQueueID, "sales"}},
+		{name: "queue get json", args: []string{"-o", "json", "queue", "get", testQueueID}, stdout: []string{`"queue_name": "sales"`, `"max_priority": 5`}},
+		{name: "queue get missing id", args: []string{"queue", "get"}, code: exitUsage, stderr: "expects 1 argument(s)"},
+		{name: "queue get unknown", args: []string{"queue", "get", "QID_unknown"}, code: exitError, stderr: "404"},
+		{name: "queue create", args: []string{"queue", "create", "-name", "support", "-max-priority", "3"}, stdout: []string{"support", "3"}},
+		{name: "queue create priority", args: []string{"queue", "create", "-name", "support", "-max-priority", "256"}, code: exitUsage, stderr: "-max-priority of 1-255"},
+		{name: "queue pause", args: []string{"queue", "pause", testQueueID}, stdout: []string{"paused"}},
+		{name: "queue delete unknown", args: []string{"queue", "delete", "QID_unknown"}, code: exitError, stderr: "404"},
+		{name: "task get", args: []string{"task", "get", "t1"}, stdout: []string{"TASK ID", "t1", testQueueID, "waiting"}},
+		{name: "task list", args: []string{"task", "list", "-queue", testQueueID}, stdout: []string{"t1"}},
+		{name: "task list missing queue", args: []string{"task", "list"}, code: exitUsage, stderr: "-queue is required"},
+		{name: "task submit bad data", args: []string{"task", "submit", "-queue", testQueueID, "-priority", "1", "-data", "call_uuid"}, code: exitUsage, stderr: "is not key=value"},
+		{name: "task cancel", args: []string{"-o", "json", "task", "cancel", "t1"}, stdout: []string{`"status": "cancelled"`}},
+		{name: "agent list", args: []string{"agent", "list", "-queue", testQueueID}, stdout: []string{"AGENT ID", "a1", "available"}},
+		{name: "agent set-state", args: []string{"-o", "json", "agent", "set-state", "-queue", testQueueID, "a1", "unavailable"}, stdout: []string{`"requested_state": "unavailable"`}},
+		{name: "agent set-state bad state", args: []string{"agent", "set-state", "-queue", testQueueID, "a1", "busy"}, code: exitUsage, stderr: "state must be"},
+		{name: "agent set-state unknown", args: []string{"agent", "set-state", "-queue", testQueueID, "a2", "available"}, code: exitError, stderr: "404"},
+		{name: "dlq list", args: []string{"dlq", "list", testQueueID}, stdout: []string{"ID", "t1", "transfer failed"}},
+		{name: "dlq replay", args: []string{"dlq", "replay", testQueueID, "t1"}, stdout: []string{"t1", "waiting", "1"}},
+		{name: "dlq replay missing queue", args: []string{"dlq", "replay"}, code: exitUsage, stderr: "expects a queue id"},
+		{name: "unauthenticated", args: []string{"queue", "list"}, noAuth: true, code: exitError, stderr: "401"},
+		{name: "no account", args: []string{"queue", "list"}, noAccount: true, code: exitUsage, stderr: "account is not set"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestAPI(t)
+			if tc.noAuth {
+				t.Setenv("QUEUECTL_APIKEY", "")
+			}
+			args := []string{"-endpoint", ts.URL}
+			if !tc.noAccount {
+				args = append(args, "-account", "123")
+			}
+
+			var stdout, stderr bytes.Buffer
+			code := run(append(args, tc.args...), &stdout, &stderr)
+			assert.Equal(t, tc.code, code, stderr.String())
+			for _, s := range tc.stdout {
+				assert.Contains(t, stdout.String(), s)
+			}
+			if tc.stderr != "" {
+				assert.Contains(t, stderr.String(), tc.stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"queuev2/logger"
+)
+
+const (
+	envPrefix      = "QUEUEV2"
+	defaultProfile = "development"
+)
+
+// Load - read <name>.yaml from the working directory or /etc/queuev2.
+// Environment variables override file values, e.g. QUEUEV2_PROFILE or
+// QUEUEV2_DEVELOPMENT_STORE_ADDRESS for development.store.address
+func Load(name string) *viper.Viper {
+	conf := viper.New()
+	conf.SetConfigName(name)
+	conf.AddConfigPath(".")
+	conf.AddConfigPath("/etc/queuev2")
+	conf.SetEnvPrefix(envPrefix)
+	conf.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	conf.AutomaticEnv()
+	conf.SetDefault("profile", defaultProfile)
+
+	if err := conf.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			logger.Fatal("reading config failed", "config", name, logger.FieldError, err)
+		}
+		logger.Warn("no config file found, using defaults", "config", name)
+	}
+
+	if level := conf.GetString(Key(conf, LogLevel)); level != "" {
+		l, err := logger.ParseLevel(level)
+		if err != nil {
+			logger.Warn("ignoring log level", logger.FieldError, err)
+		} else {
+			logger.SetLevel(l)
+		}
+	}
+	return conf
+}
+
+// Key - prefix key with the active profile, keys start with a dot like
+// ".store.address"
+func Key(conf *viper.Viper, key string) string {
+	return conf.GetString("profile") + key
+}
+
+// UnmarshalKey - decode the section of the active profile at key into out,
+// out keeps its values when the section is not set
+func UnmarshalKey(conf *viper.Viper, key string, out interface{}) error {
+	key = Key(conf, key)
+	if !conf.IsSet(key) {
+		return nil
+	}
+	return conf.UnmarshalKey(key, out)
+}
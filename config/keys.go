@@ -0,0 +1,34 @@
+package config
+
+const (
+	TelephonyHealthURL = ".telephony.healthURL"
+	HealthPort         = ".health.port"
+	TaskIDScheme       = ".api.taskIdScheme"
+	LogLevel           = ".log.level"
+	LogRedaction       = ".log.redaction"
+
+	AuthDisabled        = ".api.auth.disabled"
+	AuthAdminToken      = ".api.auth.adminToken"
+	AuthJWTHMACSecret   = ".api.auth.jwt.hmacSecret"
+	AuthJWTRSAPublicKey = ".api.auth.jwt.rsaPublicKeyFile"
+	AuthJWTIssuer       = ".api.auth.jwt.issuer"
+	AuthJWTAudience     = ".api.auth.jwt.audience"
+	AuthJWTMaxLifetime  = ".api.auth.jwt.maxLifetime"
+
+	DefaultLimits = ".api.limits"
+	BatchMaxTasks = ".api.batch.maxTasks"
+
+	IdempotencyWindow   = ".api.idempotency.window"
+	IdempotencyCallUUID = ".api.idempotency.dedupeCallUUID"
+
+	EWTMethod = ".api.ewt.method"
+
+	QueueClosedReason = ".api.queue.closedReason"
+
+	Webhooks      = ".webhooks"
+	EventLog      = ".events.log"
+	EventExchange = ".events.amqp"
+	QueueStats    = ".stats"
+	Metrics       = ".metrics"
+	Reports       = ".reports"
+)
@@ -0,0 +1,193 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"queuev2/config"
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+const (
+	accountStreamPrefix = "events:"
+	taskStreamPrefix    = "task_events:"
+
+	fieldType  = "type"
+	fieldTask  = "task_id"
+	fieldEvent = "event"
+
+	// cursorStart - cursor before the first entry of any stream
+	cursorStart = "0-0"
+)
+
+var (
+	// ErrUnsupported - the store has no stream operations
+	ErrUnsupported = errors.New("store does not support streams")
+	// ErrInvalidCursor - the cursor is not an entry id
+	ErrInvalidCursor = errors.New("cursor must be an event id such as 1526919030474-0")
+
+	cursorPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+)
+
+//Options - MaxLen bounds the stream of each account, task timelines expire
+//TaskRetention after their last event
+type Options struct {
+	MaxLen        int           `mapstructure:"maxLen"`
+	TaskRetention time.Duration `mapstructure:"taskRetention"`
+	QueueSize     int           `mapstructure:"queueSize"`
+}
+
+// DefaultOptions - about 100k events per account, timelines kept a week
+func DefaultOptions() Options {
+	return Options{
+		MaxLen:        100000,
+		TaskRetention: 7 * 24 * time.Hour,
+		QueueSize:     1000,
+	}
+}
+
+// LoadOptions - event log options of the active profile
+func LoadOptions(conf *viper.Viper) (Options, error) {
+	opts := DefaultOptions()
+	err := config.UnmarshalKey(conf, config.EventLog, &opts)
+	return opts, err
+}
+
+//Entry - event read back from the log, ID is its stream entry id and the
+//cursor to read the events after it
+type Entry struct {
+	ID string `json:"id"`
+	events.Event
+}
+
+//Log - events.Sink appending every event to the stream of its account and
+//to the timeline of its task. Appends are made in order by one goroutine
+//so they never slow down the caller
+type Log struct {
+	store   store.Store
+	streams store.Streams
+	opts    Options
+	queue   *events.Async
+}
+
+func NewLog(st store.Store, opts Options) (*Log, error) {
+	streams, ok := st.(store.Streams)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	l := &Log{
+		store:   st,
+		streams: streams,
+		opts:    opts,
+	}
+	l.queue = events.NewAsync("event log", opts.QueueSize, l.append)
+	return l, nil
+}
+
+func accountStreamKey(accountID string) string {
+	return accountStreamPrefix + "{" + accountID + "}"
+}
+
+// taskStreamKey - shares the hash tag of the account stream
+func taskStreamKey(accountID, taskID string) string {
+	return taskStreamPrefix + "{" + accountID + "}:" + taskID
+}
+
+// Handle - queue the event for appending, it is dropped when the queue is
+// full
+func (l *Log) Handle(ev events.Event) {
+	l.queue.Handle(ev)
+}
+
+func (l *Log) append(ev events.Event) {
+	if err := l.Append(ev); err != nil {
+		logger.Error("appending event failed", "event", ev.Type, logger.FieldAccountID, ev.AccountID,
+			logger.FieldTaskID, ev.TaskID, logger.FieldError, err)
+	}
+}
+
+// Append - write the event synchronously, events of unknown accounts can
+// not be stored
+func (l *Log) Append(ev events.Event) error {
+	if ev.AccountID == "" {
+		return errors.New("event has no account id")
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	fields := map[string]string{fieldType: ev.Type, fieldTask: ev.TaskID, fieldEvent: string(data)}
+
+	if _, err = l.streams.StreamAdd(accountStreamKey(ev.AccountID), l.opts.MaxLen, fields); err != nil {
+		return err
+	}
+	if ev.TaskID == "" {
+		return nil
+	}
+	key := taskStreamKey(ev.AccountID, ev.TaskID)
+	if _, err = l.streams.StreamAdd(key, 0, fields); err != nil {
+		return err
+	}
+	return l.store.SetExpireTime(key, int(l.opts.TaskRetention/time.Second))
+}
+
+// Timeline - every event of the task, oldest first
+func (l *Log) Timeline(accountID, taskID string) ([]Entry, error) {
+	raw, err := l.streams.StreamRange(taskStreamKey(accountID, taskID), "-", "+", 0)
+	if err != nil {
+		return nil, err
+	}
+	return decode(raw), nil
+}
+
+// Tail - up to limit events of the account after the cursor, waiting up to
+// wait for one when there are none. Without a cursor the newest events are
+// returned. next is the cursor of the following call
+func (l *Log) Tail(accountID, after string, limit int, wait time.Duration) (entries []Entry, next string, err error) {
+	key := accountStreamKey(accountID)
+	if after == "" {
+		raw, err := l.streams.StreamRevRange(key, "+", "-", limit)
+		if err != nil {
+			return nil, "", err
+		}
+		for i, j := 0, len(raw)-1; i < j; i, j = i+1, j-1 {
+			raw[i], raw[j] = raw[j], raw[i]
+		}
+		entries = decode(raw)
+		next = cursorStart
+	} else {
+		if !cursorPattern.MatchString(after) {
+			return nil, "", ErrInvalidCursor
+		}
+		raw, err := l.streams.StreamRead(key, after, limit, wait)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = decode(raw)
+		next = after
+	}
+	if len(entries) > 0 {
+		next = entries[len(entries)-1].ID
+	}
+	return entries, next, nil
+}
+
+// decode - entries not written by the log are skipped
+func decode(raw []store.StreamEntry) []Entry {
+	entries := make([]Entry, 0, len(raw))
+	for _, r := range raw {
+		e := Entry{ID: r.ID}
+		if err := json.Unmarshal([]byte(r.Fields[fieldEvent]), &e.Event); err != nil {
+			logger.Warn("skipping undecodable event", "event_id", r.ID, logger.FieldError, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
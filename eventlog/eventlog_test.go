@@ -0,0 +1,112 @@
+package eventlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/store/mock"
+)
+
+const testAccount = "123"
+
+func newTestLog(t *testing.T, maxLen int) *Log {
+	logger.SetLevel(logger.LevelFatal)
+	opts := DefaultOptions()
+	opts.MaxLen = maxLen
+	l, err := NewLog(mock.NewStore("", ""), opts)
+	assert.NoError(t, err)
+	return l
+}
+
+func taskEvent(eventType, taskID string) events.Event {
+	return events.Event{Type: eventType, AccountID: testAccount, QueueID: "QID_log", TaskID: taskID, Actor: "api_key:key1"}
+}
+
+func TestTimeline(t *testing.T) {
+	l := newTestLog(t, 0)
+	for _, ev := range []events.Event{
+		taskEvent(events.TaskSubmitted, "t1"),
+		taskEvent(events.TaskEnqueued, "t1"),
+		taskEvent(events.TaskSubmitted, "t2"),
+		taskEvent(events.TaskAbandoned, "t1"),
+	} {
+		assert.NoError(t, l.Append(ev))
+	}
+	assert.Error(t, l.Append(events.Event{Type: events.TaskDeadLettered}))
+
+	timeline, err := l.Timeline(testAccount, "t1")
+	assert.NoError(t, err)
+	var types []string
+	for _, e := range timeline {
+		types = append(types, e.Type)
+		assert.Equal(t, "api_key:key1", e.Actor)
+		assert.NotEmpty(t, e.ID)
+	}
+	assert.Equal(t, []string{events.TaskSubmitted, events.TaskEnqueued, events.TaskAbandoned}, types)
+
+	timeline, err = l.Timeline("456", "t1")
+	assert.NoError(t, err)
+	assert.Empty(t, timeline)
+}
+
+func TestTail(t *testing.T) {
+	l := newTestLog(t, 3)
+	entries, next, err := l.Tail(testAccount, "", 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, cursorStart, next)
+
+	for _, id := range []string{"t1", "t2", "t3", "t4"} {
+		assert.NoError(t, l.Append(taskEvent(events.TaskSubmitted, id)))
+	}
+
+	// t1 was trimmed, the newest two without a cursor
+	entries, next, err = l.Tail(testAccount, "", 2, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "t3", entries[0].TaskID)
+	assert.Equal(t, "t4", entries[1].TaskID)
+	assert.Equal(t, entries[1].ID, next)
+
+	entries, _, err = l.Tail(testAccount, cursorStart, 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "t2", entries[0].TaskID)
+
+	// nothing after the cursor, the cursor is kept
+	entries, same, err := l.Tail(testAccount, next, 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, next, same)
+
+	_, _, err = l.Tail(testAccount, "latest", 10, 0)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestTailWaits(t *testing.T) {
+	l := newTestLog(t, 0)
+	_, next, err := l.Tail(testAccount, "", 10, 0)
+	assert.NoError(t, err)
+
+	l.Handle(taskEvent(events.TaskSubmitted, "t1"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Handle(taskEvent(events.TaskEnqueued, "t1"))
+	}()
+
+	var got []string
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got) < 2 && time.Now().Before(deadline) {
+		entries, cursor, err := l.Tail(testAccount, next, 10, time.Second)
+		assert.NoError(t, err)
+		for _, e := range entries {
+			got = append(got, e.Type)
+		}
+		next = cursor
+	}
+	assert.Equal(t, []string{events.TaskSubmitted, events.TaskEnqueued}, got)
+}
@@ -0,0 +1,67 @@
+package events
+
+import "queuev2/logger"
+
+//Async - Sink handing the events over to a single goroutine through a
+//bounded queue, events are dropped when the queue is full rather than
+//slowing down the caller
+type Async struct {
+	name   string
+	batch  int
+	handle func([]Event)
+	events chan Event
+}
+
+// NewAsync - handle every event in order, size is the number of events
+// queued before dropping
+func NewAsync(name string, size int, handle func(Event)) *Async {
+	return NewAsyncBatch(name, size, 1, func(batch []Event) {
+		for _, ev := range batch {
+			handle(ev)
+		}
+	})
+}
+
+// NewAsyncBatch - handle the events in order, with up to batch of the
+// events already queued at once
+func NewAsyncBatch(name string, size, batch int, handle func([]Event)) *Async {
+	if size <= 0 {
+		size = 1
+	}
+	if batch <= 0 {
+		batch = 1
+	}
+	a := &Async{
+		name:   name,
+		batch:  batch,
+		handle: handle,
+		events: make(chan Event, size),
+	}
+	go a.run()
+	return a
+}
+
+// Handle - queue the event, it is dropped when the queue is full
+func (a *Async) Handle(ev Event) {
+	select {
+	case a.events <- ev:
+	default:
+		logger.Warn(a.name+" queue full, dropping event", "event", ev.Type, logger.FieldTaskID, ev.TaskID)
+	}
+}
+
+func (a *Async) run() {
+	for ev := range a.events {
+		batch := []Event{ev}
+	collect:
+		for len(batch) < a.batch {
+			select {
+			case ev := <-a.events:
+				batch = append(batch, ev)
+			default:
+				break collect
+			}
+		}
+		a.handle(batch)
+	}
+}
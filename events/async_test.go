@@ -0,0 +1,50 @@
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/logger"
+)
+
+func TestAsyncBatch(t *testing.T) {
+	logger.SetLevel(logger.LevelFatal)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var batches [][]string
+	a := NewAsyncBatch("test", 3, 2, func(batch []Event) {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		var ids []string
+		for _, ev := range batch {
+			ids = append(ids, ev.TaskID)
+		}
+		batches = append(batches, ids)
+	})
+
+	// t1 is taken by the handler, t2 to t4 fill the queue and t5 is dropped
+	a.Handle(Event{TaskID: "t1"})
+	assert.Eventually(t, func() bool { return len(a.events) == 0 }, time.Second, time.Millisecond)
+	for _, id := range []string{"t2", "t3", "t4", "t5"} {
+		a.Handle(Event{TaskID: id})
+	}
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"t1"}, {"t2", "t3"}, {"t4"}}, batches)
+}
+
+func TestAsync(t *testing.T) {
+	got := make(chan Event, 2)
+	a := NewAsync("test", 0, func(ev Event) { got <- ev })
+	a.Handle(Event{TaskID: "t1"})
+	assert.Equal(t, "t1", (<-got).TaskID)
+}
@@ -0,0 +1,109 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Task lifecycle event types
+const (
+	TaskSubmitted      = "task.submitted"
+	TaskEnqueued       = "task.enqueued"
+	TaskDispatched     = "task.dispatched"
+	TaskAgentReserved  = "task.agent_reserved"
+	TaskTransferred    = "task.transferred"
+	TaskTransferFailed = "task.transfer_failed"
+	TaskAbandoned      = "task.abandoned"
+	TaskDeadLettered   = "task.dead_lettered"
+)
+
+// QueuePositionsChanged - tasks joined or left the queue and the tasks
+// behind them moved. It has no task, Position is the first position whose
+// task moved; changes of one queue are coalesced into one event
+const QueuePositionsChanged = "queue.positions_changed"
+
+// Agent event types, emitted by a consumer when the state of the agent it
+// serves as changes. Agent is the consumer tag, they have no task
+const (
+	AgentAvailable   = "agent.available"
+	AgentBusy        = "agent.busy"
+	AgentUnavailable = "agent.unavailable"
+)
+
+// Types - every event type, in lifecycle order
+var Types = []string{
+	TaskSubmitted,
+	TaskEnqueued,
+	QueuePositionsChanged,
+	TaskDispatched,
+	TaskAgentReserved,
+	TaskTransferred,
+	TaskTransferFailed,
+	TaskAbandoned,
+	TaskDeadLettered,
+	AgentAvailable,
+	AgentBusy,
+	AgentUnavailable,
+}
+
+//Event - one transition of a task. Position is the 1 based position the
+//task holds, for events removing it from the queue the one it held before.
+//Actor is who caused it, "<auth method>:<subject>" for API calls and
+//"consumer:<tag>" for consumers
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	AccountID string    `json:"account_id"`
+	QueueID   string    `json:"queue_id"`
+	TaskID    string    `json:"task_id"`
+	Position  int       `json:"position,omitempty"`
+	Agent     string    `json:"agent,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+}
+
+//Sink - receives every emitted event, Handle must not block the caller
+type Sink interface {
+	Handle(ev Event)
+}
+
+//Emitter - fans events out to its sinks
+type Emitter struct {
+	mu    sync.RWMutex
+	sinks []Sink
+}
+
+func NewEmitter() *Emitter {
+	return &Emitter{}
+}
+
+// Add - register a sink for the events emitted from now on
+func (e *Emitter) Add(s Sink) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sinks = append(e.sinks, s)
+}
+
+// Emit - stamp the event with the current time when unset and hand it to
+// every sink
+func (e *Emitter) Emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, s := range e.sinks {
+		s.Handle(ev)
+	}
+}
+
+// Valid - whether t is a known event type
+func Valid(t string) bool {
+	for _, known := range Types {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
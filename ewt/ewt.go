@@ -0,0 +1,139 @@
+package ewt
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"queuev2/queuestats"
+)
+
+// Estimation methods
+const (
+	MethodAverage = "average"
+	MethodErlangC = "erlangc"
+)
+
+// ErrUnknownMethod - no estimation method with this name
+var ErrUnknownMethod = errors.New("unknown ewt method, use average or erlangc")
+
+//Input - state of the queue a task waits in
+type Input struct {
+	// Ahead - tasks ahead of the one estimated
+	Ahead     int
+	Agents    int
+	Available int
+	// HandleTime - mean time an agent spends on a task
+	HandleTime time.Duration
+	// ArrivalRate - tasks joining the queue per second
+	ArrivalRate float64
+}
+
+//Method - estimation of the wait of one task, ok is false when the input
+//is not enough for an estimate, e.g. without agents or handle times
+type Method interface {
+	Estimate(in Input) (wait time.Duration, ok bool)
+}
+
+// NewMethod - method by name, average when empty
+func NewMethod(name string) (Method, error) {
+	switch name {
+	case "", MethodAverage:
+		return Average{}, nil
+	case MethodErlangC:
+		return ErlangC{}, nil
+	}
+	return nil, ErrUnknownMethod
+}
+
+//Average - tasks ahead not taken by an available agent are handled by all
+//logged in agents in parallel, one mean handle time each
+type Average struct{}
+
+func (Average) Estimate(in Input) (time.Duration, bool) {
+	if in.Agents <= 0 || in.HandleTime <= 0 {
+		return 0, false
+	}
+	// the task itself needs an agent too
+	left := in.Ahead + 1 - in.Available
+	if left <= 0 {
+		return 0, true
+	}
+	return time.Duration(float64(left) * float64(in.HandleTime) / float64(in.Agents)), true
+}
+
+//ErlangC - the tasks ahead take Average, plus the Erlang C average speed of
+//answer for the recent arrival rate: the time until an agent frees up
+//when the load keeps them busy. Falls back to Average when the load
+//exceeds the agents, the queue then grows without bound
+type ErlangC struct{}
+
+func (ErlangC) Estimate(in Input) (time.Duration, bool) {
+	if in.Agents <= 0 || in.HandleTime <= 0 {
+		return 0, false
+	}
+	if in.Ahead+1 <= in.Available {
+		return 0, true
+	}
+
+	n := float64(in.Agents)
+	load := in.ArrivalRate * in.HandleTime.Seconds()
+	if load >= n {
+		return Average{}.Estimate(in)
+	}
+	asa := ErlangCProbability(in.Agents, load) * in.HandleTime.Seconds() / (n - load)
+	ahead := float64(in.Ahead) * in.HandleTime.Seconds() / n
+	return time.Duration((asa + ahead) * float64(time.Second)), true
+}
+
+// ErlangCProbability - probability that a task has to wait with agents
+// serving load erlangs, through the Erlang B recursion which stays stable
+// for large agent counts
+func ErlangCProbability(agents int, load float64) float64 {
+	if agents <= 0 {
+		return 1
+	}
+	if load <= 0 {
+		return 0
+	}
+	b := 1.0
+	for k := 1; k <= agents; k++ {
+		b = load * b / (float64(k) + load*b)
+	}
+	n := float64(agents)
+	c := n * b / (n - load*(1-b))
+	return math.Min(math.Max(c, 0), 1)
+}
+
+//Estimator - wait of tasks from the rolling statistics and agent presence
+//of their queue
+type Estimator struct {
+	stats  *queuestats.Stats
+	agents *queuestats.Agents
+	method Method
+}
+
+func NewEstimator(stats *queuestats.Stats, agents *queuestats.Agents, method Method) *Estimator {
+	return &Estimator{stats: stats, agents: agents, method: method}
+}
+
+// Estimate - wait of a task with ahead tasks in front of it, ok is false
+// when the queue has no agents or no handle times yet
+func (e *Estimator) Estimate(queueID string, ahead int) (wait time.Duration, ok bool, err error) {
+	rates, err := e.stats.Rates(queueID)
+	if err != nil {
+		return 0, false, err
+	}
+	loggedIn, available, err := e.agents.Count(queueID)
+	if err != nil {
+		return 0, false, err
+	}
+	wait, ok = e.method.Estimate(Input{
+		Ahead:       ahead,
+		Agents:      loggedIn,
+		Available:   available,
+		HandleTime:  rates.HandleTime,
+		ArrivalRate: rates.ArrivalRate,
+	})
+	return wait, ok, nil
+}
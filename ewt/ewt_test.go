@@ -0,0 +1,86 @@
+package ewt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/queuestats"
+	"queuev2/store/mock"
+)
+
+func TestAverage(t *testing.T) {
+	in := Input{Ahead: 5, Agents: 2, HandleTime: time.Minute}
+	wait, ok := Average{}.Estimate(in)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Minute, wait)
+
+	// one agent is free, it takes the first task ahead
+	in.Available = 1
+	wait, _ = Average{}.Estimate(in)
+	assert.Equal(t, 150*time.Second, wait)
+
+	in.Available = 6
+	wait, ok = Average{}.Estimate(in)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	_, ok = Average{}.Estimate(Input{Ahead: 1, HandleTime: time.Minute})
+	assert.False(t, ok)
+	_, ok = Average{}.Estimate(Input{Ahead: 1, Agents: 1})
+	assert.False(t, ok)
+}
+
+func TestErlangC(t *testing.T) {
+	assert.InDelta(t, 1.0/3, ErlangCProbability(2, 1), 1e-9)
+	assert.InDelta(t, 0, ErlangCProbability(2, 0), 1e-9)
+	// stable for large agent counts
+	p := ErlangCProbability(500, 480)
+	assert.True(t, p > 0 && p < 1)
+
+	// 1 erlang on 2 agents: asa = 1/3 * 60s / (2-1), plus 2 tasks ahead at 30s
+	in := Input{Ahead: 2, Agents: 2, HandleTime: time.Minute, ArrivalRate: 1.0 / 60}
+	wait, ok := ErlangC{}.Estimate(in)
+	assert.True(t, ok)
+	assert.InDelta(t, 80, wait.Seconds(), 0.01)
+
+	// overloaded, falls back to the average
+	in.ArrivalRate = 1
+	wait, _ = ErlangC{}.Estimate(in)
+	avg, _ := Average{}.Estimate(in)
+	assert.Equal(t, avg, wait)
+}
+
+func TestNewMethod(t *testing.T) {
+	m, err := NewMethod("")
+	assert.NoError(t, err)
+	assert.IsType(t, Average{}, m)
+	m, err = NewMethod(MethodErlangC)
+	assert.NoError(t, err)
+	assert.IsType(t, ErlangC{}, m)
+	_, err = NewMethod("random")
+	assert.Equal(t, ErrUnknownMethod, err)
+}
+
+func TestEstimator(t *testing.T) {
+	st := mock.NewStore("", "")
+	stats := queuestats.NewStats(st, queuestats.DefaultOptions())
+	agents := queuestats.NewAgents(st)
+	e := NewEstimator(stats, agents, Average{})
+
+	_, ok, err := e.Estimate("QID_ewt", 3)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	now := time.Now()
+	assert.NoError(t, stats.RecordHandleTime("QID_ewt", now, 20*time.Second))
+	assert.NoError(t, stats.RecordHandleTime("QID_ewt", now, 40*time.Second))
+	assert.NoError(t, agents.Heartbeat("QID_ewt", "a1", queuestats.AgentBusy))
+	assert.NoError(t, agents.Heartbeat("QID_ewt", "a2", queuestats.AgentBusy))
+
+	wait, ok, err := e.Estimate("QID_ewt", 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, wait)
+}
@@ -0,0 +1,203 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"queuev2/httpclient"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+
+	defaultTimeout = 2 * time.Second
+)
+
+//Check - probe of one dependency, a nil error means the dependency is usable.
+//It returns once ctx is done rather than holding on to a hung dependency
+type Check func(ctx context.Context) error
+
+type dependency struct {
+	name     string
+	check    Check
+	critical bool
+}
+
+//Result - outcome of one dependency check
+type Result struct {
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+//Report - readiness of the service with a breakdown per dependency
+type Report struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]Result `json:"dependencies"`
+}
+
+//Checker - runs the registered dependency checks concurrently
+type Checker struct {
+	service string
+	timeout time.Duration
+	deps    []dependency
+	routes  map[string]http.Handler
+}
+
+// NewChecker - checker with the default per check timeout
+func NewChecker(service string) *Checker {
+	return &Checker{
+		service: service,
+		timeout: defaultTimeout,
+	}
+}
+
+// Add - register a dependency, a failing critical dependency makes the
+// service not ready, a failing optional one is only reported
+func (c *Checker) Add(name string, check Check, critical bool) {
+	c.deps = append(c.deps, dependency{name: name, check: check, critical: critical})
+}
+
+// Run - execute all checks, each bounded by the checker timeout
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{
+		Status:       StatusUp,
+		Dependencies: make(map[string]Result, len(c.deps)),
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, dep := range c.deps {
+		wg.Add(1)
+		go func(dep dependency) {
+			defer wg.Done()
+			res := c.runOne(ctx, dep)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[dep.name] = res
+			if res.Status == StatusDown && dep.critical {
+				report.Status = StatusDown
+			}
+		}(dep)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func (c *Checker) runOne(ctx context.Context, dep dependency) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dep.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := Result{
+		Status:    StatusUp,
+		Critical:  dep.critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = StatusDown
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Register - add /health/live and /health/ready to the echo server
+func (c *Checker) Register(e *echo.Echo) {
+	e.GET("/health/live", c.live)
+	e.GET("/health/ready", c.ready)
+}
+
+func (c *Checker) live(ctx echo.Context) error {
+	return ctx.JSON(http.StatusOK, map[string]string{
+		"status":  StatusUp,
+		"service": c.service,
+	})
+}
+
+func (c *Checker) ready(ctx echo.Context) error {
+	report := c.Run(ctx.Request().Context())
+	if report.Status != StatusUp {
+		return ctx.JSON(http.StatusServiceUnavailable, report)
+	}
+	return ctx.JSON(http.StatusOK, report)
+}
+
+//Pinger - dependency exposing a cheap liveness probe
+type Pinger interface {
+	Ping() error
+}
+
+// PingCheck - check wrapping a Pinger such as the redis store or the AMQP
+// producer and consumer. Ping takes no context, a ping still running at the
+// deadline is left to finish in the background
+func PingCheck(p Pinger) Check {
+	return func(ctx context.Context) error {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.Ping()
+		}()
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// HTTPCheck - check passing when GET url answers with a 2XX status, the
+// request is cancelled at the deadline of ctx
+func HTTPCheck(url string) Check {
+	return func(ctx context.Context) error {
+		_, err := httpclient.GetWithContext(url, httpclient.HTTPContext{
+			Timeout: uint(defaultTimeout / time.Second),
+			Context: ctx,
+		})
+		return err
+	}
+}
+
+// Handle - serve h at path from ListenAndServe besides the health routes,
+// e.g. the metrics of the consumer
+func (c *Checker) Handle(path string, h http.Handler) {
+	if c.routes == nil {
+		c.routes = make(map[string]http.Handler)
+	}
+	c.routes[path] = h
+}
+
+// ListenAndServe - standalone health server for processes without a REST
+// API of their own, such as the consumer
+func (c *Checker) ListenAndServe(addr string) error {
+	e := echo.New()
+	e.HideBanner = true
+	e.Use(middleware.Recover())
+	c.Register(e)
+	for path, h := range c.routes {
+		e.GET(path, echo.WrapHandler(h))
+	}
+	return e.Start(addr)
+}
@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	c := NewChecker("test")
+	c.timeout = 50 * time.Millisecond
+	c.Add("ok", func(ctx context.Context) error { return nil }, true)
+	c.Add("optional", func(ctx context.Context) error { return errors.New("unreachable") }, false)
+
+	report := c.Run(context.Background())
+	assert.Equal(t, StatusUp, report.Status)
+	assert.Equal(t, StatusUp, report.Dependencies["ok"].Status)
+	assert.Equal(t, StatusDown, report.Dependencies["optional"].Status)
+	assert.Equal(t, "unreachable", report.Dependencies["optional"].Error)
+
+	c.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}, true)
+
+	report = c.Run(context.Background())
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Dependencies["slow"].Error)
+}
+
+func TestReadyEndpoint(t *testing.T) {
+	e := echo.New()
+	c := NewChecker("test")
+	c.Add("redis", func(ctx context.Context) error { return errors.New("connection refused") }, true)
+	c.Register(e)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	report := Report{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, StatusDown, report.Dependencies["redis"].Status)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// blockingPinger - dependency whose ping hangs until release is closed
+type blockingPinger struct{ release chan struct{} }
+
+func (p blockingPinger) Ping() error {
+	<-p.release
+	return nil
+}
+
+func TestChecksHonorDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+
+	for name, check := range map[string]Check{
+		"http": HTTPCheck(srv.URL),
+		"ping": PingCheck(blockingPinger{release}),
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := check(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err, name)
+		assert.Less(t, time.Since(start), time.Second, name)
+	}
+}
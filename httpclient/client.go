@@ -2,9 +2,11 @@ package httpclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -17,6 +19,12 @@ type HTTPContext struct {
 	Retry         uint
 	QueryParamMap map[string]interface{}
 	HeaderMap     map[string]string
+	// Transport - used by PostBytes instead of the default transport when
+	// set, e.g. to restrict the addresses dialed
+	Transport http.RoundTripper
+	// Context - cancels the request and its retries when done, e.g. at the
+	// deadline of the caller
+	Context context.Context
 }
 
 //Post - post the message to the specified address
@@ -92,12 +100,18 @@ func sendHTTPRequest(HTTPMethod, HTTPUrl string, requestBody interface{}, ctx HT
 			req.Header.Set(key, element)
 		}
 	}
+	if ctx.Context != nil {
+		req = req.WithContext(ctx.Context)
+	}
 
 	var resp *http.Response
 	for ctx.Retry > 0 {
 		ctx.Retry--
 
 		resp, err = client.Do(req)
+		if err != nil && ctx.Context != nil && ctx.Context.Err() != nil {
+			return nil, ctx.Context.Err()
+		}
 		if err != nil {
 			continue //TODO: can retry only for 5XX errors
 		}
@@ -120,3 +134,50 @@ func sendHTTPRequest(HTTPMethod, HTTPUrl string, requestBody interface{}, ctx HT
 
 	return nil, errors.New(maxRetryErrMsg)
 }
+
+//StatusError - response with a non 2xx status code
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http status %d: %s", e.StatusCode, e.Body)
+}
+
+//PostBytes - post body unchanged, e.g. when the caller signed it, and
+//return the response status code. ctx.Retry is ignored, the caller decides
+//what to retry; non 2xx responses are returned as *StatusError and
+//ctx.Context cancels the request
+func PostBytes(body []byte, HTTPUrl string, ctx HTTPContext) (int, error) {
+	if ctx.Timeout == 0 {
+		ctx.Timeout = DefaultTimeout
+	}
+	client := &http.Client{
+		Timeout:   time.Second * time.Duration(ctx.Timeout),
+		Transport: ctx.Transport,
+	}
+
+	req, err := http.NewRequest(POST, formatURL(HTTPUrl), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for key, element := range ctx.HeaderMap {
+		req.Header.Set(key, element)
+	}
+	if ctx.Context != nil {
+		req = req.WithContext(ctx.Context)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return resp.StatusCode, nil
+}
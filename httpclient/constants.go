@@ -16,3 +16,6 @@ const DELETE = "DELETE"
 const DefaultTimeout = 10
 
 const maxRetryErrMsg = "max retries reached"
+
+// maxErrorBodyBytes - response body kept in a StatusError
+const maxErrorBodyBytes = 4096
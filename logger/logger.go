@@ -0,0 +1,198 @@
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level - severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelFatal: "fatal",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel - parse "debug", "info", "warn", "error" or "fatal"
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Common field names, kept identical across api and consumer so a request
+// can be followed from the http call to the transfer
+const (
+	FieldRequestID = "request_id"
+	FieldAccountID = "account_id"
+	FieldQueueID   = "queue_id"
+	FieldTaskID    = "task_id"
+	FieldCallUUID  = "call_uuid"
+	FieldError     = "error"
+)
+
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// Logger - writes one JSON object per line, fields added through With are
+// repeated on every entry
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New - logger writing entries at or above level to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level}}
+}
+
+var std = New(os.Stderr, LevelInfo)
+
+// Default - the process wide logger
+func Default() *Logger {
+	return std
+}
+
+// SetOutput - redirect the process wide logger
+func SetOutput(w io.Writer) {
+	std.out.mu.Lock()
+	std.out.w = w
+	std.out.mu.Unlock()
+}
+
+// SetLevel - minimum level of the process wide logger
+func SetLevel(level Level) {
+	std.out.mu.Lock()
+	std.out.level = level
+	std.out.mu.Unlock()
+}
+
+// With - child logger carrying extra key/value pairs, it shares the output
+// and level of its parent
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal - log and exit the process with status 1
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelFatal, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	if level < l.out.level {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	addFields(entry, l.fields)
+	addFields(entry, kv)
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"ts":    entry["ts"],
+			"level": entry["level"],
+			"msg":   msg,
+			"error": "encoding log fields: " + err.Error(),
+		})
+	}
+	l.out.w.Write(append(data, '\n'))
+}
+
+// addFields - pairs with a non string key or a missing value are kept
+// under "!badkey" rather than dropped
+func addFields(entry map[string]interface{}, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok || i+1 == len(kv) {
+			entry["!badkey"] = fmt.Sprint(kv[i])
+			continue
+		}
+		switch v := kv[i+1].(type) {
+		case error:
+			entry[key] = v.Error()
+		case fmt.Stringer:
+			entry[key] = v.String()
+		default:
+			entry[key] = v
+		}
+	}
+}
+
+func Debug(msg string, kv ...interface{}) { std.log(LevelDebug, msg, kv) }
+func Info(msg string, kv ...interface{})  { std.log(LevelInfo, msg, kv) }
+func Warn(msg string, kv ...interface{})  { std.log(LevelWarn, msg, kv) }
+func Error(msg string, kv ...interface{}) { std.log(LevelError, msg, kv) }
+
+// Fatal - log on the process wide logger and exit with status 1
+func Fatal(msg string, kv ...interface{}) {
+	std.log(LevelFatal, msg, kv)
+	os.Exit(1)
+}
+
+// With - child of the process wide logger
+func With(kv ...interface{}) *Logger {
+	return std.With(kv...)
+}
+
+type ctxKey struct{}
+
+// NewContext - attach l to ctx
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext - logger attached to ctx, the process wide one otherwise
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return l
+	}
+	return std
+}
@@ -0,0 +1,48 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(buf, LevelInfo).With(FieldRequestID, "req-1")
+
+	l.Debug("dropped")
+	l.Error("publish failed", FieldTaskID, "t1", FieldError, errors.New("channel closed"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 1)
+
+	entry := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, "publish failed", entry["msg"])
+	assert.Equal(t, "req-1", entry[FieldRequestID])
+	assert.Equal(t, "t1", entry[FieldTaskID])
+	assert.Equal(t, "channel closed", entry[FieldError])
+	assert.NotEmpty(t, entry["ts"])
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Equal(t, Default(), FromContext(context.Background()))
+
+	l := With(FieldRequestID, "req-2")
+	assert.Equal(t, l, FromContext(NewContext(context.Background(), l)))
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, l)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+
+	"queuev2/config"
+)
+
+const (
+	namespace = "queuev2"
+
+	// LabelOther - account or queue label of the values past the limit
+	LabelOther = "other"
+	// LabelUnknown - label of events without an account or queue
+	LabelUnknown = "unknown"
+)
+
+//Options - at most MaxAccounts accounts and MaxQueues queues get a label
+//value of their own, the ones seen later are counted as LabelOther. Gauges
+//of queues past the limit are not exported
+type Options struct {
+	MaxAccounts int `mapstructure:"maxAccounts"`
+	MaxQueues   int `mapstructure:"maxQueues"`
+	QueueSize   int `mapstructure:"queueSize"`
+}
+
+// DefaultOptions - 100 accounts, 1000 queues
+func DefaultOptions() Options {
+	return Options{
+		MaxAccounts: 100,
+		MaxQueues:   1000,
+		QueueSize:   1000,
+	}
+}
+
+// LoadOptions - metrics options of the active profile
+func LoadOptions(conf *viper.Viper) (Options, error) {
+	opts := DefaultOptions()
+	err := config.UnmarshalKey(conf, config.Metrics, &opts)
+	return opts, err
+}
+
+//limiter - admits the first max label values
+type limiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{max: max, seen: make(map[string]struct{})}
+}
+
+// admit - whether v has a label value of its own
+func (l *limiter) admit(v string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return true
+	}
+	if len(l.seen) >= l.max {
+		return false
+	}
+	l.seen[v] = struct{}{}
+	return true
+}
+
+func (l *limiter) value(v string) string {
+	if v == "" {
+		return LabelUnknown
+	}
+	if !l.admit(v) {
+		return LabelOther
+	}
+	return v
+}
+
+// lookup - label value of v without admitting it
+func (l *limiter) lookup(v string) string {
+	if v == "" {
+		return LabelUnknown
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; !ok {
+		return LabelOther
+	}
+	return v
+}
+
+// forget - free the slot of v, false when it had none
+func (l *limiter) forget(v string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; !ok {
+		return false
+	}
+	delete(l.seen, v)
+	return true
+}
+
+var (
+	limitsMu sync.RWMutex
+	accounts = newLimiter(DefaultOptions().MaxAccounts)
+	queues   = newLimiter(DefaultOptions().MaxQueues)
+)
+
+// SetOptions - replace the label limits, call it before the first metric
+// is recorded
+func SetOptions(opts Options) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	accounts = newLimiter(opts.MaxAccounts)
+	queues = newLimiter(opts.MaxQueues)
+}
+
+func limiters() (*limiter, *limiter) {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return accounts, queues
+}
+
+// labels - account and queue label values within the limits
+func labels(accountID, queueID string) (string, string) {
+	a, q := limiters()
+	return a.value(accountID), q.value(queueID)
+}
+
+// ForgetQueue - free the label slot of a deleted queue for a new one and
+// remove its series. The agents gauge is left to the consumers of the
+// queue, which stop with it
+func ForgetQueue(accountID, queueID string) {
+	a, q := limiters()
+	if !q.forget(queueID) {
+		return
+	}
+	account := a.lookup(accountID)
+	for _, vec := range []interface{ DeleteLabelValues(...string) bool }{
+		queueDepth, waitTime, abandoned, transferTime, transferFailures,
+	} {
+		vec.DeleteLabelValues(account, queueID)
+	}
+}
+
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Tasks waiting in the queue.",
+	}, []string{"account", "queue"})
+
+	waitTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_wait_seconds",
+		Help:      "Time from enqueue until an agent was reserved for the task.",
+		Buckets:   []float64{1, 5, 10, 20, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"account", "queue"})
+
+	abandoned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_abandoned_total",
+		Help:      "Tasks which left the queue without an agent.",
+	}, []string{"account", "queue"})
+
+	transferTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transfer_duration_seconds",
+		Help:      "Latency of the transfer of a call to its agent.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"account", "queue"})
+
+	transferFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transfer_failures_total",
+		Help:      "Transfers of a call to its agent which failed.",
+	}, []string{"account", "queue"})
+
+	agents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "agents",
+		Help:      "Agents logged in to the queue by state.",
+	}, []string{"queue", "state"})
+
+	publishTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "amqp_publish_duration_seconds",
+		Help:      "Latency of AMQP publishes, including the broker confirms of batches.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"exchange"})
+
+	reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "amqp_reconnects_total",
+		Help:      "Connections to the AMQP broker dialed again after it closed them.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, waitTime, abandoned, transferTime, transferFailures,
+		agents, publishTime, reconnects)
+}
+
+// Handler - exposition of the metrics of the process
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// SetQueueDepth - queues past the limit are not exported, the depths of
+// different queues do not add up to a meaningful value
+func SetQueueDepth(accountID, queueID string, depth int) {
+	account, queue := labels(accountID, queueID)
+	if account == LabelOther || queue == LabelOther {
+		return
+	}
+	queueDepth.WithLabelValues(account, queue).Set(float64(depth))
+}
+
+// ObserveWait - an agent was reserved for a task after wait
+func ObserveWait(accountID, queueID string, wait time.Duration) {
+	account, queue := labels(accountID, queueID)
+	waitTime.WithLabelValues(account, queue).Observe(wait.Seconds())
+}
+
+// TaskAbandoned - a task left the queue without an agent
+func TaskAbandoned(accountID, queueID string) {
+	account, queue := labels(accountID, queueID)
+	abandoned.WithLabelValues(account, queue).Inc()
+}
+
+// ObserveTransfer - a transfer to an agent took d and failed when err is
+// set
+func ObserveTransfer(accountID, queueID string, d time.Duration, err error) {
+	account, queue := labels(accountID, queueID)
+	transferTime.WithLabelValues(account, queue).Observe(d.Seconds())
+	if err != nil {
+		transferFailures.WithLabelValues(account, queue).Inc()
+	}
+}
+
+// AgentStateChanged - an agent of the queue moved from one state to
+// another, from is empty when it logged in and to when it logged out.
+// Queues past the limit are not exported, like their depths
+func AgentStateChanged(queueID, from, to string) {
+	_, queue := labels("", queueID)
+	if queue == LabelOther {
+		return
+	}
+	if from != "" {
+		agents.WithLabelValues(queue, from).Dec()
+	}
+	if to != "" {
+		agents.WithLabelValues(queue, to).Inc()
+	}
+}
+
+// ObservePublish - a publish to exchange took d
+func ObservePublish(exchange string, d time.Duration) {
+	publishTime.WithLabelValues(exchange).Observe(d.Seconds())
+}
+
+// AMQPReconnected - the broker connection was dialed again
+func AMQPReconnected() {
+	reconnects.Inc()
+}
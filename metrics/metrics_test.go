@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+	"queuev2/position"
+	"queuev2/store"
+	"queuev2/store/mock"
+)
+
+func TestLabels(t *testing.T) {
+	SetOptions(Options{MaxAccounts: 2, MaxQueues: 1})
+	defer SetOptions(DefaultOptions())
+
+	account, queue := labels("a1", "q1")
+	assert.Equal(t, "a1", account)
+	assert.Equal(t, "q1", queue)
+	account, queue = labels("a2", "q2")
+	assert.Equal(t, "a2", account)
+	assert.Equal(t, LabelOther, queue)
+	account, queue = labels("a3", "q1")
+	assert.Equal(t, LabelOther, account)
+	assert.Equal(t, "q1", queue)
+	account, _ = labels("", "q1")
+	assert.Equal(t, LabelUnknown, account)
+
+	// depths past the limit are not exported
+	SetQueueDepth("a1", "q2", 5)
+	assert.Equal(t, 0, testutil.CollectAndCount(queueDepth, namespace+"_queue_depth"))
+}
+
+func TestRecorder(t *testing.T) {
+	SetOptions(DefaultOptions())
+	st := mock.NewStore("", "")
+	pos := position.NewPosition(st)
+	r := &Recorder{pos: pos}
+
+	assert.NoError(t, pos.AddItem("QID_metrics", "t1", 0))
+	assert.NoError(t, pos.AddItem("QID_metrics", "t2", 0))
+	assert.NoError(t, r.record(events.Event{Type: events.TaskEnqueued, AccountID: "123", QueueID: "QID_metrics", TaskID: "t2"}))
+	assert.Equal(t, 2.0, testutil.ToFloat64(queueDepth.WithLabelValues("123", "QID_metrics")))
+
+	assert.NoError(t, pos.RemoveItem("QID_metrics", "t1"))
+	assert.NoError(t, r.record(events.Event{Type: events.TaskAbandoned, AccountID: "123", QueueID: "QID_metrics", TaskID: "t1"}))
+	assert.Equal(t, 1.0, testutil.ToFloat64(queueDepth.WithLabelValues("123", "QID_metrics")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(abandoned.WithLabelValues("123", "QID_metrics")))
+}
+
+func TestObserveTransfer(t *testing.T) {
+	SetOptions(DefaultOptions())
+	ObserveTransfer("123", "QID_transfer", time.Second, nil)
+	ObserveTransfer("123", "QID_transfer", time.Second, errors.New("busy"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(transferFailures.WithLabelValues("123", "QID_transfer")))
+
+	AgentStateChanged("QID_transfer", "", "available")
+	AgentStateChanged("QID_transfer", "available", "busy")
+	assert.Equal(t, 0.0, testutil.ToFloat64(agents.WithLabelValues("QID_transfer", "available")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(agents.WithLabelValues("QID_transfer", "busy")))
+}
+
+func TestForgetQueue(t *testing.T) {
+	SetOptions(Options{MaxAccounts: 2, MaxQueues: 1})
+	defer SetOptions(DefaultOptions())
+	queueDepth.Reset()
+	agents.Reset()
+
+	SetQueueDepth("a1", "q1", 3)
+	TaskAbandoned("a1", "q1")
+	// past the limit, the agents of other queues do not add up in a gauge
+	AgentStateChanged("q2", "", "available")
+	assert.Equal(t, 0, testutil.CollectAndCount(agents, namespace+"_agents"))
+
+	// the slot of the deleted queue goes to the next one
+	ForgetQueue("a1", "q1")
+	assert.Equal(t, 0, testutil.CollectAndCount(queueDepth, namespace+"_queue_depth"))
+	assert.Equal(t, 0.0, testutil.ToFloat64(abandoned.WithLabelValues("a1", "q1")))
+	SetQueueDepth("a1", "q2", 4)
+	assert.Equal(t, 4.0, testutil.ToFloat64(queueDepth.WithLabelValues("a1", "q2")))
+	_, queue := labels("a1", "q1")
+	assert.Equal(t, LabelOther, queue)
+
+	// queues without a slot free none
+	ForgetQueue("a1", "q3")
+	_, queue = labels("a1", "q3")
+	assert.Equal(t, LabelOther, queue)
+}
+
+type fakePool struct{}
+
+func (fakePool) PoolStats() store.PoolStats {
+	return store.PoolStats{Active: 3, Idle: 1, WaitCount: 2, WaitDuration: time.Second}
+}
+
+func TestPoolCollector(t *testing.T) {
+	c := &poolCollector{pool: fakePool{}}
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(c))
+	assert.Equal(t, 4, testutil.CollectAndCount(c))
+	assert.NoError(t, RegisterPool(mock.NewStore("", "")))
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"queuev2/store"
+)
+
+var (
+	poolActiveDesc = prometheus.NewDesc(namespace+"_redis_pool_active_connections",
+		"Connections of the redis pool, in use or idle.", nil, nil)
+	poolIdleDesc = prometheus.NewDesc(namespace+"_redis_pool_idle_connections",
+		"Idle connections of the redis pool.", nil, nil)
+	poolWaitCountDesc = prometheus.NewDesc(namespace+"_redis_pool_waits_total",
+		"Times a caller waited for a free redis connection.", nil, nil)
+	poolWaitTimeDesc = prometheus.NewDesc(namespace+"_redis_pool_wait_seconds_total",
+		"Time spent waiting for a free redis connection.", nil, nil)
+)
+
+//poolCollector - reads the pool stats of the store on every scrape
+type poolCollector struct {
+	pool store.PoolReporter
+}
+
+// RegisterPool - export the connection pool stats of the store, stores
+// without a pool are ignored
+func RegisterPool(st store.Store) error {
+	pr, ok := st.(store.PoolReporter)
+	if !ok {
+		return nil
+	}
+	return prometheus.Register(&poolCollector{pool: pr})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolActiveDesc
+	ch <- poolIdleDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitTimeDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.pool.PoolStats()
+	ch <- prometheus.MustNewConstMetric(poolActiveDesc, prometheus.GaugeValue, float64(s.Active))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(poolWaitTimeDesc, prometheus.CounterValue, s.WaitDuration.Seconds())
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/position"
+)
+
+//Recorder - events.Sink keeping the queue depths and abandon counts
+type Recorder struct {
+	pos   *position.Position
+	queue *events.Async
+}
+
+func NewRecorder(pos *position.Position, opts Options) *Recorder {
+	r := &Recorder{pos: pos}
+	r.queue = events.NewAsync("metrics", opts.QueueSize, r.handle)
+	return r
+}
+
+// Handle - queue the event for recording, it is dropped when the queue is
+// full
+func (r *Recorder) Handle(ev events.Event) {
+	r.queue.Handle(ev)
+}
+
+func (r *Recorder) handle(ev events.Event) {
+	if err := r.record(ev); err != nil {
+		logger.Error("recording metrics failed", "event", ev.Type, logger.FieldQueueID, ev.QueueID, logger.FieldError, err)
+	}
+}
+
+func (r *Recorder) record(ev events.Event) error {
+	switch ev.Type {
+	case events.TaskAbandoned:
+		TaskAbandoned(ev.AccountID, ev.QueueID)
+	case events.TaskEnqueued, events.TaskAgentReserved, events.TaskDeadLettered:
+	default:
+		return nil
+	}
+	if ev.QueueID == "" {
+		return nil
+	}
+
+	// events only carry positions, the depth is read back from the queue
+	depth, err := r.pos.Count(ev.QueueID)
+	if err != nil {
+		return err
+	}
+	SetQueueDepth(ev.AccountID, ev.QueueID, depth)
+	return nil
+}
@@ -2,49 +2,123 @@ package consumer
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/streadway/amqp"
-	"log"
 	"queuev2/api"
+	"queuev2/events"
 	"queuev2/httpclient"
+	"queuev2/logger"
+	"queuev2/metrics"
+	"queuev2/mq/producer"
 	"queuev2/position"
-	"queuev2/store/redis"
+	"queuev2/queuestate"
+	"queuev2/queuestats"
+	"queuev2/redact"
+	"queuev2/store"
+	"sync"
 	"time"
 )
 
+// statePoll - how often the queue state is read, changes are usually
+// pushed through the store pub/sub before
+const statePoll = 5 * time.Second
+
+// agentEvents - event emitted when the agent moves to each state
+var agentEvents = map[string]string{
+	queuestats.AgentAvailable:   events.AgentAvailable,
+	queuestats.AgentBusy:        events.AgentBusy,
+	queuestats.AgentUnavailable: events.AgentUnavailable,
+}
+
+//amqpChannel - the part of *amqp.Channel starting and cancelling the
+//consumer of the queue
+type amqpChannel interface {
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+}
+
 type MQConsumer struct {
 	amqpURL    string
 	exchange   string
 	tag        string
 	queueName  string
 	bindingKey string
+	accountID  string // owner of the queue, read from its id
 	conn       *amqp.Connection
+	store      store.Store
 	pos        *position.Position
+	tasks      *api.TaskStore
+	dead       *api.DeadLetterStore
+	redactor   *redact.Redactor
+	events     *events.Emitter
+	agents     *queuestats.Agents
+	states     *queuestate.Store
+
+	mu        sync.Mutex
+	channel   amqpChannel
+	consuming bool
+	// handled - closed once the handler of the last consumer returned, a
+	// new consumer is only started after it so one task is handled at a
+	// time
+	handled   chan struct{}
+	resuming  bool
+	busy      bool
+	storeDown bool
+	// held - an operator requested this agent unavailable
+	held bool
+	// state - last known state of the queue, the consumer only takes tasks
+	// while it is dispatching
+	state queuestate.State
+	// reported - agent state last exported to the metrics
+	reported string
 }
 
-func NewMQConsumer(amqpURI, exchange, tag, queueName, bindingKey string) *MQConsumer {
+func NewMQConsumer(amqpURI, exchange, tag, queueName, bindingKey string, st store.Store) *MQConsumer {
 	c := &MQConsumer{
 		amqpURL:    amqpURI,
 		exchange:   exchange,
 		tag:        tag,
 		queueName:  queueName,
 		bindingKey: bindingKey,
+		accountID:  api.QueueAccountID(queueName),
 	}
 
-	log.Printf("dialing %q", amqpURI)
+	logger.Info("dialing amqp broker")
 	connection, err := amqp.Dial(amqpURI)
 	if err != nil {
-		log.Fatalf("error:: amqp dial: %+v", err)
+		logger.Fatal("amqp dial failed", logger.FieldError, err)
 	}
 
 	c.conn = connection
-	c.pos = position.NewPosition(redis.NewStore("127.0.0.1", "6379"))
+	c.store = st
+	c.pos = position.NewPosition(st)
+	c.tasks = api.NewTaskStore(st)
+	c.dead = api.NewDeadLetterStore(st)
+	c.redactor = redact.New(redact.DefaultOptions())
+	c.events = events.NewEmitter()
+	c.agents = queuestats.NewAgents(st)
+	c.states = queuestate.NewStore(st)
+	c.state = queuestate.State{QueueID: queueName, State: queuestate.Open}
 	return c
 }
 
+// Events - lifecycle events of the tasks handled by this consumer, add
+// sinks such as the webhook dispatcher before Start
+func (c *MQConsumer) Events() *events.Emitter {
+	return c.events
+}
+
+// SetRedactor - replace the redaction applied to logged task bodies, call
+// it before Start
+func (c *MQConsumer) SetRedactor(r *redact.Redactor) {
+	c.redactor = r
+}
+
 func (c *MQConsumer) Start() {
 	channel, err := c.conn.Channel()
 	if err != nil {
-		log.Fatalf("error:: getting channel: %+v \n", err)
+		logger.Fatal("getting channel failed", logger.FieldError, err)
 	}
 
 	if err = channel.QueueBind(
@@ -54,16 +128,154 @@ func (c *MQConsumer) Start() {
 		false,        // noWait
 		nil,          // arguments
 	); err != nil {
-		log.Fatalf("error:: creating binding: %+v \n", err)
+		logger.Fatal("creating binding failed", logger.FieldError, err)
 	}
 
 	// set prefect = 1
 	err = channel.Qos(1, 0, false)
 	if err != nil {
-		log.Fatalf("error:: set basic.qos: %v", err)
+		logger.Fatal("setting basic.qos failed", logger.FieldError, err)
 	}
+	c.channel = channel
+
+	if state, err := c.states.Get(c.queueName); err != nil {
+		logger.Warn("reading queue state failed, assuming it is open", "consumer", c.tag, logger.FieldError, err)
+	} else {
+		c.state = state
+	}
+	if err = c.update(); err != nil {
+		logger.Fatal("consumer start failed", logger.FieldError, err)
+	}
+
+	if hr, ok := c.store.(store.HealthReporter); ok {
+		go c.watchStore(hr)
+	}
+	go c.watchState()
+	go c.heartbeat()
+}
+
+// heartbeat - keep this consumer logged in as an agent of its queue, the
+// queue id is the name of its amqp queue
+func (c *MQConsumer) heartbeat() {
+	ticker := time.NewTicker(queuestats.AgentTTL / 3)
+	defer ticker.Stop()
+	for {
+		c.applyRequested()
+		c.reportState()
+		<-ticker.C
+	}
+}
+
+// applyRequested - follow the state an operator requested for this agent,
+// an agent requested unavailable stops taking tasks like a paused queue
+func (c *MQConsumer) applyRequested() {
+	requested, err := c.agents.Requested(c.queueName, c.tag)
+	if err != nil {
+		logger.Warn("reading requested agent state failed", "consumer", c.tag, logger.FieldError, err)
+		return
+	}
+	held := requested == queuestats.AgentUnavailable
+	c.mu.Lock()
+	changed := held != c.held
+	c.held = held
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	logger.Info("agent state requested", "consumer", c.tag, logger.FieldQueueID, c.queueName, "unavailable", held)
+	if err = c.update(); err != nil {
+		logger.Error("applying requested agent state failed", "consumer", c.tag, logger.FieldError, err)
+	}
+}
+
+// setBusy - record whether a task is being handled and report it at once
+// so estimates see the agent taken
+func (c *MQConsumer) setBusy(busy bool) {
+	c.mu.Lock()
+	c.busy = busy
+	c.mu.Unlock()
+	c.reportState()
+}
 
-	deliveries, err := channel.Consume(
+// reportState - heartbeat the agent state, a consumer which cancelled its
+// amqp consumer is unavailable once its last task is handled
+func (c *MQConsumer) reportState() {
+	c.mu.Lock()
+	state := queuestats.AgentAvailable
+	switch {
+	case c.busy:
+		state = queuestats.AgentBusy
+	case !c.consuming:
+		state = queuestats.AgentUnavailable
+	}
+	changed := state != c.reported
+	if changed {
+		metrics.AgentStateChanged(c.queueName, c.reported, state)
+		c.reported = state
+	}
+	c.mu.Unlock()
+	if changed {
+		c.events.Emit(events.Event{
+			Type:      agentEvents[state],
+			AccountID: c.accountID,
+			QueueID:   c.queueName,
+			Agent:     c.tag,
+			Actor:     "consumer:" + c.tag,
+		})
+	}
+	if err := c.agents.Heartbeat(c.queueName, c.tag, state); err != nil {
+		logger.Warn("agent heartbeat failed", "consumer", c.tag, logger.FieldError, err)
+	}
+}
+
+// Ping - verify the broker connection and that the queue is still declared
+func (c *MQConsumer) Ping() error {
+	if c.conn.IsClosed() {
+		return fmt.Errorf("error:: amqp connection is closed")
+	}
+	channel, err := c.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("error:: getting channel: %+v", err)
+	}
+	defer channel.Close()
+
+	_, err = channel.QueueInspect(c.queueName)
+	return err
+}
+
+// update - consume while the store is up, the agent is not held and the
+// queue state lets tasks be dispatched, cancel the consumer otherwise. The
+// agent state follows
+func (c *MQConsumer) update() error {
+	c.mu.Lock()
+	var err error
+	if !c.storeDown && !c.held && c.state.Dispatching() {
+		err = c.consume()
+	} else {
+		err = c.pause()
+	}
+	c.mu.Unlock()
+	c.reportState()
+	return err
+}
+
+// consume - start the amqp consumer, c.mu must be held. After a pause the
+// consumer is started once the in-flight message is handled
+func (c *MQConsumer) consume() error {
+	if c.consuming || c.resuming {
+		return nil
+	}
+	if c.handled != nil {
+		select {
+		case <-c.handled:
+		default:
+			c.resuming = true
+			go c.resumeAfter(c.handled)
+			return nil
+		}
+	}
+
+	deliveries, err := c.channel.Consume(
 		c.queueName, // name
 		c.tag,       // consumerTag,
 		false,       // noAck
@@ -73,39 +285,290 @@ func (c *MQConsumer) Start() {
 		nil,         // arguments
 	)
 	if err != nil {
-		log.Fatalf("error:: consumer start: %v", err)
+		return err
+	}
+
+	c.consuming = true
+	handled := make(chan struct{})
+	c.handled = handled
+	go func() {
+		defer close(handled)
+		c.handleMessages(deliveries)
+	}()
+	return nil
+}
+
+// resumeAfter - apply the current state once the handler of the cancelled
+// consumer returned
+func (c *MQConsumer) resumeAfter(handled <-chan struct{}) {
+	<-handled
+	c.mu.Lock()
+	c.resuming = false
+	c.mu.Unlock()
+	if err := c.update(); err != nil {
+		logger.Error("resuming consumer failed", "consumer", c.tag, logger.FieldError, err)
+	}
+}
+
+// pause - cancel the consumer, unacked deliveries stay with the broker and
+// the deliveries channel closes once the in-flight message is handled.
+// c.mu must be held
+func (c *MQConsumer) pause() error {
+	if !c.consuming {
+		return nil
+	}
+
+	if err := c.channel.Cancel(c.tag, false); err != nil {
+		return err
+	}
+	c.consuming = false
+	return nil
+}
+
+// watchStore - stop taking tasks while the store is down, positions could
+// not be updated for them, and resume once it is connected again
+func (c *MQConsumer) watchStore(hr store.HealthReporter) {
+	updates, unsubscribe := hr.Subscribe()
+	defer unsubscribe()
+
+	for h := range updates {
+		switch h.State {
+		case store.StateDown:
+			logger.Warn("store is down, pausing consumer", "consumer", c.tag, logger.FieldError, h.LastError)
+			c.mu.Lock()
+			c.storeDown = true
+			c.mu.Unlock()
+			if err := c.update(); err != nil {
+				logger.Error("pausing consumer failed", "consumer", c.tag, logger.FieldError, err)
+			}
+		case store.StateConnected:
+			logger.Info("store is connected, resuming consumer", "consumer", c.tag)
+			c.mu.Lock()
+			c.storeDown = false
+			c.mu.Unlock()
+			if err := c.update(); err != nil {
+				logger.Error("resuming consumer failed", "consumer", c.tag, logger.FieldError, err)
+			}
+		}
+	}
+}
+
+// watchState - follow the pause, resume and drain requests of the queue.
+// Changes are pushed through the store pub/sub when it has one, the state
+// is also polled to catch changes missed while the subscription was lost
+func (c *MQConsumer) watchState() {
+	var changes <-chan queuestate.State
+	cancel := func() {}
+	subscribe := func() {
+		if !c.states.CanWatch() {
+			return
+		}
+		ch, stop, err := c.states.Watch(c.queueName)
+		if err != nil {
+			logger.Warn("watching queue state failed", "consumer", c.tag, logger.FieldError, err)
+			return
+		}
+		changes, cancel = ch, stop
+	}
+	subscribe()
+
+	ticker := time.NewTicker(statePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case state, ok := <-changes:
+			if !ok {
+				// subscribe again on the next poll
+				cancel()
+				changes = nil
+				continue
+			}
+			c.setState(state)
+		case <-ticker.C:
+			if changes == nil {
+				subscribe()
+			}
+			state, err := c.states.Get(c.queueName)
+			if err != nil {
+				logger.Warn("reading queue state failed", "consumer", c.tag, logger.FieldError, err)
+				continue
+			}
+			c.setState(state)
+		}
+	}
+}
+
+// setState - apply the state of the queue to the amqp consumer
+func (c *MQConsumer) setState(state queuestate.State) {
+	c.mu.Lock()
+	previous := c.state.State
+	c.state = state
+	c.mu.Unlock()
+	if state.State != previous {
+		logger.Info("queue state changed", "consumer", c.tag, logger.FieldQueueID, c.queueName, "from", previous, "to", state.State)
+	}
+	if err := c.update(); err != nil {
+		logger.Error("applying queue state failed", "consumer", c.tag, "state", state.State, logger.FieldError, err)
+	}
+	c.closeIfDrained()
+}
+
+// closeIfDrained - close a draining queue once no task is waiting in it
+func (c *MQConsumer) closeIfDrained() {
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+	if state.State != queuestate.Draining {
+		return
+	}
+	waiting, err := c.pos.Count(c.queueName)
+	if err != nil {
+		logger.Warn("counting waiting tasks failed", "consumer", c.tag, logger.FieldError, err)
+		return
+	}
+	if waiting > 0 {
+		return
+	}
+	// the queue may have been resumed since the state was last read
+	if state, err = c.states.Get(c.queueName); err != nil || state.State != queuestate.Draining {
+		return
 	}
 
-	go c.handleMessages(deliveries)
+	state.State = queuestate.Closed
+	state.ChangedAt = time.Time{}
+	if err = c.states.Set(state); err != nil {
+		logger.Error("closing drained queue failed", "consumer", c.tag, logger.FieldError, err)
+		return
+	}
+	c.setState(state)
 }
 
 func (c *MQConsumer) handleMessages(deliveries <-chan amqp.Delivery) {
 	agentURL := "sip:1111@freeswitch-registrar-10x.i3clogic.com:5508"
 	for d := range deliveries {
-		log.Printf(
-			"received task at consumer: [%v] %+v",
-			d.DeliveryTag,
-			string(d.Body),
-		)
+		requestID, _ := d.Headers[producer.HeaderRequestID].(string)
+		l := logger.With(logger.FieldRequestID, requestID, "delivery_tag", d.DeliveryTag)
+		if c.redactor.Sample() {
+			l.Info("received task at consumer", "body", c.redactor.Body(d.Body))
+		} else {
+			l.Info("received task at consumer")
+		}
+
 		task := &api.Task{}
 		err := json.Unmarshal(d.Body, task)
+		if err == nil && (task.AccountID == "" || task.TaskID == "") {
+			err = errors.New("task has no account or task id")
+		}
 		if err != nil {
-			log.Println("error:: ", err)
+			// rejected without requeue, the broker routes it to the dead
+			// letter exchange of the queue when one is set
+			l.Error("decoding task failed, dead lettering it", logger.FieldError, err)
+			c.emit(events.Event{Type: events.TaskDeadLettered, Error: err.Error()}, task)
+			c.deadLetter(l, &api.DeadLetter{
+				ID:     fmt.Sprintf("msg-%d", time.Now().UnixNano()),
+				Reason: err.Error(),
+				Body:   string(d.Body),
+			})
+			d.Nack(false, false)
+			continue
 		}
 
 		callUUID := task.CallData["call_uuid"]
-		log.Println("debug: finding agent for call_uuid", callUUID)
+		l = l.With(logger.FieldTaskID, task.TaskID, logger.FieldQueueID, task.QueueID, logger.FieldCallUUID, callUUID)
+		c.setBusy(true)
+		dispatched := 0
+		if rank, err := c.pos.GetPosition(task.QueueID, task.TaskID); err == nil {
+			dispatched = rank + 1
+		}
+		c.emit(events.Event{Type: events.TaskDispatched, Position: dispatched}, task)
+		l.Debug("finding agent")
 		time.Sleep(100 * time.Second)
 
-		log.Printf("debug: agent %s found for call_uuid %s", agentURL, callUUID)
-		c.pos.RemoveItem(task.TaskID)
+		l.Debug("agent found", "agent", agentURL)
+		held := 0
+		if rank, err := c.pos.GetPosition(task.QueueID, task.TaskID); err == nil {
+			held = rank + 1
+		}
+		c.pos.RemoveItem(task.QueueID, task.TaskID)
+		if !c.dispatch(l, task) {
+			l.Info("task was cancelled, dropping it")
+			d.Ack(false)
+			c.setBusy(false)
+			c.closeIfDrained()
+			continue
+		}
+		c.emit(events.Event{Type: events.TaskAgentReserved, Position: held, Agent: agentURL}, task)
 		// Execute modify on call
+		start := time.Now()
 		err = c.transferToAgent(agentURL, callUUID)
+		metrics.ObserveTransfer(task.AccountID, task.QueueID, time.Since(start), err)
 		if err != nil {
-			log.Println("error:: ", err)
+			l.Error("transfer to agent failed", "agent", agentURL, logger.FieldError, err)
+			task.Status = api.TaskStatusFailed
+			c.emit(events.Event{Type: events.TaskTransferFailed, Agent: agentURL, Error: err.Error()}, task)
+			// kept so an operator can replay it once the cause is fixed
+			failed := *task
+			failed.Position = 0
+			c.deadLetter(l, &api.DeadLetter{ID: task.TaskID, Reason: "transfer failed: " + err.Error(), Task: &failed})
+		} else {
+			l.Info("call transferred to agent", "agent", agentURL)
+			task.Status = api.TaskStatusTransferred
+			c.emit(events.Event{Type: events.TaskTransferred, Agent: agentURL}, task)
+		}
+		task.Position = 0
+		if err = c.tasks.Save(task); err != nil {
+			l.Error("saving task status failed", logger.FieldError, err)
 		}
 		d.Ack(false)
+		c.setBusy(false)
+		c.closeIfDrained()
+	}
+}
+
+// deadLetter - keep a message this consumer gave up on for the dlq
+// endpoints of the API
+func (c *MQConsumer) deadLetter(l *logger.Logger, dl *api.DeadLetter) {
+	dl.QueueID = c.queueName
+	dl.DeadAt = time.Now().UTC()
+	if err := c.dead.Add(dl); err != nil {
+		l.Error("storing dead letter failed", logger.FieldError, err)
+	}
+}
+
+// emit - ev completed with the ids of task and this consumer as actor
+func (c *MQConsumer) emit(ev events.Event, task *api.Task) {
+	ev.AccountID = task.AccountID
+	ev.QueueID = task.QueueID
+	ev.TaskID = task.TaskID
+	ev.Actor = "consumer:" + c.tag
+	c.events.Emit(ev)
+}
+
+// dispatch - claim the task against a concurrent cancel and mark it
+// dispatched, false when it was cancelled through the API. Tasks are
+// transferred when the store cannot be reached
+func (c *MQConsumer) dispatch(l *logger.Logger, task *api.Task) bool {
+	// received, so queued even if its publish was not confirmed
+	if err := c.tasks.Confirmed(task.AccountID, task.TaskID); err != nil {
+		l.Warn("clearing unconfirmed task failed", logger.FieldError, err)
+	}
+	claimed, err := c.tasks.Claim(task.AccountID, task.TaskID, api.TaskStatusDispatched)
+	if err != nil {
+		l.Warn("claiming task failed, transferring it", logger.FieldError, err)
+		return true
+	}
+	if !claimed {
+		return false
+	}
+	if current, err := c.tasks.Get(task.AccountID, task.TaskID); err == nil && current.Status == api.TaskStatusCancelled {
+		// cancelled before tasks were claimed
+		return false
+	}
+	task.Status = api.TaskStatusDispatched
+	if err = c.tasks.Save(task); err != nil {
+		l.Warn("saving dispatched status failed", logger.FieldError, err)
 	}
+	return true
 }
 
 func (c *MQConsumer) transferToAgent(agentURL, callUUID string) error {
@@ -0,0 +1,324 @@
+package consumer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/api"
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/position"
+	"queuev2/queuestate"
+	"queuev2/queuestats"
+	"queuev2/redact"
+	"queuev2/store"
+	"queuev2/store/mock"
+)
+
+const testQueue = "QID_MTIzX3NhbGVzNQ=="
+
+// fakeChannel - counts the consumers started and cancelled, no message is
+// ever delivered. Cancel closes the deliveries unless inFlight is set, as
+// the broker does once the message being handled is acked
+type fakeChannel struct {
+	mu         sync.Mutex
+	consumes   int
+	cancels    int
+	inFlight   bool
+	deliveries chan amqp.Delivery
+}
+
+func (f *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consumes++
+	f.deliveries = make(chan amqp.Delivery)
+	return f.deliveries, nil
+}
+
+func (f *fakeChannel) Cancel(consumer string, noWait bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels++
+	if !f.inFlight {
+		close(f.deliveries)
+	}
+	return nil
+}
+
+// handled - the in-flight message is handled, the cancelled deliveries close
+func (f *fakeChannel) handled() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight = false
+	close(f.deliveries)
+}
+
+func (f *fakeChannel) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.consumes, f.cancels
+}
+
+// newTestConsumer - consumer of testQueue over a fake channel, not started
+func newTestConsumer(st store.Store) (*MQConsumer, *fakeChannel) {
+	logger.SetLevel(logger.LevelFatal)
+	ch := &fakeChannel{}
+	return &MQConsumer{
+		tag:       "consumer-1",
+		queueName: testQueue,
+		accountID: api.QueueAccountID(testQueue),
+		store:     st,
+		pos:       position.NewPosition(st),
+		tasks:     api.NewTaskStore(st),
+		dead:      api.NewDeadLetterStore(st),
+		redactor:  redact.New(redact.DefaultOptions()),
+		events:    events.NewEmitter(),
+		agents:    queuestats.NewAgents(st),
+		states:    queuestate.NewStore(st),
+		channel:   ch,
+		state:     queuestate.State{QueueID: testQueue, State: queuestate.Open},
+	}, ch
+}
+
+// eventSink - events handed to the sink
+type eventSink struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (s *eventSink) Handle(ev events.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+func (c *MQConsumer) isConsuming() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.consuming
+}
+
+func TestUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		state     string
+		storeDown bool
+		consuming bool
+	}{
+		{queuestate.Open, false, true},
+		{queuestate.Paused, false, false},
+		{queuestate.Draining, false, true},
+		{queuestate.Closed, false, true},
+		{queuestate.Open, true, false},
+		{queuestate.Draining, true, false},
+	} {
+		c, ch := newTestConsumer(mock.NewStore("", ""))
+		c.state.State, c.storeDown = tc.state, tc.storeDown
+		assert.NoError(t, c.update())
+		assert.Equal(t, tc.consuming, c.isConsuming(), tc.state)
+
+		// applying the same state again changes nothing
+		assert.NoError(t, c.update())
+		consumes, cancels := ch.counts()
+		if tc.consuming {
+			assert.Equal(t, 1, consumes, tc.state)
+		} else {
+			assert.Equal(t, 0, consumes, tc.state)
+		}
+		assert.Equal(t, 0, cancels, tc.state)
+	}
+
+	c, ch := newTestConsumer(mock.NewStore("", ""))
+	assert.NoError(t, c.update())
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Paused})
+	assert.False(t, c.isConsuming())
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Open})
+	assert.Eventually(t, c.isConsuming, time.Second, 5*time.Millisecond)
+	consumes, cancels := ch.counts()
+	assert.Equal(t, 2, consumes)
+	assert.Equal(t, 1, cancels)
+}
+
+func TestResumeAfterInFlight(t *testing.T) {
+	c, ch := newTestConsumer(mock.NewStore("", ""))
+	assert.NoError(t, c.update())
+	ch.mu.Lock()
+	ch.inFlight = true
+	ch.mu.Unlock()
+
+	// resumed while the handler still has its message
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Paused})
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Open})
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Open})
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, c.isConsuming())
+	consumes, _ := ch.counts()
+	assert.Equal(t, 1, consumes)
+
+	ch.handled()
+	assert.Eventually(t, c.isConsuming, time.Second, 5*time.Millisecond)
+	consumes, cancels := ch.counts()
+	assert.Equal(t, 2, consumes)
+	assert.Equal(t, 1, cancels)
+
+	// paused again before the handler returned, it stays paused
+	ch.mu.Lock()
+	ch.inFlight = true
+	ch.mu.Unlock()
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Paused})
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Open})
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Paused})
+	ch.handled()
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, c.isConsuming())
+	consumes, _ = ch.counts()
+	assert.Equal(t, 2, consumes)
+}
+
+func TestWatchState(t *testing.T) {
+	st := mock.NewStore("", "")
+	c, ch := newTestConsumer(st)
+	assert.NoError(t, c.update())
+	go c.watchState()
+
+	// pushed through the store pub/sub, long before the next poll
+	states := queuestate.NewStore(st)
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, states.Set(queuestate.State{QueueID: testQueue, State: queuestate.Paused}))
+		return !c.isConsuming()
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, states.Set(queuestate.State{QueueID: testQueue, State: queuestate.Open}))
+	assert.Eventually(t, c.isConsuming, time.Second, 10*time.Millisecond)
+	consumes, cancels := ch.counts()
+	assert.Equal(t, 2, consumes)
+	assert.Equal(t, 1, cancels)
+}
+
+func TestCloseIfDrained(t *testing.T) {
+	st := mock.NewStore("", "")
+	c, _ := newTestConsumer(st)
+	states := queuestate.NewStore(st)
+	draining := queuestate.State{QueueID: testQueue, State: queuestate.Draining, Reason: "moved to support"}
+	assert.NoError(t, states.Set(draining))
+	assert.NoError(t, c.pos.AddItem(testQueue, "t1", 1))
+
+	// a task is still waiting
+	c.setState(draining)
+	state, err := states.Get(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, queuestate.Draining, state.State)
+
+	assert.NoError(t, c.pos.RemoveItem(testQueue, "t1"))
+	c.closeIfDrained()
+	state, err = states.Get(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, queuestate.Closed, state.State)
+	assert.Equal(t, "moved to support", state.Reason)
+	// a task submitted while it closed is still dispatched
+	assert.True(t, c.isConsuming())
+
+	// resumed through the API since the consumer last read the state
+	assert.NoError(t, states.Set(queuestate.State{QueueID: testQueue, State: queuestate.Open}))
+	c.state = draining
+	c.closeIfDrained()
+	state, err = states.Get(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, queuestate.Open, state.State)
+}
+
+func TestAgentEvents(t *testing.T) {
+	c, _ := newTestConsumer(mock.NewStore("", ""))
+	sink := &eventSink{}
+	c.events.Add(sink)
+
+	c.reportState()
+	assert.NoError(t, c.update())
+	c.setBusy(true)
+	c.reportState()
+	// paused while handling a task, unavailable once it is done
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Paused})
+	c.setBusy(false)
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Open})
+	// resumed once the handler of the cancelled consumer returned
+	assert.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.events) == 5
+	}, time.Second, 5*time.Millisecond)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	var types []string
+	for _, ev := range sink.events {
+		types = append(types, ev.Type)
+		assert.Equal(t, "123", ev.AccountID)
+		assert.Equal(t, testQueue, ev.QueueID)
+		assert.Equal(t, "consumer-1", ev.Agent)
+		assert.Empty(t, ev.TaskID)
+	}
+	// not consuming before the update, heartbeats without a change emit
+	// nothing
+	assert.Equal(t, []string{events.AgentUnavailable, events.AgentAvailable, events.AgentBusy,
+		events.AgentUnavailable, events.AgentAvailable}, types)
+
+	loggedIn, available, err := c.agents.Count(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loggedIn)
+	assert.Equal(t, 1, available)
+}
+
+func TestApplyRequested(t *testing.T) {
+	st := mock.NewStore("", "")
+	c, ch := newTestConsumer(st)
+	assert.NoError(t, c.update())
+	agents := queuestats.NewAgents(st)
+
+	assert.NoError(t, agents.Request(testQueue, "consumer-1", queuestats.AgentUnavailable))
+	c.applyRequested()
+	assert.False(t, c.isConsuming())
+	// a queue resumed meanwhile does not take the agent back
+	c.setState(queuestate.State{QueueID: testQueue, State: queuestate.Open})
+	assert.False(t, c.isConsuming())
+	list, err := agents.List(testQueue)
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, queuestats.AgentUnavailable, list[0].State)
+	}
+
+	assert.NoError(t, agents.Request(testQueue, "consumer-1", queuestats.AgentAvailable))
+	c.applyRequested()
+	assert.Eventually(t, c.isConsuming, time.Second, 5*time.Millisecond)
+	consumes, cancels := ch.counts()
+	assert.Equal(t, 2, consumes)
+	assert.Equal(t, 1, cancels)
+}
+
+func TestDeadLetterUndecodable(t *testing.T) {
+	st := mock.NewStore("", "")
+	c, _ := newTestConsumer(st)
+	deliveries := make(chan amqp.Delivery, 1)
+	deliveries <- amqp.Delivery{Body: []byte("not a task"), Acknowledger: &nopAcknowledger{}}
+	close(deliveries)
+	c.handleMessages(deliveries)
+
+	letters, err := api.NewDeadLetterStore(st).List(testQueue)
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, testQueue, letters[0].QueueID)
+		assert.Equal(t, "not a task", letters[0].Body)
+		assert.Nil(t, letters[0].Task)
+		assert.NotEmpty(t, letters[0].Reason)
+	}
+}
+
+// nopAcknowledger - accepts every ack and nack of a delivery
+type nopAcknowledger struct{}
+
+func (*nopAcknowledger) Ack(tag uint64, multiple bool) error           { return nil }
+func (*nopAcknowledger) Nack(tag uint64, multiple, requeue bool) error { return nil }
+func (*nopAcknowledger) Reject(tag uint64, requeue bool) error         { return nil }
@@ -0,0 +1,111 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/mq/producer"
+)
+
+const (
+	// eventBindingKey - every account, queue and event type of the topic
+	// exchange
+	eventBindingKey = "#"
+	// eventRetry - wait before dialing the broker again or redelivering an
+	// event the handler failed on
+	eventRetry = 5 * time.Second
+)
+
+//EventHandler - handles one event of the exchange, the message is requeued
+//when it fails
+type EventHandler func(ev events.Event) error
+
+//EventConsumer - consumes the lifecycle events every process publishes to
+//the event exchange from a durable queue, so one process sees the events
+//of all of them. Messages are acked once handled and redelivered after a
+//failure or a lost connection, a handler may see an event twice
+type EventConsumer struct {
+	amqpURL   string
+	exchange  string
+	queueName string
+	handle    EventHandler
+}
+
+func NewEventConsumer(amqpURI, exchange, queueName string, handle EventHandler) *EventConsumer {
+	return &EventConsumer{
+		amqpURL:   amqpURI,
+		exchange:  exchange,
+		queueName: queueName,
+		handle:    handle,
+	}
+}
+
+// Start - consume in the background, the broker is dialed again whenever
+// the connection is lost
+func (ec *EventConsumer) Start() {
+	go func() {
+		for {
+			if err := ec.consume(); err != nil {
+				logger.Error("consuming events failed", "queue", ec.queueName, logger.FieldError, err)
+			}
+			time.Sleep(eventRetry)
+		}
+	}()
+}
+
+// consume - declare and bind the queue then handle its messages until the
+// channel closes
+func (ec *EventConsumer) consume() error {
+	conn, err := amqp.Dial(ec.amqpURL)
+	if err != nil {
+		return fmt.Errorf("error:: amqp dial: %+v", err)
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("error:: getting channel: %+v", err)
+	}
+	if err = channel.ExchangeDeclare(ec.exchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("error:: exchange declare: %+v", err)
+	}
+	if _, err = channel.QueueDeclare(ec.queueName, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("error:: queue declare: %+v", err)
+	}
+	if err = channel.QueueBind(ec.queueName, eventBindingKey, ec.exchange, false, nil); err != nil {
+		return fmt.Errorf("error:: queue bind: %+v", err)
+	}
+	if err = channel.Qos(100, 0, false); err != nil {
+		return fmt.Errorf("error:: basic.qos: %+v", err)
+	}
+	deliveries, err := channel.Consume(ec.queueName, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("error:: queue consume: %+v", err)
+	}
+	logger.Info("consuming events", "exchange", ec.exchange, "queue", ec.queueName)
+
+	for d := range deliveries {
+		ec.deliver(d)
+	}
+	return fmt.Errorf("error:: event deliveries closed")
+}
+
+func (ec *EventConsumer) deliver(d amqp.Delivery) {
+	msg := producer.EventMessage{}
+	if err := json.Unmarshal(d.Body, &msg); err != nil || msg.Version > producer.EventSchemaVersion {
+		logger.Error("invalid event message, dropping it", "routing_key", d.RoutingKey, "version", msg.Version, logger.FieldError, err)
+		d.Nack(false, false)
+		return
+	}
+	if err := ec.handle(msg.Event); err != nil {
+		logger.Error("handling event failed, requeuing it", "event", msg.Type, logger.FieldTaskID, msg.TaskID, logger.FieldError, err)
+		time.Sleep(eventRetry)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
@@ -0,0 +1,139 @@
+package producer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+
+	"queuev2/config"
+	"queuev2/events"
+	"queuev2/logger"
+)
+
+// EventSchemaVersion - version of EventMessage, bumped on incompatible
+// changes so consumers can handle both during an upgrade
+const EventSchemaVersion = 1
+
+const contentTypeJSON = "application/json"
+
+//EventMessage - body of the messages published to the event exchange
+type EventMessage struct {
+	Version int `json:"version"`
+	events.Event
+}
+
+//EventOptions - events are published in batches of up to BatchSize, a
+//batch the broker did not confirm is retried MaxAttempts times
+type EventOptions struct {
+	Exchange    string        `mapstructure:"exchange"`
+	QueueSize   int           `mapstructure:"queueSize"`
+	BatchSize   int           `mapstructure:"batchSize"`
+	MaxAttempts int           `mapstructure:"maxAttempts"`
+	Backoff     time.Duration `mapstructure:"backoff"`
+}
+
+// DefaultEventOptions - 5 attempts 1s, 2s, 4s and 8s apart
+func DefaultEventOptions() EventOptions {
+	return EventOptions{
+		Exchange:    "queuev2-events",
+		QueueSize:   1000,
+		BatchSize:   100,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+	}
+}
+
+// LoadEventOptions - event exchange options of the active profile
+func LoadEventOptions(conf *viper.Viper) (EventOptions, error) {
+	opts := DefaultEventOptions()
+	err := config.UnmarshalKey(conf, config.EventExchange, &opts)
+	return opts, err
+}
+
+// EventRoutingKey - "<account>.<queue>.<event type>" such as
+// "123.QID_sales.task.abandoned", dots in the ids are replaced so they
+// stay one word of the topic
+func EventRoutingKey(ev events.Event) string {
+	return routingWord(ev.AccountID) + "." + routingWord(ev.QueueID) + "." + ev.Type
+}
+
+func routingWord(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.ReplaceAll(s, ".", "_")
+}
+
+//EventPublisher - events.Sink publishing every event to a topic exchange
+//with publisher confirms
+type EventPublisher struct {
+	producer *MQProducer
+	opts     EventOptions
+	queue    *events.Async
+}
+
+// NewEventPublisher - declare the topic exchange and start publishing
+func NewEventPublisher(p *MQProducer, opts EventOptions) (*EventPublisher, error) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if err := p.DeclareExchange(opts.Exchange, amqp.ExchangeTopic); err != nil {
+		return nil, err
+	}
+
+	ep := &EventPublisher{
+		producer: p,
+		opts:     opts,
+	}
+	ep.queue = events.NewAsyncBatch("event publish", opts.QueueSize, opts.BatchSize, ep.publish)
+	return ep, nil
+}
+
+// Handle - queue the event for publishing, it is dropped when the queue is
+// full
+func (ep *EventPublisher) Handle(ev events.Event) {
+	ep.queue.Handle(ev)
+}
+
+// publish - retry the messages the broker did not confirm, the ones still
+// failing after MaxAttempts are dropped
+func (ep *EventPublisher) publish(batch []events.Event) {
+	msgs := make([]Message, 0, len(batch))
+	for _, ev := range batch {
+		body, err := json.Marshal(EventMessage{Version: EventSchemaVersion, Event: ev})
+		if err != nil {
+			logger.Error("encoding event failed", "event", ev.Type, logger.FieldTaskID, ev.TaskID, logger.FieldError, err)
+			continue
+		}
+		msgs = append(msgs, Message{
+			RoutingKey:   EventRoutingKey(ev),
+			Body:         body,
+			ContentType:  contentTypeJSON,
+			DeliveryMode: amqp.Persistent,
+		})
+	}
+
+	for attempt := 1; len(msgs) > 0; attempt++ {
+		var failed []Message
+		var lastErr error
+		for i, err := range ep.producer.publishConfirmed(ep.opts.Exchange, msgs) {
+			if err != nil {
+				failed = append(failed, msgs[i])
+				lastErr = err
+			}
+		}
+		if len(failed) == 0 {
+			return
+		}
+		if attempt >= ep.opts.MaxAttempts {
+			logger.Error("publishing events failed, dropping them", "events", len(failed), "attempts", attempt, logger.FieldError, lastErr)
+			return
+		}
+		logger.Warn("publishing events failed, retrying", "events", len(failed), "attempt", attempt, logger.FieldError, lastErr)
+		time.Sleep(ep.opts.Backoff << uint(attempt-1))
+		msgs = failed
+	}
+}
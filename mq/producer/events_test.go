@@ -0,0 +1,30 @@
+package producer
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+)
+
+func TestEventRoutingKey(t *testing.T) {
+	ev := events.Event{Type: events.TaskAbandoned, AccountID: "123", QueueID: "QID_sales"}
+	assert.Equal(t, "123.QID_sales.task.abandoned", EventRoutingKey(ev))
+
+	ev = events.Event{Type: events.TaskDeadLettered, AccountID: "acme.eu"}
+	assert.Equal(t, "acme_eu._.task.dead_lettered", EventRoutingKey(ev))
+}
+
+func TestEventMessage(t *testing.T) {
+	body, err := json.Marshal(EventMessage{Version: EventSchemaVersion, Event: events.Event{Type: events.TaskEnqueued, TaskID: "t1", Position: 2}})
+	assert.NoError(t, err)
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &decoded))
+	assert.Equal(t, float64(EventSchemaVersion), decoded["version"])
+	assert.Equal(t, events.TaskEnqueued, decoded["type"])
+	assert.Equal(t, "t1", decoded["task_id"])
+	assert.Equal(t, float64(2), decoded["position"])
+}
@@ -1,17 +1,46 @@
 package producer
 
 import (
+	"errors"
 	"fmt"
 	"github.com/streadway/amqp"
-	"log"
+	"queuev2/logger"
+	"queuev2/metrics"
+	"sync"
+	"time"
 )
 
+// HeaderRequestID - amqp header carrying the X-Request-ID of the api call
+// that published the message
+const HeaderRequestID = "x-request-id"
+
+// confirmTimeout - how long a publish waits for the broker confirms
+const confirmTimeout = 10 * time.Second
+
+// ErrNotConfirmed - the broker did not confirm the message in time, it may
+// or may not have been queued
+var ErrNotConfirmed = errors.New("message not confirmed by the broker")
+
+//Message - one message of a batch, ContentType defaults to text/plain and
+//DeliveryMode to transient
+type Message struct {
+	RoutingKey   string
+	Body         []byte
+	Priority     uint8
+	Headers      amqp.Table
+	ContentType  string
+	DeliveryMode uint8
+}
+
 type MQProducer struct {
 	amqpURL      string
 	exchange     string
 	exchangeType string
-	conn         *amqp.Connection
 	MaxPriority  uint8
+
+	// conn is replaced when the broker closed it
+	mu   sync.Mutex
+	conn *amqp.Connection
 }
 
 func NewMQProducer(amqpURI, exchange, exchangeType string) *MQProducer {
@@ -21,10 +50,10 @@ func NewMQProducer(amqpURI, exchange, exchangeType string) *MQProducer {
 		exchangeType: exchangeType,
 	}
 
-	log.Printf("dialing %q", amqpURI)
+	logger.Info("dialing amqp broker")
 	connection, err := amqp.Dial(amqpURI)
 	if err != nil {
-		log.Fatalf("error:: amqp dial: %+v", err)
+		logger.Fatal("amqp dial failed", logger.FieldError, err)
 	}
 
 	p.conn = connection
@@ -33,24 +62,30 @@ func NewMQProducer(amqpURI, exchange, exchangeType string) *MQProducer {
 
 func (p *MQProducer) Start() {
 	if err := p.declareExchange(); err != nil {
-		log.Fatalf("error:: prodcuer start: %+v", err)
+		logger.Fatal("producer start failed", logger.FieldError, err)
 	}
 }
 
 func (p *MQProducer) declareExchange() error {
-	channel, err := p.conn.Channel()
+	return p.DeclareExchange(p.exchange, p.exchangeType)
+}
+
+// DeclareExchange - declare a durable exchange besides the one of the
+// tasks, e.g. the topic exchange of lifecycle events
+func (p *MQProducer) DeclareExchange(exchange, exchangeType string) error {
+	channel, err := p.channel()
 	if err != nil {
-		return fmt.Errorf("error:: getting channel: %+v", err)
+		return err
 	}
-	log.Printf("got Channel, declaring %q Exchange (%q)", p.exchangeType, p.exchange)
+	logger.Info("declaring exchange", "exchange", exchange, "type", exchangeType)
 	if err := channel.ExchangeDeclare(
-		p.exchange,     // name
-		p.exchangeType, // type
-		true,           // durable
-		false,          // auto-deleted
-		false,          // internal
-		false,          // noWait
-		nil,            // arguments
+		exchange,     // name
+		exchangeType, // type
+		true,         // durable
+		false,        // auto-deleted
+		false,        // internal
+		false,        // noWait
+		nil,          // arguments
 	); err != nil {
 		return fmt.Errorf("error:: exchange declare: %+v", err)
 	}
@@ -60,38 +95,185 @@ func (p *MQProducer) declareExchange() error {
 	return nil
 }
 
-func (p *MQProducer) PublishMessage(routingKey string, body []byte, priority uint8) error {
+// Ping - verify the broker connection by opening and closing a channel, a
+// closed connection is dialed again
+func (p *MQProducer) Ping() error {
+	channel, err := p.channel()
+	if err != nil {
+		return err
+	}
+	return channel.Close()
+}
+
+// channel - open a channel, the broker is dialed again when it closed the
+// connection so publishing recovers from broker restarts
+func (p *MQProducer) channel() (*amqp.Channel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn.IsClosed() {
+		logger.Warn("amqp connection is closed, dialing broker again")
+		conn, err := amqp.Dial(p.amqpURL)
+		if err != nil {
+			return nil, fmt.Errorf("error:: amqp dial: %+v", err)
+		}
+		p.conn = conn
+		metrics.AMQPReconnected()
+	}
 	channel, err := p.conn.Channel()
 	if err != nil {
-		return fmt.Errorf("error:: getting channel: %+v", err)
-	}
-	if err = channel.Publish(
-		p.exchange, // publish to an exchange
-		routingKey, // routing to 0 or more queues
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentType:     "text/plain",
-			ContentEncoding: "",
-			Body:            body,
-			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			Priority:        priority,       // 0-9
-		},
-	); err != nil {
-		return fmt.Errorf("error:: exchange Publish: %+v", err)
+		return nil, fmt.Errorf("error:: getting channel: %+v", err)
+	}
+	return channel, nil
+}
+
+// PublishMessage - publish body with the given priority and wait for the
+// broker confirm, headers such as HeaderRequestID travel with the message
+// to the consumer
+func (p *MQProducer) PublishMessage(routingKey string, body []byte, priority uint8, headers amqp.Table) error {
+	return p.publishConfirmed(p.exchange, []Message{{
+		RoutingKey: routingKey,
+		Body:       body,
+		Priority:   priority,
+		Headers:    headers,
+	}})[0]
+}
+
+// PublishBatch - publish msgs on a single channel in confirm mode and wait
+// for the broker confirms, the error of each message is at its index
+func (p *MQProducer) PublishBatch(msgs []Message) []error {
+	return p.publishConfirmed(p.exchange, msgs)
+}
+
+// publishConfirmed - PublishBatch to any exchange
+func (p *MQProducer) publishConfirmed(exchange string, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	fail := func(from int, err error) {
+		for i := from; i < len(msgs); i++ {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	channel, err := p.channel()
+	if err != nil {
+		fail(0, err)
+		return errs
+	}
+	defer channel.Close()
+
+	if err = channel.Confirm(false); err != nil {
+		fail(0, fmt.Errorf("error:: confirm mode: %+v", err))
+		return errs
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, len(msgs)))
+	start := time.Now()
+	defer func() {
+		metrics.ObservePublish(exchange, time.Since(start))
+	}()
+
+	// delivery tags start at 1 and follow the publish order
+	var published []int
+	for i, m := range msgs {
+		headers := m.Headers
+		if headers == nil {
+			headers = amqp.Table{}
+		}
+		contentType, mode := m.ContentType, m.DeliveryMode
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		if mode == 0 {
+			mode = amqp.Transient
+		}
+		err = channel.Publish(exchange, m.RoutingKey, false, false, amqp.Publishing{
+			Headers:      headers,
+			ContentType:  contentType,
+			Body:         m.Body,
+			DeliveryMode: mode,
+			Priority:     m.Priority,
+		})
+		if err != nil {
+			// the channel is closed, nothing after this message can be sent
+			fail(i, fmt.Errorf("error:: exchange Publish: %+v", err))
+			break
+		}
+		published = append(published, i)
+	}
+
+	timeout := time.NewTimer(confirmTimeout)
+	defer timeout.Stop()
+	for range published {
+		select {
+		case c, ok := <-confirms:
+			if !ok {
+				markUnconfirmed(errs, published, ErrNotConfirmed)
+				return errs
+			}
+			if n := int(c.DeliveryTag) - 1; n >= 0 && n < len(published) {
+				idx := published[n]
+				if c.Ack {
+					errs[idx] = nil
+				} else {
+					errs[idx] = errors.New("error:: message nacked by the broker")
+				}
+				published[n] = -1
+			}
+		case <-timeout.C:
+			markUnconfirmed(errs, published, ErrNotConfirmed)
+			return errs
+		}
+	}
+	return errs
+}
+
+// markUnconfirmed - set err on messages still waiting for a confirm,
+// confirmed ones are marked with -1 in published
+func markUnconfirmed(errs []error, published []int, err error) {
+	for _, idx := range published {
+		if idx >= 0 {
+			errs[idx] = err
+		}
+	}
+}
+
+// QueueDepth - number of messages waiting in the queue
+func (p *MQProducer) QueueDepth(queueName string) (int, error) {
+	channel, err := p.channel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	q, err := channel.QueueInspect(queueName)
+	if err != nil {
+		return 0, fmt.Errorf("error:: queue inspect: %+v", err)
+	}
+	return q.Messages, nil
+}
+
+// DeleteQueue - delete the queue and the messages still waiting in it
+func (p *MQProducer) DeleteQueue(queueName string) error {
+	channel, err := p.channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	logger.Info("deleting queue", logger.FieldQueueID, queueName)
+	if _, err = channel.QueueDelete(queueName, false, false, false); err != nil {
+		return fmt.Errorf("error:: queue delete: %+v", err)
 	}
-	channel.Close()
 	return nil
 }
 
 func (p *MQProducer) CreateQueue(queueName string, maxPriority uint8) error {
 	p.MaxPriority = maxPriority
-	channel, err := p.conn.Channel()
+	channel, err := p.channel()
 	if err != nil {
-		return fmt.Errorf("error:: getting channel: %+v", err)
+		return err
 	}
-	log.Printf("declaring queue %s", queueName)
+	logger.Info("declaring queue", logger.FieldQueueID, queueName)
 	_, err = channel.QueueDeclare(
 		queueName, // name of the queue
 		true,      // durable
@@ -101,5 +283,10 @@ func (p *MQProducer) CreateQueue(queueName string, maxPriority uint8) error {
 		amqp.Table{"x-max-priority": maxPriority}, // arguments
 	)
 	channel.Close()
+	if err != nil {
+		// an existing queue declared with other arguments is a
+		// PRECONDITION_FAILED *amqp.Error
+		return fmt.Errorf("error:: queue declare: %w", err)
+	}
 	return nil
 }
@@ -1,32 +1,192 @@
 package position
 
 import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"queuev2/logger"
 	"queuev2/store"
 )
 
 type Position struct {
-	store store.Store
+	store  store.Store
+	pubsub store.PubSub
 }
 
-const positionSet = "p_set"
+// positionSetPrefix - one sorted set per queue, ranks are only meaningful
+// among tasks of the same queue
+const positionSetPrefix = "p_set:"
+
+// legacyPositionSet - the single set of every queue used before the sets
+// per queue, it was emptied whenever a process started
+const legacyPositionSet = "p_set"
+
+// changeChannelPrefix - changes of queue <id> are published on
+// positions:<id> so every API replica can push them to its streams
+const changeChannelPrefix = "positions:"
 
-func NewPosition(store store.Store) *Position {
+// change events
+const (
+	EventAdded   = "added"
+	EventRemoved = "removed"
+	EventCleared = "cleared"
+)
+
+//Change - items joined or left the queue, the positions of every item
+//behind them moved
+type Change struct {
+	QueueID string   `json:"queue_id"`
+	Event   string   `json:"event"`
+	Items   []string `json:"items,omitempty"`
+}
+
+func NewPosition(st store.Store) *Position {
 	p := &Position{
-		store: store,
+		store: st,
 	}
-	store.DeleteKey(positionSet)
+	p.pubsub, _ = st.(store.PubSub)
 	return p
 }
 
-func (p *Position) AddItem(item string, score int) error {
-	err := p.store.AddSortedSet(positionSet, score, item)
+// MigrateLegacy - remove the set shared by every queue of older releases.
+// Its items cannot be assigned to their queue, the account of a task being
+// unknown, so tasks waiting across the upgrade report no position until
+// they are dispatched, as they did after any restart before. The sets per
+// queue are no longer emptied on start, they survive restarts
+func MigrateLegacy(st store.Store) error {
+	exists, err := st.KeyExists(legacyPositionSet)
+	if err != nil || exists != 1 {
+		return err
+	}
+	if err = st.DeleteKey(legacyPositionSet); err != nil {
+		return err
+	}
+	logger.Info("removed the position set shared by every queue, positions are kept per queue")
+	return nil
+}
+
+func setKey(queueID string) string {
+	return positionSetPrefix + queueID
+}
+
+func (p *Position) AddItem(queueID, item string, score int) error {
+	err := p.store.AddSortedSet(setKey(queueID), score, item)
+	if err == nil {
+		p.publish(Change{QueueID: queueID, Event: EventAdded, Items: []string{item}})
+	}
+	return err
+}
+
+// AddItems - add items of one queue with a single store call
+func (p *Position) AddItems(queueID string, scores map[string]int) error {
+	if err := p.store.AddSortedSetMulti(setKey(queueID), scores); err != nil {
+		return err
+	}
+	items := make([]string, 0, len(scores))
+	for item := range scores {
+		items = append(items, item)
+	}
+	p.publish(Change{QueueID: queueID, Event: EventAdded, Items: items})
+	return nil
+}
+
+func (p *Position) RemoveItem(queueID, item string) error {
+	err := p.store.RemoveSortedSet(setKey(queueID), item)
+	if err == nil {
+		p.publish(Change{QueueID: queueID, Event: EventRemoved, Items: []string{item}})
+	}
+	return err
+}
+
+// List - waiting items of the queue in position order
+func (p *Position) List(queueID string) ([]string, error) {
+	return p.store.GetAllItemsSortedSet(setKey(queueID))
+}
+
+// Scores - waiting items of the queue with their score, the queue max
+// priority minus the priority of the item
+func (p *Position) Scores(queueID string) (map[string]int, error) {
+	return p.store.GetAllScoresSortedSet(setKey(queueID))
+}
+
+// Count - number of waiting items of the queue
+func (p *Position) Count(queueID string) (int, error) {
+	return p.store.GetCountSortedSet(setKey(queueID))
+}
+
+// Clear - forget every position of the queue
+func (p *Position) Clear(queueID string) error {
+	err := p.store.DeleteKey(setKey(queueID))
+	if err == nil {
+		p.publish(Change{QueueID: queueID, Event: EventCleared})
+	}
 	return err
 }
 
-func (p *Position) RemoveItem(item string) error {
-	return p.store.RemoveSortedSet(positionSet, item)
+// GetPositions - 0 based rank of each item, -1 for items not in the queue
+func (p *Position) GetPositions(queueID string, items []string) ([]int, error) {
+	return p.store.GetRanksSortedSet(setKey(queueID), items)
+}
+
+// GetPosition - 0 based rank of item in its queue
+func (p *Position) GetPosition(queueID, item string) (int, error) {
+	return p.store.GetRankSortedSet(setKey(queueID), item)
+}
+
+// CanWatch - false when the store cannot fan out changes
+func (p *Position) CanWatch() bool {
+	return p.pubsub != nil
 }
 
-func (p *Position) GetPosition(item string) (int, error) {
-	return p.store.GetRankSortedSet(positionSet, item)
+// Watch - changes of every queue, published by any process sharing the
+// store. The channel closes when the subscription is lost
+func (p *Position) Watch() (<-chan Change, func(), error) {
+	msgs, cancel, err := p.pubsub.PSubscribe(changeChannelPrefix + "*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := make(chan Change)
+	done := make(chan struct{})
+	go func() {
+		defer close(changes)
+		for msg := range msgs {
+			var ch Change
+			if err := json.Unmarshal([]byte(msg.Data), &ch); err != nil {
+				logger.Warn("invalid position change", "channel", msg.Channel, logger.FieldError, err)
+				continue
+			}
+			if ch.QueueID == "" {
+				ch.QueueID = strings.TrimPrefix(msg.Channel, changeChannelPrefix)
+			}
+			select {
+			case changes <- ch:
+			case <-done:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return changes, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}, nil
+}
+
+// publish - positions are already stored, a lost change only delays the
+// streams until the next one
+func (p *Position) publish(ch Change) {
+	if p.pubsub == nil {
+		return
+	}
+	data, err := json.Marshal(ch)
+	if err != nil {
+		return
+	}
+	if err = p.pubsub.Publish(changeChannelPrefix+ch.QueueID, string(data)); err != nil {
+		logger.Warn("failed to publish position change", logger.FieldQueueID, ch.QueueID, logger.FieldError, err)
+	}
 }
@@ -0,0 +1,178 @@
+package queuestate
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+// Queue states, a queue is open until it is paused or drained
+const (
+	// Open - tasks are accepted and dispatched
+	Open = "open"
+	// Paused - tasks are accepted and wait until the queue is resumed
+	Paused = "paused"
+	// Draining - new tasks are rejected, the waiting ones are dispatched.
+	// The queue is closed once none is left
+	Draining = "draining"
+	// Closed - drained, new tasks are rejected with the reason of the state.
+	// Consumers keep dispatching, a submit racing the drain may still have
+	// queued a task
+	Closed = "closed"
+)
+
+const (
+	stateKeyPrefix = "queuestate:"
+
+	// changeChannelPrefix - state changes of queue <id> are published on
+	// queuestate:<id> so consumers react without waiting for their next poll
+	changeChannelPrefix = "queuestate:"
+)
+
+//State - dispatch state of a queue, Reason is the message rejected submits
+//get while the queue is draining or closed
+type State struct {
+	QueueID   string    `json:"queue_id"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Accepting - whether new tasks may be submitted
+func (s State) Accepting() bool {
+	return s.State == Open || s.State == Paused
+}
+
+// Dispatching - whether consumers take the waiting tasks, only a paused
+// queue holds them
+func (s State) Dispatching() bool {
+	return s.State != Paused
+}
+
+//Store - state of each queue keyed by queue id, queues without a stored
+//state are open. Queue ids are unique across accounts so consumers, which
+//only know their queue id, read the same keys as the API
+type Store struct {
+	store  store.Store
+	pubsub store.PubSub
+}
+
+func NewStore(st store.Store) *Store {
+	s := &Store{store: st}
+	s.pubsub, _ = st.(store.PubSub)
+	return s
+}
+
+func stateKey(queueID string) string {
+	return stateKeyPrefix + queueID
+}
+
+// Get - current state of the queue
+func (s *Store) Get(queueID string) (State, error) {
+	key := stateKey(queueID)
+	exists, err := s.store.KeyExists(key)
+	if err != nil {
+		return State{}, err
+	}
+	if exists != 1 {
+		return State{QueueID: queueID, State: Open}, nil
+	}
+
+	data, err := s.store.GetStruct(key)
+	if err != nil {
+		return State{}, err
+	}
+	state := State{}
+	if err = json.Unmarshal([]byte(data), &state); err != nil {
+		return State{}, err
+	}
+	state.QueueID = queueID
+	return state, nil
+}
+
+// Set - replace the state of the queue and notify its consumers, opening a
+// queue removes its stored state
+func (s *Store) Set(state State) error {
+	if state.ChangedAt.IsZero() {
+		state.ChangedAt = time.Now().UTC()
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	key := stateKey(state.QueueID)
+	if state.State == Open {
+		err = s.store.DeleteKey(key)
+	} else {
+		// a paused queue must stay paused
+		err = s.store.SetStructNoExpire(key, string(data))
+	}
+	if err != nil {
+		return err
+	}
+	s.publish(state.QueueID, string(data))
+	return nil
+}
+
+// Delete - forget the state of a deleted queue
+func (s *Store) Delete(queueID string) error {
+	return s.store.DeleteKey(stateKey(queueID))
+}
+
+// CanWatch - false when the store cannot fan out changes, callers poll Get
+func (s *Store) CanWatch() bool {
+	return s.pubsub != nil
+}
+
+// Watch - states set for the queue by any process sharing the store. The
+// channel closes when the subscription is lost
+func (s *Store) Watch(queueID string) (<-chan State, func(), error) {
+	msgs, cancel, err := s.pubsub.PSubscribe(changeChannelPrefix + queueID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	states := make(chan State)
+	done := make(chan struct{})
+	go func() {
+		defer close(states)
+		for msg := range msgs {
+			var state State
+			if err := json.Unmarshal([]byte(msg.Data), &state); err != nil {
+				logger.Warn("invalid queue state", "channel", msg.Channel, logger.FieldError, err)
+				continue
+			}
+			if state.QueueID == "" {
+				state.QueueID = strings.TrimPrefix(msg.Channel, changeChannelPrefix)
+			}
+			select {
+			case states <- state:
+			case <-done:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return states, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}, nil
+}
+
+// publish - the state is already stored, consumers missing the change pick
+// it up on their next poll
+func (s *Store) publish(queueID, data string) {
+	if s.pubsub == nil {
+		return
+	}
+	if err := s.pubsub.Publish(changeChannelPrefix+queueID, data); err != nil {
+		logger.Warn("failed to publish queue state", logger.FieldQueueID, queueID, logger.FieldError, err)
+	}
+}
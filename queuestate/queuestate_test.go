@@ -0,0 +1,65 @@
+package queuestate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/store/mock"
+)
+
+const testQueue = "QID_MTIzX3NhbGVzNQ=="
+
+func TestStore(t *testing.T) {
+	s := NewStore(mock.NewStore("", ""))
+	state, err := s.Get(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, Open, state.State)
+	assert.True(t, state.Accepting())
+	assert.True(t, state.Dispatching())
+
+	states, cancel, err := s.Watch(testQueue)
+	assert.NoError(t, err)
+	defer cancel()
+
+	assert.NoError(t, s.Set(State{QueueID: testQueue, State: Draining, Reason: "moved to support"}))
+	state, err = s.Get(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, Draining, state.State)
+	assert.Equal(t, "moved to support", state.Reason)
+	assert.False(t, state.ChangedAt.IsZero())
+	assert.False(t, state.Accepting())
+	assert.True(t, state.Dispatching())
+
+	select {
+	case got := <-states:
+		assert.Equal(t, testQueue, got.QueueID)
+		assert.Equal(t, Draining, got.State)
+	case <-time.After(time.Second):
+		t.Fatal("state change was not published")
+	}
+
+	assert.NoError(t, s.Set(State{QueueID: testQueue, State: Open}))
+	state, err = s.Get(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, Open, state.State)
+	assert.Empty(t, state.Reason)
+}
+
+func TestStateDispatching(t *testing.T) {
+	for _, tc := range []struct {
+		state                  string
+		accepting, dispatching bool
+	}{
+		{Open, true, true},
+		{Paused, true, false},
+		{Draining, false, true},
+		// tasks queued by a submit racing the drain are still dispatched
+		{Closed, false, true},
+	} {
+		state := State{State: tc.state}
+		assert.Equal(t, tc.accepting, state.Accepting(), tc.state)
+		assert.Equal(t, tc.dispatching, state.Dispatching(), tc.state)
+	}
+}
@@ -0,0 +1,166 @@
+package queuestats
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"queuev2/store"
+)
+
+const (
+	agentsHashPrefix = "agents:"
+	// agentRequestsHashPrefix - state an operator requested for agents of
+	// the queue, kept apart from the heartbeats which overwrite presences
+	agentRequestsHashPrefix = "agent_requests:"
+)
+
+// AgentTTL - agents are logged out when they miss heartbeats for this long
+const AgentTTL = 30 * time.Second
+
+// Agent states, an unavailable agent is logged in but takes no task, e.g.
+// the consumer of a paused queue
+const (
+	AgentAvailable   = "available"
+	AgentBusy        = "busy"
+	AgentUnavailable = "unavailable"
+)
+
+//agentPresence - value of an agent in the agents hash of a queue
+type agentPresence struct {
+	State string `json:"state"`
+	Seen  int64  `json:"seen"`
+}
+
+//Agent - agent logged in to a queue. RequestedState is the state an
+//operator asked for, the agent applies it on its next heartbeat
+type Agent struct {
+	AgentID        string    `json:"agent_id"`
+	State          string    `json:"state"`
+	RequestedState string    `json:"requested_state,omitempty"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+//Agents - presence of the agents serving each queue, every consumer is one
+//agent handling a task at a time
+type Agents struct {
+	store store.Store
+}
+
+func NewAgents(st store.Store) *Agents {
+	return &Agents{store: st}
+}
+
+func agentsKey(queueID string) string {
+	return agentsHashPrefix + queueID
+}
+
+func agentRequestsKey(queueID string) string {
+	return agentRequestsHashPrefix + queueID
+}
+
+// Heartbeat - log the agent in or keep it logged in with its current state
+func (a *Agents) Heartbeat(queueID, agentID, state string) error {
+	data, err := json.Marshal(agentPresence{State: state, Seen: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	return a.store.SetStructInHashNoExpire(agentsKey(queueID), agentID, string(data))
+}
+
+// Logout - remove the agent before its heartbeats expire
+func (a *Agents) Logout(queueID, agentID string) error {
+	return a.store.DeleteStructFromHash(agentsKey(queueID), agentID)
+}
+
+// Count - agents serving the queue, available or busy, and how many of
+// them are available. Unavailable agents are not counted
+func (a *Agents) Count(queueID string) (loggedIn, available int, err error) {
+	agents, err := a.presences(queueID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range agents {
+		switch p.State {
+		case AgentAvailable:
+			available++
+			loggedIn++
+		case AgentBusy:
+			loggedIn++
+		}
+	}
+	return loggedIn, available, nil
+}
+
+// List - agents logged in to the queue, unavailable ones included, by id
+func (a *Agents) List(queueID string) ([]Agent, error) {
+	presences, err := a.presences(queueID)
+	if err != nil {
+		return nil, err
+	}
+	agents := make([]Agent, 0, len(presences))
+	for id, p := range presences {
+		requested, err := a.Requested(queueID, id)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, Agent{AgentID: id, State: p.State, RequestedState: requested, LastSeen: time.Unix(p.Seen, 0).UTC()})
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].AgentID < agents[j].AgentID })
+	return agents, nil
+}
+
+// Request - ask the agent to become available or unavailable. An
+// unavailable agent stops taking tasks until it is requested available
+func (a *Agents) Request(queueID, agentID, state string) error {
+	if state == AgentUnavailable {
+		return a.store.SetStructInHashNoExpire(agentRequestsKey(queueID), agentID, state)
+	}
+	return a.clearRequest(queueID, agentID)
+}
+
+// Requested - state requested for the agent, empty when none was
+func (a *Agents) Requested(queueID, agentID string) (string, error) {
+	key := agentRequestsKey(queueID)
+	exists, err := a.store.KeyExistsInHash(key, agentID)
+	if err != nil || exists != 1 {
+		return "", err
+	}
+	return a.store.GetStructFromHash(key, agentID)
+}
+
+func (a *Agents) clearRequest(queueID, agentID string) error {
+	key := agentRequestsKey(queueID)
+	exists, err := a.store.KeyExistsInHash(key, agentID)
+	if err != nil || exists != 1 {
+		return err
+	}
+	return a.store.DeleteStructFromHash(key, agentID)
+}
+
+// presences - logged in agents by id, agents which missed their heartbeats
+// are removed together with their requested state
+func (a *Agents) presences(queueID string) (map[string]agentPresence, error) {
+	key := agentsKey(queueID)
+	ids, err := a.store.GetKeysFromHash(key)
+	if err != nil {
+		return nil, err
+	}
+
+	oldest := time.Now().Add(-AgentTTL).Unix()
+	presences := make(map[string]agentPresence, len(ids))
+	for _, id := range ids {
+		data, err := a.store.GetStructFromHash(key, id)
+		if err != nil {
+			continue
+		}
+		var p agentPresence
+		if json.Unmarshal([]byte(data), &p) != nil || p.Seen < oldest {
+			a.store.DeleteStructFromHash(key, id)
+			a.clearRequest(queueID, id)
+			continue
+		}
+		presences[id] = p
+	}
+	return presences, nil
+}
@@ -0,0 +1,206 @@
+package queuestats
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+
+	"queuev2/config"
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/metrics"
+	"queuev2/store"
+)
+
+const (
+	arrivalsKeyPrefix    = "stats:arrivals:"
+	handleTimesKeyPrefix = "stats:handle:"
+
+	// minRateSpan - arrival rates are averaged over at least this long so
+	// the first arrivals do not read as a burst
+	minRateSpan = time.Minute
+)
+
+//Options - statistics cover the last Window, at most MaxSamples per queue
+//and kind are kept
+type Options struct {
+	Window     time.Duration `mapstructure:"window"`
+	MaxSamples int           `mapstructure:"maxSamples"`
+	QueueSize  int           `mapstructure:"queueSize"`
+}
+
+// DefaultOptions - the last hour, at most 500 samples
+func DefaultOptions() Options {
+	return Options{
+		Window:     time.Hour,
+		MaxSamples: 500,
+		QueueSize:  1000,
+	}
+}
+
+// LoadOptions - statistics options of the active profile
+func LoadOptions(conf *viper.Viper) (Options, error) {
+	opts := DefaultOptions()
+	err := config.UnmarshalKey(conf, config.QueueStats, &opts)
+	return opts, err
+}
+
+//Rates - recent traffic of a queue
+type Rates struct {
+	Arrivals    int
+	ArrivalRate float64 // tasks per second
+	Handled     int
+	HandleTime  time.Duration // mean
+}
+
+//Stats - rolling statistics of each queue kept in the store, so every
+//process records into and reads the same windows
+type Stats struct {
+	store store.Store
+	opts  Options
+}
+
+func NewStats(st store.Store, opts Options) *Stats {
+	if opts.Window <= 0 {
+		opts.Window = DefaultOptions().Window
+	}
+	return &Stats{store: st, opts: opts}
+}
+
+func (s *Stats) window(prefix, queueID string) *window {
+	return &window{store: s.store, key: prefix + queueID, length: s.opts.Window, max: s.opts.MaxSamples}
+}
+
+// RecordArrival - a task joined the queue
+func (s *Stats) RecordArrival(queueID string, at time.Time) error {
+	return s.window(arrivalsKeyPrefix, queueID).record(at, 1)
+}
+
+// RecordHandleTime - a consumer finished with a task after d
+func (s *Stats) RecordHandleTime(queueID string, at time.Time, d time.Duration) error {
+	return s.window(handleTimesKeyPrefix, queueID).record(at, d.Seconds())
+}
+
+// Rates - arrivals and handle times of the window ending now
+func (s *Stats) Rates(queueID string) (Rates, error) {
+	now := time.Now()
+	arrivals, err := s.window(arrivalsKeyPrefix, queueID).samples(now)
+	if err != nil {
+		return Rates{}, err
+	}
+	handled, err := s.window(handleTimesKeyPrefix, queueID).samples(now)
+	if err != nil {
+		return Rates{}, err
+	}
+
+	r := Rates{Arrivals: len(arrivals), Handled: len(handled)}
+	if len(arrivals) > 0 {
+		span := now.Sub(arrivals[0].Time)
+		if span < minRateSpan {
+			span = minRateSpan
+		}
+		if span > s.opts.Window {
+			span = s.opts.Window
+		}
+		r.ArrivalRate = float64(len(arrivals)) / span.Seconds()
+	}
+	if len(handled) > 0 {
+		var total float64
+		for _, h := range handled {
+			total += h.Value
+		}
+		r.HandleTime = time.Duration(total / float64(len(handled)) * float64(time.Second))
+	}
+	return r, nil
+}
+
+//Recorder - events.Sink feeding the statistics, handle times run from the
+//dispatch of a task to its transfer so the dispatch and the outcome must
+//be emitted in the same process, e.g. by the consumer
+type Recorder struct {
+	stats *Stats
+	queue *events.Async
+
+	// dispatched - dispatch time per account and task, only touched by run
+	dispatched map[string]time.Time
+}
+
+func NewRecorder(stats *Stats) *Recorder {
+	r := &Recorder{
+		stats:      stats,
+		dispatched: make(map[string]time.Time),
+	}
+	r.queue = events.NewAsync("stats", stats.opts.QueueSize, r.handle)
+	return r
+}
+
+// Handle - queue the event for recording, it is dropped when the queue is
+// full
+func (r *Recorder) Handle(ev events.Event) {
+	r.queue.Handle(ev)
+}
+
+func (r *Recorder) handle(ev events.Event) {
+	if err := r.record(ev); err != nil {
+		logger.Error("recording queue stats failed", "event", ev.Type, logger.FieldQueueID, ev.QueueID, logger.FieldError, err)
+	}
+}
+
+func (r *Recorder) record(ev events.Event) error {
+	key := ev.AccountID + ":" + ev.TaskID
+	switch ev.Type {
+	case events.TaskEnqueued:
+		if err := r.stats.RecordEnqueued(ev.QueueID, ev.TaskID, ev.Time); err != nil {
+			return err
+		}
+		return r.stats.RecordArrival(ev.QueueID, ev.Time)
+	case events.TaskDispatched:
+		r.dispatched[key] = ev.Time
+		r.prune(ev.Time)
+	case events.TaskAgentReserved:
+		wait, ok, err := r.stats.RecordAnswered(ev.QueueID, ev.TaskID, ev.Time)
+		if ok {
+			metrics.ObserveWait(ev.AccountID, ev.QueueID, wait)
+		}
+		return err
+	case events.TaskTransferred, events.TaskTransferFailed:
+		outcome := OutcomeHandled
+		if ev.Type == events.TaskTransferFailed {
+			outcome = OutcomeFailed
+		}
+		if err := r.stats.Count(ev.QueueID, outcome, ev.Time); err != nil {
+			return err
+		}
+		start, ok := r.dispatched[key]
+		if !ok {
+			return nil
+		}
+		delete(r.dispatched, key)
+		return r.stats.RecordHandleTime(ev.QueueID, ev.Time, ev.Time.Sub(start))
+	case events.TaskAbandoned:
+		delete(r.dispatched, key)
+		if err := r.stats.RecordLeft(ev.QueueID, ev.TaskID); err != nil {
+			return err
+		}
+		return r.stats.Count(ev.QueueID, OutcomeAbandoned, ev.Time)
+	case events.TaskDeadLettered:
+		if ev.QueueID == "" {
+			return nil
+		}
+		if err := r.stats.RecordLeft(ev.QueueID, ev.TaskID); err != nil {
+			return err
+		}
+		return r.stats.Count(ev.QueueID, OutcomeFailed, ev.Time)
+	}
+	return nil
+}
+
+// prune - forget dispatches without an outcome, e.g. cancelled tasks the
+// consumer dropped
+func (r *Recorder) prune(now time.Time) {
+	for key, t := range r.dispatched {
+		if now.Sub(t) > r.stats.opts.Window {
+			delete(r.dispatched, key)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package queuestats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+	"queuev2/position"
+	"queuev2/store/mock"
+)
+
+const testQueue = "QID_stats"
+
+func TestWindow(t *testing.T) {
+	st := mock.NewStore("", "")
+	w := &window{store: st, key: "w", length: time.Minute, max: 3}
+	now := time.Now()
+
+	assert.NoError(t, w.record(now.Add(-2*time.Minute), 1))
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, w.record(now.Add(time.Duration(i)*time.Second), float64(i)))
+	}
+
+	samples, err := w.samples(now.Add(4 * time.Second))
+	assert.NoError(t, err)
+	var values []float64
+	for _, s := range samples {
+		values = append(values, s.Value)
+	}
+	// the old sample left the window, the oldest one above max was dropped
+	assert.Equal(t, []float64{1, 2, 3}, values)
+
+	members, err := st.GetAllItemsSortedSet("w")
+	assert.NoError(t, err)
+	assert.Len(t, members, 3)
+}
+
+func TestRates(t *testing.T) {
+	s := NewStats(mock.NewStore("", ""), DefaultOptions())
+	r, err := s.Rates(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, Rates{}, r)
+
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, s.RecordArrival(testQueue, now))
+	}
+	assert.NoError(t, s.RecordHandleTime(testQueue, now, 30*time.Second))
+	assert.NoError(t, s.RecordHandleTime(testQueue, now, 90*time.Second))
+
+	r, err = s.Rates(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, r.Arrivals)
+	// averaged over at least a minute
+	assert.InDelta(t, 0.1, r.ArrivalRate, 1e-9)
+	assert.Equal(t, 2, r.Handled)
+	assert.Equal(t, time.Minute, r.HandleTime)
+}
+
+func TestRecorder(t *testing.T) {
+	s := NewStats(mock.NewStore("", ""), DefaultOptions())
+	r := &Recorder{stats: s, dispatched: make(map[string]time.Time)}
+	now := time.Now()
+	ev := events.Event{AccountID: "123", QueueID: testQueue, TaskID: "t1"}
+
+	for _, step := range []struct {
+		eventType string
+		at        time.Time
+	}{
+		{events.TaskEnqueued, now},
+		{events.TaskDispatched, now.Add(time.Second)},
+		{events.TaskTransferred, now.Add(46 * time.Second)},
+		// no dispatch, no handle time
+		{events.TaskTransferFailed, now.Add(50 * time.Second)},
+	} {
+		ev.Type, ev.Time = step.eventType, step.at
+		assert.NoError(t, r.record(ev))
+	}
+
+	rates, err := s.Rates(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rates.Arrivals)
+	assert.Equal(t, 1, rates.Handled)
+	assert.Equal(t, 45*time.Second, rates.HandleTime)
+	assert.Empty(t, r.dispatched)
+}
+
+func TestAgents(t *testing.T) {
+	st := mock.NewStore("", "")
+	a := NewAgents(st)
+	assert.NoError(t, a.Heartbeat(testQueue, "c1", AgentAvailable))
+	assert.NoError(t, a.Heartbeat(testQueue, "c2", AgentBusy))
+	assert.NoError(t, a.Heartbeat(testQueue, "c3", AgentUnavailable))
+	assert.NoError(t, st.SetStructInHash(agentsKey(testQueue), "gone", `{"state":"available","seen":1}`))
+
+	loggedIn, available, err := a.Count(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loggedIn)
+	assert.Equal(t, 1, available)
+
+	assert.NoError(t, a.Logout(testQueue, "c1"))
+	loggedIn, available, err = a.Count(testQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loggedIn)
+	assert.Equal(t, 0, available)
+}
+
+func TestAgentsList(t *testing.T) {
+	st := mock.NewStore("", "")
+	a := NewAgents(st)
+	assert.NoError(t, a.Heartbeat(testQueue, "c2", AgentBusy))
+	assert.NoError(t, a.Heartbeat(testQueue, "c1", AgentUnavailable))
+	assert.NoError(t, a.Request(testQueue, "c1", AgentUnavailable))
+	assert.NoError(t, st.SetStructInHash(agentsKey(testQueue), "gone", `{"state":"available","seen":1}`))
+	assert.NoError(t, a.Request(testQueue, "gone", AgentUnavailable))
+
+	agents, err := a.List(testQueue)
+	assert.NoError(t, err)
+	if assert.Len(t, agents, 2) {
+		assert.Equal(t, "c1", agents[0].AgentID)
+		assert.Equal(t, AgentUnavailable, agents[0].State)
+		assert.Equal(t, AgentUnavailable, agents[0].RequestedState)
+		assert.Equal(t, "c2", agents[1].AgentID)
+		assert.Empty(t, agents[1].RequestedState)
+		assert.WithinDuration(t, time.Now(), agents[1].LastSeen, 2*time.Second)
+	}
+	// the request of a logged out agent goes with it
+	requested, err := a.Requested(testQueue, "gone")
+	assert.NoError(t, err)
+	assert.Empty(t, requested)
+
+	assert.NoError(t, a.Request(testQueue, "c1", AgentAvailable))
+	requested, err = a.Requested(testQueue, "c1")
+	assert.NoError(t, err)
+	assert.Empty(t, requested)
+	assert.NoError(t, a.Request(testQueue, "c1", AgentAvailable))
+}
+
+func TestSnapshot(t *testing.T) {
+	st := mock.NewStore("", "")
+	s := NewStats(st, DefaultOptions())
+	r := &Recorder{stats: s, dispatched: make(map[string]time.Time)}
+	pos := position.NewPosition(st)
+	agents := NewAgents(st)
+	now := time.Now()
+
+	// t1 and t2 answered after 10s and 40s, t3 abandoned, t4 and t5 waiting
+	for i, id := range []string{"t1", "t2", "t3", "t4", "t5"} {
+		assert.NoError(t, pos.AddItem(testQueue, id, i%2))
+		ev := events.Event{Type: events.TaskEnqueued, AccountID: "123", QueueID: testQueue, TaskID: id, Time: now.Add(-time.Minute)}
+		assert.NoError(t, r.record(ev))
+	}
+	for id, wait := range map[string]time.Duration{"t1": 10 * time.Second, "t2": 40 * time.Second} {
+		assert.NoError(t, pos.RemoveItem(testQueue, id))
+		at := now.Add(-time.Minute + wait)
+		assert.NoError(t, r.record(events.Event{Type: events.TaskAgentReserved, QueueID: testQueue, TaskID: id, Time: at}))
+		assert.NoError(t, r.record(events.Event{Type: events.TaskTransferred, QueueID: testQueue, TaskID: id, Time: at}))
+	}
+	assert.NoError(t, pos.RemoveItem(testQueue, "t3"))
+	assert.NoError(t, r.record(events.Event{Type: events.TaskAbandoned, QueueID: testQueue, TaskID: "t3", Time: now}))
+	assert.NoError(t, agents.Heartbeat(testQueue, "c1", AgentBusy))
+
+	snap, err := s.Snapshot(pos, agents, testQueue, 5, 15*time.Minute, 20*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, snap.Waiting)
+	assert.Equal(t, map[string]int{"5": 1, "4": 1}, snap.WaitingByPriority)
+	assert.InDelta(t, 60, snap.OldestWaitSeconds, 1)
+	assert.Equal(t, 900, snap.IntervalSeconds)
+	assert.Equal(t, 2, snap.Answered)
+	assert.InDelta(t, 25, snap.AverageWaitSeconds, 1)
+	assert.InDelta(t, 40, snap.MaxWaitSeconds, 1)
+	assert.Equal(t, 2, snap.Handled)
+	assert.Equal(t, 1, snap.Abandoned)
+	assert.Equal(t, 0, snap.Failed)
+	assert.Equal(t, AgentCounts{LoggedIn: 1, Available: 0}, snap.Agents)
+	if assert.NotNil(t, snap.ServiceLevel.Percent) {
+		assert.InDelta(t, 50, *snap.ServiceLevel.Percent, 0.01)
+	}
+
+	empty, err := s.Snapshot(pos, agents, "QID_empty", 5, time.Minute, 20*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, empty.Waiting)
+	assert.Nil(t, empty.ServiceLevel.Percent)
+}
+
+func TestSnapshotKeepsDispatchedWaits(t *testing.T) {
+	st := mock.NewStore("", "")
+	s := NewStats(st, DefaultOptions())
+	pos := position.NewPosition(st)
+	agents := NewAgents(st)
+	now := time.Now()
+
+	assert.NoError(t, s.RecordEnqueued(testQueue, "stale", now.Add(-25*time.Hour)))
+	assert.NoError(t, s.RecordEnqueued(testQueue, "t1", now.Add(-2*time.Minute)))
+	assert.NoError(t, s.RecordEnqueued(testQueue, "t2", now.Add(-time.Minute)))
+	assert.NoError(t, pos.AddItem(testQueue, "t2", 0))
+
+	// t1 was taken by a consumer, its agent is not reserved yet
+	snap, err := s.Snapshot(pos, agents, testQueue, 5, time.Minute, 20*time.Second)
+	assert.NoError(t, err)
+	assert.InDelta(t, 60, snap.OldestWaitSeconds, 1)
+
+	wait, ok, err := s.RecordAnswered(testQueue, "t1", now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.InDelta(t, 2*time.Minute, wait, float64(time.Second))
+
+	members, err := st.GetAllItemsSortedSet(enqueuedKey(testQueue))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"t2"}, members)
+}
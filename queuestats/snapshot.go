@@ -0,0 +1,246 @@
+package queuestats
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"queuev2/position"
+)
+
+const (
+	waitsKeyPrefix    = "stats:waits:"
+	enqueuedKeyPrefix = "stats:enqueued:"
+	countersKeyPrefix = "stats:"
+
+	// enqueuedRetention - seconds the enqueue times of a queue without new
+	// tasks are kept
+	enqueuedRetention = 24 * 3600
+	// counterBucket - outcome counters are kept per minute
+	counterBucket = time.Minute
+)
+
+// Outcomes counted per interval
+const (
+	OutcomeHandled   = "handled"
+	OutcomeAbandoned = "abandoned"
+	OutcomeFailed    = "failed"
+)
+
+//AgentCounts - agents logged in to a queue and the ones without a task
+type AgentCounts struct {
+	LoggedIn  int `json:"logged_in"`
+	Available int `json:"available"`
+}
+
+//ServiceLevel - share of the tasks answered in the interval which waited
+//at most ThresholdSeconds, nil when none was answered
+type ServiceLevel struct {
+	ThresholdSeconds int      `json:"threshold_seconds"`
+	Percent          *float64 `json:"percent"`
+}
+
+//Snapshot - current state of a queue and its outcomes over the last
+//IntervalSeconds. Waits are those of the tasks an agent was reserved for,
+//at most MaxSamples of them
+type Snapshot struct {
+	QueueID           string         `json:"queue_id"`
+	Time              time.Time      `json:"time"`
+	Waiting           int            `json:"waiting"`
+	WaitingByPriority map[string]int `json:"waiting_by_priority"`
+	OldestWaitSeconds int            `json:"oldest_wait_seconds"`
+
+	IntervalSeconds    int          `json:"interval_seconds"`
+	Answered           int          `json:"answered"`
+	AverageWaitSeconds float64      `json:"average_wait_seconds"`
+	MaxWaitSeconds     float64      `json:"max_wait_seconds"`
+	Handled            int          `json:"handled"`
+	Abandoned          int          `json:"abandoned"`
+	Failed             int          `json:"failed"`
+	Agents             AgentCounts  `json:"agents"`
+	ServiceLevel       ServiceLevel `json:"service_level"`
+}
+
+func enqueuedKey(queueID string) string {
+	return enqueuedKeyPrefix + queueID
+}
+
+// counterKey - the counters of a queue share its hash tag so they are read
+// with one GetMulti
+func counterKey(queueID, outcome string, bucket int64) string {
+	return countersKeyPrefix + "{" + queueID + "}:" + outcome + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// Window - the period statistics are kept for, the longest interval of a
+// snapshot
+func (s *Stats) Window() time.Duration {
+	return s.opts.Window
+}
+
+// RecordEnqueued - remember when the task joined the queue
+func (s *Stats) RecordEnqueued(queueID, taskID string, at time.Time) error {
+	if err := s.store.AddSortedSet(enqueuedKey(queueID), int(at.Unix()), taskID); err != nil {
+		return err
+	}
+	return s.store.SetExpireTime(enqueuedKey(queueID), enqueuedRetention)
+}
+
+// RecordAnswered - an agent was reserved for the task, its wait is the time
+// since it joined the queue. ok is false for tasks which joined before
+// stats were recorded
+func (s *Stats) RecordAnswered(queueID, taskID string, at time.Time) (wait time.Duration, ok bool, err error) {
+	enqueued, err := s.store.GetScoreSortedSet(enqueuedKey(queueID), taskID)
+	if err != nil {
+		return 0, false, nil
+	}
+	if err = s.store.RemoveSortedSet(enqueuedKey(queueID), taskID); err != nil {
+		return 0, false, err
+	}
+	wait = at.Sub(time.Unix(int64(enqueued), 0))
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true, s.window(waitsKeyPrefix, queueID).record(at, wait.Seconds())
+}
+
+// RecordLeft - the task left the queue without an agent
+func (s *Stats) RecordLeft(queueID, taskID string) error {
+	return s.store.RemoveSortedSet(enqueuedKey(queueID), taskID)
+}
+
+// Count - add one to the outcome counter of the minute
+func (s *Stats) Count(queueID, outcome string, at time.Time) error {
+	key := counterKey(queueID, outcome, at.Unix()/int64(counterBucket/time.Second))
+	if _, err := s.store.AtomicIncrement(key); err != nil {
+		return err
+	}
+	return s.store.SetExpireTime(key, int((s.opts.Window+counterBucket)/time.Second))
+}
+
+// counts - outcome counts of the minutes of the interval ending now
+func (s *Stats) counts(queueID, outcome string, now time.Time, interval time.Duration) (int, error) {
+	last := now.Unix() / int64(counterBucket/time.Second)
+	n := int64(interval / counterBucket)
+	keys := make([]string, 0, n)
+	for b := last - n + 1; b <= last; b++ {
+		keys = append(keys, counterKey(queueID, outcome, b))
+	}
+	values, err := s.store.GetMulti(keys)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, v := range values {
+		if c, err := strconv.Atoi(v); err == nil {
+			total += c
+		}
+	}
+	return total, nil
+}
+
+// Snapshot - statistics of the queue, interval is rounded down to whole
+// minutes and capped to the window
+func (s *Stats) Snapshot(pos *position.Position, agents *Agents, queueID string, maxPriority uint8, interval, threshold time.Duration) (*Snapshot, error) {
+	now := time.Now()
+	if interval > s.opts.Window {
+		interval = s.opts.Window
+	}
+	if interval < counterBucket {
+		interval = counterBucket
+	}
+	interval = interval - interval%counterBucket
+
+	snap := &Snapshot{
+		QueueID:           queueID,
+		Time:              now.UTC(),
+		WaitingByPriority: map[string]int{},
+		IntervalSeconds:   int(interval / time.Second),
+		ServiceLevel:      ServiceLevel{ThresholdSeconds: int(threshold / time.Second)},
+	}
+
+	scores, err := pos.Scores(queueID)
+	if err != nil {
+		return nil, err
+	}
+	snap.Waiting = len(scores)
+	for _, score := range scores {
+		snap.WaitingByPriority[strconv.Itoa(int(maxPriority)-score)]++
+	}
+	if snap.OldestWaitSeconds, err = s.oldestWait(queueID, scores, now); err != nil {
+		return nil, err
+	}
+
+	waits, err := s.window(waitsKeyPrefix, queueID).samples(now)
+	if err != nil {
+		return nil, err
+	}
+	from := now.Add(-interval)
+	var total float64
+	within := 0
+	for _, w := range waits {
+		if w.Time.Before(from) {
+			continue
+		}
+		snap.Answered++
+		total += w.Value
+		if w.Value > snap.MaxWaitSeconds {
+			snap.MaxWaitSeconds = w.Value
+		}
+		if w.Value <= threshold.Seconds() {
+			within++
+		}
+	}
+	if snap.Answered > 0 {
+		snap.AverageWaitSeconds = total / float64(snap.Answered)
+		percent := float64(within) * 100 / float64(snap.Answered)
+		snap.ServiceLevel.Percent = &percent
+	}
+
+	for outcome, count := range map[string]*int{
+		OutcomeHandled:   &snap.Handled,
+		OutcomeAbandoned: &snap.Abandoned,
+		OutcomeFailed:    &snap.Failed,
+	} {
+		if *count, err = s.counts(queueID, outcome, now, interval); err != nil {
+			return nil, err
+		}
+	}
+
+	if snap.Agents.LoggedIn, snap.Agents.Available, err = agents.Count(queueID); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// oldestWait - wait of the earliest enqueued task still waiting. A task
+// taken by a consumer leaves the positions before its wait is recorded, so
+// only entries older than enqueuedRetention, of tasks which left the queue
+// without an event, are dropped on the way
+func (s *Stats) oldestWait(queueID string, waiting map[string]int, now time.Time) (int, error) {
+	if len(waiting) == 0 {
+		return 0, nil
+	}
+	enqueued, err := s.store.GetAllScoresSortedSet(enqueuedKey(queueID))
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]string, 0, len(enqueued))
+	for id := range enqueued {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return enqueued[ids[i]] < enqueued[ids[j]] })
+	stale := int(now.Unix()) - enqueuedRetention
+	for _, id := range ids {
+		if _, ok := waiting[id]; ok {
+			return int(now.Unix()) - enqueued[id], nil
+		}
+		if enqueued[id] >= stale {
+			continue
+		}
+		if err = s.store.RemoveSortedSet(enqueuedKey(queueID), id); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
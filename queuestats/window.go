@@ -0,0 +1,92 @@
+package queuestats
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"queuev2/store"
+)
+
+//Sample - one value recorded in a window
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+//window - samples of the last Length in one sorted set scored by unix
+//time, members are "<unix ms>:<value>:<nonce>" so equal values recorded
+//at the same time stay distinct. At most max samples are kept
+type window struct {
+	store  store.Store
+	key    string
+	length time.Duration
+	max    int
+}
+
+func (w *window) record(at time.Time, value float64) error {
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	member := strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10) + ":" +
+		strconv.FormatFloat(value, 'f', -1, 64) + ":" + hex.EncodeToString(nonce)
+	if err := w.store.AddSortedSet(w.key, int(at.Unix()), member); err != nil {
+		return err
+	}
+	if err := w.store.SetExpireTime(w.key, int(w.length/time.Second)+1); err != nil {
+		return err
+	}
+	_, err := w.samples(at)
+	return err
+}
+
+// samples - samples of the window ending at now, oldest first. Samples
+// which left the window or exceed max are removed
+func (w *window) samples(now time.Time) ([]Sample, error) {
+	members, err := w.store.GetAllItemsSortedSet(w.key)
+	if err != nil {
+		return nil, err
+	}
+
+	from := now.Add(-w.length)
+	samples := make([]Sample, 0, len(members))
+	var kept, expired []string
+	for _, m := range members {
+		s, ok := parseSample(m)
+		if !ok || s.Time.Before(from) {
+			expired = append(expired, m)
+			continue
+		}
+		samples = append(samples, s)
+		kept = append(kept, m)
+	}
+	if over := len(samples) - w.max; w.max > 0 && over > 0 {
+		expired = append(expired, kept[:over]...)
+		samples = samples[over:]
+	}
+	for _, m := range expired {
+		if err = w.store.RemoveSortedSet(w.key, m); err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+func parseSample(member string) (Sample, bool) {
+	parts := strings.SplitN(member, ":", 3)
+	if len(parts) != 3 {
+		return Sample{}, false
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Sample{}, false
+	}
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return Sample{}, false
+	}
+	return Sample{Time: time.Unix(0, ms*int64(time.Millisecond)), Value: value}, true
+}
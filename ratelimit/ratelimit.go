@@ -0,0 +1,197 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"queuev2/store"
+)
+
+const (
+	limitsHash       = "account_limits"
+	bucketKeyPrefix  = "rl:"
+	accountParam     = "accountID"
+	defaultCacheTTL  = 10 * time.Second
+	quotaRetryAfter  = 30 * time.Second
+	headerRetryAfter = "Retry-After"
+)
+
+var (
+	// ErrQuotaExceeded - account or queue quota reached
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrRateLimited - token bucket empty
+	ErrRateLimited = errors.New("rate limited")
+)
+
+//Rate - token bucket settings, zero RequestsPerSecond means unlimited
+type Rate struct {
+	RequestsPerSecond float64 `json:"requests_per_second" validate:"min=0"`
+	Burst             int     `json:"burst" validate:"min=0"`
+}
+
+//Limits - rate limits and quotas of an account, zero values are unlimited
+type Limits struct {
+	// Account - shared by every route of the account
+	Account Rate `json:"account"`
+	// Routes - keyed by "<METHOD> <route path>", e.g.
+	// "POST /v1.0/accounts/:accountID/task"
+	Routes          map[string]Rate `json:"routes,omitempty" validate:"dive"`
+	MaxQueues       int             `json:"max_queues" validate:"min=0"`
+	MaxWaitingTasks int             `json:"max_waiting_tasks" validate:"min=0"`
+}
+
+type cachedLimits struct {
+	limits  Limits
+	expires time.Time
+}
+
+//Limiter - per account and per route token buckets kept in the store so the
+//limits hold across API replicas
+type Limiter struct {
+	store    store.Store
+	defaults Limits
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedLimits
+}
+
+func NewLimiter(st store.Store, defaults Limits) *Limiter {
+	return &Limiter{
+		store:    st,
+		defaults: defaults,
+		cacheTTL: defaultCacheTTL,
+		cache:    make(map[string]cachedLimits),
+	}
+}
+
+// Limits - account limits, defaults when none were configured
+func (l *Limiter) Limits(accountID string) (Limits, error) {
+	l.mu.Lock()
+	cached, ok := l.cache[accountID]
+	l.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.limits, nil
+	}
+
+	limits := l.defaults
+	exists, err := l.store.KeyExistsInHash(limitsHash, accountID)
+	if err != nil {
+		return limits, err
+	}
+	if exists == 1 {
+		data, err := l.store.GetStructFromHash(limitsHash, accountID)
+		if err != nil {
+			return limits, err
+		}
+		if err = json.Unmarshal([]byte(data), &limits); err != nil {
+			return limits, err
+		}
+	}
+
+	l.mu.Lock()
+	l.cache[accountID] = cachedLimits{limits: limits, expires: time.Now().Add(l.cacheTTL)}
+	l.mu.Unlock()
+	return limits, nil
+}
+
+// SetLimits - store account limits, other replicas pick them up within the
+// cache ttl
+func (l *Limiter) SetLimits(accountID string, limits Limits) error {
+	data, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	if err = l.store.SetStructInHashNoExpire(limitsHash, accountID, string(data)); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	delete(l.cache, accountID)
+	l.mu.Unlock()
+	return nil
+}
+
+// Middleware - 429 with Retry-After once the account or route bucket is
+// empty, the tokens taken from the other buckets are returned so a rejected
+// request uses up none of them
+func (l *Limiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		accID := c.Param(accountParam)
+		if accID == "" {
+			return next(c)
+		}
+
+		limits, err := l.Limits(accID)
+		if err != nil {
+			// fail open, the store being unavailable is reported elsewhere
+			return next(c)
+		}
+
+		route := c.Request().Method + " " + c.Path()
+		buckets := []struct {
+			key  string
+			rate Rate
+		}{
+			{bucketKeyPrefix + accID, limits.Account},
+			{bucketKeyPrefix + accID + ":" + route, limits.Routes[route]},
+		}
+		for i, b := range buckets {
+			if b.rate.RequestsPerSecond <= 0 {
+				continue
+			}
+			ok, wait, err := l.store.TakeToken(b.key, b.rate.RequestsPerSecond, burst(b.rate))
+			if err != nil {
+				return next(c)
+			}
+			if !ok {
+				for _, taken := range buckets[:i] {
+					if taken.rate.RequestsPerSecond > 0 {
+						// best effort, the token refills anyway
+						_ = l.store.ReturnToken(taken.key, burst(taken.rate))
+					}
+				}
+				return TooManyRequests(c, wait, "rate limit exceeded", ErrRateLimited)
+			}
+		}
+		return next(c)
+	}
+}
+
+// CheckQuota - ErrQuotaExceeded once used reached max, max zero is unlimited
+func CheckQuota(used, max int) error {
+	if max > 0 && used >= max {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// QuotaExceeded - 429 response for a reached quota
+func QuotaExceeded(c echo.Context, msg string) error {
+	return TooManyRequests(c, quotaRetryAfter, msg, ErrQuotaExceeded)
+}
+
+// TooManyRequests - 429 with Retry-After rounded up to whole seconds, cause
+// tells rate limits and quotas apart
+func TooManyRequests(c echo.Context, wait time.Duration, msg string, cause error) error {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	c.Response().Header().Set(headerRetryAfter, strconv.Itoa(secs))
+	return echo.NewHTTPError(http.StatusTooManyRequests, msg).SetInternal(cause)
+}
+
+func burst(r Rate) int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return int(math.Ceil(r.RequestsPerSecond))
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/store/mock"
+)
+
+func TestMiddleware(t *testing.T) {
+	l := NewLimiter(mock.NewStore("", ""), Limits{})
+	assert.NoError(t, l.SetLimits("123", Limits{
+		Account: Rate{RequestsPerSecond: 0.001, Burst: 3},
+		Routes: map[string]Rate{
+			"POST /v1.0/accounts/:accountID/task": {RequestsPerSecond: 0.001, Burst: 1},
+		},
+	}))
+
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e.POST("/v1.0/accounts/:accountID/task", ok, l.Middleware)
+	e.GET("/v1.0/accounts/:accountID/queue", ok, l.Middleware)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/v1.0/accounts/123/task").Code)
+	rec := do(http.MethodPost, "/v1.0/accounts/123/task")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	// the rejected request gave its account token back, two are left for
+	// other routes
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/v1.0/accounts/123/queue").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/v1.0/accounts/123/queue").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(http.MethodGet, "/v1.0/accounts/123/queue").Code)
+
+	// accounts without limits are not throttled
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, do(http.MethodPost, "/v1.0/accounts/456/task").Code)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	assert.NoError(t, CheckQuota(5, 0))
+	assert.NoError(t, CheckQuota(4, 5))
+	assert.Equal(t, ErrQuotaExceeded, CheckQuota(5, 5))
+}
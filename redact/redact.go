@@ -0,0 +1,209 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"queuev2/config"
+)
+
+//Mode - how a redacted value is replaced
+type Mode string
+
+const (
+	// ModeMask - replace the value with Masked
+	ModeMask Mode = "mask"
+	// ModeHash - replace the value with a keyed sha256 digest, equal values
+	// keep matching across log lines without being readable
+	ModeHash Mode = "hash"
+
+	Masked = "[REDACTED]"
+
+	callDataPrefix = "call_data."
+	hashPrefix     = "sha256:"
+	hashLength     = 16
+)
+
+//Options - redaction applied to logged bodies
+type Options struct {
+	// Fields - dotted JSON paths, "*" matches any key of an object, arrays
+	// are walked transparently, e.g. "call_data.*" or "caller.phone"
+	Fields []string
+	// CallDataKeys - shorthand for "call_data.<key>" paths
+	CallDataKeys []string
+	// Keep - dotted paths left readable when a "*" of Fields matches them,
+	// e.g. the call_uuid operators correlate calls by
+	Keep []string
+	Mode Mode
+	// HashSalt - HMAC key of ModeHash, set it so digests cannot be reversed
+	// by hashing known phone numbers
+	HashSalt string
+	// MaxBodyBytes - redacted bodies are cut after this size, 0 disables the limit
+	MaxBodyBytes int
+	// SampleRate - fraction of requests whose bodies are logged, 0 to 1
+	SampleRate float64
+}
+
+// DefaultOptions - mask every call_data value but the call_uuid and webhook
+// secrets, keep bodies under 4KiB
+func DefaultOptions() Options {
+	return Options{
+		Fields:       []string{"call_data.*", "secret"},
+		Keep:         []string{callDataPrefix + "call_uuid"},
+		Mode:         ModeMask,
+		MaxBodyBytes: 4096,
+		SampleRate:   1,
+	}
+}
+
+//Redactor - masks or hashes configured fields of JSON bodies before they
+//are logged
+type Redactor struct {
+	opts  Options
+	paths [][]string
+	keep  map[string]bool
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// New - redactor for opts, an unknown mode falls back to ModeMask
+func New(opts Options) *Redactor {
+	if opts.Mode != ModeHash {
+		opts.Mode = ModeMask
+	}
+	if opts.SampleRate < 0 {
+		opts.SampleRate = 0
+	} else if opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+
+	r := &Redactor{opts: opts, keep: make(map[string]bool), rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, f := range opts.Fields {
+		if f = strings.TrimSpace(f); f != "" {
+			r.paths = append(r.paths, strings.Split(f, "."))
+		}
+	}
+	for _, k := range opts.CallDataKeys {
+		if k = strings.TrimSpace(k); k != "" {
+			r.paths = append(r.paths, strings.Split(callDataPrefix+k, "."))
+		}
+	}
+	for _, k := range opts.Keep {
+		if k = strings.TrimSpace(k); k != "" {
+			r.keep[k] = true
+		}
+	}
+	return r
+}
+
+// Sample - whether the bodies of this request should be logged
+func (r *Redactor) Sample() bool {
+	switch r.opts.SampleRate {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Float64() < r.opts.SampleRate
+}
+
+// Body - redacted and size limited copy of body for logging. Bodies that
+// are not JSON cannot be inspected and are replaced by their size when any
+// field is configured
+func (r *Redactor) Body(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+
+	out := body
+	if len(r.paths) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil || dec.More() {
+			return fmt.Sprintf("[non-json body, %d bytes]", len(body))
+		}
+		for _, p := range r.paths {
+			v = r.apply(v, p, "")
+		}
+		var err error
+		if out, err = json.Marshal(v); err != nil {
+			return fmt.Sprintf("[unencodable body, %d bytes]", len(body))
+		}
+	}
+	return r.truncate(out)
+}
+
+func (r *Redactor) truncate(b []byte) string {
+	if r.opts.MaxBodyBytes <= 0 || len(b) <= r.opts.MaxBodyBytes {
+		return string(b)
+	}
+	return fmt.Sprintf("%s...[truncated %d bytes]", b[:r.opts.MaxBodyBytes], len(b)-r.opts.MaxBodyBytes)
+}
+
+// apply - redact the values at path below v, at is the dotted path of v
+func (r *Redactor) apply(v interface{}, path []string, at string) interface{} {
+	if len(path) == 0 {
+		return r.replace(v)
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			childAt := k
+			if at != "" {
+				childAt = at + "." + k
+			}
+			if path[0] == k || (path[0] == "*" && !r.keep[childAt]) {
+				t[k] = r.apply(child, path[1:], childAt)
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = r.apply(child, path, at)
+		}
+	}
+	return v
+}
+
+func (r *Redactor) replace(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if r.opts.Mode == ModeMask {
+		return Masked
+	}
+
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	default:
+		b, _ := json.Marshal(t)
+		s = string(b)
+	}
+	mac := hmac.New(sha256.New, []byte(r.opts.HashSalt))
+	mac.Write([]byte(s))
+	return hashPrefix + hex.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// LoadOptions - redaction rules of the active profile, the default rules
+// when it has none
+func LoadOptions(conf *viper.Viper) (Options, error) {
+	opts := DefaultOptions()
+	err := config.UnmarshalKey(conf, config.LogRedaction, &opts)
+	return opts, err
+}
@@ -0,0 +1,61 @@
+package redact
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const taskBody = `{"task_id":"t1","priority":3,"call_data":{"call_uuid":"c1","from":"+15551234567"},` +
+	`"contacts":[{"phone":"+15557654321","name":"a"}]}`
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	v := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(s), &v))
+	return v
+}
+
+func TestMask(t *testing.T) {
+	r := New(Options{Fields: []string{"contacts.phone"}, CallDataKeys: []string{"from"}})
+	v := decode(t, r.Body([]byte(taskBody)))
+
+	callData := v["call_data"].(map[string]interface{})
+	assert.Equal(t, Masked, callData["from"])
+	assert.Equal(t, "c1", callData["call_uuid"])
+	contact := v["contacts"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, Masked, contact["phone"])
+	assert.Equal(t, "a", contact["name"])
+	assert.Equal(t, float64(3), v["priority"])
+}
+
+func TestHash(t *testing.T) {
+	r := New(Options{Fields: []string{"call_data.*"}, Mode: ModeHash, HashSalt: "s"})
+	first := decode(t, r.Body([]byte(taskBody)))["call_data"].(map[string]interface{})
+	second := decode(t, r.Body([]byte(taskBody)))["call_data"].(map[string]interface{})
+
+	assert.True(t, strings.HasPrefix(first["from"].(string), hashPrefix))
+	assert.NotContains(t, first["from"], "5551234567")
+	assert.Equal(t, first["from"], second["from"])
+	assert.NotEqual(t, first["from"], first["call_uuid"])
+}
+
+func TestBodyLimits(t *testing.T) {
+	r := New(Options{Fields: []string{"call_data.*"}, MaxBodyBytes: 10})
+	assert.Contains(t, r.Body([]byte(taskBody)), "...[truncated")
+	assert.Equal(t, "[non-json body, 9 bytes]", r.Body([]byte("from=+155")))
+	assert.Equal(t, "", r.Body(nil))
+
+	hooks := New(DefaultOptions()).Body([]byte(`[{"id":"wh_1","secret":"s3cr3t-signing-key"}]`))
+	assert.NotContains(t, hooks, "s3cr3t")
+	assert.Contains(t, hooks, "wh_1")
+
+	// calls stay traceable by their call_uuid
+	task := decode(t, New(DefaultOptions()).Body([]byte(taskBody)))["call_data"].(map[string]interface{})
+	assert.Equal(t, "c1", task["call_uuid"])
+	assert.Equal(t, Masked, task["from"])
+
+	assert.False(t, New(Options{SampleRate: 0}).Sample())
+	assert.True(t, New(DefaultOptions()).Sample())
+}
@@ -0,0 +1,135 @@
+package reporting
+
+import (
+	"time"
+
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+const (
+	enqueuedKeyPrefix = "report:enqueued:"
+
+	// enqueuedRetention - seconds the enqueue times of a queue without new
+	// tasks are kept
+	enqueuedRetention = 24 * 3600
+	// purgeEvery - how often buckets past the retention are removed
+	purgeEvery = time.Hour
+)
+
+//Aggregator - adds the lifecycle events to the buckets. It must be the
+//only writer of the storage and see the events of every process, so it is
+//fed by the consumer of the event exchange rather than added as a sink of
+//one process. The enqueue times are kept in the store
+type Aggregator struct {
+	store   store.Store
+	reports *Reports
+}
+
+func NewAggregator(st store.Store, reports *Reports) *Aggregator {
+	a := &Aggregator{store: st, reports: reports}
+	go a.purge()
+	return a
+}
+
+// purge - remove the buckets past the retention
+func (a *Aggregator) purge() {
+	if a.reports.opts.Retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(purgeEvery)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := a.reports.storage.Purge(now.Add(-a.reports.opts.Retention)); err != nil {
+			logger.Error("purging reports failed", logger.FieldError, err)
+		}
+	}
+}
+
+// Record - add the event to its bucket, events which do not count towards
+// a report are ignored
+func (a *Aggregator) Record(ev events.Event) error {
+	if ev.AccountID == "" || ev.QueueID == "" {
+		return nil
+	}
+	var queue, agent Counters
+	switch ev.Type {
+	case events.TaskEnqueued:
+		if err := a.store.AddSortedSet(enqueuedKey(ev.QueueID), int(ev.Time.Unix()), ev.TaskID); err != nil {
+			return err
+		}
+		if err := a.store.SetExpireTime(enqueuedKey(ev.QueueID), enqueuedRetention); err != nil {
+			return err
+		}
+		queue.Offered = 1
+	case events.TaskAgentReserved:
+		queue.Answered = 1
+		wait, ok, err := a.waited(ev)
+		if err != nil {
+			return err
+		}
+		if ok {
+			queue.Timed = 1
+			queue.AnswerSeconds = wait.Seconds()
+			queue.LongestWaitSeconds = wait.Seconds()
+			if wait <= a.reports.opts.SLThreshold {
+				queue.AnsweredInSL = 1
+			}
+		}
+		// the task was offered to the agent and taken
+		agent = queue
+		agent.Offered = 1
+	case events.TaskTransferred:
+		queue.Handled = 1
+		agent.Handled = 1
+	case events.TaskTransferFailed:
+		queue.Failed = 1
+		agent.Failed = 1
+	case events.TaskAbandoned, events.TaskDeadLettered:
+		wait, ok, err := a.waited(ev)
+		if err != nil {
+			return err
+		}
+		if ok {
+			queue.LongestWaitSeconds = wait.Seconds()
+		}
+		if ev.Type == events.TaskAbandoned {
+			queue.Abandoned = 1
+		} else {
+			queue.Failed = 1
+		}
+	default:
+		return nil
+	}
+
+	start := ev.Time.UTC().Truncate(BucketSize)
+	if err := a.reports.storage.Add(Row{Start: start, AccountID: ev.AccountID, QueueID: ev.QueueID, Counters: queue}); err != nil {
+		return err
+	}
+	if ev.Agent == "" || agent == (Counters{}) {
+		return nil
+	}
+	return a.reports.storage.Add(Row{Start: start, AccountID: ev.AccountID, QueueID: ev.QueueID, AgentID: ev.Agent, Counters: agent})
+}
+
+// waited - time since the task was enqueued, ok is false for tasks enqueued
+// before reporting was enabled
+func (a *Aggregator) waited(ev events.Event) (time.Duration, bool, error) {
+	enqueued, err := a.store.GetScoreSortedSet(enqueuedKey(ev.QueueID), ev.TaskID)
+	if err != nil {
+		return 0, false, nil
+	}
+	if err = a.store.RemoveSortedSet(enqueuedKey(ev.QueueID), ev.TaskID); err != nil {
+		return 0, false, err
+	}
+	wait := ev.Time.Sub(time.Unix(int64(enqueued), 0))
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true, nil
+}
+
+func enqueuedKey(queueID string) string {
+	return enqueuedKeyPrefix + queueID
+}
@@ -0,0 +1,65 @@
+package reporting
+
+import (
+	"sync"
+	"time"
+)
+
+type bucketKey struct {
+	start                   int64
+	account, queue, agentID string
+}
+
+//MemoryStorage - Storage kept in process, for tests and single process
+//deployments without long retention
+type MemoryStorage struct {
+	mu   sync.Mutex
+	rows map[bucketKey]*Row
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{rows: make(map[bucketKey]*Row)}
+}
+
+func (m *MemoryStorage) Add(row Row) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := bucketKey{row.Start.Unix(), row.AccountID, row.QueueID, row.AgentID}
+	r, ok := m.rows[k]
+	if !ok {
+		r = &Row{Start: row.Start.UTC(), AccountID: row.AccountID, QueueID: row.QueueID, AgentID: row.AgentID}
+		m.rows[k] = r
+	}
+	r.Add(row.Counters)
+	return nil
+}
+
+func (m *MemoryStorage) Rows(q Query) ([]Row, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rows []Row
+	for _, r := range m.rows {
+		if r.AccountID != q.AccountID || (q.QueueID != "" && r.QueueID != q.QueueID) {
+			continue
+		}
+		if (r.AgentID != "") != q.ByAgent {
+			continue
+		}
+		if r.Start.Before(q.From) || !r.Start.Before(q.To) {
+			continue
+		}
+		rows = append(rows, *r)
+	}
+	return rows, nil
+}
+
+func (m *MemoryStorage) Purge(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, r := range m.rows {
+		if r.Start.Before(before) {
+			delete(m.rows, k)
+		}
+	}
+	return nil
+}
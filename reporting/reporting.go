@@ -0,0 +1,313 @@
+package reporting
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"queuev2/config"
+)
+
+// BucketSize - the events are aggregated into buckets of 15 minutes, the
+// hourly and daily reports add them up
+const BucketSize = 15 * time.Minute
+
+// Report intervals
+const (
+	IntervalQuarterHour = "15m"
+	IntervalHour        = "1h"
+	IntervalDay         = "1d"
+)
+
+var intervals = map[string]time.Duration{
+	IntervalQuarterHour: BucketSize,
+	IntervalHour:        time.Hour,
+	IntervalDay:         24 * time.Hour,
+}
+
+var (
+	ErrUnknownInterval = errors.New("interval must be 15m, 1h or 1d")
+	ErrInvalidRange    = errors.New("from must be before to")
+)
+
+// IntervalLength - length of a report interval
+func IntervalLength(interval string) (time.Duration, error) {
+	d, ok := intervals[interval]
+	if !ok {
+		return 0, ErrUnknownInterval
+	}
+	return d, nil
+}
+
+//Options - Path is the SQLite database of the reports, reporting is
+//disabled without it. Queue is the durable queue of the event exchange the
+//reports are aggregated from, one process only may consume it. Answers
+//within SLThreshold count towards the service level, buckets older than
+//Retention are purged
+type Options struct {
+	Path        string        `mapstructure:"path"`
+	Queue       string        `mapstructure:"queue"`
+	SLThreshold time.Duration `mapstructure:"slThreshold"`
+	Retention   time.Duration `mapstructure:"retention"`
+}
+
+// DefaultOptions - 20 second service level, 400 days of buckets
+func DefaultOptions() Options {
+	return Options{
+		Queue:       "queuev2-reports",
+		SLThreshold: 20 * time.Second,
+		Retention:   400 * 24 * time.Hour,
+	}
+}
+
+// LoadOptions - report options of the active profile, DefaultOptions for
+// the ones it does not set
+func LoadOptions(conf *viper.Viper) (Options, error) {
+	opts := DefaultOptions()
+	err := config.UnmarshalKey(conf, config.Reports, &opts)
+	return opts, err
+}
+
+//Counters - outcomes of the tasks of a bucket. Timed is the number of
+//answers with a known wait, the base of the service level and the average
+//speed of answer
+type Counters struct {
+	Offered            int
+	Answered           int
+	Timed              int
+	AnsweredInSL       int
+	Handled            int
+	Abandoned          int
+	Failed             int
+	AnswerSeconds      float64
+	LongestWaitSeconds float64
+}
+
+// Add - sum of the counters, the longest wait is the maximum of both
+func (c *Counters) Add(o Counters) {
+	c.Offered += o.Offered
+	c.Answered += o.Answered
+	c.Timed += o.Timed
+	c.AnsweredInSL += o.AnsweredInSL
+	c.Handled += o.Handled
+	c.Abandoned += o.Abandoned
+	c.Failed += o.Failed
+	c.AnswerSeconds += o.AnswerSeconds
+	if o.LongestWaitSeconds > c.LongestWaitSeconds {
+		c.LongestWaitSeconds = o.LongestWaitSeconds
+	}
+}
+
+//Row - counters of a queue, or of an agent of the queue when AgentID is
+//set, for the bucket beginning at Start
+type Row struct {
+	Start     time.Time
+	AccountID string
+	QueueID   string
+	AgentID   string
+	Counters
+}
+
+//Query - rows of the account with a Start from From up to To exclusive,
+//the agent rows when ByAgent is set. An empty QueueID selects every queue
+type Query struct {
+	AccountID string
+	QueueID   string
+	ByAgent   bool
+	From      time.Time
+	To        time.Time
+}
+
+//Storage - keeps the buckets, Add adds the counters to the row of the same
+//bucket, queue and agent
+type Storage interface {
+	Add(row Row) error
+	Rows(q Query) ([]Row, error)
+	// Purge removes the buckets which began before the time
+	Purge(before time.Time) error
+}
+
+//Line - one interval of a report, ServiceLevelPercent and
+//AverageSpeedOfAnswerSeconds are nil without answers with a known wait
+type Line struct {
+	Start                       time.Time `json:"start"`
+	End                         time.Time `json:"end"`
+	QueueID                     string    `json:"queue_id"`
+	AgentID                     string    `json:"agent_id,omitempty"`
+	Offered                     int       `json:"offered"`
+	Answered                    int       `json:"answered"`
+	Handled                     int       `json:"handled"`
+	Abandoned                   int       `json:"abandoned"`
+	Failed                      int       `json:"failed"`
+	ServiceLevelPercent         *float64  `json:"service_level_percent"`
+	AverageSpeedOfAnswerSeconds *float64  `json:"average_speed_of_answer_seconds"`
+	LongestWaitSeconds          float64   `json:"longest_wait_seconds"`
+}
+
+//Report - lines of the intervals with tasks, ordered by start, queue and
+//agent
+type Report struct {
+	AccountID                    string    `json:"account_id"`
+	Interval                     string    `json:"interval"`
+	GroupBy                      string    `json:"group_by"`
+	From                         time.Time `json:"from"`
+	To                           time.Time `json:"to"`
+	ServiceLevelThresholdSeconds int       `json:"service_level_threshold_seconds"`
+	Lines                        []Line    `json:"lines"`
+}
+
+// Groupings of a report
+const (
+	GroupByQueue = "queue"
+	GroupByAgent = "agent"
+)
+
+//Reports - builds reports from the buckets of the storage
+type Reports struct {
+	storage Storage
+	opts    Options
+}
+
+func NewReports(storage Storage, opts Options) *Reports {
+	if opts.SLThreshold <= 0 {
+		opts.SLThreshold = DefaultOptions().SLThreshold
+	}
+	return &Reports{storage: storage, opts: opts}
+}
+
+// Report - the buckets of the query added up per interval, the range is
+// widened to whole intervals in UTC
+func (r *Reports) Report(q Query, interval string) (*Report, error) {
+	length, err := IntervalLength(interval)
+	if err != nil {
+		return nil, err
+	}
+	if !q.From.Before(q.To) {
+		return nil, ErrInvalidRange
+	}
+	q.From = q.From.UTC().Truncate(length)
+	if to := q.To.UTC().Truncate(length); to.Before(q.To) {
+		q.To = to.Add(length)
+	} else {
+		q.To = to
+	}
+
+	rows, err := r.storage.Rows(q)
+	if err != nil {
+		return nil, err
+	}
+
+	type lineKey struct {
+		start          int64
+		queue, agentID string
+	}
+	sums := make(map[lineKey]*Row)
+	for _, row := range rows {
+		k := lineKey{row.Start.UTC().Truncate(length).Unix(), row.QueueID, row.AgentID}
+		sum, ok := sums[k]
+		if !ok {
+			sum = &Row{Start: time.Unix(k.start, 0).UTC(), QueueID: row.QueueID, AgentID: row.AgentID}
+			sums[k] = sum
+		}
+		sum.Add(row.Counters)
+	}
+
+	report := &Report{
+		AccountID:                    q.AccountID,
+		Interval:                     interval,
+		GroupBy:                      GroupByQueue,
+		From:                         q.From,
+		To:                           q.To,
+		ServiceLevelThresholdSeconds: int(r.opts.SLThreshold / time.Second),
+		Lines:                        make([]Line, 0, len(sums)),
+	}
+	if q.ByAgent {
+		report.GroupBy = GroupByAgent
+	}
+	for _, sum := range sums {
+		report.Lines = append(report.Lines, newLine(sum, length))
+	}
+	sort.Slice(report.Lines, func(i, j int) bool {
+		a, b := report.Lines[i], report.Lines[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.QueueID != b.QueueID {
+			return a.QueueID < b.QueueID
+		}
+		return a.AgentID < b.AgentID
+	})
+	return report, nil
+}
+
+func newLine(sum *Row, length time.Duration) Line {
+	l := Line{
+		Start:              sum.Start,
+		End:                sum.Start.Add(length),
+		QueueID:            sum.QueueID,
+		AgentID:            sum.AgentID,
+		Offered:            sum.Offered,
+		Answered:           sum.Answered,
+		Handled:            sum.Handled,
+		Abandoned:          sum.Abandoned,
+		Failed:             sum.Failed,
+		LongestWaitSeconds: sum.LongestWaitSeconds,
+	}
+	if sum.Timed > 0 {
+		sl := float64(sum.AnsweredInSL) * 100 / float64(sum.Timed)
+		asa := sum.AnswerSeconds / float64(sum.Timed)
+		l.ServiceLevelPercent, l.AverageSpeedOfAnswerSeconds = &sl, &asa
+	}
+	return l
+}
+
+var csvHeader = []string{
+	"start", "end", "queue_id", "agent_id", "offered", "answered", "handled", "abandoned", "failed",
+	"service_level_percent", "average_speed_of_answer_seconds", "longest_wait_seconds",
+}
+
+// WriteCSV - the lines of the report with a header row, undefined service
+// levels and speeds of answer are empty
+func WriteCSV(w io.Writer, report *Report) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, l := range report.Lines {
+		record := []string{
+			l.Start.Format(time.RFC3339),
+			l.End.Format(time.RFC3339),
+			l.QueueID,
+			l.AgentID,
+			strconv.Itoa(l.Offered),
+			strconv.Itoa(l.Answered),
+			strconv.Itoa(l.Handled),
+			strconv.Itoa(l.Abandoned),
+			strconv.Itoa(l.Failed),
+			formatOptional(l.ServiceLevelPercent),
+			formatOptional(l.AverageSpeedOfAnswerSeconds),
+			formatFloat(l.LongestWaitSeconds),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatOptional(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return formatFloat(*v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
@@ -0,0 +1,132 @@
+package reporting
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+	"queuev2/store/mock"
+)
+
+const (
+	testAccount = "123"
+	testQueue   = "QID_reports"
+)
+
+func newTestAggregator() (*Aggregator, *Reports) {
+	reports := NewReports(NewMemoryStorage(), DefaultOptions())
+	return &Aggregator{store: mock.NewStore("", ""), reports: reports}, reports
+}
+
+func TestAggregator(t *testing.T) {
+	a, reports := newTestAggregator()
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h, m, s int) time.Time {
+		return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second)
+	}
+	record := func(eventType, taskID, agent string, when time.Time) {
+		assert.NoError(t, a.Record(events.Event{Type: eventType, AccountID: testAccount, QueueID: testQueue, TaskID: taskID, Agent: agent, Time: when}))
+	}
+
+	// t1 answered after 10s, t2 after 50s and its transfer failed, t3
+	// abandoned after 90s
+	record(events.TaskEnqueued, "t1", "", at(9, 0, 0))
+	record(events.TaskEnqueued, "t2", "", at(9, 1, 0))
+	record(events.TaskEnqueued, "t3", "", at(9, 20, 0))
+	record(events.TaskAgentReserved, "t1", "sip:a1", at(9, 0, 10))
+	record(events.TaskTransferred, "t1", "sip:a1", at(9, 0, 11))
+	record(events.TaskAgentReserved, "t2", "sip:a1", at(9, 1, 50))
+	record(events.TaskTransferFailed, "t2", "sip:a1", at(9, 1, 51))
+	record(events.TaskAbandoned, "t3", "", at(9, 21, 30))
+	// answered without a known wait
+	record(events.TaskAgentReserved, "t4", "sip:a2", at(10, 5, 0))
+
+	q := Query{AccountID: testAccount, From: day, To: day.Add(24 * time.Hour)}
+	quarter, err := reports.Report(q, IntervalQuarterHour)
+	assert.NoError(t, err)
+	if assert.Len(t, quarter.Lines, 3) {
+		l := quarter.Lines[0]
+		assert.Equal(t, at(9, 0, 0), l.Start)
+		assert.Equal(t, at(9, 15, 0), l.End)
+		assert.Equal(t, 2, l.Offered)
+		assert.Equal(t, 2, l.Answered)
+		assert.Equal(t, 1, l.Handled)
+		assert.Equal(t, 1, l.Failed)
+		assert.InDelta(t, 50, *l.ServiceLevelPercent, 1e-9)
+		assert.InDelta(t, 30, *l.AverageSpeedOfAnswerSeconds, 1e-9)
+		assert.InDelta(t, 50, l.LongestWaitSeconds, 1e-9)
+
+		assert.Equal(t, 1, quarter.Lines[1].Abandoned)
+		assert.InDelta(t, 90, quarter.Lines[1].LongestWaitSeconds, 1e-9)
+		assert.Nil(t, quarter.Lines[2].ServiceLevelPercent)
+	}
+
+	hourly, err := reports.Report(q, IntervalHour)
+	assert.NoError(t, err)
+	if assert.Len(t, hourly.Lines, 2) {
+		l := hourly.Lines[0]
+		assert.Equal(t, 3, l.Offered)
+		assert.Equal(t, 1, l.Abandoned)
+		assert.InDelta(t, 90, l.LongestWaitSeconds, 1e-9)
+		assert.InDelta(t, 50, *l.ServiceLevelPercent, 1e-9)
+	}
+
+	q.ByAgent = true
+	agents, err := reports.Report(q, IntervalDay)
+	assert.NoError(t, err)
+	assert.Equal(t, GroupByAgent, agents.GroupBy)
+	if assert.Len(t, agents.Lines, 2) {
+		l := agents.Lines[0]
+		assert.Equal(t, "sip:a1", l.AgentID)
+		assert.Equal(t, 2, l.Offered)
+		assert.Equal(t, 2, l.Answered)
+		assert.Equal(t, 1, l.Handled)
+		assert.Equal(t, 1, l.Failed)
+		assert.Equal(t, "sip:a2", agents.Lines[1].AgentID)
+	}
+}
+
+func TestReportRange(t *testing.T) {
+	_, reports := newTestAggregator()
+	from := time.Date(2024, 3, 1, 9, 7, 0, 0, time.UTC)
+	r, err := reports.Report(Query{AccountID: testAccount, From: from, To: from.Add(time.Minute)}, IntervalHour)
+	assert.NoError(t, err)
+	assert.Equal(t, from.Truncate(time.Hour), r.From)
+	assert.Equal(t, from.Truncate(time.Hour).Add(time.Hour), r.To)
+	assert.Empty(t, r.Lines)
+
+	_, err = reports.Report(Query{From: from, To: from}, IntervalHour)
+	assert.Equal(t, ErrInvalidRange, err)
+	_, err = reports.Report(Query{From: from, To: from.Add(time.Hour)}, "1w")
+	assert.Equal(t, ErrUnknownInterval, err)
+}
+
+func TestWriteCSV(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	sl := 50.0
+	report := &Report{Lines: []Line{
+		{Start: start, End: start.Add(time.Hour), QueueID: testQueue, Offered: 2, Answered: 1, ServiceLevelPercent: &sl, AverageSpeedOfAnswerSeconds: &sl, LongestWaitSeconds: 50},
+		{Start: start.Add(time.Hour), End: start.Add(2 * time.Hour), QueueID: testQueue, Abandoned: 1},
+	}}
+	var buf bytes.Buffer
+	assert.NoError(t, WriteCSV(&buf, report))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, strings.Join(csvHeader, ","), lines[0])
+	assert.Equal(t, "2024-03-01T09:00:00Z,2024-03-01T10:00:00Z,QID_reports,,2,1,0,0,0,50.00,50.00,50.00", lines[1])
+	assert.Equal(t, "2024-03-01T10:00:00Z,2024-03-01T11:00:00Z,QID_reports,,0,0,0,1,0,,,0.00", lines[2])
+}
+
+func TestMemoryStoragePurge(t *testing.T) {
+	m := NewMemoryStorage()
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	assert.NoError(t, m.Add(Row{Start: start, AccountID: testAccount, QueueID: testQueue, Counters: Counters{Offered: 1}}))
+	assert.NoError(t, m.Add(Row{Start: start.Add(BucketSize), AccountID: testAccount, QueueID: testQueue, Counters: Counters{Offered: 1}}))
+	assert.NoError(t, m.Purge(start.Add(BucketSize)))
+	rows, err := m.Rows(Query{AccountID: testAccount, From: start, To: start.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+}
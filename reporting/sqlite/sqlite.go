@@ -0,0 +1,125 @@
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	// registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+
+	"queuev2/reporting"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS report_buckets (
+	account_id           TEXT    NOT NULL,
+	queue_id             TEXT    NOT NULL,
+	agent_id             TEXT    NOT NULL DEFAULT '',
+	start                INTEGER NOT NULL,
+	offered              INTEGER NOT NULL DEFAULT 0,
+	answered             INTEGER NOT NULL DEFAULT 0,
+	timed                INTEGER NOT NULL DEFAULT 0,
+	answered_in_sl       INTEGER NOT NULL DEFAULT 0,
+	handled              INTEGER NOT NULL DEFAULT 0,
+	abandoned            INTEGER NOT NULL DEFAULT 0,
+	failed               INTEGER NOT NULL DEFAULT 0,
+	answer_seconds       REAL    NOT NULL DEFAULT 0,
+	longest_wait_seconds REAL    NOT NULL DEFAULT 0,
+	PRIMARY KEY (account_id, queue_id, agent_id, start)
+);
+CREATE INDEX IF NOT EXISTS report_buckets_start ON report_buckets (start);
+`
+
+const upsert = `
+INSERT INTO report_buckets (account_id, queue_id, agent_id, start, offered, answered, timed,
+	answered_in_sl, handled, abandoned, failed, answer_seconds, longest_wait_seconds)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (account_id, queue_id, agent_id, start) DO UPDATE SET
+	offered = offered + excluded.offered,
+	answered = answered + excluded.answered,
+	timed = timed + excluded.timed,
+	answered_in_sl = answered_in_sl + excluded.answered_in_sl,
+	handled = handled + excluded.handled,
+	abandoned = abandoned + excluded.abandoned,
+	failed = failed + excluded.failed,
+	answer_seconds = answer_seconds + excluded.answer_seconds,
+	longest_wait_seconds = MAX(longest_wait_seconds, excluded.longest_wait_seconds)
+`
+
+const selectRows = `
+SELECT start, queue_id, agent_id, offered, answered, timed, answered_in_sl, handled, abandoned,
+	failed, answer_seconds, longest_wait_seconds
+FROM report_buckets
+WHERE account_id = ? AND start >= ? AND start < ? AND (? = '' OR queue_id = ?) AND (agent_id != '') = ?
+`
+
+//Storage - reporting.Storage in a SQLite database, one file may be shared
+//by the processes of a host
+type Storage struct {
+	db *sql.DB
+}
+
+// Open - open or create the database at path, ":memory:" for a database
+// kept in process
+func Open(path string) (*Storage, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite serializes writers, a single connection avoids busy errors
+	// within the process and keeps in memory databases to one instance
+	db.SetMaxOpenConns(1)
+	s, err := New(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// New - storage on an open database, the table is created when missing
+func New(db *sql.DB) (*Storage, error) {
+	if _, err := db.Exec(schema); err != nil {
+		return nil, err
+	}
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) Add(row reporting.Row) error {
+	c := row.Counters
+	_, err := s.db.Exec(upsert, row.AccountID, row.QueueID, row.AgentID, row.Start.Unix(),
+		c.Offered, c.Answered, c.Timed, c.AnsweredInSL, c.Handled, c.Abandoned, c.Failed,
+		c.AnswerSeconds, c.LongestWaitSeconds)
+	return err
+}
+
+func (s *Storage) Rows(q reporting.Query) ([]reporting.Row, error) {
+	res, err := s.db.Query(selectRows, q.AccountID, q.From.Unix(), q.To.Unix(), q.QueueID, q.QueueID, q.ByAgent)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var rows []reporting.Row
+	for res.Next() {
+		row := reporting.Row{AccountID: q.AccountID}
+		var start int64
+		c := &row.Counters
+		if err = res.Scan(&start, &row.QueueID, &row.AgentID, &c.Offered, &c.Answered, &c.Timed, &c.AnsweredInSL,
+			&c.Handled, &c.Abandoned, &c.Failed, &c.AnswerSeconds, &c.LongestWaitSeconds); err != nil {
+			return nil, err
+		}
+		row.Start = time.Unix(start, 0).UTC()
+		rows = append(rows, row)
+	}
+	return rows, res.Err()
+}
+
+func (s *Storage) Purge(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM report_buckets WHERE start < ?", before.Unix())
+	return err
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,55 @@
+package sqlite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/reporting"
+)
+
+func TestStorage(t *testing.T) {
+	s, err := Open(":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	queue := reporting.Row{Start: start, AccountID: "123", QueueID: "q1"}
+	queue.Counters = reporting.Counters{Offered: 1, Answered: 1, Timed: 1, AnswerSeconds: 10, LongestWaitSeconds: 10}
+	assert.NoError(t, s.Add(queue))
+	queue.Counters = reporting.Counters{Offered: 1, Abandoned: 1, LongestWaitSeconds: 40}
+	assert.NoError(t, s.Add(queue))
+	queue.Counters = reporting.Counters{Offered: 1, LongestWaitSeconds: 5}
+	assert.NoError(t, s.Add(queue))
+	assert.NoError(t, s.Add(reporting.Row{Start: start, AccountID: "123", QueueID: "q1", AgentID: "a1", Counters: reporting.Counters{Answered: 1}}))
+	assert.NoError(t, s.Add(reporting.Row{Start: start, AccountID: "456", QueueID: "q1", Counters: reporting.Counters{Offered: 1}}))
+
+	q := reporting.Query{AccountID: "123", From: start, To: start.Add(time.Hour)}
+	rows, err := s.Rows(q)
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, start, rows[0].Start)
+		assert.Equal(t, "q1", rows[0].QueueID)
+		assert.Equal(t, reporting.Counters{Offered: 3, Answered: 1, Timed: 1, Abandoned: 1, AnswerSeconds: 10, LongestWaitSeconds: 40}, rows[0].Counters)
+	}
+
+	q.ByAgent = true
+	rows, err = s.Rows(q)
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "a1", rows[0].AgentID)
+	}
+
+	q.ByAgent, q.QueueID = false, "q2"
+	rows, err = s.Rows(q)
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+
+	assert.NoError(t, s.Purge(start.Add(time.Minute)))
+	rows, err = s.Rows(reporting.Query{AccountID: "123", From: start, To: start.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+}
@@ -0,0 +1,34 @@
+package store
+
+import "time"
+
+//State - connection state of a store backend
+type State string
+
+const (
+	// StateConnected - backend reachable
+	StateConnected State = "connected"
+	// StateDegraded - connection lost, reconnect in progress
+	StateDegraded State = "degraded"
+	// StateDown - reconnect attempts exhausted, still retrying in background
+	StateDown State = "down"
+)
+
+//Health - snapshot of the store connection health
+type Health struct {
+	State           State     `json:"state"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastErrorAt     time.Time `json:"last_error_at,omitempty"`
+	LastConnectedAt time.Time `json:"last_connected_at,omitempty"`
+	ChangedAt       time.Time `json:"changed_at"`
+}
+
+//HealthReporter - implemented by stores which track their connection health
+type HealthReporter interface {
+	Health() Health
+	// Ping checks the backend with a round trip
+	Ping() error
+	// Subscribe returns a channel receiving every state change and a
+	// function to cancel the subscription
+	Subscribe() (<-chan Health, func())
+}
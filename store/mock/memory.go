@@ -12,8 +12,12 @@ package mock
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"queuev2/store"
 )
 
 const (
@@ -33,6 +37,15 @@ var (
 //MemStore - struct for in memory store
 type MemStore struct {
 	dict sync.Map
+	mu   sync.Mutex
+
+	// hashes are maps mutated in place
+	hashMu sync.RWMutex
+
+	subsMu sync.RWMutex
+	subs   map[*subscription]struct{}
+
+	streamMu sync.Mutex
 }
 
 // NewStore - to create the redis connection
@@ -53,6 +66,21 @@ func (m *MemStore) Set(key, value string) error {
 	return nil
 }
 
+//SetNX - expire time is not tracked by the in memory store
+func (m *MemStore) SetNX(key, value string, expire int) (bool, error) {
+	if fail := strings.Contains(key, setFail); fail {
+		return false, errSetFailed
+	}
+
+	_, loaded := m.dict.LoadOrStore(key, value)
+	return !loaded, nil
+}
+
+//SetEX - expire time is not tracked by the in memory store
+func (m *MemStore) SetEX(key, value string, expire int) error {
+	return m.Set(key, value)
+}
+
 //Get ...
 func (m *MemStore) Get(key string) (string, error) {
 	if fail := strings.Contains(key, getFail); fail {
@@ -68,6 +96,20 @@ func (m *MemStore) Get(key string) (string, error) {
 	return s, nil
 }
 
+//GetMulti ...
+func (m *MemStore) GetMulti(keys []string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		if fail := strings.Contains(key, getFail); fail {
+			return nil, errGetFailed
+		}
+		if val, ok := m.dict.Load(key); ok {
+			values[i] = fmt.Sprintf("%s", val)
+		}
+	}
+	return values, nil
+}
+
 //GetStruct ...
 func (m *MemStore) GetStruct(key string) (string, error) {
 	if fail := strings.Contains(key, getFail); fail {
@@ -101,6 +143,16 @@ func (m *MemStore) SetStruct(key string, value string) error {
 	return nil
 }
 
+//SetMultiStruct ...
+func (m *MemStore) SetMultiStruct(items map[string]string) error {
+	for key, value := range items {
+		if err := m.SetStruct(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //DeleteKey ...
 func (m *MemStore) DeleteKey(key string) error {
 	if fail := strings.Contains(key, delFail); fail {
@@ -144,6 +196,25 @@ func (m *MemStore) SetExpireTime(key string, timeout int) error {
 	return nil
 }
 
+//SetStructNoExpire - the mock store does not expire keys
+func (m *MemStore) SetStructNoExpire(key string, value string) error {
+	return m.SetStruct(key, value)
+}
+
+//PersistKey ...
+func (m *MemStore) PersistKey(key string) error {
+	if fail := strings.Contains(key, genFail); fail {
+		return errSetFailed
+	}
+
+	_, ok := m.dict.Load(key)
+	if !ok {
+		return errKeyNotFound
+	}
+
+	return nil
+}
+
 //GetKeys list of keys via pattern matching
 func (m *MemStore) GetKeys(pattern string) ([]string, error) {
 	if fail := strings.Contains(pattern, genFail); fail {
@@ -170,6 +241,9 @@ func (m *MemStore) GetStructFromHash(primaryKey, secondaryKey string) (string, e
 		return "", errGetFailed
 	}
 
+	m.hashMu.RLock()
+	defer m.hashMu.RUnlock()
+
 	reply, ok := m.dict.Load(primaryKey)
 	if !ok {
 		return "", errKeyNotFound
@@ -195,12 +269,20 @@ func (m *MemStore) GetStructFromHash(primaryKey, secondaryKey string) (string, e
 	return val, nil
 }
 
+//SetStructInHashNoExpire - the mock store does not expire keys
+func (m *MemStore) SetStructInHashNoExpire(primaryKey, secondaryKey string, value string) error {
+	return m.SetStructInHash(primaryKey, secondaryKey, value)
+}
+
 //SetStructInHash - set key(secondaryKey) val(value) inside a hash (primaryKey)
 func (m *MemStore) SetStructInHash(primaryKey, secondaryKey string, value string) error {
 	if fail := strings.Contains(primaryKey+secondaryKey, setFail); fail {
 		return errSetFailed
 	}
 
+	m.hashMu.Lock()
+	defer m.hashMu.Unlock()
+
 	recMap := make(map[string]interface{})
 	if val, ok := m.dict.Load(primaryKey); ok {
 		recMap, ok = val.(map[string]interface{})
@@ -222,6 +304,9 @@ func (m *MemStore) GetKeysFromHash(uuid string) ([]string, error) {
 		return nil, errGetFailed
 	}
 
+	m.hashMu.RLock()
+	defer m.hashMu.RUnlock()
+
 	val, ok := m.dict.Load(uuid)
 	if !ok {
 		return nil, nil
@@ -244,6 +329,9 @@ func (m *MemStore) DeleteStructFromHash(primaryKey, secondaryKey string) error {
 		return errDelFailed
 	}
 
+	m.hashMu.Lock()
+	defer m.hashMu.Unlock()
+
 	recMap := make(map[string]interface{})
 	if val, ok := m.dict.Load(primaryKey); ok {
 		recMap, ok = val.(map[string]interface{})
@@ -264,6 +352,9 @@ func (m *MemStore) KeyExistsInHash(primaryKey, secondaryKey string) (int, error)
 		return -1, errGetFailed
 	}
 
+	m.hashMu.RLock()
+	defer m.hashMu.RUnlock()
+
 	val, ok := m.dict.Load(primaryKey)
 	if !ok {
 		return 0, nil
@@ -282,8 +373,23 @@ func (m *MemStore) KeyExistsInHash(primaryKey, secondaryKey string) (int, error)
 	return 0, nil
 }
 
-func (m *MemStore) AtomicIncrement(key string) error {
-	return nil
+func (m *MemStore) AtomicIncrement(key string) (int64, error) {
+	if fail := strings.Contains(key, setFail); fail {
+		return 0, errSetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var val int64
+	if cur, ok := m.dict.Load(key); ok {
+		if _, err := fmt.Sscan(fmt.Sprintf("%v", cur), &val); err != nil {
+			return 0, errors.New("value is not an integer")
+		}
+	}
+	val++
+	m.dict.Store(key, fmt.Sprintf("%d", val))
+	return val, nil
 }
 
 func (m *MemStore) SetMultiStructInHash(primaryKey string, keyVal map[string]string) error {
@@ -291,6 +397,9 @@ func (m *MemStore) SetMultiStructInHash(primaryKey string, keyVal map[string]str
 		return errSetFailed
 	}
 
+	m.hashMu.Lock()
+	defer m.hashMu.Unlock()
+
 	multiMap := make(map[string]interface{})
 	if val, ok := m.dict.Load(primaryKey); ok {
 		multiMap, ok = val.(map[string]interface{})
@@ -313,6 +422,9 @@ func (m *MemStore) DelMultiKeyFromHash(primaryKey string, delKeys []interface{})
 		return errDelFailed
 	}
 
+	m.hashMu.Lock()
+	defer m.hashMu.Unlock()
+
 	multiMap := make(map[string]interface{})
 	if val, ok := m.dict.Load(primaryKey); ok {
 		multiMap, ok = val.(map[string]interface{})
@@ -335,6 +447,9 @@ func (m *MemStore) GetHashKeyCount(key string) (int, error) {
 		return 0, errGetFailed
 	}
 
+	m.hashMu.RLock()
+	defer m.hashMu.RUnlock()
+
 	multiMap := make(map[string]interface{})
 	if val, ok := m.dict.Load(key); ok {
 		multiMap, ok = val.(map[string]interface{})
@@ -426,3 +541,293 @@ func (m *MemStore) QueuePeakIndex(key string, index int32) (string, error){
 		return "", fmt.Errorf("index out of range")
 	}
 }
+
+//Health - in memory store is always connected
+func (m *MemStore) Health() store.Health {
+	return store.Health{State: store.StateConnected}
+}
+
+//Ping - in memory store is always reachable
+func (m *MemStore) Ping() error {
+	return nil
+}
+
+//Subscribe - in memory store never changes state
+func (m *MemStore) Subscribe() (<-chan store.Health, func()) {
+	ch := make(chan store.Health)
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(ch) }) }
+}
+
+//sortedSet - member to score, ordered like redis by score then member
+type sortedSet map[string]int
+
+func (z sortedSet) members() []string {
+	items := make([]string, 0, len(z))
+	for item := range z {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if z[items[i]] != z[items[j]] {
+			return z[items[i]] < z[items[j]]
+		}
+		return items[i] < items[j]
+	})
+	return items
+}
+
+func (m *MemStore) loadSortedSet(key string) (sortedSet, error) {
+	val, ok := m.dict.Load(key)
+	if !ok {
+		return sortedSet{}, nil
+	}
+	z, ok := val.(sortedSet)
+	if !ok {
+		return nil, errors.New("parsing failed at sorted set " + key)
+	}
+	return z, nil
+}
+
+//AddSortedSet ...
+func (m *MemStore) AddSortedSet(key string, score int, data string) error {
+	if fail := strings.Contains(key, setFail); fail {
+		return errSetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return err
+	}
+	z[data] = score
+	m.dict.Store(key, z)
+	return nil
+}
+
+//AddSortedSetMulti ...
+func (m *MemStore) AddSortedSetMulti(key string, items map[string]int) error {
+	if fail := strings.Contains(key, setFail); fail {
+		return errSetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return err
+	}
+	for data, score := range items {
+		z[data] = score
+	}
+	m.dict.Store(key, z)
+	return nil
+}
+
+//RemoveSortedSet ...
+func (m *MemStore) RemoveSortedSet(key string, data string) error {
+	if fail := strings.Contains(key, delFail); fail {
+		return errDelFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return err
+	}
+	delete(z, data)
+	return nil
+}
+
+//GetRankSortedSet ...
+func (m *MemStore) GetRankSortedSet(key string, data string) (int, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return 0, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return 0, err
+	}
+	for i, item := range z.members() {
+		if item == data {
+			return i, nil
+		}
+	}
+	return 0, errKeyNotFound
+}
+
+//GetScoreSortedSet ...
+func (m *MemStore) GetScoreSortedSet(key string, data string) (int, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return 0, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return 0, err
+	}
+	score, ok := z[data]
+	if !ok {
+		return 0, errKeyNotFound
+	}
+	return score, nil
+}
+
+//GetAllScoresSortedSet ...
+func (m *MemStore) GetAllScoresSortedSet(key string) (map[string]int, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return nil, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]int, len(z))
+	for item, score := range z {
+		scores[item] = score
+	}
+	return scores, nil
+}
+
+//GetRangeByScoreSortedSet ...
+func (m *MemStore) GetRangeByScoreSortedSet(key string, max, count int) ([]string, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return nil, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return nil, err
+	}
+	items := []string{}
+	for _, item := range z.members() {
+		if z[item] > max || len(items) == count {
+			break
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+//GetRanksSortedSet ...
+func (m *MemStore) GetRanksSortedSet(key string, members []string) ([]int, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return nil, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return nil, err
+	}
+	rank := make(map[string]int, len(z))
+	for i, item := range z.members() {
+		rank[item] = i
+	}
+	ranks := make([]int, len(members))
+	for i, item := range members {
+		if r, ok := rank[item]; ok {
+			ranks[i] = r
+		} else {
+			ranks[i] = -1
+		}
+	}
+	return ranks, nil
+}
+
+//GetAllItemsSortedSet ...
+func (m *MemStore) GetAllItemsSortedSet(key string) ([]string, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return nil, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return nil, err
+	}
+	return z.members(), nil
+}
+
+//GetCountSortedSet ...
+func (m *MemStore) GetCountSortedSet(key string) (int, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return 0, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z, err := m.loadSortedSet(key)
+	if err != nil {
+		return 0, err
+	}
+	return len(z), nil
+}
+
+type bucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+//TakeToken - in process token bucket
+func (m *MemStore) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	if fail := strings.Contains(key, genFail); fail {
+		return false, 0, errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	b, ok := m.dict.Load(key)
+	state, _ := b.(*bucket)
+	if !ok || state == nil {
+		state = &bucket{tokens: float64(burst), ts: now}
+		m.dict.Store(key, state)
+	}
+
+	state.tokens += now.Sub(state.ts).Seconds() * rate
+	if state.tokens > float64(burst) {
+		state.tokens = float64(burst)
+	}
+	state.ts = now
+
+	if state.tokens >= 1 {
+		state.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - state.tokens) / rate * float64(time.Second))
+	return false, wait, nil
+}
+
+//ReturnToken - in process token bucket
+func (m *MemStore) ReturnToken(key string, burst int) error {
+	if fail := strings.Contains(key, genFail); fail {
+		return errGetFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, _ := m.dict.Load(key)
+	if state, ok := b.(*bucket); ok {
+		state.tokens++
+		if state.tokens > float64(burst) {
+			state.tokens = float64(burst)
+		}
+	}
+	return nil
+}
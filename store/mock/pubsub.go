@@ -0,0 +1,64 @@
+package mock
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"queuev2/store"
+)
+
+//subscription - in process pattern subscriber
+type subscription struct {
+	pattern string
+	ch      chan store.Message
+	done    chan struct{}
+}
+
+//Publish - deliver to the subscribers of this store only
+func (m *MemStore) Publish(channel, message string) error {
+	if fail := strings.Contains(channel, setFail); fail {
+		return errSetFailed
+	}
+
+	m.subsMu.RLock()
+	defer m.subsMu.RUnlock()
+	for sub := range m.subs {
+		if ok, _ := path.Match(sub.pattern, channel); !ok {
+			continue
+		}
+		select {
+		case sub.ch <- store.Message{Channel: channel, Data: message}:
+		case <-sub.done:
+		}
+	}
+	return nil
+}
+
+//PSubscribe - patterns follow path.Match which is close to the redis glob
+func (m *MemStore) PSubscribe(pattern string) (<-chan store.Message, func(), error) {
+	sub := &subscription{
+		pattern: pattern,
+		ch:      make(chan store.Message, 64),
+		done:    make(chan struct{}),
+	}
+
+	m.subsMu.Lock()
+	if m.subs == nil {
+		m.subs = make(map[*subscription]struct{})
+	}
+	m.subs[sub] = struct{}{}
+	m.subsMu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			// unblock publishers first, they hold the read lock
+			close(sub.done)
+			m.subsMu.Lock()
+			delete(m.subs, sub)
+			close(sub.ch)
+			m.subsMu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,207 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"queuev2/store"
+)
+
+//memStream - stream kept in the dict so KeyExists, SetExpireTime and
+//DeleteKey apply to it, added is closed and replaced on every append to
+//wake up readers
+type memStream struct {
+	entries []store.StreamEntry
+	lastMS  int64
+	lastSeq int64
+	added   chan struct{}
+}
+
+//streamID - parsed "<ms>-<seq>" id
+type streamID struct {
+	ms, seq int64
+}
+
+func parseStreamID(id string, last bool) (streamID, error) {
+	switch id {
+	case "-":
+		return streamID{0, 0}, nil
+	case "+":
+		return streamID{1<<63 - 1, 1<<63 - 1}, nil
+	}
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return streamID{}, errors.New("invalid stream id " + id)
+	}
+	if len(parts) == 1 {
+		// incomplete ids cover every sequence of the millisecond
+		if last {
+			return streamID{ms, 1<<63 - 1}, nil
+		}
+		return streamID{ms, 0}, nil
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return streamID{}, errors.New("invalid stream id " + id)
+	}
+	return streamID{ms, seq}, nil
+}
+
+func (a streamID) less(b streamID) bool {
+	return a.ms < b.ms || (a.ms == b.ms && a.seq < b.seq)
+}
+
+// stream - the stream at key, created when create is set. Callers hold
+// streamMu
+func (m *MemStore) stream(key string, create bool) (*memStream, error) {
+	val, ok := m.dict.Load(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		s := &memStream{added: make(chan struct{})}
+		m.dict.Store(key, s)
+		return s, nil
+	}
+	s, ok := val.(*memStream)
+	if !ok {
+		return nil, errors.New("WRONGTYPE key is not a stream")
+	}
+	return s, nil
+}
+
+//StreamAdd - ids use the redis format, trimming is exact
+func (m *MemStore) StreamAdd(key string, maxLen int, fields map[string]string) (string, error) {
+	if fail := strings.Contains(key, setFail); fail {
+		return "", errSetFailed
+	}
+
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	s, err := m.stream(key, true)
+	if err != nil {
+		return "", err
+	}
+
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms <= s.lastMS {
+		ms = s.lastMS
+		s.lastSeq++
+	} else {
+		s.lastSeq = 0
+	}
+	s.lastMS = ms
+	id := fmt.Sprintf("%d-%d", ms, s.lastSeq)
+
+	copied := make(map[string]string, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	s.entries = append(s.entries, store.StreamEntry{ID: id, Fields: copied})
+	if maxLen > 0 && len(s.entries) > maxLen {
+		s.entries = append([]store.StreamEntry(nil), s.entries[len(s.entries)-maxLen:]...)
+	}
+	close(s.added)
+	s.added = make(chan struct{})
+	return id, nil
+}
+
+//StreamRange ...
+func (m *MemStore) StreamRange(key, start, end string, count int) ([]store.StreamEntry, error) {
+	return m.streamRange(key, start, end, count, false)
+}
+
+//StreamRevRange ...
+func (m *MemStore) StreamRevRange(key, end, start string, count int) ([]store.StreamEntry, error) {
+	return m.streamRange(key, start, end, count, true)
+}
+
+func (m *MemStore) streamRange(key, start, end string, count int, reverse bool) ([]store.StreamEntry, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return nil, errGetFailed
+	}
+	from, err := parseStreamID(start, false)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseStreamID(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	s, err := m.stream(key, false)
+	if err != nil || s == nil {
+		return []store.StreamEntry{}, err
+	}
+
+	entries := []store.StreamEntry{}
+	for i := range s.entries {
+		e := s.entries[i]
+		if reverse {
+			e = s.entries[len(s.entries)-1-i]
+		}
+		id, _ := parseStreamID(e.ID, false)
+		if id.less(from) || to.less(id) {
+			continue
+		}
+		entries = append(entries, e)
+		if count > 0 && len(entries) == count {
+			break
+		}
+	}
+	return entries, nil
+}
+
+//StreamRead ...
+func (m *MemStore) StreamRead(key, afterID string, count int, block time.Duration) ([]store.StreamEntry, error) {
+	if fail := strings.Contains(key, getFail); fail {
+		return nil, errGetFailed
+	}
+	after, err := parseStreamID(afterID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(block)
+	for {
+		m.streamMu.Lock()
+		s, err := m.stream(key, false)
+		if err != nil {
+			m.streamMu.Unlock()
+			return nil, err
+		}
+		if s == nil {
+			// like XREAD a missing stream is not created, poll until it is
+			s = &memStream{added: make(chan struct{})}
+			time.AfterFunc(10*time.Millisecond, func() { close(s.added) })
+		}
+		entries := []store.StreamEntry{}
+		for _, e := range s.entries {
+			id, _ := parseStreamID(e.ID, false)
+			if !after.less(id) {
+				continue
+			}
+			entries = append(entries, e)
+			if count > 0 && len(entries) == count {
+				break
+			}
+		}
+		added := s.added
+		m.streamMu.Unlock()
+
+		wait := time.Until(deadline)
+		if len(entries) > 0 || wait <= 0 {
+			return entries, nil
+		}
+		select {
+		case <-added:
+		case <-time.After(wait):
+		}
+	}
+}
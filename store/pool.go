@@ -0,0 +1,17 @@
+package store
+
+import "time"
+
+//PoolStats - connection pool usage, WaitCount and WaitDuration are totals
+//since the pool was created
+type PoolStats struct {
+	Active       int
+	Idle         int
+	WaitCount    int64
+	WaitDuration time.Duration
+}
+
+//PoolReporter - implemented by stores with a connection pool
+type PoolReporter interface {
+	PoolStats() PoolStats
+}
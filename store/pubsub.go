@@ -0,0 +1,19 @@
+package store
+
+//Message - payload published on a channel
+type Message struct {
+	Channel string
+	Data    string
+}
+
+//PubSub - implemented by stores which fan out messages to every process
+//subscribed, e.g. all API replicas
+type PubSub interface {
+	Publish(channel, message string) error
+	// PSubscribe returns a channel receiving messages of every channel
+	// matching the glob pattern and a function to cancel the subscription.
+	// The channel is closed when the subscription is cancelled or its
+	// connection is lost, in the latter case callers cancel and subscribe
+	// again
+	PSubscribe(pattern string) (<-chan Message, func(), error)
+}
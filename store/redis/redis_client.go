@@ -1,6 +1,8 @@
 package redis
 
 import (
+	"strconv"
+
 	"github.com/gomodule/redigo/redis"
 )
 
@@ -16,6 +18,34 @@ func (c *Connection) Set(key, value string) error {
 	return err
 }
 
+//SetNX set key with expire time (seconds) only if it does not exist,
+//returns false if the key was already present
+func (c *Connection) SetNX(key, value string, expire int) (bool, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = redis.String(conn.Do("SET", key, value, "NX", "EX", expire))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//SetEX set key with expire time (seconds)
+func (c *Connection) SetEX(key, value string, expire int) error {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("SET", key, value, "EX", expire)
+	return err
+}
+
 //Get key
 func (c *Connection) Get(key string) (string, error) {
 	conn, err := c.getConnFromPool()
@@ -58,6 +88,64 @@ func (c *Connection) SetStruct(key string, value string) error {
 	return err
 }
 
+//SetStructNoExpire - SET without an expire time, it replaces the one of the
+//key
+func (c *Connection) SetStructNoExpire(key string, value string) error {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("SET", key, value)
+	return err
+}
+
+//SetMultiStruct - pipelined SETEX of every key
+func (c *Connection) SetMultiStruct(items map[string]string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for key, value := range items {
+		if err = conn.Send("SETEX", key, c.expireTime, value); err != nil {
+			return err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return err
+	}
+	for range items {
+		if _, err = conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//GetMulti - MGET
+func (c *Connection) GetMulti(keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return []string{}, nil
+	}
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, k := range keys {
+		args[i] = k
+	}
+	return redis.Strings(conn.Do("MGET", args...))
+}
+
 //DeleteKey ...
 func (c *Connection) DeleteKey(key string) error {
 	conn, err := c.getConnFromPool()
@@ -94,6 +182,18 @@ func (c *Connection) SetExpireTime(key string, timeout int) error {
 	return err
 }
 
+//PersistKey remove the expire time of a key
+func (c *Connection) PersistKey(key string) error {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PERSIST", key)
+	return err
+}
+
 //GetKeys list of keys via pattern matching
 func (c *Connection) GetKeys(pattern string) ([]string, error) {
 	conn, err := c.getConnFromPool()
@@ -141,6 +241,30 @@ func (c *Connection) SetStructInHash(primaryKey, secondaryKey string, value stri
 	return err
 }
 
+//SetStructInHashNoExpire - HSET and PERSIST in one MULTI/EXEC so the hash is
+//never left with the field but an expire time
+func (c *Connection) SetStructInHashNoExpire(primaryKey, secondaryKey string, value string) error {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err = conn.Send("HSET", primaryKey, secondaryKey, value); err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	if err = conn.Send("PERSIST", primaryKey); err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
 //GetKeysFromHash get list of keys inside a hash
 func (c *Connection) GetKeysFromHash(uuid string) ([]string, error) {
 	conn, err := c.getConnFromPool()
@@ -180,15 +304,14 @@ func (c *Connection) KeyExistsInHash(primaryKey, secondaryKey string) (int, erro
 	return val, err
 }
 
-// Atomic Operation on a value
-func (c *Connection) AtomicIncrement(key string) error {
+// Atomic Operation on a value, returns the incremented value
+func (c *Connection) AtomicIncrement(key string) (int64, error) {
 	conn, err := c.getConnFromPool()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer conn.Close()
-	_, err = conn.Do("INCR", key)
-	return err
+	return redis.Int64(conn.Do("INCR", key))
 }
 
 func (c *Connection) SetMultiStructInHash(primaryKey string, keyVal map[string]string) error {
@@ -312,6 +435,26 @@ func (c *Connection) AddSortedSet(key string, score int, data string) error {
 	return noErrNil(err)
 }
 
+//AddSortedSetMulti - add or update several members with a single ZADD
+func (c *Connection) AddSortedSetMulti(key string, items map[string]int) error {
+	if len(items) == 0 {
+		return nil
+	}
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, 0, 1+2*len(items))
+	args = append(args, key)
+	for member, score := range items {
+		args = append(args, score, member)
+	}
+	_, err = conn.Do("ZADD", args...)
+	return noErrNil(err)
+}
+
 func (c *Connection) RemoveSortedSet(key string, data string) error {
 	conn, err := c.getConnFromPool()
 	if err != nil {
@@ -337,6 +480,96 @@ func (c *Connection) GetRankSortedSet(key string, data string) (int, error) {
 	return rank, nil
 }
 
+//GetScoreSortedSet - ZSCORE, redis.ErrNil when the member is missing
+func (c *Connection) GetScoreSortedSet(key string, data string) (int, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	score, err := redis.Float64(conn.Do("ZSCORE", key, data))
+	if err != nil {
+		return 0, err
+	}
+	return int(score), nil
+}
+
+//GetAllScoresSortedSet - ZRANGE WITHSCORES
+func (c *Connection) GetAllScoresSortedSet(key string) (map[string]int, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[string]int, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		scores[values[i]] = int(score)
+	}
+	return scores, nil
+}
+
+//GetRangeByScoreSortedSet - ZRANGEBYSCORE -inf max LIMIT 0 count
+func (c *Connection) GetRangeByScoreSortedSet(key string, max, count int) ([]string, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", key, "-inf", max, "LIMIT", 0, count))
+}
+
+//GetCountSortedSet - ZCARD
+func (c *Connection) GetCountSortedSet(key string) (int, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return redis.Int(conn.Do("ZCARD", key))
+}
+
+//GetRanksSortedSet - ZRANK of every member in one pipeline
+func (c *Connection) GetRanksSortedSet(key string, members []string) ([]int, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, m := range members {
+		if err = conn.Send("ZRANK", key, m); err != nil {
+			return nil, err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	ranks := make([]int, len(members))
+	for i := range members {
+		rank, err := redis.Int(conn.Receive())
+		if err == redis.ErrNil {
+			rank = -1
+		} else if err != nil {
+			return nil, err
+		}
+		ranks[i] = rank
+	}
+	return ranks, nil
+}
+
 func (c *Connection) GetAllItemsSortedSet(key string) ([]string, error) {
 	var items []string
 	conn, err := c.getConnFromPool()
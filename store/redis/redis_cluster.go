@@ -0,0 +1,421 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const clusterSlots = 16384
+
+// HashTag - wrap tag in braces, keys sharing a hash tag map to the same
+// cluster slot which multi-key commands such as DoublePush require.
+//
+// Keys read or written together are tagged by what groups them:
+//   - task:{<account>}:<task> by account, written by SetMultiStruct
+//   - stats:{<queue>}:<outcome>:<minute> by queue, read by GetMulti
+//   - events:{<account>} and task_events:{<account>}:<task> by account
+//
+// Every other key (queue registry and owners, positions, queue states,
+// idempotency records, unconfirmed tasks, agents and their requested
+// states, dead letters, rate limit buckets) is only used by single key
+// commands and left untagged. A multi-key command added over them must
+// tag them first, a cluster rejects it with CROSSSLOT otherwise
+func HashTag(tag string) string {
+	return "{" + tag + "}"
+}
+
+// Slot - cluster hash slot of a key, only the hash tag is hashed when present
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+//clusterPool - one connection pool per cluster node plus the slot map
+type clusterPool struct {
+	opts    Options
+	dialOpt []redis.DialOption
+
+	mu    sync.RWMutex
+	seeds []string
+	slots [clusterSlots]string
+	pools map[string]*redis.Pool
+}
+
+func newClusterPool(opts Options, dialOpt []redis.DialOption) *clusterPool {
+	return &clusterPool{
+		opts:    opts,
+		dialOpt: dialOpt,
+		seeds:   append([]string{}, opts.Cluster.Addrs...),
+		pools:   make(map[string]*redis.Pool),
+	}
+}
+
+// refresh - load the slot map from the first node that answers CLUSTER SLOTS
+func (cp *clusterPool) refresh() error {
+	cp.mu.RLock()
+	nodes := append([]string{}, cp.seeds...)
+	for addr := range cp.pools {
+		nodes = append(nodes, addr)
+	}
+	cp.mu.RUnlock()
+
+	var lastErr error
+	for _, addr := range nodes {
+		conn := cp.pool(addr).Get()
+		reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var slots [clusterSlots]string
+		for _, r := range reply {
+			rng, err := redis.Values(r, nil)
+			if err != nil || len(rng) < 3 {
+				continue
+			}
+			start, _ := redis.Int(rng[0], nil)
+			end, _ := redis.Int(rng[1], nil)
+			master, err := redis.Values(rng[2], nil)
+			if err != nil || len(master) < 2 {
+				continue
+			}
+			host, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if host == "" {
+				host, _, _ = net.SplitHostPort(addr)
+			}
+			nodeAddr := net.JoinHostPort(host, strconv.Itoa(port))
+			for i := start; i <= end && i < clusterSlots; i++ {
+				slots[i] = nodeAddr
+			}
+		}
+
+		cp.mu.Lock()
+		cp.slots = slots
+		cp.mu.Unlock()
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no cluster node configured")
+	}
+	return errors.New("failed to load cluster slots: " + lastErr.Error())
+}
+
+func (cp *clusterPool) pool(addr string) *redis.Pool {
+	cp.mu.RLock()
+	p, ok := cp.pools[addr]
+	cp.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if p, ok = cp.pools[addr]; ok {
+		return p
+	}
+	p = &redis.Pool{
+		MaxIdle:     cp.opts.MaxIdle,
+		MaxActive:   cp.opts.MaxActive,
+		Wait:        cp.opts.Wait,
+		IdleTimeout: cp.opts.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, cp.dialOpt...)
+		},
+	}
+	cp.pools[addr] = p
+	return p
+}
+
+func (cp *clusterPool) addrForSlot(slot int) string {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	if addr := cp.slots[slot]; addr != "" {
+		return addr
+	}
+	return cp.seeds[0]
+}
+
+// masters - distinct node addresses currently owning slots
+func (cp *clusterPool) masters() []string {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, addr := range cp.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, cp.seeds...)
+	}
+	return addrs
+}
+
+func (cp *clusterPool) Get() redis.Conn {
+	return &clusterConn{cp: cp}
+}
+
+func (cp *clusterPool) Stats() redis.PoolStats {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	var stats redis.PoolStats
+	for _, p := range cp.pools {
+		s := p.Stats()
+		stats.ActiveCount += s.ActiveCount
+		stats.IdleCount += s.IdleCount
+		stats.WaitCount += s.WaitCount
+		stats.WaitDuration += s.WaitDuration
+	}
+	return stats
+}
+
+func (cp *clusterPool) Close() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for addr, p := range cp.pools {
+		p.Close()
+		delete(cp.pools, addr)
+	}
+	return nil
+}
+
+type pendingCmd struct {
+	name string
+	args []interface{}
+}
+
+//clusterConn - redis.Conn that binds to the node owning the first key it
+//sees, commands sent before that (MULTI) are buffered and replayed
+type clusterConn struct {
+	cp      *clusterPool
+	conn    redis.Conn
+	pending []pendingCmd
+	multi   bool
+}
+
+func (cc *clusterConn) Close() error {
+	if cc.conn == nil {
+		return nil
+	}
+	return cc.conn.Close()
+}
+
+func (cc *clusterConn) Err() error {
+	if cc.conn == nil {
+		return nil
+	}
+	return cc.conn.Err()
+}
+
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cc.conn == nil {
+		if cmd == "" && len(cc.pending) == 0 {
+			return nil, nil
+		}
+		if strings.EqualFold(cmd, "KEYS") {
+			return cc.cp.keys(args...)
+		}
+		if err := cc.bind(keyOf(cmd, args)); err != nil {
+			return nil, err
+		}
+	}
+
+	inTx := cc.multi
+	cc.trackMulti(cmd)
+	reply, err := cc.conn.Do(cmd, args...)
+	if inTx || cmd == "" {
+		return reply, err
+	}
+
+	redirect, addr, asking := parseRedirect(err)
+	if !redirect {
+		return reply, err
+	}
+	if !asking {
+		cc.cp.refresh()
+	}
+
+	cc.conn.Close()
+	cc.conn = cc.cp.pool(addr).Get()
+	if asking {
+		if _, err := cc.conn.Do("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return cc.conn.Do(cmd, args...)
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	cc.trackMulti(cmd)
+	if cc.conn == nil {
+		key := keyOf(cmd, args)
+		if key == "" {
+			cc.pending = append(cc.pending, pendingCmd{name: cmd, args: args})
+			return nil
+		}
+		if err := cc.bind(key); err != nil {
+			return err
+		}
+	}
+	return cc.conn.Send(cmd, args...)
+}
+
+func (cc *clusterConn) Flush() error {
+	if cc.conn == nil {
+		return nil
+	}
+	return cc.conn.Flush()
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if cc.conn == nil {
+		return nil, errors.New("cluster connection is not bound to a node")
+	}
+	return cc.conn.Receive()
+}
+
+func (cc *clusterConn) bind(key string) error {
+	var addr string
+	if key == "" {
+		addr = cc.cp.masters()[0]
+	} else {
+		addr = cc.cp.addrForSlot(Slot(key))
+	}
+
+	conn := cc.cp.pool(addr).Get()
+	if err := conn.Err(); err != nil {
+		conn.Close()
+		return err
+	}
+	cc.conn = conn
+
+	pending := cc.pending
+	cc.pending = nil
+	for _, p := range pending {
+		if err := conn.Send(p.name, p.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackMulti - redirects are not followed inside MULTI/EXEC, the whole
+// transaction has to target one node
+func (cc *clusterConn) trackMulti(cmd string) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		cc.multi = true
+	case "EXEC", "DISCARD":
+		cc.multi = false
+	}
+}
+
+// keys - KEYS only scans the node it runs on, so ask every master
+func (cp *clusterPool) keys(args ...interface{}) (interface{}, error) {
+	var all []interface{}
+	for _, addr := range cp.masters() {
+		conn := cp.pool(addr).Get()
+		reply, err := redis.Values(conn.Do("KEYS", args...))
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, reply...)
+	}
+	return all, nil
+}
+
+func keyOf(cmd string, args []interface{}) string {
+	switch strings.ToUpper(cmd) {
+	case "", "MULTI", "EXEC", "DISCARD", "PING", "KEYS", "INFO", "ROLE", "CLUSTER", "SCRIPT", "ASKING":
+		return ""
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return ""
+		}
+		// redigo scripts pass the key count as an int, which redis.Int
+		// does not convert
+		if n, err := strconv.Atoi(argString(args[1])); err != nil || n == 0 {
+			return ""
+		}
+		return argString(args[2])
+	case "XREAD":
+		// the options come first, the keys follow STREAMS
+		for i := 0; i < len(args)-1; i++ {
+			if strings.EqualFold(argString(args[i]), "STREAMS") {
+				return argString(args[i+1])
+			}
+		}
+		return ""
+	}
+
+	if len(args) == 0 {
+		return ""
+	}
+	return argString(args[0])
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseRedirect - parse "MOVED <slot> <addr>" and "ASK <slot> <addr>" errors
+func parseRedirect(err error) (bool, string, bool) {
+	rerr, ok := err.(redis.Error)
+	if !ok {
+		return false, "", false
+	}
+
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 {
+		return false, "", false
+	}
+	switch fields[0] {
+	case "MOVED":
+		return true, fields[2], false
+	case "ASK":
+		return true, fields[2], true
+	}
+	return false, "", false
+}
+
+// crc16 - CRC16-CCITT (XMODEM) as used by redis cluster key hashing
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
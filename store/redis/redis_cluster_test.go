@@ -0,0 +1,24 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlot(t *testing.T) {
+	assert.Equal(t, 0x31C3, int(crc16("123456789")))
+	assert.Equal(t, 12182, Slot("foo"))
+	assert.Equal(t, Slot("{user1000}.following"), Slot("{user1000}.followers"))
+	assert.Equal(t, Slot("ctlq"+HashTag("QID_1")), Slot("q"+HashTag("QID_1")))
+
+	// empty tag hashes the whole key
+	assert.Equal(t, int(crc16("{}foo")%clusterSlots), Slot("{}foo"))
+}
+
+func TestKeyOf(t *testing.T) {
+	assert.Equal(t, "events:{123}", keyOf("XADD", []interface{}{"events:{123}", "MAXLEN", "~", 10, "*"}))
+	assert.Equal(t, "events:{123}", keyOf("XREAD", []interface{}{"COUNT", 10, "BLOCK", int64(500), "STREAMS", "events:{123}", "0-0"}))
+	assert.Equal(t, "q{QID_1}", keyOf("EVAL", []interface{}{"script", 1, "q{QID_1}"}))
+	assert.Equal(t, "", keyOf("PING", nil))
+}
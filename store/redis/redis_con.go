@@ -2,21 +2,36 @@ package redis
 
 import (
 	"errors"
-	"os"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+
+	"queuev2/logger"
+	"queuev2/store"
 )
 
 //Connection - address to pass in newPool Connection
 type Connection struct {
-	address           string
-	port              string
-	pool              *redis.Pool
+	opts              Options
+	dialOpts          []redis.DialOption
+	optErr            error
+	sentinel          *sentinel
+	poolMu            sync.RWMutex
+	pool              connPool
 	connectionChannel chan bool
 	isRedisConnected  bool
 	expireTime        string
+	health            healthTracker
+}
+
+//connPool - a single redigo pool, or one pool per node in cluster mode
+type connPool interface {
+	Get() redis.Conn
+	Stats() redis.PoolStats
+	Close() error
 }
 
 var (
@@ -26,24 +41,51 @@ var (
 
 // NewStore - to configure the redis connection
 func NewStore(address, port string) *Connection {
-	once.Do(func() {
-		redisConn = &Connection{
-			address:           address,
-			port:              port,
-			connectionChannel: make(chan bool),
-		}
+	return NewStoreWithOptions(DefaultOptions(address, port))
+}
 
-		redisConn.expireTime = "86400"
+// NewStoreWithOptions - to configure the redis connection for standalone,
+// sentinel or cluster deployments
+func NewStoreWithOptions(opts Options) *Connection {
+	once.Do(func() {
+		redisConn = newConnection(opts)
 		go redisConn.reconnectListener()
 		err := redisConn.connect()
 		if err != nil {
+			redisConn.setState(store.StateDegraded, err)
 			redisConn.connectionChannel <- false
+			return
 		}
-
+		redisConn.setState(store.StateConnected, nil)
 	})
 	return redisConn
 }
 
+func newConnection(opts Options) *Connection {
+	c := &Connection{
+		opts:              opts,
+		connectionChannel: make(chan bool),
+		expireTime:        strconv.Itoa(opts.KeyExpireTime),
+	}
+	c.health.health = store.Health{State: store.StateDegraded, ChangedAt: time.Now()}
+
+	tlsConf, err := opts.tlsConfig()
+	if err == nil {
+		err = opts.validate()
+	}
+	if err != nil {
+		logger.Error("invalid redis options", logger.FieldError, err)
+		c.optErr = err
+		return c
+	}
+
+	c.dialOpts = opts.dialOptions(tlsConf, opts.Username, opts.Password, opts.DB)
+	if opts.Mode == ModeSentinel {
+		c.sentinel = newSentinel(opts, opts.dialOptions(tlsConf, opts.Sentinel.Username, opts.Sentinel.Password, 0))
+	}
+	return c
+}
+
 func (c *Connection) reconnectListener() {
 	// default keep-alive config
 	duration := 20
@@ -68,7 +110,7 @@ func (c *Connection) reconnectListener() {
 
 		t.Reset(d)
 		if count >= missCount {
-			c.connectWithExitOnError(maxRetryCount)
+			c.reconnect(maxRetryCount)
 
 			count = 0
 			t.Reset(d)
@@ -76,39 +118,71 @@ func (c *Connection) reconnectListener() {
 	}
 }
 
-func (c *Connection) isConnected() bool {
+// Ping - round trip to redis through the pool
+func (c *Connection) Ping() error {
 	conn, err := c.getConnFromPool()
 	if err != nil {
-		return false
-	}
-
-	if _, err = conn.Do("ping"); err != nil {
-		return false
+		return err
 	}
+	defer conn.Close()
 
-	return true
+	_, err = conn.Do("PING")
+	return err
 }
 
-func (c *Connection) connectWithExitOnError(maxRetryCount int) {
+// reconnect - retry with backoff until redis is reachable again. The state is
+// degraded while retrying and down once maxRetryCount attempts failed, after
+// that the retries continue at the maximum delay
+func (c *Connection) reconnect(maxRetryCount int) {
 	if c.isRedisConnected {
 		return
 	}
 
-	for i := 1; i <= maxRetryCount; i++ {
-		duration := c.delayInMS(i)
-		time.Sleep(duration)
+	c.setState(store.StateDegraded, nil)
+	for i := 1; ; i++ {
+		attempt := i
+		if attempt > maxRetryCount {
+			attempt = maxRetryCount
+		}
+		time.Sleep(c.delayInMS(attempt))
+
 		err := c.connect()
-		if err == nil && c.isConnected() {
+		if err == nil {
+			err = c.Ping()
+		}
+		if err == nil {
+			c.isRedisConnected = true
+			c.setState(store.StateConnected, nil)
 			return
 		}
-	}
 
-	os.Exit(1)
+		if i >= maxRetryCount {
+			c.setState(store.StateDown, err)
+		} else {
+			c.recordError(err)
+		}
+		logger.Error("redis reconnect failed", "attempt", i, logger.FieldError, err)
+	}
 }
 
 //connect - connect to redis
 func (c *Connection) connect() error {
-	c.pool = c.newPool()
+	if c.optErr != nil {
+		return c.optErr
+	}
+
+	pool, err := c.newPool()
+	if err != nil {
+		return err
+	}
+
+	c.poolMu.Lock()
+	old := c.pool
+	c.pool = pool
+	c.poolMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
 
 	conn, err := c.getConnFromPool()
 	if err != nil {
@@ -120,41 +194,85 @@ func (c *Connection) connect() error {
 }
 
 func (c *Connection) getConnFromPool() (redis.Conn, error) {
-	if c.pool == nil {
+	c.poolMu.RLock()
+	pool := c.pool
+	c.poolMu.RUnlock()
+	if pool == nil {
 		return nil, errors.New("connection pool is nil")
 	}
 
-	conn := c.pool.Get()
+	conn := pool.Get()
 	err := conn.Err()
 	c.notifyReconnectListener(err == nil)
 	if err != nil {
+		conn.Close()
+		c.recordError(err)
 		return nil, errors.New("failed to get redis conn from pool: " + err.Error() + "\n")
 	}
 	return conn, nil
 }
 
+// PoolStats - usage of the current pool, in cluster mode summed over the
+// nodes. Counters restart when a reconnect replaces the pool
+func (c *Connection) PoolStats() store.PoolStats {
+	c.poolMu.RLock()
+	pool := c.pool
+	c.poolMu.RUnlock()
+	if pool == nil {
+		return store.PoolStats{}
+	}
+
+	s := pool.Stats()
+	return store.PoolStats{
+		Active:       s.ActiveCount,
+		Idle:         s.IdleCount,
+		WaitCount:    s.WaitCount,
+		WaitDuration: s.WaitDuration,
+	}
+}
+
 func (c *Connection) notifyReconnectListener(isErrorNil bool) {
 	select {
 	case c.connectionChannel <- isErrorNil:
-		if !isErrorNil {
-		}
 	default:
 	}
 }
 
-func (c *Connection) newPool() *redis.Pool {
+func (c *Connection) newPool() (connPool, error) {
+	if c.opts.Mode == ModeCluster {
+		// database index is always 0 in cluster mode
+		cp := newClusterPool(c.opts, append(c.dialOpts, redis.DialDatabase(0)))
+		if err := cp.refresh(); err != nil {
+			return nil, err
+		}
+		return cp, nil
+	}
+
 	return &redis.Pool{
 		// Maximum number of idle connections in the pool.
-		MaxIdle: 80,
+		MaxIdle: c.opts.MaxIdle,
 		// max number of connections
-		MaxActive: 12000,
+		MaxActive: c.opts.MaxActive,
+		// wait for a free connection instead of failing at MaxActive
+		Wait:        c.opts.Wait,
+		IdleTimeout: c.opts.IdleTimeout,
 		// Dial is an application supplied function for creating and
 		// configuring a connection.
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", c.address+":"+c.port)
-			return c, err
+			if c.sentinel != nil {
+				return c.sentinel.dial(c.dialOpts)
+			}
+			return redis.Dial("tcp", net.JoinHostPort(c.opts.Address, c.opts.Port), c.dialOpts...)
 		},
-	}
+		// after a sentinel failover the old master comes back as a replica,
+		// drop idle connections that no longer point to the master
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if c.sentinel == nil || time.Since(t) < time.Minute {
+				return nil
+			}
+			return checkMasterRole(conn)
+		},
+	}, nil
 }
 
 func (c *Connection) delayInMS(attempt int) time.Duration {
@@ -6,3 +6,30 @@ const (
 	confRedisMaxEventMissCount = ".store.connectionStatus.allowedEventMissCount"
 	confRedisKeyExpireTime = ".store.expireTime"
 )
+
+const (
+	confRedisMode             = ".store.mode"
+	confRedisAddress          = ".store.address"
+	confRedisPort             = ".store.port"
+	confRedisUsername         = ".store.username"
+	confRedisPassword         = ".store.password"
+	confRedisDB               = ".store.db"
+	confRedisTLSEnabled       = ".store.tls.enabled"
+	confRedisTLSCAFile        = ".store.tls.caFile"
+	confRedisTLSCertFile      = ".store.tls.certFile"
+	confRedisTLSKeyFile       = ".store.tls.keyFile"
+	confRedisTLSServerName    = ".store.tls.serverName"
+	confRedisTLSSkipVerify    = ".store.tls.insecureSkipVerify"
+	confRedisSentinelMaster   = ".store.sentinel.masterName"
+	confRedisSentinelAddrs    = ".store.sentinel.addrs"
+	confRedisSentinelUsername = ".store.sentinel.username"
+	confRedisSentinelPassword = ".store.sentinel.password"
+	confRedisClusterAddrs     = ".store.cluster.addrs"
+	confRedisPoolMaxIdle      = ".store.pool.maxIdle"
+	confRedisPoolMaxActive    = ".store.pool.maxActive"
+	confRedisPoolWait         = ".store.pool.wait"
+	confRedisPoolIdleTimeout  = ".store.pool.idleTimeout"
+	confRedisConnectTimeout   = ".store.timeout.connect"
+	confRedisReadTimeout      = ".store.timeout.read"
+	confRedisWriteTimeout     = ".store.timeout.write"
+)
@@ -0,0 +1,85 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+//healthTracker - current health of the connection and its subscribers
+type healthTracker struct {
+	mu     sync.RWMutex
+	health store.Health
+	subs   map[chan store.Health]struct{}
+}
+
+// Health - current connection health
+func (c *Connection) Health() store.Health {
+	c.health.mu.RLock()
+	defer c.health.mu.RUnlock()
+	return c.health.health
+}
+
+// Subscribe - receive health updates on every state change. The channel
+// holds only the latest update, a slow subscriber never blocks the store
+func (c *Connection) Subscribe() (<-chan store.Health, func()) {
+	ch := make(chan store.Health, 1)
+
+	c.health.mu.Lock()
+	if c.health.subs == nil {
+		c.health.subs = make(map[chan store.Health]struct{})
+	}
+	c.health.subs[ch] = struct{}{}
+	c.health.mu.Unlock()
+
+	var unsubOnce sync.Once
+	return ch, func() {
+		unsubOnce.Do(func() {
+			c.health.mu.Lock()
+			delete(c.health.subs, ch)
+			c.health.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// recordError - remember the last error without changing the state
+func (c *Connection) recordError(err error) {
+	c.health.mu.Lock()
+	c.health.health.LastError = err.Error()
+	c.health.health.LastErrorAt = time.Now()
+	c.health.mu.Unlock()
+}
+
+func (c *Connection) setState(state store.State, err error) {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+
+	now := time.Now()
+	h := &c.health.health
+	if err != nil {
+		h.LastError = err.Error()
+		h.LastErrorAt = now
+	}
+	if state == store.StateConnected {
+		h.LastConnectedAt = now
+	}
+	if h.State == state {
+		return
+	}
+
+	logger.Warn("redis store state changed", "from", h.State, "to", state, "last_error", h.LastError)
+	h.State = state
+	h.ChangedAt = now
+
+	for ch := range c.health.subs {
+		// keep only the latest update for subscribers lagging behind
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- *h
+	}
+}
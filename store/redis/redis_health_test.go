@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+func TestSetState(t *testing.T) {
+	logger.SetLevel(logger.LevelFatal)
+	c := newConnection(DefaultOptions("127.0.0.1", "1"))
+	ch, unsubscribe := c.Subscribe()
+
+	// degraded until the first connect, errors are kept without an update
+	c.setState(store.StateDegraded, errors.New("dial failed"))
+	h := c.Health()
+	assert.Equal(t, store.StateDegraded, h.State)
+	assert.Equal(t, "dial failed", h.LastError)
+	assert.Empty(t, ch)
+
+	c.setState(store.StateConnected, nil)
+	h = <-ch
+	assert.Equal(t, store.StateConnected, h.State)
+	assert.False(t, h.LastConnectedAt.IsZero())
+
+	// a subscriber lagging behind only gets the latest update
+	c.setState(store.StateDegraded, nil)
+	c.setState(store.StateDown, errors.New("retries exhausted"))
+	c.setState(store.StateDown, errors.New("still unreachable"))
+	h = <-ch
+	assert.Equal(t, store.StateDown, h.State)
+	assert.Equal(t, "retries exhausted", h.LastError)
+	assert.Empty(t, ch)
+	assert.Equal(t, "still unreachable", c.Health().LastError)
+
+	unsubscribe()
+	unsubscribe()
+	_, open := <-ch
+	assert.False(t, open)
+	// no update is sent to the closed channel
+	c.setState(store.StateConnected, nil)
+}
+
+func TestReconnect(t *testing.T) {
+	logger.SetLevel(logger.LevelFatal)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	// nothing listens on the port until redis comes back
+	l.Close()
+
+	c := newConnection(DefaultOptions("127.0.0.1", strconv.Itoa(addr.Port)))
+	ch, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	c.setState(store.StateConnected, nil)
+	<-ch
+
+	done := make(chan struct{})
+	go func() {
+		c.reconnect(2)
+		close(done)
+	}()
+	assert.Equal(t, store.StateDegraded, (<-ch).State)
+	// the process keeps running and retrying once the attempts are used up
+	h := <-ch
+	assert.Equal(t, store.StateDown, h.State)
+	assert.Contains(t, h.LastError, "refused")
+
+	l, err = net.Listen("tcp", addr.String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go serveOK(l)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect did not return once redis was reachable")
+	}
+	assert.Equal(t, store.StateConnected, (<-ch).State)
+	assert.True(t, c.isRedisConnected)
+	assert.NoError(t, c.Ping())
+}
+
+// serveOK - minimal redis server answering +OK to every command
+func serveOK(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if !strings.HasPrefix(line, "*") {
+					continue
+				}
+				// an array of bulk strings, a length and a value line each
+				n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				for i := 0; i < 2*n; i++ {
+					if _, err = r.ReadString('\n'); err != nil {
+						return
+					}
+				}
+				if _, err = conn.Write([]byte("+OK\r\n")); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/spf13/viper"
+)
+
+//Mode - redis deployment topology the store connects to
+type Mode string
+
+const (
+	ModeStandalone Mode = "standalone"
+	ModeSentinel   Mode = "sentinel"
+	ModeCluster    Mode = "cluster"
+)
+
+//TLSOptions - tls settings used while dialing redis (and sentinels)
+type TLSOptions struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+//SentinelOptions - master discovery through redis sentinel
+type SentinelOptions struct {
+	MasterName string
+	Addrs      []string
+	Username   string
+	Password   string
+}
+
+//ClusterOptions - seed nodes of a redis cluster
+type ClusterOptions struct {
+	Addrs []string
+}
+
+//Options - connection settings of the redis store
+type Options struct {
+	Mode     Mode
+	Address  string
+	Port     string
+	Username string
+	Password string
+	DB       int
+	TLS      TLSOptions
+	Sentinel SentinelOptions
+	Cluster  ClusterOptions
+
+	MaxIdle        int
+	MaxActive      int
+	Wait           bool
+	IdleTimeout    time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// KeyExpireTime in seconds, used by SETEX and hash writes
+	KeyExpireTime int
+}
+
+// DefaultOptions - standalone options matching the historical pool settings
+func DefaultOptions(address, port string) Options {
+	return Options{
+		Mode:           ModeStandalone,
+		Address:        address,
+		Port:           port,
+		MaxIdle:        80,
+		MaxActive:      12000,
+		IdleTimeout:    240 * time.Second,
+		ConnectTimeout: 5 * time.Second,
+		KeyExpireTime:  86400,
+	}
+}
+
+// LoadOptions - read store options of the active profile from config,
+// unset keys keep the values of DefaultOptions
+func LoadOptions(conf *viper.Viper) Options {
+	p := conf.GetString("profile")
+	opts := DefaultOptions("127.0.0.1", "6379")
+
+	setString := func(key string, dst *string) {
+		if conf.IsSet(p + key) {
+			*dst = conf.GetString(p + key)
+		}
+	}
+	setInt := func(key string, dst *int) {
+		if conf.IsSet(p + key) {
+			*dst = conf.GetInt(p + key)
+		}
+	}
+	setDuration := func(key string, dst *time.Duration) {
+		if conf.IsSet(p + key) {
+			*dst = conf.GetDuration(p + key)
+		}
+	}
+	setBool := func(key string, dst *bool) {
+		if conf.IsSet(p + key) {
+			*dst = conf.GetBool(p + key)
+		}
+	}
+	setStrings := func(key string, dst *[]string) {
+		if conf.IsSet(p + key) {
+			*dst = conf.GetStringSlice(p + key)
+		}
+	}
+
+	if conf.IsSet(p + confRedisMode) {
+		opts.Mode = Mode(conf.GetString(p + confRedisMode))
+	}
+	setString(confRedisAddress, &opts.Address)
+	setString(confRedisPort, &opts.Port)
+	setString(confRedisUsername, &opts.Username)
+	setString(confRedisPassword, &opts.Password)
+	setInt(confRedisDB, &opts.DB)
+
+	setBool(confRedisTLSEnabled, &opts.TLS.Enabled)
+	setString(confRedisTLSCAFile, &opts.TLS.CAFile)
+	setString(confRedisTLSCertFile, &opts.TLS.CertFile)
+	setString(confRedisTLSKeyFile, &opts.TLS.KeyFile)
+	setString(confRedisTLSServerName, &opts.TLS.ServerName)
+	setBool(confRedisTLSSkipVerify, &opts.TLS.InsecureSkipVerify)
+
+	setString(confRedisSentinelMaster, &opts.Sentinel.MasterName)
+	setStrings(confRedisSentinelAddrs, &opts.Sentinel.Addrs)
+	setString(confRedisSentinelUsername, &opts.Sentinel.Username)
+	setString(confRedisSentinelPassword, &opts.Sentinel.Password)
+	setStrings(confRedisClusterAddrs, &opts.Cluster.Addrs)
+
+	setInt(confRedisPoolMaxIdle, &opts.MaxIdle)
+	setInt(confRedisPoolMaxActive, &opts.MaxActive)
+	setBool(confRedisPoolWait, &opts.Wait)
+	setDuration(confRedisPoolIdleTimeout, &opts.IdleTimeout)
+	setDuration(confRedisConnectTimeout, &opts.ConnectTimeout)
+	setDuration(confRedisReadTimeout, &opts.ReadTimeout)
+	setDuration(confRedisWriteTimeout, &opts.WriteTimeout)
+	setInt(confRedisKeyExpireTime, &opts.KeyExpireTime)
+
+	return opts
+}
+
+func (o Options) validate() error {
+	switch o.Mode {
+	case ModeStandalone:
+		if o.Address == "" || o.Port == "" {
+			return errors.New("redis address and port are required")
+		}
+	case ModeSentinel:
+		if o.Sentinel.MasterName == "" || len(o.Sentinel.Addrs) == 0 {
+			return errors.New("sentinel master name and addresses are required")
+		}
+	case ModeCluster:
+		if len(o.Cluster.Addrs) == 0 {
+			return errors.New("cluster seed addresses are required")
+		}
+	default:
+		return errors.New("unknown redis mode: " + string(o.Mode))
+	}
+	return nil
+}
+
+func (o Options) tlsConfig() (*tls.Config, error) {
+	if !o.TLS.Enabled {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		ServerName:         o.TLS.ServerName,
+		InsecureSkipVerify: o.TLS.InsecureSkipVerify,
+	}
+
+	if o.TLS.CAFile != "" {
+		ca, err := ioutil.ReadFile(o.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + o.TLS.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if o.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLS.CertFile, o.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// dialOptions - options for data nodes, sentinels use their own credentials
+func (o Options) dialOptions(tlsConf *tls.Config, username, password string, db int) []redis.DialOption {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(o.ConnectTimeout),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+		redis.DialDatabase(db),
+	}
+	if username != "" {
+		opts = append(opts, redis.DialUsername(username))
+	}
+	if password != "" {
+		opts = append(opts, redis.DialPassword(password))
+	}
+	if tlsConf != nil {
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConf),
+			redis.DialTLSSkipVerify(o.TLS.InsecureSkipVerify))
+	}
+	return opts
+}
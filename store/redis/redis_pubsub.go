@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"queuev2/logger"
+	"queuev2/store"
+)
+
+const (
+	// pubSubBuffer - messages held for a slow subscriber before the
+	// connection reader blocks
+	pubSubBuffer = 64
+	// pubSubPing - keep idle subscriptions alive through proxies
+	pubSubPing = 30 * time.Second
+)
+
+//Publish - PUBLISH message, in cluster mode it reaches the subscribers of
+//every node
+func (c *Connection) Publish(channel, message string) error {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", channel, message)
+	return err
+}
+
+//PSubscribe - PSUBSCRIBE on a pool connection held until the subscription
+//is cancelled
+func (c *Connection) PSubscribe(pattern string) (<-chan store.Message, func(), error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, nil, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	if err = psc.PSubscribe(pattern); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	ping := pubSubPing
+	if c.opts.ReadTimeout > 0 && c.opts.ReadTimeout/2 < ping {
+		ping = c.opts.ReadTimeout / 2
+	}
+
+	ch := make(chan store.Message, pubSubBuffer)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ping)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				psc.Ping("")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(ch)
+		defer conn.Close()
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				select {
+				case ch <- store.Message{Channel: v.Channel, Data: string(v.Data)}:
+				case <-done:
+					return
+				}
+			case redis.Subscription:
+				if v.Count == 0 {
+					return
+				}
+			case error:
+				select {
+				case <-done:
+				default:
+					logger.Warn("redis subscription lost", "pattern", pattern, logger.FieldError, v)
+				}
+				return
+			}
+		}
+	}()
+
+	var cancelOnce sync.Once
+	return ch, func() {
+		cancelOnce.Do(func() {
+			close(done)
+			psc.PUnsubscribe(pattern)
+		})
+	}, nil
+}
@@ -7,6 +7,10 @@ import (
 )
 
 func (c *Connection) DoublePush(ctlq, q string, data []byte) error {
+	if c.opts.Mode == ModeCluster && Slot(ctlq) != Slot(q) {
+		return errors.New("DoublePush keys " + ctlq + " and " + q + " map to different cluster slots, use a common HashTag")
+	}
+
 	conn, err := c.getConnFromPool()
 	if err != nil {
 		return err
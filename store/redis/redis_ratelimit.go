@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// tokenBucketScript - refill by elapsed redis server time so all API
+// replicas share one clock, returns {allowed, retry after ms}
+var tokenBucketScript = redis.NewScript(1, `
+	local rate = tonumber(ARGV[1])
+	local burst = tonumber(ARGV[2])
+	local t = redis.call("TIME")
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+	local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+	local tokens = tonumber(state[1])
+	local ts = tonumber(state[2])
+	if tokens == nil or ts == nil then
+		tokens = burst
+		ts = now
+	end
+
+	tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+	local allowed = 0
+	local retry = 0
+	if tokens >= 1 then
+		tokens = tokens - 1
+		allowed = 1
+	else
+		retry = math.ceil((1 - tokens) / rate * 1000)
+	end
+
+	redis.call("HSET", KEYS[1], "tokens", tostring(tokens))
+	redis.call("HSET", KEYS[1], "ts", now)
+	redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+	return {allowed, retry}
+`)
+
+// returnTokenScript - add a token back to an existing bucket, up to burst
+var returnTokenScript = redis.NewScript(1, `
+	local burst = tonumber(ARGV[1])
+	local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+	if tokens == nil then
+		return 0
+	end
+	redis.call("HSET", KEYS[1], "tokens", tostring(math.min(burst, tokens + 1)))
+	return 1
+`)
+
+//TakeToken token bucket shared by every client of the redis store
+func (c *Connection) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return false, 0, err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Int64s(tokenBucketScript.Do(conn, key, rate, burst))
+	if err != nil {
+		return false, 0, err
+	}
+	if len(reply) != 2 {
+		return false, 0, redis.Error("unexpected token bucket reply")
+	}
+	return reply[0] == 1, time.Duration(reply[1]) * time.Millisecond, nil
+}
+
+//ReturnToken - undo a TakeToken whose request was rejected by another bucket
+func (c *Connection) ReturnToken(key string, burst int) error {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = returnTokenScript.Do(conn, key, burst)
+	return err
+}
@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//sentinel - resolves the current master address through the configured sentinels
+type sentinel struct {
+	opts    Options
+	dialOpt []redis.DialOption
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newSentinel(opts Options, dialOpt []redis.DialOption) *sentinel {
+	return &sentinel{
+		opts:    opts,
+		dialOpt: dialOpt,
+		addrs:   append([]string{}, opts.Sentinel.Addrs...),
+	}
+}
+
+// masterAddr - ask the sentinels one by one for the master, the sentinel
+// that answered is moved to the front so it is asked first next time
+func (s *sentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string{}, s.addrs...)
+	s.mu.Unlock()
+
+	var lastErr error
+	for i, addr := range addrs {
+		master, err := s.queryMaster(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if i > 0 {
+			s.mu.Lock()
+			s.addrs[0], s.addrs[i] = s.addrs[i], s.addrs[0]
+			s.mu.Unlock()
+		}
+		return master, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no sentinel configured")
+	}
+	return "", errors.New("failed to discover master " + s.opts.Sentinel.MasterName + ": " + lastErr.Error())
+}
+
+func (s *sentinel) queryMaster(addr string) (string, error) {
+	conn, err := redis.Dial("tcp", addr, s.dialOpt...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.opts.Sentinel.MasterName))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", errors.New("unexpected sentinel reply from " + addr)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// dial - dial the master announced by sentinel and verify its role, a node
+// still announced as master during a failover may already be a replica
+func (s *sentinel) dial(dialOpt []redis.DialOption) (redis.Conn, error) {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := redis.Dial("tcp", addr, dialOpt...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkMasterRole(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func checkMasterRole(conn redis.Conn) error {
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+
+	name, err := redis.String(role[0], nil)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(name, "master") {
+		return errors.New("redis node role is " + name + ", expected master")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"queuev2/store"
+)
+
+// streamReadMargin - XREAD BLOCK ends this long before the read timeout of
+// the connection would
+const streamReadMargin = 100 * time.Millisecond
+
+//StreamAdd - XADD with an approximate MAXLEN which lets redis trim whole
+//nodes only
+func (c *Connection) StreamAdd(key string, maxLen int, fields map[string]string) (string, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	args := []interface{}{key}
+	if maxLen > 0 {
+		args = append(args, "MAXLEN", "~", maxLen)
+	}
+	args = append(args, "*")
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	return redis.String(conn.Do("XADD", args...))
+}
+
+//StreamRange - XRANGE, count 0 returns every entry
+func (c *Connection) StreamRange(key, start, end string, count int) ([]store.StreamEntry, error) {
+	return c.streamRange("XRANGE", key, start, end, count)
+}
+
+//StreamRevRange - XREVRANGE, count 0 returns every entry
+func (c *Connection) StreamRevRange(key, end, start string, count int) ([]store.StreamEntry, error) {
+	return c.streamRange("XREVRANGE", key, end, start, count)
+}
+
+func (c *Connection) streamRange(cmd, key, from, to string, count int) ([]store.StreamEntry, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	args := []interface{}{key, from, to}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	return streamEntries(conn.Do(cmd, args...))
+}
+
+//StreamRead - XREAD on a single stream, the wait is capped below the read
+//timeout of pool connections
+func (c *Connection) StreamRead(key, afterID string, count int, block time.Duration) ([]store.StreamEntry, error) {
+	conn, err := c.getConnFromPool()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if c.opts.ReadTimeout > 0 && block > c.opts.ReadTimeout-streamReadMargin {
+		block = c.opts.ReadTimeout - streamReadMargin
+	}
+	args := []interface{}{}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	if block > 0 {
+		args = append(args, "BLOCK", block.Milliseconds())
+	}
+	args = append(args, "STREAMS", key, afterID)
+
+	streams, err := redis.Values(conn.Do("XREAD", args...))
+	if err == redis.ErrNil {
+		return []store.StreamEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 {
+		return []store.StreamEntry{}, nil
+	}
+	// one [key, entries] pair per stream read
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected XREAD reply of %d elements", len(stream))
+	}
+	return streamEntries(stream[1], nil)
+}
+
+// streamEntries - parse [[id, [field, value, ...]], ...]
+func streamEntries(reply interface{}, err error) ([]store.StreamEntry, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]store.StreamEntry, 0, len(values))
+	for _, v := range values {
+		entry, err := redis.Values(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry of %d elements", len(entry))
+		}
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := redis.StringMap(entry[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, store.StreamEntry{ID: id, Fields: fields})
+	}
+	return entries, nil
+}
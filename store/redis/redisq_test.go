@@ -7,8 +7,6 @@ import (
 	"strconv"
 	"testing"
 
-	"cigol/pkg/logger/mocklogger"
-
 	"github.com/google/uuid"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -28,25 +26,32 @@ func TestMain(m *testing.M) {
 	conf.Set("development.store.connectionStatus.allowedEventMissCount", 3)
 	conf.Set("development.store.retryMaxAttempt", 5)
 
-	lgr := mocklogger.CreateLogger()
-	conn = &Connection{
-		address:           "127.0.0.1",
-		port:              "6379",
-		connectionChannel: make(chan bool),
-	}
+	conf.Set("development.store.address", "127.0.0.1")
+	conf.Set("development.store.port", "6379")
 
-	logger = lgr
+	conn = newConnection(LoadOptions(conf))
 
 	err := conn.connect()
+	if err == nil {
+		err = conn.Ping()
+	}
 	if err != nil {
-		log.Println("unable to connect: ", err)
-		os.Exit(0)
+		log.Println("unable to connect, skipping the tests which need redis: ", err)
+		conn = nil
 	}
 
 	os.Exit(m.Run())
 }
 
+// requireRedis - skip the test when no redis server is reachable
+func requireRedis(t *testing.T) {
+	if conn == nil {
+		t.Skip("redis is not reachable")
+	}
+}
+
 func TestDoublePush(t *testing.T) {
+	requireRedis(t)
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		t.Log(err)
@@ -79,6 +84,7 @@ func TestDoublePush(t *testing.T) {
 }
 
 func TestPopAndMove(t *testing.T) {
+	requireRedis(t)
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		t.Log(err)
@@ -108,6 +114,7 @@ func TestPopAndMove(t *testing.T) {
 }
 
 func TestRemoveItem(t *testing.T) {
+	requireRedis(t)
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		t.Log(err)
@@ -133,6 +140,7 @@ func TestRemoveItem(t *testing.T) {
 }
 
 func TestLockUnlock(t *testing.T) {
+	requireRedis(t)
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		t.Log(err)
@@ -154,6 +162,7 @@ func TestLockUnlock(t *testing.T) {
 }
 
 func TestMultiLock(t *testing.T) {
+	requireRedis(t)
 	type table struct {
 		id int
 		ch chan error
@@ -1,22 +1,40 @@
 package store
 
+import "time"
+
 //Store interface definition of meta-data storage
 type Store interface {
 	Get(string) (string, error)
 	Set(string, string) error
+	SetNX(key, value string, expire int) (bool, error)
+	// SetEX writes the key with an expire time (seconds) in one command
+	SetEX(key, value string, expire int) error
 	GetStruct(string) (string, error)
 	SetStruct(string, string) error
+	// SetStructNoExpire writes the key without an expire time, clearing the
+	// one it had, for records which must outlive the default expire time
+	SetStructNoExpire(key, value string) error
+	// SetMultiStruct writes every key with the default expire time in one
+	// round trip, in cluster mode the keys must share a hash slot
+	SetMultiStruct(map[string]string) error
+	// GetMulti returns the value of every key, "" for missing keys, in
+	// cluster mode the keys must share a hash slot
+	GetMulti(keys []string) ([]string, error)
 	DeleteKey(string) error
 	KeyExists(string) (int, error)
 	SetExpireTime(string, int) error
+	PersistKey(string) error
 	GetKeys(string) ([]string, error)
 	GetHashKeyCount(string) (int, error)
 	GetStructFromHash(string, string) (string, error)
 	SetStructInHash(string, string, string) error
+	// SetStructInHashNoExpire sets the field and removes the expire time of
+	// the hash in one transaction
+	SetStructInHashNoExpire(primaryKey, secondaryKey, value string) error
 	GetKeysFromHash(string) ([]string, error)
 	DeleteStructFromHash(string, string) error
 	KeyExistsInHash(string, string) (int, error)
-	AtomicIncrement(key string) error
+	AtomicIncrement(key string) (int64, error)
 	SetMultiStructInHash(string, map[string]string) error
 	DelMultiKeyFromHash(string, []interface{}) error
 	QueuePush(string, ...string) error
@@ -24,9 +42,25 @@ type Store interface {
 	QueuePeak(string) (string, error)
 	QueuePeakIndex(string, int32) (string, error)
 	AddSortedSet(key string, score int, data string) error
+	AddSortedSetMulti(key string, items map[string]int) error
 	RemoveSortedSet(key string, data string) error
 	GetRankSortedSet(key string, data string) (int, error)
+	// GetRanksSortedSet returns the rank of each member, -1 when missing
+	GetRanksSortedSet(key string, members []string) ([]int, error)
 	GetAllItemsSortedSet(key string) ([]string, error)
+	GetCountSortedSet(key string) (int, error)
+	GetScoreSortedSet(key string, data string) (int, error)
+	// GetAllScoresSortedSet returns every member with its score
+	GetAllScoresSortedSet(key string) (map[string]int, error)
+	// GetRangeByScoreSortedSet returns at most count members scored up to
+	// max, lowest score first
+	GetRangeByScoreSortedSet(key string, max, count int) ([]string, error)
+	// TakeToken removes one token from the bucket refilled at rate tokens
+	// per second up to burst, on failure it returns the time until a token
+	// is available
+	TakeToken(key string, rate float64, burst int) (bool, time.Duration, error)
+	// ReturnToken puts back a token taken from the bucket, up to burst
+	ReturnToken(key string, burst int) error
 }
 
 //Simple queue interface definition
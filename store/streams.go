@@ -0,0 +1,25 @@
+package store
+
+import "time"
+
+//StreamEntry - one entry of an append only stream, ids increase with the
+//time the entry was added
+type StreamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+//Streams - implemented by stores with append only logs, e.g. redis streams
+type Streams interface {
+	// StreamAdd appends the entry and returns its id, the stream is trimmed
+	// to about maxLen entries, 0 keeps every entry
+	StreamAdd(key string, maxLen int, fields map[string]string) (string, error)
+	// StreamRange returns up to count entries with ids from start to end
+	// inclusive, "-" and "+" stand for the first and the last entry
+	StreamRange(key, start, end string, count int) ([]StreamEntry, error)
+	// StreamRevRange is StreamRange newest first, from end down to start
+	StreamRevRange(key, end, start string, count int) ([]StreamEntry, error)
+	// StreamRead returns up to count entries added after the id, waiting
+	// up to block for one when there are none
+	StreamRead(key, afterID string, count int, block time.Duration) ([]StreamEntry, error)
+}
@@ -0,0 +1,131 @@
+package taskid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"queuev2/store"
+)
+
+const (
+	SchemeULID     = "ulid"
+	SchemeSequence = "sequence"
+
+	sequenceKeyPrefix = "task_seq:"
+	crockford         = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+var (
+	// ErrInvalidExternalID - client supplied id with unsupported characters or length
+	ErrInvalidExternalID = errors.New("external id must be 1-128 characters of [A-Za-z0-9._:-]")
+
+	externalIDRegEx = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,128}$`)
+)
+
+//Generator - creates task ids unique and ordered across API replicas
+type Generator interface {
+	NewID(accountID string) (string, error)
+}
+
+// New - generator for the configured scheme, ULID when scheme is empty
+func New(scheme string, st store.Store) (Generator, error) {
+	switch scheme {
+	case "", SchemeULID:
+		return NewULIDGenerator(), nil
+	case SchemeSequence:
+		return NewSequenceGenerator(st), nil
+	}
+	return nil, fmt.Errorf("unknown task id scheme %q", scheme)
+}
+
+// ValidateExternalID - check an id supplied by the client
+func ValidateExternalID(id string) error {
+	if !externalIDRegEx.MatchString(id) {
+		return ErrInvalidExternalID
+	}
+	return nil
+}
+
+//ULIDGenerator - 48 bit millisecond timestamp followed by 80 random bits,
+//monotonic within the same millisecond of one process
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	lastMS  uint64
+	lastRnd [10]byte
+}
+
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{}
+}
+
+func (g *ULIDGenerator) NewID(accountID string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= g.lastMS {
+		// same (or skewed back) millisecond, increment the random part
+		ms = g.lastMS
+		if !increment(g.lastRnd[:]) {
+			return "", errors.New("ulid random part overflow")
+		}
+	} else {
+		if _, err := rand.Read(g.lastRnd[:]); err != nil {
+			return "", err
+		}
+		g.lastMS = ms
+	}
+
+	var raw [16]byte
+	binary.BigEndian.PutUint16(raw[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(raw[2:6], uint32(ms))
+	copy(raw[6:], g.lastRnd[:])
+	return encodeULID(raw), nil
+}
+
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID - 128 bits as 26 crockford base32 characters
+func encodeULID(raw [16]byte) string {
+	hi := binary.BigEndian.Uint64(raw[0:8])
+	lo := binary.BigEndian.Uint64(raw[8:16])
+
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+//SequenceGenerator - per account counter kept in the store
+type SequenceGenerator struct {
+	store store.Store
+}
+
+func NewSequenceGenerator(st store.Store) *SequenceGenerator {
+	return &SequenceGenerator{store: st}
+}
+
+func (g *SequenceGenerator) NewID(accountID string) (string, error) {
+	seq, err := g.store.AtomicIncrement(sequenceKeyPrefix + accountID)
+	if err != nil {
+		return "", err
+	}
+	// zero padded so ids sort lexically in creation order
+	return fmt.Sprintf("%s_%016d", accountID, seq), nil
+}
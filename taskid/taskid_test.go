@@ -0,0 +1,49 @@
+package taskid
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/store/mock"
+)
+
+func TestULIDOrdered(t *testing.T) {
+	g := NewULIDGenerator()
+
+	ids := make([]string, 1000)
+	seen := make(map[string]bool)
+	for i := range ids {
+		id, err := g.NewID("123")
+		assert.NoError(t, err)
+		assert.Len(t, id, 26)
+		assert.False(t, seen[id])
+		seen[id] = true
+		ids[i] = id
+	}
+	assert.True(t, sort.StringsAreSorted(ids))
+}
+
+func TestSequence(t *testing.T) {
+	g, err := New(SchemeSequence, mock.NewStore("", ""))
+	assert.NoError(t, err)
+
+	id, err := g.NewID("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "123_0000000000000001", id)
+
+	id, err = g.NewID("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "123_0000000000000002", id)
+
+	id, err = g.NewID("456")
+	assert.NoError(t, err)
+	assert.Equal(t, "456_0000000000000001", id)
+}
+
+func TestValidateExternalID(t *testing.T) {
+	assert.NoError(t, ValidateExternalID("crm:ticket-42"))
+	assert.Error(t, ValidateExternalID(""))
+	assert.Error(t, ValidateExternalID("has space"))
+}
@@ -0,0 +1,126 @@
+package wallboard
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"queuev2/queuestats"
+	"queuev2/store"
+)
+
+const thresholdsKeyPrefix = "wallboard:thresholds:"
+
+// Alert metrics
+const (
+	MetricWaiting         = "waiting"
+	MetricLongestWait     = "longest_wait_seconds"
+	MetricServiceLevel    = "service_level_percent"
+	MetricAvailableAgents = "available_agents"
+)
+
+//Thresholds - alert limits of a queue, unset limits raise no alert.
+//ServiceLevelThresholdSeconds is the answer time the service level of the
+//queue is measured against, the default one when 0
+type Thresholds struct {
+	MaxWaiting                   *int     `json:"max_waiting,omitempty" validate:"omitempty,min=0"`
+	MaxLongestWaitSeconds        *int     `json:"max_longest_wait_seconds,omitempty" validate:"omitempty,min=0"`
+	MinServiceLevelPercent       *float64 `json:"min_service_level_percent,omitempty" validate:"omitempty,min=0,max=100"`
+	MinAvailableAgents           *int     `json:"min_available_agents,omitempty" validate:"omitempty,min=0"`
+	ServiceLevelThresholdSeconds int      `json:"service_level_threshold_seconds,omitempty" validate:"omitempty,min=1,max=3600"`
+}
+
+//Alert - a limit of the queue which is exceeded
+type Alert struct {
+	QueueID   string  `json:"queue_id"`
+	Metric    string  `json:"metric"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"`
+	Message   string  `json:"message"`
+}
+
+// Check - alerts of the snapshot, the service level raises none before a
+// task was answered in the interval
+func Check(snap *queuestats.Snapshot, t Thresholds) []Alert {
+	var alerts []Alert
+	add := func(metric string, threshold, value float64, format string) {
+		alerts = append(alerts, Alert{
+			QueueID:   snap.QueueID,
+			Metric:    metric,
+			Threshold: threshold,
+			Value:     value,
+			Message:   fmt.Sprintf(format, value, threshold),
+		})
+	}
+
+	if t.MaxWaiting != nil && snap.Waiting > *t.MaxWaiting {
+		add(MetricWaiting, float64(*t.MaxWaiting), float64(snap.Waiting), "waiting %.0f > %.0f")
+	}
+	if t.MaxLongestWaitSeconds != nil && snap.OldestWaitSeconds > *t.MaxLongestWaitSeconds {
+		add(MetricLongestWait, float64(*t.MaxLongestWaitSeconds), float64(snap.OldestWaitSeconds), "longest wait %.0fs > %.0fs")
+	}
+	if sl := snap.ServiceLevel.Percent; t.MinServiceLevelPercent != nil && sl != nil && *sl < *t.MinServiceLevelPercent {
+		add(MetricServiceLevel, *t.MinServiceLevelPercent, *sl, "service level %.1f%% < %.1f%%")
+	}
+	if t.MinAvailableAgents != nil && snap.Agents.Available < *t.MinAvailableAgents {
+		add(MetricAvailableAgents, float64(*t.MinAvailableAgents), float64(snap.Agents.Available), "available agents %.0f < %.0f")
+	}
+	return alerts
+}
+
+//Store - thresholds of the queues of an account in one hash
+type Store struct {
+	store store.Store
+}
+
+func NewStore(st store.Store) *Store {
+	return &Store{store: st}
+}
+
+func thresholdsKey(accountID string) string {
+	return thresholdsKeyPrefix + "{" + accountID + "}"
+}
+
+// Get - thresholds of the queue, none are set for queues without any
+func (s *Store) Get(accountID, queueID string) (Thresholds, error) {
+	all, err := s.All(accountID)
+	if err != nil {
+		return Thresholds{}, err
+	}
+	return all[queueID], nil
+}
+
+// All - thresholds of every queue of the account which has some
+func (s *Store) All(accountID string) (map[string]Thresholds, error) {
+	key := thresholdsKey(accountID)
+	queueIDs, err := s.store.GetKeysFromHash(key)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]Thresholds, len(queueIDs))
+	for _, queueID := range queueIDs {
+		data, err := s.store.GetStructFromHash(key, queueID)
+		if err != nil {
+			return nil, err
+		}
+		var t Thresholds
+		if err = json.Unmarshal([]byte(data), &t); err != nil {
+			return nil, err
+		}
+		all[queueID] = t
+	}
+	return all, nil
+}
+
+// Set - replace the thresholds of the queue
+func (s *Store) Set(accountID, queueID string, t Thresholds) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.store.SetStructInHashNoExpire(thresholdsKey(accountID), queueID, string(data))
+}
+
+// Delete - forget the thresholds of a deleted queue
+func (s *Store) Delete(accountID, queueID string) error {
+	return s.store.DeleteStructFromHash(thresholdsKey(accountID), queueID)
+}
@@ -0,0 +1,61 @@
+package wallboard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/queuestats"
+	"queuev2/store/mock"
+)
+
+func intPtr(n int) *int { return &n }
+
+func TestCheck(t *testing.T) {
+	sl := 70.0
+	snap := &queuestats.Snapshot{
+		QueueID:           "QID_wall",
+		Waiting:           12,
+		OldestWaitSeconds: 150,
+		Agents:            queuestats.AgentCounts{LoggedIn: 3, Available: 0},
+		ServiceLevel:      queuestats.ServiceLevel{ThresholdSeconds: 20, Percent: &sl},
+	}
+	assert.Empty(t, Check(snap, Thresholds{}))
+
+	minSL := 80.0
+	alerts := Check(snap, Thresholds{
+		MaxWaiting:             intPtr(20),
+		MaxLongestWaitSeconds:  intPtr(120),
+		MinServiceLevelPercent: &minSL,
+		MinAvailableAgents:     intPtr(1),
+	})
+	if assert.Len(t, alerts, 3) {
+		assert.Equal(t, Alert{QueueID: "QID_wall", Metric: MetricLongestWait, Threshold: 120, Value: 150, Message: "longest wait 150s > 120s"}, alerts[0])
+		assert.Equal(t, MetricServiceLevel, alerts[1].Metric)
+		assert.Equal(t, "service level 70.0% < 80.0%", alerts[1].Message)
+		assert.Equal(t, MetricAvailableAgents, alerts[2].Metric)
+	}
+
+	// no service level alert before a task was answered
+	snap.ServiceLevel.Percent = nil
+	assert.Empty(t, Check(snap, Thresholds{MinServiceLevelPercent: &minSL}))
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(mock.NewStore("", ""))
+	th, err := s.Get("123", "q1")
+	assert.NoError(t, err)
+	assert.Equal(t, Thresholds{}, th)
+
+	assert.NoError(t, s.Set("123", "q1", Thresholds{MaxWaiting: intPtr(5)}))
+	assert.NoError(t, s.Set("123", "q2", Thresholds{MinAvailableAgents: intPtr(1)}))
+	all, err := s.All("123")
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, 5, *all["q1"].MaxWaiting)
+
+	assert.NoError(t, s.Delete("123", "q1"))
+	th, err = s.Get("123", "q1")
+	assert.NoError(t, err)
+	assert.Nil(t, th.MaxWaiting)
+}
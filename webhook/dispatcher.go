@@ -0,0 +1,611 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"queuev2/config"
+	"queuev2/events"
+	"queuev2/httpclient"
+	"queuev2/logger"
+	"queuev2/position"
+	"queuev2/store"
+)
+
+//Options - delivery settings, Timeout is in seconds per attempt.
+//AllowPrivateNetworks lets webhooks post to loopback, link-local and
+//private addresses, only for deployments whose receivers are internal
+type Options struct {
+	Workers              int           `mapstructure:"workers"`
+	QueueSize            int           `mapstructure:"queueSize"`
+	MaxAttempts          int           `mapstructure:"maxAttempts"`
+	Backoff              time.Duration `mapstructure:"backoff"`
+	Timeout              uint          `mapstructure:"timeout"`
+	CacheTTL             time.Duration `mapstructure:"cacheTTL"`
+	AllowPrivateNetworks bool          `mapstructure:"allowPrivateNetworks"`
+	// PositionCoalesce - position changes of one queue within this window
+	// are delivered as one queue.positions_changed event
+	PositionCoalesce time.Duration `mapstructure:"positionCoalesce"`
+}
+
+// DefaultOptions - 5 attempts 1s, 2s, 4s and 8s apart
+func DefaultOptions() Options {
+	return Options{
+		Workers:     4,
+		QueueSize:   1000,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		Timeout:     httpclient.DefaultTimeout,
+		CacheTTL:    10 * time.Second,
+
+		PositionCoalesce: time.Second,
+	}
+}
+
+// LoadOptions - webhook options of the active profile
+func LoadOptions(conf *viper.Viper) (Options, error) {
+	opts := DefaultOptions()
+	err := config.UnmarshalKey(conf, config.Webhooks, &opts)
+	return opts, err
+}
+
+const (
+	// scheduleKey - sorted set of every pending delivery scored by the unix
+	// time it is due, shared by the processes so a pending delivery is
+	// picked up again whichever process scheduled it and whether or not it
+	// still runs
+	scheduleKey = "webhook_schedule"
+
+	// attemptClaimPrefix - webhook_attempt:<delivery id>:<attempts> is set by
+	// the process making that attempt so it is made once
+	attemptClaimPrefix = "webhook_attempt:"
+
+	// pollClaimPrefix - webhook_schedule_poll:<slot> is set by the process
+	// reading the due deliveries of that poll interval, the others skip it
+	pollClaimPrefix = "webhook_schedule_poll:"
+)
+
+// pollBatch - most due deliveries read from the schedule per poll
+const pollBatch = 100
+
+//job - one attempt of a pending delivery
+type job struct {
+	delivery *Delivery
+}
+
+//queueKey - queue of an account with position changes to deliver
+type queueKey struct {
+	accountID, queueID string
+}
+
+//cachedWebhooks - webhooks of an account read at most once per CacheTTL
+type cachedWebhooks struct {
+	hooks  []*Webhook
+	loaded time.Time
+}
+
+//Dispatcher - events.Sink delivering the events of every process it runs
+//in, attempts are made by a pool of workers and retried with exponential
+//backoff, every outcome is written to the delivery log
+type Dispatcher struct {
+	store     *Store
+	pos       *position.Position
+	opts      Options
+	transport http.RoundTripper
+
+	// ctx - done once the dispatcher is closed, cancelling the attempts in
+	// flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queue *events.Async
+	jobs  chan *job
+
+	mu    sync.Mutex
+	cache map[string]cachedWebhooks
+
+	// moved - first 1 based position which moved per queue since the last
+	// flush
+	movedMu sync.Mutex
+	moved   map[queueKey]events.Event
+}
+
+func NewDispatcher(st store.Store, opts Options) *Dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if opts.PositionCoalesce <= 0 {
+		opts.PositionCoalesce = time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		store:     NewStore(st),
+		pos:       position.NewPosition(st),
+		opts:      opts,
+		transport: newTransport(opts.AllowPrivateNetworks),
+		ctx:       ctx,
+		cancel:    cancel,
+		jobs:      make(chan *job, opts.QueueSize),
+		cache:     make(map[string]cachedWebhooks),
+		moved:     make(map[queueKey]events.Event),
+	}
+
+	d.queue = events.NewAsync("webhook event", opts.QueueSize, d.dispatch)
+	go d.flush()
+	go d.poll()
+	for i := 0; i < opts.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Close - stop polling the schedule and cancel the attempts in flight, the
+// deliveries stay scheduled and are picked up by the other processes
+func (d *Dispatcher) Close() {
+	d.cancel()
+}
+
+// Store - webhooks and delivery log used by the dispatcher
+func (d *Dispatcher) Store() *Store {
+	return d.store
+}
+
+// CheckURL - CheckURL with the private network setting of the dispatcher
+func (d *Dispatcher) CheckURL(ctx context.Context, rawURL string) error {
+	return CheckURL(ctx, rawURL, d.opts.AllowPrivateNetworks)
+}
+
+// Handle - queue the event for matching, it is dropped when the queue is
+// full rather than slowing down the caller
+func (d *Dispatcher) Handle(ev events.Event) {
+	d.queue.Handle(ev)
+}
+
+// Invalidate - forget the cached webhooks of the account after a change
+func (d *Dispatcher) Invalidate(accountID string) {
+	d.mu.Lock()
+	delete(d.cache, accountID)
+	d.mu.Unlock()
+}
+
+// Replay - attempt the deliveries again with a new cycle of attempts,
+// every failed one when ids is empty
+func (d *Dispatcher) Replay(accountID, webhookID string, ids []string) ([]*Delivery, error) {
+	if _, err := d.store.Get(accountID, webhookID); err != nil {
+		return nil, err
+	}
+
+	var deliveries []*Delivery
+	if len(ids) == 0 {
+		all, err := d.store.ListDeliveries(webhookID)
+		if err != nil {
+			return nil, err
+		}
+		for _, del := range all {
+			if del.Status == DeliveryFailed {
+				deliveries = append(deliveries, del)
+			}
+		}
+	}
+	for _, id := range ids {
+		del, err := d.store.GetDelivery(webhookID, id)
+		if err != nil {
+			return nil, err
+		}
+		if del.Status == DeliveryPending {
+			return nil, ErrDeliveryPending
+		}
+		deliveries = append(deliveries, del)
+	}
+
+	replayed := []*Delivery{}
+	for _, del := range deliveries {
+		del.Status = DeliveryPending
+		del.AttemptsLeft = d.opts.MaxAttempts
+		del.NextAttemptAt = nil
+		del.UpdatedAt = time.Now().UTC()
+		if err := d.schedule(del, del.UpdatedAt.Add(d.lease())); err != nil {
+			return nil, err
+		}
+		d.enqueue(&job{delivery: del})
+		replayed = append(replayed, del)
+	}
+	return replayed, nil
+}
+
+func (d *Dispatcher) flush() {
+	ticker := time.NewTicker(d.opts.PositionCoalesce)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.flushPositions()
+		}
+	}
+}
+
+// dispatch - create a delivery per matching webhook. Tasks joining or
+// leaving the queue move the tasks behind them, the queue is noted for the
+// next positions flush when a webhook subscribed to position changes
+func (d *Dispatcher) dispatch(ev events.Event) {
+	hooks, err := d.webhooks(ev.AccountID)
+	if err != nil {
+		logger.Error("loading webhooks failed", logger.FieldAccountID, ev.AccountID, logger.FieldError, err)
+		return
+	}
+
+	wantsPositions := false
+	for _, h := range hooks {
+		if h.QueueID != ev.QueueID {
+			continue
+		}
+		if h.Wants(ev.Type) {
+			d.deliver(h, ev)
+		}
+		wantsPositions = wantsPositions || h.Wants(events.QueuePositionsChanged)
+	}
+	if !wantsPositions || ev.Position <= 0 {
+		return
+	}
+
+	var first int
+	switch ev.Type {
+	case events.TaskEnqueued:
+		first = ev.Position + 1
+	case events.TaskAgentReserved, events.TaskAbandoned:
+		first = ev.Position
+	default:
+		return
+	}
+	key := queueKey{ev.AccountID, ev.QueueID}
+	d.movedMu.Lock()
+	defer d.movedMu.Unlock()
+	if moved, ok := d.moved[key]; !ok || first < moved.Position {
+		d.moved[key] = events.Event{
+			Type:      events.QueuePositionsChanged,
+			AccountID: ev.AccountID,
+			QueueID:   ev.QueueID,
+			Position:  first,
+		}
+	}
+}
+
+// flushPositions - one delivery per queue and webhook for the changes of
+// the last window, whatever the number of tasks which moved
+func (d *Dispatcher) flushPositions() {
+	d.movedMu.Lock()
+	pending := d.moved
+	d.moved = make(map[queueKey]events.Event)
+	d.movedMu.Unlock()
+
+	for key, moved := range pending {
+		waiting, err := d.pos.Count(key.queueID)
+		if err != nil {
+			logger.Error("counting positions failed", logger.FieldQueueID, key.queueID, logger.FieldError, err)
+			continue
+		}
+		if waiting < moved.Position {
+			// no task was behind the ones which joined or left
+			continue
+		}
+
+		hooks, err := d.webhooks(key.accountID)
+		if err != nil {
+			logger.Error("loading webhooks failed", logger.FieldAccountID, key.accountID, logger.FieldError, err)
+			continue
+		}
+		moved.Time = time.Now().UTC()
+		for _, h := range hooks {
+			if h.QueueID == key.queueID && h.Wants(events.QueuePositionsChanged) {
+				d.deliver(h, moved)
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(h *Webhook, ev events.Event) {
+	id, err := randomHex(idBytes)
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	del := &Delivery{
+		ID:        "whd_" + id,
+		WebhookID: h.ID,
+		AccountID: h.AccountID,
+		Event:     ev,
+		Status:    DeliveryPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+
+		AttemptsLeft: d.opts.MaxAttempts,
+	}
+	// the first attempt is made at once, the schedule only matters when
+	// this process stops before making it
+	if err = d.schedule(del, now.Add(d.lease())); err != nil {
+		logger.Error("saving webhook delivery failed", "webhook_id", h.ID, logger.FieldError, err)
+		return
+	}
+	d.enqueue(&job{delivery: del})
+}
+
+// lease - time an attempt may take before the delivery is picked up again
+// by the schedule
+func (d *Dispatcher) lease() time.Duration {
+	return time.Duration(d.opts.Timeout)*time.Second + 30*time.Second
+}
+
+func scheduleMember(del *Delivery) string {
+	return del.WebhookID + " " + del.ID + " " + del.AccountID
+}
+
+// schedule - save the pending delivery and the time it is due
+func (d *Dispatcher) schedule(del *Delivery, due time.Time) error {
+	if err := d.store.SaveDelivery(del); err != nil {
+		return err
+	}
+	return d.store.store.AddSortedSet(scheduleKey, int(due.Unix()), scheduleMember(del))
+}
+
+// unschedule - the delivery succeeded, failed or is gone
+func (d *Dispatcher) unschedule(member string) {
+	if err := d.store.store.RemoveSortedSet(scheduleKey, member); err != nil {
+		logger.Error("removing webhook delivery schedule failed", "delivery", member, logger.FieldError, err)
+	}
+}
+
+// enqueue - hand the job to a worker, with a full queue the delivery stays
+// scheduled and is picked up once it is due
+func (d *Dispatcher) enqueue(j *job) {
+	select {
+	case d.jobs <- j:
+	default:
+		logger.Warn("webhook delivery queue full, postponing delivery", "webhook_id", j.delivery.WebhookID, "delivery_id", j.delivery.ID)
+	}
+}
+
+// poll - enqueue the due deliveries, retries and deliveries left pending
+// by a stopped process alike. One process reads the schedule per interval
+func (d *Dispatcher) poll() {
+	every := d.pollInterval()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if d.claimPoll(now, every) {
+				d.enqueueDue()
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) pollInterval() time.Duration {
+	every := d.opts.Backoff
+	if every > time.Second {
+		every = time.Second
+	}
+	if every < 10*time.Millisecond {
+		every = 10 * time.Millisecond
+	}
+	return every
+}
+
+// claimPoll - whether this process reads the schedule in the interval of
+// now, the claim expires with the interval
+func (d *Dispatcher) claimPoll(now time.Time, every time.Duration) bool {
+	slot := now.UnixNano() / int64(every)
+	claimed, err := d.store.store.SetNX(pollClaimPrefix+strconv.FormatInt(slot, 10), "1", int(every/time.Second)+1)
+	if err != nil {
+		logger.Error("claiming webhook delivery schedule failed", logger.FieldError, err)
+		return false
+	}
+	return claimed
+}
+
+// enqueueDue - enqueue the deliveries due now, oldest first and at most
+// pollBatch of them, the rest are read by the next polls
+func (d *Dispatcher) enqueueDue() {
+	now := time.Now()
+	due, err := d.store.store.GetRangeByScoreSortedSet(scheduleKey, int(now.Unix()), pollBatch)
+	if err != nil {
+		logger.Error("loading webhook delivery schedule failed", logger.FieldError, err)
+		return
+	}
+	for _, member := range due {
+		parts := strings.SplitN(member, " ", 3)
+		if len(parts) != 3 {
+			d.unschedule(member)
+			continue
+		}
+		del, err := d.store.GetDelivery(parts[0], parts[1])
+		if err == ErrDeliveryNotFound {
+			d.unschedule(member)
+			continue
+		}
+		if err != nil {
+			logger.Error("loading webhook delivery failed", "delivery_id", parts[1], logger.FieldError, err)
+			continue
+		}
+		if del.Status != DeliveryPending {
+			d.unschedule(member)
+			continue
+		}
+		if del.NextAttemptAt != nil && del.NextAttemptAt.After(now) {
+			// scores are in seconds
+			continue
+		}
+		// not due again before the attempt had time to finish
+		if err = d.store.store.AddSortedSet(scheduleKey, int(now.Add(d.lease()).Unix()), member); err != nil {
+			logger.Error("saving webhook delivery schedule failed", "delivery_id", del.ID, logger.FieldError, err)
+			continue
+		}
+		d.enqueue(&job{delivery: del})
+	}
+}
+
+func claimKey(del *Delivery) string {
+	return attemptClaimPrefix + del.ID + ":" + strconv.Itoa(del.Attempts)
+}
+
+// claim - whether this process makes the next attempt of the delivery, a
+// delivery enqueued twice is only attempted once
+func (d *Dispatcher) claim(del *Delivery) (bool, error) {
+	return d.store.store.SetNX(claimKey(del), "1", int(d.lease()/time.Second))
+}
+
+// postpone - the endpoint was not called, release the claim and leave the
+// attempt to the schedule after wait
+func (d *Dispatcher) postpone(del *Delivery, wait time.Duration) {
+	if err := d.store.store.DeleteKey(claimKey(del)); err != nil {
+		logger.Error("releasing webhook attempt failed", "delivery_id", del.ID, logger.FieldError, err)
+	}
+	due := time.Now().Add(wait)
+	if err := d.store.store.AddSortedSet(scheduleKey, int(due.Unix()), scheduleMember(del)); err != nil {
+		logger.Error("saving webhook delivery schedule failed", "delivery_id", del.ID, logger.FieldError, err)
+	}
+}
+
+func (d *Dispatcher) work() {
+	for j := range d.jobs {
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.attempt(j)
+	}
+}
+
+func (d *Dispatcher) attempt(j *job) {
+	del := j.delivery
+	l := logger.With("webhook_id", del.WebhookID, "delivery_id", del.ID, logger.FieldTaskID, del.Event.TaskID)
+
+	claimed, err := d.claim(del)
+	if err != nil || !claimed {
+		// attempted elsewhere, or left scheduled until the store is back
+		return
+	}
+
+	h, err := d.webhook(del.AccountID, del.WebhookID)
+	if err == ErrWebhookNotFound {
+		// deleted with its delivery log
+		d.unschedule(scheduleMember(del))
+		return
+	}
+	if err != nil {
+		// no attempt is used up
+		l.Error("loading webhook failed", logger.FieldError, err)
+		d.postpone(del, d.opts.Backoff)
+		return
+	}
+
+	body, err := json.Marshal(del.Event)
+	if err != nil {
+		l.Error("encoding webhook event failed", logger.FieldError, err)
+		return
+	}
+	ts := time.Now().Unix()
+	status, err := httpclient.PostBytes(body, h.URL, httpclient.HTTPContext{
+		Timeout:   d.opts.Timeout,
+		Transport: d.transport,
+		Context:   d.ctx,
+		HeaderMap: map[string]string{
+			"Content-Type":  httpclient.ContentTypeJSON,
+			HeaderSignature: Sign(h.Secret, ts, body),
+			HeaderTimestamp: strconv.FormatInt(ts, 10),
+			HeaderDelivery:  del.ID,
+			HeaderEvent:     del.Event.Type,
+		},
+	})
+	if d.ctx.Err() != nil {
+		// closed during the attempt, made again by another process
+		d.postpone(del, 0)
+		return
+	}
+
+	del.Attempts++
+	del.AttemptsLeft--
+	del.ResponseStatus = status
+	del.UpdatedAt = time.Now().UTC()
+	if err == nil {
+		del.Status = DeliverySucceeded
+		del.LastError = ""
+		del.NextAttemptAt = nil
+		if err = d.store.SaveDelivery(del); err != nil {
+			l.Error("saving webhook delivery failed", logger.FieldError, err)
+		}
+		d.unschedule(scheduleMember(del))
+		return
+	}
+	d.retry(j, l, status, err)
+}
+
+// retry - schedule the next attempt after a network error, 429 or 5xx,
+// other failures and the last attempt fail the delivery. The next attempt
+// is stored so it is made by any process polling the schedule
+func (d *Dispatcher) retry(j *job, l *logger.Logger, status int, err error) {
+	del := j.delivery
+	del.LastError = err.Error()
+	del.NextAttemptAt = nil
+	retryable := status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	if !retryable || del.AttemptsLeft <= 0 {
+		del.Status = DeliveryFailed
+		l.Warn("webhook delivery failed", "attempts", del.Attempts, logger.FieldError, err)
+		if err := d.store.SaveDelivery(del); err != nil {
+			l.Error("saving webhook delivery failed", logger.FieldError, err)
+		}
+		d.unschedule(scheduleMember(del))
+		return
+	}
+
+	tries := d.opts.MaxAttempts - del.AttemptsLeft
+	next := time.Now().UTC().Add(d.opts.Backoff << uint(tries-1))
+	del.NextAttemptAt = &next
+	if err := d.schedule(del, next); err != nil {
+		l.Error("saving webhook delivery failed", logger.FieldError, err)
+	}
+}
+
+func (d *Dispatcher) webhook(accountID, id string) (*Webhook, error) {
+	hooks, err := d.webhooks(accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hooks {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return nil, ErrWebhookNotFound
+}
+
+func (d *Dispatcher) webhooks(accountID string) ([]*Webhook, error) {
+	d.mu.Lock()
+	c, ok := d.cache[accountID]
+	d.mu.Unlock()
+	if ok && time.Since(c.loaded) < d.opts.CacheTTL {
+		return c.hooks, nil
+	}
+
+	hooks, err := d.store.List(accountID)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.cache[accountID] = cachedWebhooks{hooks: hooks, loaded: time.Now()}
+	d.mu.Unlock()
+	return hooks, nil
+}
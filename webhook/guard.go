@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress - the webhook url points inside our network
+var ErrForbiddenAddress = errors.New("webhook url resolves to a loopback, link-local or private address")
+
+// sharedAddressSpace - carrier grade NAT range of RFC 6598, not covered by
+// net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// forbiddenIP - addresses a tenant must not make us post to, e.g. the
+// cloud metadata service at 169.254.169.254 or internal services
+func forbiddenIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// CheckURL - reject urls which are not http or https or whose host resolves
+// to a forbidden address, allowPrivate lifts the address check for
+// deployments posting to internal receivers
+func CheckURL(ctx context.Context, rawURL string, allowPrivate bool) error {
+	u, err := neturl.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("must be an http or https url")
+	}
+	if allowPrivate {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("host %s cannot be resolved", u.Hostname())
+	}
+	for _, a := range addrs {
+		if forbiddenIP(a.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// newTransport - transport checking every address it connects to, the
+// check at creation alone would let a host re-resolve to a private address
+// later. Proxies are not used so the check applies to the receiver itself
+func newTransport(allowPrivate bool) *http.Transport {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || forbiddenIP(ip) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		}
+	}
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
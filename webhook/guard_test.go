@@ -0,0 +1,54 @@
+package webhook
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+	"queuev2/store/mock"
+)
+
+func TestCheckURL(t *testing.T) {
+	ctx := context.Background()
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"https://10.1.2.3/hook",
+		"https://172.16.0.1/hook",
+		"https://192.168.1.10/hook",
+		"https://100.64.0.1/hook",
+		"http://0.0.0.0/hook",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+	} {
+		assert.Equal(t, ErrForbiddenAddress, CheckURL(ctx, url, false), url)
+		assert.NoError(t, CheckURL(ctx, url, true), url)
+	}
+	assert.NoError(t, CheckURL(ctx, "https://203.0.113.10/hook", false))
+	assert.Error(t, CheckURL(ctx, "ftp://203.0.113.10/hook", false))
+	assert.Error(t, CheckURL(ctx, "https:///hook", true))
+}
+
+func TestDeliveryToPrivateAddressRefused(t *testing.T) {
+	r, ts := newReceiver(t)
+	opts := DefaultOptions()
+	opts.Backoff = time.Millisecond
+	opts.MaxAttempts = 2
+	d := NewDispatcher(mock.NewStore("", ""), opts)
+	// stored directly, as if the host resolved to a public address when the
+	// webhook was created
+	w := &Webhook{AccountID: testAccount, QueueID: testQueue, URL: ts.URL, Events: []string{events.TaskAbandoned}}
+	assert.NoError(t, d.Store().Create(w))
+
+	d.Handle(events.Event{Type: events.TaskAbandoned, AccountID: testAccount, QueueID: testQueue, TaskID: "t1"})
+	del := waitStatus(t, d, w.ID, DeliveryFailed)
+	assert.True(t, strings.Contains(del.LastError, ErrForbiddenAddress.Error()), del.LastError)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Empty(t, r.received)
+}
@@ -0,0 +1,272 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"queuev2/events"
+	"queuev2/store"
+)
+
+const (
+	webhooksHashPrefix   = "webhooks:"
+	deliveriesHashPrefix = "webhook_deliveries:"
+	idBytes              = 8
+	secretBytes          = 24
+
+	// deliveryRetention - seconds the delivery log of a webhook is kept
+	// after its last delivery
+	deliveryRetention = 7 * 24 * 3600
+	// maxDeliveries - deliveries kept per webhook, the oldest are dropped
+	maxDeliveries = 1000
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	// ErrWebhookNotFound - no webhook with this id for the account
+	ErrWebhookNotFound = errors.New("webhook not found")
+	// ErrDeliveryNotFound - no delivery with this id for the webhook
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	// ErrDeliveryPending - the delivery is still being attempted
+	ErrDeliveryPending = errors.New("webhook delivery is still pending")
+)
+
+//Webhook - url notified of the events of one queue, Secret signs every
+//delivery
+type Webhook struct {
+	ID        string    `json:"id"`
+	AccountID string    `json:"account_id"`
+	QueueID   string    `json:"queue_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wants - whether the webhook subscribed to the event type
+func (w *Webhook) Wants(eventType string) bool {
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//Delivery - one event sent to a webhook and the outcome of its attempts
+type Delivery struct {
+	ID             string       `json:"id"`
+	WebhookID      string       `json:"webhook_id"`
+	AccountID      string       `json:"account_id"`
+	Event          events.Event `json:"event"`
+	Status         string       `json:"status"`
+	Attempts       int          `json:"attempts"`
+	ResponseStatus int          `json:"response_status,omitempty"`
+	LastError      string       `json:"last_error,omitempty"`
+	// AttemptsLeft - attempts of the current cycle still allowed, reset
+	// on replay
+	AttemptsLeft  int        `json:"attempts_left,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+//Store - webhooks in one store hash per account, deliveries in one hash
+//per webhook
+type Store struct {
+	store store.Store
+}
+
+func NewStore(st store.Store) *Store {
+	return &Store{store: st}
+}
+
+func webhooksKey(accountID string) string {
+	return webhooksHashPrefix + accountID
+}
+
+func deliveriesKey(webhookID string) string {
+	return deliveriesHashPrefix + webhookID
+}
+
+// Create - assign an id, and a secret unless the caller chose one
+func (s *Store) Create(w *Webhook) error {
+	id, err := randomHex(idBytes)
+	if err != nil {
+		return err
+	}
+	if w.Secret == "" {
+		if w.Secret, err = randomHex(secretBytes); err != nil {
+			return err
+		}
+	}
+	w.ID = "wh_" + id
+	w.CreatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return s.store.SetStructInHashNoExpire(webhooksKey(w.AccountID), w.ID, string(data))
+}
+
+// Get - webhook of the account including its secret
+func (s *Store) Get(accountID, id string) (*Webhook, error) {
+	exists, err := s.store.KeyExistsInHash(webhooksKey(accountID), id)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 1 {
+		return nil, ErrWebhookNotFound
+	}
+
+	data, err := s.store.GetStructFromHash(webhooksKey(accountID), id)
+	if err != nil {
+		return nil, err
+	}
+	w := &Webhook{}
+	if err = json.Unmarshal([]byte(data), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// List - webhooks of the account including their secrets
+func (s *Store) List(accountID string) ([]*Webhook, error) {
+	ids, err := s.store.GetKeysFromHash(webhooksKey(accountID))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []*Webhook{}
+	for _, id := range ids {
+		w, err := s.Get(accountID, id)
+		if err != nil {
+			continue
+		}
+		hooks = append(hooks, w)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+// Delete - remove the webhook with its delivery log
+func (s *Store) Delete(accountID, id string) error {
+	if _, err := s.Get(accountID, id); err != nil {
+		return err
+	}
+	if err := s.store.DeleteStructFromHash(webhooksKey(accountID), id); err != nil {
+		return err
+	}
+	if n, err := s.store.KeyExists(deliveriesKey(id)); err != nil || n == 0 {
+		return err
+	}
+	return s.store.DeleteKey(deliveriesKey(id))
+}
+
+// DeleteQueue - remove the webhooks subscribed to the queue with their
+// delivery logs
+func (s *Store) DeleteQueue(accountID, queueID string) error {
+	hooks, err := s.List(accountID)
+	if err != nil {
+		return err
+	}
+	for _, w := range hooks {
+		if w.QueueID != queueID {
+			continue
+		}
+		if err = s.Delete(accountID, w.ID); err != nil && err != ErrWebhookNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveDelivery - write the delivery to the log of its webhook and drop the
+// oldest ones above maxDeliveries
+func (s *Store) SaveDelivery(d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	key := deliveriesKey(d.WebhookID)
+	if err = s.store.SetStructInHash(key, d.ID, string(data)); err != nil {
+		return err
+	}
+	if err = s.store.SetExpireTime(key, deliveryRetention); err != nil {
+		return err
+	}
+
+	count, err := s.store.GetHashKeyCount(key)
+	if err != nil || count <= maxDeliveries {
+		return err
+	}
+	deliveries, err := s.ListDeliveries(d.WebhookID)
+	if err != nil {
+		return err
+	}
+	// trim to 90% so the log is not trimmed on every delivery
+	var drop []interface{}
+	for _, old := range deliveries[maxDeliveries*9/10:] {
+		drop = append(drop, old.ID)
+	}
+	return s.store.DelMultiKeyFromHash(key, drop)
+}
+
+// GetDelivery - one delivery of the webhook
+func (s *Store) GetDelivery(webhookID, id string) (*Delivery, error) {
+	exists, err := s.store.KeyExistsInHash(deliveriesKey(webhookID), id)
+	if err != nil {
+		return nil, err
+	}
+	if exists != 1 {
+		return nil, ErrDeliveryNotFound
+	}
+
+	data, err := s.store.GetStructFromHash(deliveriesKey(webhookID), id)
+	if err != nil {
+		return nil, err
+	}
+	d := &Delivery{}
+	if err = json.Unmarshal([]byte(data), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ListDeliveries - delivery log of the webhook, newest first
+func (s *Store) ListDeliveries(webhookID string) ([]*Delivery, error) {
+	ids, err := s.store.GetKeysFromHash(deliveriesKey(webhookID))
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []*Delivery{}
+	for _, id := range ids {
+		d, err := s.GetDelivery(webhookID, id)
+		if err != nil {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	return deliveries, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,384 @@
+package webhook
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"queuev2/events"
+	"queuev2/logger"
+	"queuev2/position"
+	"queuev2/store"
+	"queuev2/store/mock"
+)
+
+const (
+	testAccount = "123"
+	testQueue   = "QID_hooks"
+)
+
+//receiver - webhook endpoint answering with the queued status codes, 200
+//once they are used up
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   [][]byte
+	got      chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{statuses: statuses, got: make(chan struct{}, 100)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.received = append(r.received, req)
+		r.bodies = append(r.bodies, body)
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.got <- struct{}{}
+	}))
+	t.Cleanup(ts.Close)
+	return r, ts
+}
+
+func (r *receiver) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d deliveries", i, n)
+		}
+	}
+}
+
+func newTestDispatcher(t *testing.T, url string, eventTypes ...string) (*Dispatcher, *Webhook) {
+	logger.SetLevel(logger.LevelFatal)
+	opts := DefaultOptions()
+	opts.Backoff = time.Millisecond
+	opts.MaxAttempts = 3
+	opts.PositionCoalesce = 20 * time.Millisecond
+	// the receivers listen on loopback
+	opts.AllowPrivateNetworks = true
+	d := NewDispatcher(mock.NewStore("", ""), opts)
+
+	w := &Webhook{AccountID: testAccount, QueueID: testQueue, URL: url, Events: eventTypes}
+	assert.NoError(t, d.Store().Create(w))
+	return d, w
+}
+
+// waitStatus - poll the delivery log until the delivery reaches status
+func waitStatus(t *testing.T, d *Dispatcher, webhookID, status string) *Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := d.Store().ListDeliveries(webhookID)
+		assert.NoError(t, err)
+		if len(deliveries) > 0 && deliveries[0].Status == status {
+			return deliveries[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no %s delivery", status)
+	return nil
+}
+
+func TestDeliverySigned(t *testing.T) {
+	r, ts := newReceiver(t)
+	d, w := newTestDispatcher(t, ts.URL, events.TaskTransferred)
+
+	d.Handle(events.Event{Type: events.TaskEnqueued, AccountID: testAccount, QueueID: testQueue, TaskID: "t0"})
+	d.Handle(events.Event{Type: events.TaskTransferred, AccountID: testAccount, QueueID: "QID_other", TaskID: "t1"})
+	d.Handle(events.Event{Type: events.TaskTransferred, AccountID: testAccount, QueueID: testQueue, TaskID: "t2"})
+	r.wait(t, 1)
+
+	del := waitStatus(t, d, w.ID, DeliverySucceeded)
+	assert.Equal(t, "t2", del.Event.TaskID)
+	assert.Equal(t, 1, del.Attempts)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Len(t, r.received, 1)
+	req := r.received[0]
+	ts64, err := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	assert.NoError(t, err)
+	assert.True(t, Verify(w.Secret, req.Header.Get(HeaderSignature), ts64, r.bodies[0]))
+	assert.False(t, Verify("other-secret", req.Header.Get(HeaderSignature), ts64, r.bodies[0]))
+	assert.Equal(t, del.ID, req.Header.Get(HeaderDelivery))
+	assert.Equal(t, events.TaskTransferred, req.Header.Get(HeaderEvent))
+}
+
+func TestDeliveryRetried(t *testing.T) {
+	r, ts := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	d, w := newTestDispatcher(t, ts.URL, events.TaskAbandoned)
+
+	d.Handle(events.Event{Type: events.TaskAbandoned, AccountID: testAccount, QueueID: testQueue, TaskID: "t1"})
+	r.wait(t, 3)
+
+	del := waitStatus(t, d, w.ID, DeliverySucceeded)
+	assert.Equal(t, 3, del.Attempts)
+	assert.Equal(t, http.StatusOK, del.ResponseStatus)
+}
+
+func TestDeliveryFailedAndReplayed(t *testing.T) {
+	r, ts := newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusGone)
+	d, w := newTestDispatcher(t, ts.URL, events.TaskTransferFailed)
+
+	d.Handle(events.Event{Type: events.TaskTransferFailed, AccountID: testAccount, QueueID: testQueue, TaskID: "t1"})
+	r.wait(t, 3)
+	del := waitStatus(t, d, w.ID, DeliveryFailed)
+	assert.Equal(t, 3, del.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, del.ResponseStatus)
+
+	// 410 is not retried
+	replayed, err := d.Replay(testAccount, w.ID, nil)
+	assert.NoError(t, err)
+	assert.Len(t, replayed, 1)
+	r.wait(t, 1)
+	del = waitStatus(t, d, w.ID, DeliveryFailed)
+	assert.Equal(t, 4, del.Attempts)
+	assert.Equal(t, http.StatusGone, del.ResponseStatus)
+
+	_, err = d.Replay(testAccount, w.ID, []string{del.ID})
+	assert.NoError(t, err)
+	r.wait(t, 1)
+	assert.Equal(t, 5, waitStatus(t, d, w.ID, DeliverySucceeded).Attempts)
+
+	_, err = d.Replay(testAccount, w.ID, []string{"whd_unknown"})
+	assert.Equal(t, ErrDeliveryNotFound, err)
+	_, err = d.Replay("456", w.ID, nil)
+	assert.Equal(t, ErrWebhookNotFound, err)
+}
+
+func TestPendingDeliveryResumed(t *testing.T) {
+	r, ts := newReceiver(t)
+	logger.SetLevel(logger.LevelFatal)
+	st := mock.NewStore("", "")
+	w := &Webhook{AccountID: testAccount, QueueID: testQueue, URL: ts.URL, Events: []string{events.TaskAbandoned}}
+	assert.NoError(t, NewStore(st).Create(w))
+
+	// left pending by a process which stopped before retrying
+	next := time.Now().UTC().Add(-time.Second)
+	del := &Delivery{
+		ID:            "whd_stopped",
+		WebhookID:     w.ID,
+		AccountID:     testAccount,
+		Event:         events.Event{Type: events.TaskAbandoned, AccountID: testAccount, QueueID: testQueue, TaskID: "t1"},
+		Status:        DeliveryPending,
+		Attempts:      1,
+		AttemptsLeft:  2,
+		NextAttemptAt: &next,
+	}
+	assert.NoError(t, NewStore(st).SaveDelivery(del))
+	assert.NoError(t, st.AddSortedSet(scheduleKey, int(next.Unix()), scheduleMember(del)))
+
+	opts := DefaultOptions()
+	opts.Backoff = time.Millisecond
+	opts.AllowPrivateNetworks = true
+	d := NewDispatcher(st, opts)
+	r.wait(t, 1)
+
+	got := waitStatus(t, d, w.ID, DeliverySucceeded)
+	assert.Equal(t, 2, got.Attempts)
+	assert.Nil(t, got.NextAttemptAt)
+	assert.Eventually(t, func() bool {
+		scheduled, err := st.GetAllScoresSortedSet(scheduleKey)
+		return err == nil && len(scheduled) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPositionsChanged(t *testing.T) {
+	r, ts := newReceiver(t)
+	d, w := newTestDispatcher(t, ts.URL, events.QueuePositionsChanged)
+
+	pos := position.NewPosition(d.store.store)
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, pos.AddItem(testQueue, "t"+strconv.Itoa(i+2), i))
+	}
+
+	// t1 held position 3 then t0 position 1, the 50 tasks behind moved
+	d.Handle(events.Event{Type: events.TaskAgentReserved, AccountID: testAccount, QueueID: testQueue, TaskID: "t1", Position: 3})
+	d.Handle(events.Event{Type: events.TaskAbandoned, AccountID: testAccount, QueueID: testQueue, TaskID: "t0", Position: 1})
+	r.wait(t, 1)
+
+	del := waitStatus(t, d, w.ID, DeliverySucceeded)
+	assert.Equal(t, events.QueuePositionsChanged, del.Event.Type)
+	assert.Equal(t, testQueue, del.Event.QueueID)
+	assert.Empty(t, del.Event.TaskID)
+	assert.Equal(t, 1, del.Event.Position)
+
+	// the changes of the window were coalesced
+	time.Sleep(2 * d.opts.PositionCoalesce)
+	deliveries, err := d.Store().ListDeliveries(w.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	d, w := newTestDispatcher(t, "http://localhost", events.TaskEnqueued)
+	s := d.Store()
+
+	hooks, err := s.List(testAccount)
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 1)
+	assert.NotEmpty(t, hooks[0].Secret)
+
+	assert.Equal(t, ErrWebhookNotFound, s.Delete("456", w.ID))
+	assert.NoError(t, s.Delete(testAccount, w.ID))
+	_, err = s.Get(testAccount, w.ID)
+	assert.Equal(t, ErrWebhookNotFound, err)
+}
+
+//lookupFailStore - store failing to list the webhooks while fail is set
+type lookupFailStore struct {
+	store.Store
+	mu   sync.Mutex
+	fail bool
+}
+
+func (s *lookupFailStore) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+func (s *lookupFailStore) GetKeysFromHash(key string) ([]string, error) {
+	s.mu.Lock()
+	fail := s.fail
+	s.mu.Unlock()
+	if fail && strings.HasPrefix(key, webhooksHashPrefix) {
+		return nil, errors.New("store unavailable")
+	}
+	return s.Store.GetKeysFromHash(key)
+}
+
+func TestWebhookLookupFailure(t *testing.T) {
+	r, ts := newReceiver(t)
+	logger.SetLevel(logger.LevelFatal)
+	st := &lookupFailStore{Store: mock.NewStore("", "")}
+	w := &Webhook{AccountID: testAccount, QueueID: testQueue, URL: ts.URL, Events: []string{events.TaskAbandoned}}
+	assert.NoError(t, NewStore(st).Create(w))
+
+	del := &Delivery{
+		ID:           "whd_lookup",
+		WebhookID:    w.ID,
+		AccountID:    testAccount,
+		Event:        events.Event{Type: events.TaskAbandoned, AccountID: testAccount, QueueID: testQueue, TaskID: "t1"},
+		Status:       DeliveryPending,
+		AttemptsLeft: 2,
+	}
+	assert.NoError(t, NewStore(st).SaveDelivery(del))
+	assert.NoError(t, st.AddSortedSet(scheduleKey, int(time.Now().Unix()), scheduleMember(del)))
+
+	opts := DefaultOptions()
+	opts.Backoff = 50 * time.Millisecond
+	opts.MaxAttempts = 2
+	opts.AllowPrivateNetworks = true
+	st.setFail(true)
+	d := NewDispatcher(st, opts)
+	defer d.Close()
+
+	// the endpoint was not called, the delivery keeps its attempts
+	time.Sleep(200 * time.Millisecond)
+	pending := waitStatus(t, d, w.ID, DeliveryPending)
+	assert.Equal(t, 0, pending.Attempts)
+	assert.Equal(t, 2, pending.AttemptsLeft)
+
+	st.setFail(false)
+	r.wait(t, 1)
+	got := waitStatus(t, d, w.ID, DeliverySucceeded)
+	assert.Equal(t, 1, got.Attempts)
+	assert.Equal(t, 1, got.AttemptsLeft)
+}
+
+func TestCloseCancelsAttempt(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	d, w := newTestDispatcher(t, ts.URL, events.TaskAbandoned)
+	d.Handle(events.Event{Type: events.TaskAbandoned, AccountID: testAccount, QueueID: testQueue, TaskID: "t1"})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no attempt")
+	}
+	d.Close()
+
+	// left pending and due at once for the other processes
+	assert.Eventually(t, func() bool {
+		score, err := d.store.store.GetScoreSortedSet(scheduleKey, scheduleMember(&Delivery{WebhookID: w.ID, ID: pendingID(t, d, w.ID), AccountID: testAccount}))
+		return err == nil && int64(score) <= time.Now().Unix()
+	}, time.Second, 5*time.Millisecond)
+	del := waitStatus(t, d, w.ID, DeliveryPending)
+	assert.Equal(t, 0, del.Attempts)
+	claimed, err := d.claim(del)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func pendingID(t *testing.T, d *Dispatcher, webhookID string) string {
+	deliveries, err := d.Store().ListDeliveries(webhookID)
+	assert.NoError(t, err)
+	if len(deliveries) == 0 {
+		return ""
+	}
+	return deliveries[0].ID
+}
+
+func TestEnqueueDueReadsDueOnly(t *testing.T) {
+	st := mock.NewStore("", "")
+	now := time.Now()
+	assert.NoError(t, st.AddSortedSet(scheduleKey, int(now.Add(time.Hour).Unix()), "w later a"))
+	assert.NoError(t, st.AddSortedSet(scheduleKey, int(now.Add(-time.Minute).Unix()), "w first a"))
+	assert.NoError(t, st.AddSortedSet(scheduleKey, int(now.Unix()), "w second a"))
+
+	due, err := st.GetRangeByScoreSortedSet(scheduleKey, int(now.Unix()), pollBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"w first a", "w second a"}, due)
+	due, err = st.GetRangeByScoreSortedSet(scheduleKey, int(now.Unix()), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"w first a"}, due)
+
+	// one process reads the schedule per poll interval
+	d := &Dispatcher{store: NewStore(st)}
+	assert.True(t, d.claimPoll(now, 10*time.Millisecond))
+	assert.False(t, d.claimPoll(now, 10*time.Millisecond))
+	assert.True(t, d.claimPoll(now.Add(10*time.Millisecond), 10*time.Millisecond))
+}
+
+func TestDeleteQueueWebhooks(t *testing.T) {
+	d, w := newTestDispatcher(t, "http://localhost", events.TaskEnqueued)
+	s := d.Store()
+	other := &Webhook{AccountID: testAccount, QueueID: "QID_other", URL: "http://localhost", Events: []string{events.TaskEnqueued}}
+	assert.NoError(t, s.Create(other))
+	assert.NoError(t, s.SaveDelivery(&Delivery{ID: "whd_1", WebhookID: w.ID, AccountID: testAccount, Status: DeliveryFailed}))
+
+	assert.NoError(t, s.DeleteQueue(testAccount, testQueue))
+	_, err := s.Get(testAccount, w.ID)
+	assert.Equal(t, ErrWebhookNotFound, err)
+	deliveries, err := s.ListDeliveries(w.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, deliveries)
+	_, err = s.Get(testAccount, other.ID)
+	assert.NoError(t, err)
+}